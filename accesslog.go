@@ -0,0 +1,59 @@
+package retroproxy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// AccessRecord is a completed session, encoded as one line of JSON in an access log.
+type AccessRecord struct {
+	// Time is when the session ended.
+	Time      time.Time `json:"time"`
+	Proxy     string    `json:"proxy"`
+	SessionId string    `json:"session_id"`
+	ClientIP  string    `json:"client_ip"`
+	Account   string    `json:"account,omitempty"`
+	Character string    `json:"character,omitempty"`
+	// ServerAddress is the address of the server of the session, if it got that far.
+	ServerAddress string `json:"server_address,omitempty"`
+	// ClientBytes, ServerBytes, ClientPackets and ServerPackets count what was read from each side.
+	ClientBytes   uint64           `json:"client_bytes"`
+	ServerBytes   uint64           `json:"server_bytes"`
+	ClientPackets uint64           `json:"client_packets"`
+	ServerPackets uint64           `json:"server_packets"`
+	DurationMs    int64            `json:"duration_ms"`
+	Reason        DisconnectReason `json:"reason"`
+}
+
+// AccessLog writes a line of JSON for each completed session, for analytics rather than troubleshooting. It is safe
+// for concurrent use.
+type AccessLog struct {
+	wc  io.WriteCloser
+	enc *json.Encoder
+	mu  sync.Mutex
+}
+
+// NewAccessLog returns an AccessLog that writes to wc. Records are not buffered, so that each line is complete as soon
+// as its session ends.
+func NewAccessLog(wc io.WriteCloser) *AccessLog {
+	return &AccessLog{
+		wc:  wc,
+		enc: json.NewEncoder(wc),
+	}
+}
+
+// Write records a completed session.
+func (l *AccessLog) Write(rec AccessRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(rec)
+}
+
+// Close closes the underlying writer.
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.wc.Close()
+}
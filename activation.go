@@ -0,0 +1,139 @@
+package retroproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// ActivatedListeners are the TCP listeners passed to the process by systemd socket activation, which the proxies use
+// instead of binding their addresses themselves, so that systemd keeps the ports open while the proxy restarts. It is
+// safe for concurrent use.
+type ActivatedListeners struct {
+	mu  sync.Mutex
+	lns []*net.TCPListener
+}
+
+// ActivatedListenersFromEnv returns the listeners passed by systemd socket activation, as told by the LISTEN_PID and
+// LISTEN_FDS environment variables, which it unsets so that the child processes don't inherit them. It returns nil if
+// the process was not socket-activated.
+func ActivatedListenersFromEnv() (*ActivatedListeners, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	// The variables may have been inherited from a parent that was activated itself.
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", fds)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	a := &ActivatedListeners{}
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		// The listener has a duplicate of the file descriptor, which isn't inherited by the child processes.
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("could not use file descriptor %d (%s): %w", fd, name, err)
+		}
+		tcpLn, ok := ln.(*net.TCPListener)
+		if !ok {
+			ln.Close()
+			a.Close()
+			return nil, fmt.Errorf("file descriptor %d (%s) is not a tcp listener", fd, name)
+		}
+		a.lns = append(a.lns, tcpLn)
+	}
+	return a, nil
+}
+
+// Listen takes the listener of a bound to addr, or listens on addr if a is nil or has none, see ListenSupervised.
+// A taken listener is not restarted, since its address stays bound by systemd.
+//
+// Each listener is bound to a single address, so the proxies get theirs whatever the order of the sockets of the
+// units. An unspecified IP, as bound by a ListenStream with only a port, matches the unspecified IPs of both families.
+func (a *ActivatedListeners) Listen(addr *net.TCPAddr, restart bool, logger Logger) (*SupervisedListener, error) {
+	if a == nil {
+		return ListenSupervised(addr, restart, logger)
+	}
+	ln := a.take(addr)
+	if ln == nil {
+		return ListenSupervised(addr, restart, logger)
+	}
+	logger.Info("using listener from socket activation",
+		zap.String("address", ln.Addr().String()),
+	)
+	return &SupervisedListener{
+		addr:   ln.Addr().(*net.TCPAddr),
+		logger: logger,
+		done:   make(chan struct{}),
+		ln:     ln,
+	}, nil
+}
+
+// take removes the listener bound to addr from a and returns it, or nil if there is none.
+func (a *ActivatedListeners) take(addr *net.TCPAddr) *net.TCPListener {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, ln := range a.lns {
+		lnAddr := ln.Addr().(*net.TCPAddr)
+		if lnAddr.Port != addr.Port {
+			continue
+		}
+		unspecified := (addr.IP == nil || addr.IP.IsUnspecified()) && lnAddr.IP.IsUnspecified()
+		if unspecified || lnAddr.IP.Equal(addr.IP) {
+			a.lns = append(a.lns[:i], a.lns[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// Addrs returns the addresses of the listeners that were not taken yet.
+func (a *ActivatedListeners) Addrs() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	addrs := make([]string, len(a.lns))
+	for i, ln := range a.lns {
+		addrs[i] = ln.Addr().String()
+	}
+	return addrs
+}
+
+// Close closes the listeners that were not taken.
+func (a *ActivatedListeners) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var err error
+	for _, ln := range a.lns {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	a.lns = nil
+	return err
+}
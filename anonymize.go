@@ -0,0 +1,150 @@
+package retroproxy
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kralamoure/retroproto"
+	"github.com/kralamoure/retroproto/enum"
+)
+
+// anonymizer replaces personal data and secrets in packets with pseudonyms, which are stable for the lifetime of the
+// anonymizer so that cross-references are kept. It is not safe for concurrent use.
+//
+// The scrubbed fields are:
+//   - the username and password hash of AccountCredential, sent by the client to the login server;
+//   - the nickname of AccountPseudo;
+//   - the key of AksHelloConnect;
+//   - the tickets of AccountSelectServerSuccess, AccountSelectServerPlainSuccess and AccountSendTicket;
+//   - the character names of AccountCharactersListSuccess, AccountCharacterSelectedSuccess, GameMovement (players,
+//     merchants and mutant players), ChatMessageSuccess (sender) and ChatSend (private receiver).
+//
+// Chat texts are kept as is.
+type anonymizer struct {
+	pseudonyms map[string]map[string]string
+}
+
+func newAnonymizer() *anonymizer {
+	return &anonymizer{pseudonyms: make(map[string]map[string]string)}
+}
+
+// pseudonym returns the pseudonym of the value v of the kind of data kind, such as "character".
+func (a *anonymizer) pseudonym(kind, v string) string {
+	if v == "" {
+		return ""
+	}
+	m, ok := a.pseudonyms[kind]
+	if !ok {
+		m = make(map[string]string)
+		a.pseudonyms[kind] = m
+	}
+	p, ok := m[v]
+	if !ok {
+		p = kind + strconv.Itoa(len(m)+1)
+		m[v] = p
+	}
+	return p
+}
+
+// anonymize returns pkt, coming from dir, with its personal data and secrets replaced.
+func (a *anonymizer) anonymize(dir Direction, pkt string) string {
+	if dir == DirectionClient {
+		return a.anonymizeCli(pkt)
+	}
+	return a.anonymizeSvr(pkt)
+}
+
+func (a *anonymizer) anonymizeCli(pkt string) string {
+	id, _ := retroproto.MsgCliIdByPkt(pkt)
+	extra := strings.TrimPrefix(pkt, string(id))
+	switch id {
+	case retroproto.AccountCredential:
+		// "<username>\n#<crypto method><hash>"
+		username, pwd, ok := strings.Cut(pkt, "\n")
+		if !ok || len(pwd) < 2 {
+			return pkt
+		}
+		return a.pseudonym("account", username) + "\n" + pwd[:2] + "redacted"
+	case retroproto.AccountSendTicket:
+		return string(id) + a.pseudonym("ticket", extra)
+	case retroproto.ChatSend:
+		// The channel is the name of the receiver for private messages.
+		channel, rest, ok := strings.Cut(extra, "|")
+		if !ok || len(channel) < 2 {
+			return pkt
+		}
+		return string(id) + a.pseudonym("character", channel) + "|" + rest
+	}
+	return pkt
+}
+
+func (a *anonymizer) anonymizeSvr(pkt string) string {
+	id, _ := retroproto.MsgSvrIdByPkt(pkt)
+	extra := strings.TrimPrefix(pkt, string(id))
+	switch id {
+	case retroproto.AksHelloConnect:
+		return string(id) + a.pseudonym("key", extra)
+	case retroproto.AccountPseudo:
+		return string(id) + a.pseudonym("nickname", extra)
+	case retroproto.AccountSelectServerSuccess:
+		// The ticket follows the encoded address of the game server, made of 8 characters for the host and 3 for the
+		// port.
+		const addrLen = 11
+		if len(extra) <= addrLen {
+			return pkt
+		}
+		return string(id) + extra[:addrLen] + a.pseudonym("ticket", extra[addrLen:])
+	case retroproto.AccountSelectServerPlainSuccess:
+		addr, ticket, ok := strings.Cut(extra, ";")
+		if !ok {
+			return pkt
+		}
+		return string(id) + addr + ";" + a.pseudonym("ticket", ticket)
+	case retroproto.AccountCharactersListSuccess:
+		// "<subscription>|<count>|<character>|...", where characters are "<id>;<name>;...".
+		sli := strings.Split(extra, "|")
+		for i := 2; i < len(sli); i++ {
+			sli[i] = a.replaceField(sli[i], ";", 1, "character")
+		}
+		return string(id) + strings.Join(sli, "|")
+	case retroproto.AccountCharacterSelectedSuccess:
+		// "|<id>|<name>|..."
+		return string(id) + a.replaceField(extra, "|", 2, "character")
+	case retroproto.ChatMessageSuccess:
+		// "<channel>|<sender id>|<sender name>|..."
+		return string(id) + a.replaceField(extra, "|", 2, "character")
+	case retroproto.GameMovement:
+		// "|<sprite>|...", where added sprites are "+<cell>;<direction>;<bonus>;<id>;<name>;<type>[,<title>];...".
+		sli := strings.Split(extra, "|")
+		for i, sprite := range sli {
+			if len(sprite) < 2 || (sprite[0] != '+' && sprite[0] != '~') {
+				continue
+			}
+			fields := strings.SplitN(sprite, ";", 7)
+			if len(fields) < 6 {
+				continue
+			}
+			typ, _, _ := strings.Cut(fields[5], ",")
+			n, err := strconv.Atoi(typ)
+			if err != nil {
+				continue
+			}
+			if n > 0 || n == enum.GameMovementSpriteType.OfflineCharacter || n == enum.GameMovementSpriteType.MutantPlayer {
+				fields[4] = a.pseudonym("character", fields[4])
+				sli[i] = strings.Join(fields, ";")
+			}
+		}
+		return string(id) + strings.Join(sli, "|")
+	}
+	return pkt
+}
+
+// replaceField replaces the field at index i of s, split by sep, with its pseudonym of the given kind.
+func (a *anonymizer) replaceField(s, sep string, i int, kind string) string {
+	fields := strings.Split(s, sep)
+	if len(fields) <= i {
+		return s
+	}
+	fields[i] = a.pseudonym(kind, fields[i])
+	return strings.Join(fields, sep)
+}
@@ -0,0 +1,142 @@
+package retroproxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit of a server address in a CircuitBreaker.
+type BreakerState string
+
+const (
+	// BreakerClosed lets every connection to the server through.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen refuses the connections to the server until the cooldown expires.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe connection to the server through, whose result closes or reopens the circuit.
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// CircuitBreaker stops the proxies from connecting to a server that keeps failing. Each server address has its own
+// circuit, which opens after a number of consecutive failures within a window. Connections to an open circuit are
+// refused until a cooldown expires, after which one probe connection decides whether the circuit closes again.
+// It is safe for concurrent use.
+type CircuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state        BreakerState
+	failures     int
+	firstFailure time.Time
+	// changedAt is when the circuit was opened or when its probe was let through.
+	changedAt time.Time
+}
+
+// NewCircuitBreaker returns a CircuitBreaker that opens a circuit after threshold consecutive failures within window
+// and keeps it open for cooldown.
+func NewCircuitBreaker(threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		circuits:  make(map[string]*circuit),
+	}
+}
+
+// Cooldown returns how long a circuit stays open.
+func (b *CircuitBreaker) Cooldown() time.Duration {
+	return b.cooldown
+}
+
+// Allow reports whether a connection to addr may be attempted. Once the cooldown of an open circuit expires, it lets
+// one probe through, and another one if the first doesn't report its result within a cooldown.
+func (b *CircuitBreaker) Allow(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[addr]
+	if !ok || c.state == BreakerClosed {
+		return true
+	}
+	if time.Since(c.changedAt) < b.cooldown {
+		return false
+	}
+	c.state = BreakerHalfOpen
+	c.changedAt = time.Now()
+	return true
+}
+
+// Success records a successful connection to addr, which closes its circuit.
+func (b *CircuitBreaker) Success(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.circuits, addr)
+}
+
+// Failure records a failed connection to addr and reports whether it opened its circuit.
+func (b *CircuitBreaker) Failure(addr string) (opened bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	c, ok := b.circuits[addr]
+	if !ok {
+		c = &circuit{state: BreakerClosed}
+		b.circuits[addr] = c
+	}
+
+	switch c.state {
+	case BreakerHalfOpen:
+		c.state = BreakerOpen
+		c.changedAt = now
+		return true
+	case BreakerOpen:
+		return false
+	}
+
+	if c.failures == 0 || now.Sub(c.firstFailure) > b.window {
+		c.failures = 0
+		c.firstFailure = now
+	}
+	c.failures++
+	if c.failures < b.threshold {
+		return false
+	}
+	c.state = BreakerOpen
+	c.changedAt = now
+	return true
+}
+
+// CircuitInfo is the state of the circuit of a server address.
+type CircuitInfo struct {
+	Address  string       `json:"address"`
+	State    BreakerState `json:"state"`
+	Failures int          `json:"failures"`
+}
+
+// Circuits returns the circuits that recently failed, sorted by address. The addresses that are not listed are closed.
+func (b *CircuitBreaker) Circuits() []CircuitInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	circuits := make([]CircuitInfo, 0, len(b.circuits))
+	for addr, c := range b.circuits {
+		if c.state == BreakerClosed && time.Since(c.firstFailure) > b.window {
+			// Its failures are too old to count anymore.
+			delete(b.circuits, addr)
+			continue
+		}
+		circuits = append(circuits, CircuitInfo{Address: addr, State: c.state, Failures: c.failures})
+	}
+	sort.Slice(circuits, func(i, j int) bool {
+		return circuits[i].Address < circuits[j].Address
+	})
+	return circuits
+}
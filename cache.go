@@ -10,12 +10,12 @@ import (
 
 // Cache is an implementation of Storer for an in-memory cache.
 type Cache struct {
-	logger  *zap.Logger
+	logger  Logger
 	tickets map[string]Ticket
 	mu      sync.Mutex
 }
 
-func NewCache(logger *zap.Logger) *Cache {
+func NewCache(logger Logger) *Cache {
 	if logger == nil {
 		logger = zap.NewNop()
 	}
@@ -35,6 +35,7 @@ func (r *Cache) SetTicket(id string, t Ticket) {
 	)
 }
 
+// UseTicket gets and deletes the ticket under the lock of the cache, so it can only be used once.
 func (r *Cache) UseTicket(id string) (Ticket, bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -49,6 +50,10 @@ func (r *Cache) UseTicket(id string) (Ticket, bool) {
 }
 
 func (r *Cache) DeleteOldTickets(maxDur time.Duration) {
+	r.deleteOldTickets(maxDur)
+}
+
+func (r *Cache) deleteOldTickets(maxDur time.Duration) (n int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	now := time.Now()
@@ -56,9 +61,21 @@ func (r *Cache) DeleteOldTickets(maxDur time.Duration) {
 		deadline := r.tickets[id].IssuedAt.Add(maxDur)
 		if now.After(deadline) {
 			delete(r.tickets, id)
+			n++
 			r.logger.Debug("old ticket deleted",
 				zap.String("ticket_id", id),
 			)
 		}
 	}
+	return n
+}
+
+func (r *Cache) snapshot() map[string]Ticket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tickets := make(map[string]Ticket, len(r.tickets))
+	for id, t := range r.tickets {
+		tickets[id] = t
+	}
+	return tickets
 }
@@ -0,0 +1,336 @@
+package retroproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Direction is the side of a proxied connection that a packet comes from.
+type Direction string
+
+const (
+	DirectionClient Direction = "client"
+	DirectionServer Direction = "server"
+)
+
+// MarkerSessionStart is the marker of the record written when a session starts, before any of its packets, so that
+// captures of the same session made elsewhere, such as by the client, can be aligned on it.
+const MarkerSessionStart = "session_start"
+
+// CaptureRecord is a single packet of a capture, encoded as one line of JSON.
+type CaptureRecord struct {
+	Direction Direction `json:"direction,omitempty"`
+	// Time is the wall clock time of the record, in Unix nanoseconds.
+	Time int64 `json:"time"`
+	// Elapsed is the time since the session started, in nanoseconds, when the capture records timing. It's measured
+	// with a monotonic clock, so unlike Time it's not skewed by adjustments of the wall clock.
+	Elapsed   int64  `json:"elapsed,omitempty"`
+	SessionId string `json:"session_id"`
+	// Seq is the index of the packet among those read from its side of the session, starting at 1. It is missing from
+	// the captures made before sequence numbers were added.
+	Seq uint64 `json:"seq,omitempty"`
+	// Packet is the packet as it was read, without its terminator. It's encoded in base64 in the JSON of the records,
+	// which then have the encoding CaptureEncodingBase64, when it isn't valid UTF-8, such as the Latin-1 text sent by
+	// some clients, so that it isn't replaced with U+FFFD.
+	Packet string `json:"packet,omitempty"`
+	// Marker is set on the records that mark an event of the session instead of a packet, such as
+	// MarkerSessionStart. They have no direction nor packet.
+	Marker string `json:"marker,omitempty"`
+	// Injected is set on the packets that weren't read from their side but injected from the admin console as if that
+	// side sent them. They have no sequence number.
+	Injected bool `json:"injected,omitempty"`
+}
+
+// CaptureEncodingBase64 is the encoding of the packets of the JSON records that are encoded in base64.
+const CaptureEncodingBase64 = "base64"
+
+// captureRecordFields are the fields of a CaptureRecord, without its methods.
+type captureRecordFields CaptureRecord
+
+// jsonCaptureRecord is the JSON of a CaptureRecord.
+type jsonCaptureRecord struct {
+	captureRecordFields
+	// Encoding is the encoding of the packet, which is plain text if empty.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func (rec CaptureRecord) MarshalJSON() ([]byte, error) {
+	j := jsonCaptureRecord{captureRecordFields: captureRecordFields(rec)}
+	if !utf8.ValidString(rec.Packet) {
+		j.Packet = base64.StdEncoding.EncodeToString([]byte(rec.Packet))
+		j.Encoding = CaptureEncodingBase64
+	}
+	// The encoder of the record escapes HTML or not itself.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(j)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (rec *CaptureRecord) UnmarshalJSON(data []byte) error {
+	var j jsonCaptureRecord
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	switch j.Encoding {
+	case "":
+	case CaptureEncodingBase64:
+		pkt, err := base64.StdEncoding.DecodeString(j.Packet)
+		if err != nil {
+			return fmt.Errorf("invalid base64 packet: %w", err)
+		}
+		j.Packet = string(pkt)
+	default:
+		return fmt.Errorf("unknown packet encoding: %q", j.Encoding)
+	}
+	*rec = CaptureRecord(j.captureRecordFields)
+	return nil
+}
+
+// CaptureFormat is the file format of a Capture.
+type CaptureFormat string
+
+const (
+	// CaptureFormatJSON writes a CaptureRecord per line, which the tools of the proxy read.
+	CaptureFormatJSON CaptureFormat = "json"
+	// CaptureFormatPcap writes a pcap file, in which each session is a synthetic TCP connection over IPv4 whose server
+	// side has the port PcapServerPort, for network tools such as Wireshark. Markers are not written.
+	CaptureFormatPcap CaptureFormat = "pcap"
+)
+
+// captureEncoder writes the records of a Capture in its format.
+type captureEncoder interface {
+	Encode(rec CaptureRecord) error
+}
+
+// jsonEncoder writes records as lines of JSON.
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e jsonEncoder) Encode(rec CaptureRecord) error {
+	return e.enc.Encode(rec)
+}
+
+// Capture writes packets as newline-delimited JSON, or in another CaptureFormat. It is safe for concurrent use.
+type Capture struct {
+	wc     io.WriteCloser
+	bw     *bufio.Writer
+	enc    captureEncoder
+	filter *CaptureFilter
+	anon   *anonymizer
+	timing bool
+	mu     sync.Mutex
+
+	// stopFlush stops the goroutine flushing the capture periodically, if any, which flushWg waits for.
+	stopFlush chan struct{}
+	flushWg   sync.WaitGroup
+}
+
+func NewCapture(wc io.WriteCloser) *Capture {
+	bw := bufio.NewWriter(wc)
+	return &Capture{
+		wc:  wc,
+		bw:  bw,
+		enc: jsonEncoder{json.NewEncoder(bw)},
+	}
+}
+
+// NewCaptureFormat makes a Capture that writes packets to wc in the given format.
+func NewCaptureFormat(wc io.WriteCloser, format CaptureFormat) (*Capture, error) {
+	switch format {
+	case CaptureFormatJSON, "":
+		return NewCapture(wc), nil
+	case CaptureFormatPcap:
+		bw := bufio.NewWriter(wc)
+		enc, err := newPcapEncoder(bw)
+		if err != nil {
+			return nil, err
+		}
+		return &Capture{wc: wc, bw: bw, enc: enc}, nil
+	default:
+		return nil, fmt.Errorf("unknown capture format: %q", format)
+	}
+}
+
+// SetFilter makes the capture only write the packets selected by f, or all of them if f is nil.
+func (c *Capture) SetFilter(f *CaptureFilter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filter = f
+}
+
+// SetAnonymize makes the capture replace account names, character names, keys and tickets with pseudonyms which are
+// stable within the capture.
+func (c *Capture) SetAnonymize(anonymize bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if anonymize {
+		c.anon = newAnonymizer()
+	} else {
+		c.anon = nil
+	}
+}
+
+// SetTiming makes the capture record the time since the start of the session of each packet, and the markers.
+func (c *Capture) SetTiming(timing bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timing = timing
+}
+
+// SetFlushInterval makes the capture flush the buffered records every interval until it's closed, also flushing the
+// underlying writer if it has a Flush method, like a compressed RotatingFile, so that a crash loses little. It must be
+// called at most once, before Close.
+func (c *Capture) SetFlushInterval(interval time.Duration) {
+	c.stopFlush = make(chan struct{})
+	c.flushWg.Add(1)
+	go func() {
+		defer c.flushWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// The errors are returned by the next writes.
+				c.flush()
+			case <-c.stopFlush:
+				return
+			}
+		}
+	}()
+}
+
+// Write records pkt, the packet with the sequence number seq read from the dir side of a session that started at
+// startedAt.
+func (c *Capture) Write(dir Direction, sessionId string, startedAt time.Time, seq uint64, pkt string) error {
+	return c.writePkt(CaptureRecord{
+		Direction: dir,
+		SessionId: sessionId,
+		Seq:       seq,
+		Packet:    pkt,
+	}, startedAt)
+}
+
+// WriteInjected records pkt, a packet injected into a session that started at startedAt as if its dir side sent it.
+func (c *Capture) WriteInjected(dir Direction, sessionId string, startedAt time.Time, pkt string) error {
+	return c.writePkt(CaptureRecord{
+		Direction: dir,
+		SessionId: sessionId,
+		Packet:    pkt,
+		Injected:  true,
+	}, startedAt)
+}
+
+// writePkt records the packet of rec, through the filter and the anonymizer, setting its time.
+func (c *Capture) writePkt(rec CaptureRecord, startedAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.filter != nil && !c.filter.Match(rec.Direction, rec.SessionId, rec.Packet) {
+		return nil
+	}
+	if c.anon != nil {
+		rec.Packet = c.anon.anonymize(rec.Direction, rec.Packet)
+	}
+	rec.Time = time.Now().UnixNano()
+	if c.timing {
+		rec.Elapsed = time.Since(startedAt).Nanoseconds()
+	}
+	return c.enc.Encode(rec)
+}
+
+// Mark records marker for a session that started at startedAt, if the capture records timing. Markers are written
+// whatever the filter of the capture.
+func (c *Capture) Mark(sessionId string, startedAt time.Time, marker string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.timing {
+		return nil
+	}
+	now := time.Now()
+	return c.enc.Encode(CaptureRecord{
+		Time:      now.UnixNano(),
+		Elapsed:   now.Sub(startedAt).Nanoseconds(),
+		SessionId: sessionId,
+		Marker:    marker,
+	})
+}
+
+// EndSession records the end of a session that was captured, which closes its connection in pcap captures.
+func (c *Capture) EndSession(sessionId string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if enc, ok := c.enc.(*pcapEncoder); ok {
+		return enc.End(sessionId, time.Now())
+	}
+	return nil
+}
+
+// writeRecord records rec as it is, keeping its time, without going through the filter and the anonymizer.
+func (c *Capture) writeRecord(rec CaptureRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(rec)
+}
+
+// flush writes the buffered records to the underlying writer, and flushes it if it has a Flush method.
+func (c *Capture) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.bw.Flush()
+	if err != nil {
+		return err
+	}
+	if f, ok := c.wc.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close flushes the buffered records and closes the underlying writer.
+func (c *Capture) Close() error {
+	if c.stopFlush != nil {
+		close(c.stopFlush)
+		c.flushWg.Wait()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.bw.Flush()
+	if err != nil {
+		c.wc.Close()
+		return err
+	}
+	return c.wc.Close()
+}
+
+// CaptureReader reads the records of a capture written by Capture.
+type CaptureReader struct {
+	dec *json.Decoder
+}
+
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{dec: json.NewDecoder(r)}
+}
+
+// Read returns the next record, or io.EOF when there are none left.
+func (r *CaptureReader) Read() (CaptureRecord, error) {
+	var rec CaptureRecord
+	err := r.dec.Decode(&rec)
+	if err != nil {
+		return CaptureRecord{}, err
+	}
+	return rec, nil
+}
@@ -0,0 +1,64 @@
+package retroproxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nopWriteCloser is a bytes.Buffer to which a Capture writes.
+type nopWriteCloser struct {
+	bytes.Buffer
+}
+
+func (w *nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkt      string
+		encoding string
+	}{
+		{name: "ascii", pkt: "BM*|salut|"},
+		{name: "utf-8", pkt: "BM*|salut à tous|"},
+		// The Latin-1 text of old clients.
+		{name: "latin-1", pkt: "BM*|salut \xe0 tous|", encoding: `"encoding":"base64"`},
+		{name: "binary", pkt: "\xff\xfe\x01", encoding: `"encoding":"base64"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w nopWriteCloser
+			c := NewCapture(&w)
+			if err := c.Write(DirectionClient, "s1", time.Now(), 1, tt.pkt); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.encoding != "" && !strings.Contains(w.String(), tt.encoding) {
+				t.Errorf("record %q doesn't have %s", w.String(), tt.encoding)
+			}
+			if tt.encoding == "" && strings.Contains(w.String(), "encoding") {
+				t.Errorf("record %q has an encoding", w.String())
+			}
+
+			rec, err := NewCaptureReader(&w).Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Packet != tt.pkt || rec.SessionId != "s1" || rec.Seq != 1 {
+				t.Errorf("read %+v, want packet %q of s1 with seq 1", rec, tt.pkt)
+			}
+		})
+	}
+}
+
+func TestCaptureReaderUnknownEncoding(t *testing.T) {
+	rd := NewCaptureReader(strings.NewReader(`{"direction":"client","packet":"BD","encoding":"rot13"}` + "\n"))
+	if rec, err := rd.Read(); err == nil {
+		t.Errorf("read %+v, want an error", rec)
+	}
+}
@@ -0,0 +1,267 @@
+package retroproxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kralamoure/retroproto"
+)
+
+// CaptureFilter selects the packets written to a capture. It is made from an expression of comparisons of the fields
+// of a packet, combined with && (and), || (or), ! (not) and parentheses, like
+//
+//	dir=server && (id=cMK || id=GDM)
+//
+// The fields are dir (client or server), id (the message id, such as cMK), name (the message name, such as
+// ChatMessageSuccess) and session (the session id), compared with = or !=. Values may be double quoted.
+type CaptureFilter struct {
+	root filterNode
+	expr string
+}
+
+// NewCaptureFilter parses expr, failing on unknown fields, directions, message ids and message names.
+func NewCaptureFilter(expr string) (*CaptureFilter, error) {
+	toks, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid capture filter: %w", err)
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("invalid capture filter: unexpected %q", p.toks[p.pos].text)
+	}
+	return &CaptureFilter{root: root, expr: expr}, nil
+}
+
+// Match reports whether the packet pkt of the session sessionId, coming from dir, is selected by the filter.
+func (f *CaptureFilter) Match(dir Direction, sessionId string, pkt string) bool {
+	var id, name string
+	if dir == DirectionServer {
+		msgId, _ := retroproto.MsgSvrIdByPkt(pkt)
+		id = string(msgId)
+		name, _ = retroproto.MsgSvrNameByID(msgId)
+	} else {
+		msgId, _ := retroproto.MsgCliIdByPkt(pkt)
+		id = string(msgId)
+		name, _ = retroproto.MsgCliNameByID(msgId)
+	}
+	return f.root.eval(filterPacket{dir: string(dir), id: id, name: name, session: sessionId})
+}
+
+func (f *CaptureFilter) String() string {
+	return f.expr
+}
+
+// messageNames are the names of the messages of both directions, as retroproto only looks them up by id.
+var messageNames = func() map[string]struct{} {
+	m := make(map[string]struct{}, len(retroproto.MsgCliIds)+len(retroproto.MsgSvrIds))
+	for _, id := range retroproto.MsgCliIds {
+		if name, ok := retroproto.MsgCliNameByID(id); ok {
+			m[name] = struct{}{}
+		}
+	}
+	for _, id := range retroproto.MsgSvrIds {
+		if name, ok := retroproto.MsgSvrNameByID(id); ok {
+			m[name] = struct{}{}
+		}
+	}
+	return m
+}()
+
+type filterPacket struct {
+	dir     string
+	id      string
+	name    string
+	session string
+}
+
+type filterNode interface {
+	eval(p filterPacket) bool
+}
+
+type filterAnd struct{ left, right filterNode }
+
+func (n filterAnd) eval(p filterPacket) bool { return n.left.eval(p) && n.right.eval(p) }
+
+type filterOr struct{ left, right filterNode }
+
+func (n filterOr) eval(p filterPacket) bool { return n.left.eval(p) || n.right.eval(p) }
+
+type filterNot struct{ node filterNode }
+
+func (n filterNot) eval(p filterPacket) bool { return !n.node.eval(p) }
+
+type filterCmp struct {
+	field string
+	value string
+	neq   bool
+}
+
+func (n filterCmp) eval(p filterPacket) bool {
+	var v string
+	switch n.field {
+	case "dir":
+		v = p.dir
+	case "id":
+		v = p.id
+	case "name":
+		v = p.name
+	case "session":
+		v = p.session
+	}
+	return (v == n.value) != n.neq
+}
+
+type filterTokenKind int
+
+const (
+	filterTokenWord filterTokenKind = iota
+	filterTokenOp
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var toks []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"), strings.HasPrefix(expr[i:], "!="):
+			toks = append(toks, filterToken{kind: filterTokenOp, text: expr[i : i+2]})
+			i += 2
+		case c == '(' || c == ')' || c == '!' || c == '=':
+			toks = append(toks, filterToken{kind: filterTokenOp, text: string(c)})
+			i++
+		case c == '"':
+			end := strings.IndexByte(expr[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("invalid capture filter: unterminated string")
+			}
+			toks = append(toks, filterToken{kind: filterTokenWord, text: expr[i+1 : i+1+end]})
+			i += end + 2
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t()!=&|\"", rune(expr[j])) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("invalid capture filter: unexpected %q", c)
+			}
+			toks = append(toks, filterToken{kind: filterTokenWord, text: expr[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+type filterParser struct {
+	toks []filterToken
+	pos  int
+}
+
+func (p *filterParser) peekOp(op string) bool {
+	return p.pos < len(p.toks) && p.toks[p.pos].kind == filterTokenOp && p.toks[p.pos].text == op
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("||") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("&&") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	switch {
+	case p.peekOp("!"):
+		p.pos++
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{node: node}, nil
+	case p.peekOp("("):
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peekOp(")") {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return node, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *filterParser) parseCmp() (filterNode, error) {
+	if p.pos+3 > len(p.toks) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	field, op, value := p.toks[p.pos], p.toks[p.pos+1], p.toks[p.pos+2]
+	if field.kind != filterTokenWord {
+		return nil, fmt.Errorf("unexpected %q", field.text)
+	}
+	if op.kind != filterTokenOp || (op.text != "=" && op.text != "!=") {
+		return nil, fmt.Errorf("expected = or != after %q", field.text)
+	}
+	if value.kind != filterTokenWord {
+		return nil, fmt.Errorf("expected a value after %q", field.text+op.text)
+	}
+	p.pos += 3
+
+	switch field.text {
+	case "dir":
+		if value.text != string(DirectionClient) && value.text != string(DirectionServer) {
+			return nil, fmt.Errorf("unknown direction: %q", value.text)
+		}
+	case "id":
+		_, cliOk := retroproto.MsgCliNameByID(retroproto.MsgCliId(value.text))
+		_, svrOk := retroproto.MsgSvrNameByID(retroproto.MsgSvrId(value.text))
+		if !cliOk && !svrOk {
+			return nil, fmt.Errorf("unknown message id: %q", value.text)
+		}
+	case "name":
+		if _, ok := messageNames[value.text]; !ok {
+			return nil, fmt.Errorf("unknown message name: %q", value.text)
+		}
+	case "session":
+	default:
+		return nil, fmt.Errorf("unknown field: %q", field.text)
+	}
+	return filterCmp{field: field.text, value: value.text, neq: op.text == "!="}, nil
+}
@@ -0,0 +1,81 @@
+package retroproxy
+
+import (
+	"testing"
+)
+
+func TestNewCaptureFilterErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{name: "empty", expr: ""},
+		{name: "unknown field", expr: "map=7411"},
+		{name: "unknown direction", expr: "dir=both"},
+		{name: "unknown id", expr: "id=zzz"},
+		{name: "unknown name", expr: "name=ChatMessageSucces"},
+		{name: "missing operator", expr: "id cMK"},
+		{name: "missing value", expr: "id="},
+		{name: "missing )", expr: "(id=cMK || id=GDM"},
+		{name: "unexpected )", expr: "id=cMK)"},
+		{name: "missing operand", expr: "id=cMK &&"},
+		{name: "unterminated string", expr: `session="s1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if f, err := NewCaptureFilter(tt.expr); err == nil {
+				t.Errorf("NewCaptureFilter(%q) = %v, want an error", tt.expr, f)
+			}
+		})
+	}
+}
+
+func TestCaptureFilterMatch(t *testing.T) {
+	type packet struct {
+		dir     Direction
+		session string
+		pkt     string
+	}
+	var (
+		chat    = packet{DirectionServer, "s1", "cMK@|0||hello|"}
+		mapData = packet{DirectionServer, "s2", "GDM|7411|0706131721|"}
+		date    = packet{DirectionClient, "s1", "BD"}
+	)
+	tests := []struct {
+		expr  string
+		match []packet
+		skip  []packet
+	}{
+		{expr: "dir=server", match: []packet{chat, mapData}, skip: []packet{date}},
+		{expr: "dir!=server", match: []packet{date}, skip: []packet{chat, mapData}},
+		{expr: "id=cMK", match: []packet{chat}, skip: []packet{mapData, date}},
+		{expr: "name=ChatMessageSuccess", match: []packet{chat}, skip: []packet{mapData, date}},
+		{expr: "name=BasicsGetDate", match: []packet{date}, skip: []packet{chat, mapData}},
+		{expr: `session="s1"`, match: []packet{chat, date}, skip: []packet{mapData}},
+		// && binds tighter than ||.
+		{expr: "dir=client || id=cMK && session=s2", match: []packet{date}, skip: []packet{chat, mapData}},
+		{expr: "(dir=client || id=cMK) && session=s1", match: []packet{chat, date}, skip: []packet{mapData}},
+		// ! binds tighter than &&.
+		{expr: "!dir=client && session=s1", match: []packet{chat}, skip: []packet{mapData, date}},
+		{expr: "!(dir=client && session=s1)", match: []packet{chat, mapData}, skip: []packet{date}},
+		{expr: "dir=server && (id=cMK || id=GDM)", match: []packet{chat, mapData}, skip: []packet{date}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := NewCaptureFilter(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tt.match {
+				if !f.Match(p.dir, p.session, p.pkt) {
+					t.Errorf("%q from %s of %s doesn't match", p.pkt, p.dir, p.session)
+				}
+			}
+			for _, p := range tt.skip {
+				if f.Match(p.dir, p.session, p.pkt) {
+					t.Errorf("%q from %s of %s matches", p.pkt, p.dir, p.session)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package retroproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certCheckInterval is how often a CertReloader checks whether its files changed, at most. It bounds the stats of
+// the files on busy listeners.
+const certCheckInterval = time.Second
+
+// CertReloader serves a TLS certificate from its files through GetCertificate, loading it again once the files change,
+// so that it can be renewed without restarting the proxy, such as by cert-manager. A certificate that fails to load is
+// logged, and the previous one is kept. It is safe for concurrent use.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   Logger
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// certMod and keyMod are the modification times of the files when they were last loaded, successfully or not.
+	certMod time.Time
+	keyMod  time.Time
+	// checkedAt is when the files were last checked for changes.
+	checkedAt time.Time
+}
+
+// NewCertReloader returns a CertReloader for the certificate and key files, which are loaded right away.
+func NewCertReloader(certFile, keyFile string, logger Logger) (*CertReloader, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	err = r.load(certMod, keyMod)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the latest certificate, to be set as the GetCertificate of a tls.Config.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.checkedAt) >= certCheckInterval {
+		r.checkedAt = now
+		certMod, keyMod, err := r.modTimes()
+		if err != nil {
+			r.logger.Error("could not check tls certificate files", zap.Error(err))
+		} else if !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod) {
+			r.reload(certMod, keyMod)
+		}
+	}
+	return r.cert, nil
+}
+
+// Reload loads the certificate again even if its files didn't change, such as on SIGHUP.
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		r.logger.Error("could not reload tls certificate", zap.Error(err))
+		return err
+	}
+	return r.reload(certMod, keyMod)
+}
+
+// reload loads the certificate and logs the outcome. r.mu must be held.
+func (r *CertReloader) reload(certMod, keyMod time.Time) error {
+	err := r.load(certMod, keyMod)
+	if err != nil {
+		// It's tried again once the files change, such as when the other one of a renewed pair is written.
+		r.certMod, r.keyMod = certMod, keyMod
+		r.logger.Error("could not reload tls certificate, keeping the previous one",
+			zap.String("cert_file", r.certFile),
+			zap.Error(err),
+		)
+		return err
+	}
+	r.logger.Info("reloaded tls certificate",
+		zap.String("cert_file", r.certFile),
+		zap.Time("not_after", r.cert.Leaf.NotAfter),
+	)
+	return nil
+}
+
+// load parses the certificate, with its leaf so that it's not parsed again by each handshake, and sets it along with
+// the modification times of its files. r.mu must be held, unless r is not shared yet.
+func (r *CertReloader) load(certMod, keyMod time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load tls certificate: %w", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("could not parse tls certificate: %w", err)
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// modTimes returns the modification times of the certificate and key files, following symlinks, which is how
+// renewed secrets are swapped in when mounted in a container.
+func (r *CertReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	fi, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	certMod = fi.ModTime()
+	fi, err = os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certMod, fi.ModTime(), nil
+}
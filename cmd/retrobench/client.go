@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kralamoure/retroproto"
+	"go.uber.org/zap"
+)
+
+// weightedPkt is a packet of the mix sent by the clients, which is picked with a probability proportional to weight.
+type weightedPkt struct {
+	pkt    string
+	weight int
+}
+
+// parseMix parses the packets of the form [<weight>:]<packet>, whose weight is 1 by default.
+func parseMix(specs []string) ([]weightedPkt, error) {
+	var mix []weightedPkt
+	for _, spec := range specs {
+		w := weightedPkt{pkt: spec, weight: 1}
+		if i := strings.IndexByte(spec, ':'); i > 0 {
+			if weight, err := strconv.Atoi(spec[:i]); err == nil {
+				if weight <= 0 {
+					return nil, fmt.Errorf("invalid weight of packet %q", spec)
+				}
+				w = weightedPkt{pkt: spec[i+1:], weight: weight}
+			}
+		}
+		if w.pkt == "" {
+			return nil, fmt.Errorf("empty packet in %q", spec)
+		}
+		mix = append(mix, w)
+	}
+	if len(mix) == 0 {
+		return nil, errors.New("empty packet mix")
+	}
+	return mix, nil
+}
+
+// pick returns a packet of mix at random.
+func pick(mix []weightedPkt, rnd *rand.Rand) string {
+	total := 0
+	for _, w := range mix {
+		total += w.weight
+	}
+	n := rnd.Intn(total)
+	for _, w := range mix {
+		if n < w.weight {
+			return w.pkt
+		}
+		n -= w.weight
+	}
+	return mix[len(mix)-1].pkt
+}
+
+// stats are the results of the clients. The counters are updated atomically, and the latencies under mu.
+type stats struct {
+	connected atomic.Int64
+	sent      atomic.Int64
+	received  atomic.Int64
+	bytesSent atomic.Int64
+	bytesRecv atomic.Int64
+	errors    atomic.Int64
+
+	mu         sync.Mutex
+	handshakes []time.Duration
+	latencies  []time.Duration
+}
+
+func (s *stats) addLatencies(handshake time.Duration, latencies []time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handshakes = append(s.handshakes, handshake)
+	s.latencies = append(s.latencies, latencies...)
+}
+
+// maxUnanswered is how many packets a client may have sent without getting their reply, beyond which the proxy is too
+// slow for the rate of the clients.
+const maxUnanswered = 1024
+
+// client is a simulated game client, which logs in with a ticket then sends packets of the mix until ctx is done.
+type client struct {
+	id     int
+	addr   string
+	ticket string
+	mix    []weightedPkt
+	// interval is the time between two packets, or zero to send the next packet once the previous one is answered.
+	interval time.Duration
+	stats    *stats
+}
+
+// run connects to the proxy and sends packets until ctx is done, counting the errors that end it before.
+func (c *client) run(ctx context.Context) {
+	err := c.bench(ctx)
+	if err != nil && ctx.Err() == nil {
+		c.stats.errors.Add(1)
+		logger.Debug("client failed", zap.Int("client", c.id), zap.Error(err))
+	}
+}
+
+func (c *client) bench(ctx context.Context) error {
+	conn, err := (&net.Dialer{Timeout: 3 * time.Second}).DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	rd := bufio.NewReader(conn)
+	start := time.Now()
+	_, err = c.read(rd, retroproto.AksHelloGame)
+	if err != nil {
+		return fmt.Errorf("could not read hello: %w", err)
+	}
+	err = c.write(conn, fmt.Sprint(retroproto.AccountSendTicket, c.ticket))
+	if err != nil {
+		return err
+	}
+	_, err = c.read(rd, retroproto.AccountTicketResponseSuccess)
+	if err != nil {
+		return fmt.Errorf("ticket refused: %w", err)
+	}
+	handshake := time.Since(start)
+	c.stats.connected.Add(1)
+
+	// The stub server answers every packet in order, so each reply is matched with the oldest packet not answered yet.
+	sentAt := make(chan time.Time, maxUnanswered)
+	// answered gets a value for each reply in closed loop.
+	answered := make(chan struct{}, 1)
+	var latencies []time.Duration
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			_, err := c.read(rd, retroproto.BasicsNothing)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			latencies = append(latencies, time.Since(<-sentAt))
+			if c.interval == 0 {
+				answered <- struct{}{}
+			}
+		}
+	}()
+	defer func() {
+		conn.Close()
+		<-errCh
+		c.stats.addLatencies(handshake, latencies)
+	}()
+
+	rnd := rand.New(rand.NewSource(int64(c.id)))
+	var tick <-chan time.Time
+	if c.interval > 0 {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case sentAt <- time.Now():
+		default:
+			return fmt.Errorf("more than %d packets not answered", maxUnanswered)
+		}
+		err := c.write(conn, pick(c.mix, rnd))
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-tick:
+		case <-answered:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (c *client) write(conn net.Conn, pkt string) error {
+	n, err := conn.Write([]byte(pkt + "\n\x00"))
+	c.stats.bytesSent.Add(int64(n))
+	if err != nil {
+		return err
+	}
+	c.stats.sent.Add(1)
+	return nil
+}
+
+// read reads the next packet, which must have the given id.
+func (c *client) read(rd *bufio.Reader, id retroproto.MsgSvrId) (string, error) {
+	pkt, err := rd.ReadString('\x00')
+	c.stats.bytesRecv.Add(int64(len(pkt)))
+	if err != nil {
+		return "", err
+	}
+	pkt = strings.TrimSuffix(pkt, "\x00")
+	if !strings.HasPrefix(pkt, string(id)) {
+		return "", fmt.Errorf("unexpected packet: %q", pkt)
+	}
+	c.stats.received.Add(1)
+	return pkt, nil
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+func sortDurations(d []time.Duration) {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+}
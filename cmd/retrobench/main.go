@@ -0,0 +1,242 @@
+// Command retrobench measures the game proxy under load: it runs a game proxy in front of a stub game server, and
+// simulated clients that log in with tickets and send a mix of packets through it, then reports the throughput, the
+// latencies and the errors.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kralamoure/retroproto"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/game"
+	"github.com/kralamoure/retroproxy/internal/gametest"
+)
+
+var (
+	debug         bool
+	addr          string
+	clients       int
+	duration      time.Duration
+	rampUp        time.Duration
+	rate          float64
+	packets       []string
+	maxPacketSize int
+	tcpNoDelay    bool
+	proxyLogLevel string
+)
+
+var logger *zap.Logger
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	err := loadVars()
+	if err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return 0
+		}
+		log.Println(err)
+		return 2
+	}
+	mix, err := parseMix(packets)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	var level zapcore.Level
+	err = level.Set(proxyLogLevel)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if debug {
+		tmp, err := zap.NewDevelopment()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		logger = tmp
+	} else {
+		tmp, err := zap.NewProduction()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		logger = tmp
+	}
+	defer logger.Sync()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// The stub accepts every ticket and answers each other packet with a BasicsNothing message, so that the clients
+	// can measure the latency of each of their packets.
+	st, err := gametest.New(gametest.Config{
+		Script: []gametest.Step{
+			gametest.TicketStep,
+			{Replies: []string{string(retroproto.BasicsNothing)}, Repeat: true},
+		},
+		NoRecord: true,
+	})
+	if err != nil {
+		logger.Error("could not start stub server", zap.Error(err))
+		return 1
+	}
+	defer st.Close()
+
+	storer := retroproxy.NewCache(nil)
+	px, err := game.New(game.Config{
+		Addr:          addr,
+		Storer:        storer,
+		MaxPacketSize: maxPacketSize,
+		TCPNagle:      !tcpNoDelay,
+		Logger:        logger.Named("game").WithOptions(zap.IncreaseLevel(level)),
+	})
+	if err != nil {
+		logger.Error("could not make game proxy", zap.Error(err))
+		return 1
+	}
+	proxyCtx, stopProxy := context.WithCancel(context.Background())
+	proxyErrCh := make(chan error, 1)
+	go func() {
+		proxyErrCh <- px.ListenAndServe(proxyCtx)
+	}()
+	defer func() {
+		stopProxy()
+		<-proxyErrCh
+	}()
+	for !px.Listening() {
+		select {
+		case err := <-proxyErrCh:
+			proxyErrCh <- err
+			logger.Error("could not start game proxy", zap.Error(err))
+			return 1
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	logger.Info("starting benchmark",
+		zap.String("address", addr),
+		zap.Int("clients", clients),
+		zap.Duration("duration", duration),
+		zap.Float64("rate", rate),
+	)
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	s := &stats{}
+	benchCtx, stopBench := context.WithTimeout(ctx, duration)
+	defer stopBench()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		if i > 0 && rampUp > 0 {
+			select {
+			case <-time.After(rampUp / time.Duration(clients)):
+			case <-benchCtx.Done():
+			}
+		}
+		if benchCtx.Err() != nil {
+			break
+		}
+		ticket := strconv.Itoa(i)
+		storer.SetTicket(ticket, st.Ticket(ticket))
+		c := &client{id: i, addr: addr, ticket: ticket, mix: mix, interval: interval, stats: s}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.run(benchCtx)
+		}()
+	}
+	<-benchCtx.Done()
+	wg.Wait()
+
+	report(s, time.Since(start))
+	return 0
+}
+
+// report prints the results of the benchmark, which lasted elapsed.
+func report(s *stats, elapsed time.Duration) {
+	sortDurations(s.handshakes)
+	sortDurations(s.latencies)
+	secs := elapsed.Seconds()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintf(tw, "duration\t%s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(tw, "clients connected\t%d/%d\n", s.connected.Load(), clients)
+	fmt.Fprintf(tw, "errors\t%d\n", s.errors.Load())
+	fmt.Fprintf(tw, "packets sent\t%d (%.0f/s)\n", s.sent.Load(), float64(s.sent.Load())/secs)
+	fmt.Fprintf(tw, "packets received\t%d (%.0f/s)\n", s.received.Load(), float64(s.received.Load())/secs)
+	fmt.Fprintf(tw, "bytes sent\t%d (%.0f/s)\n", s.bytesSent.Load(), float64(s.bytesSent.Load())/secs)
+	fmt.Fprintf(tw, "bytes received\t%d (%.0f/s)\n", s.bytesRecv.Load(), float64(s.bytesRecv.Load())/secs)
+	for _, l := range []struct {
+		name string
+		d    []time.Duration
+	}{
+		{"handshake latency", s.handshakes},
+		{"packet latency", s.latencies},
+	} {
+		fmt.Fprintf(tw, "%s\tp50 %s\tp90 %s\tp99 %s\tmax %s\n", l.name,
+			percentile(l.d, 50), percentile(l.d, 90), percentile(l.d, 99), percentile(l.d, 100))
+	}
+}
+
+func loadVars() error {
+	flags := pflag.NewFlagSet("retrobench", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of retrobench: retrobench [flags]")
+		flags.PrintDefaults()
+	}
+	flags.BoolVarP(&debug, "debug", "d", false, "Enable debug mode")
+	flags.StringVarP(&addr, "game", "g", "127.0.0.1:5556", "Dofus game proxy listener address")
+	flags.IntVarP(&clients, "clients", "c", 100, "Number of simulated clients")
+	flags.DurationVar(&duration, "duration", 30*time.Second, "Duration of the benchmark")
+	flags.DurationVar(&rampUp, "ramp-up", 0, "Time over which the clients connect (all at once if zero)")
+	flags.Float64Var(&rate, "rate", 10,
+		"Packets sent per second by each client (as fast as the replies come if zero)")
+	flags.StringArrayVar(&packets, "packet", []string{"3:BD", "BM*|hello|"},
+		"Packet sent by the clients, optionally preceded by <weight>: (repeatable)")
+	flags.IntVar(&maxPacketSize, "max-packet-size", 64*1024, "Maximum size of a Dofus game packet")
+	flags.BoolVar(&tcpNoDelay, "tcp-nodelay", true, "Send small packets right away instead of using Nagle's algorithm")
+	flags.StringVar(&proxyLogLevel, "proxy-log-level", "warn", "Minimum level of the logs of the game proxy")
+	flags.SortFlags = false
+	err := flags.Parse(os.Args)
+	if err != nil {
+		return err
+	}
+	if clients <= 0 {
+		return errors.New("clients must be positive")
+	}
+	if duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	if rate < 0 {
+		return errors.New("rate can't be negative")
+	}
+	_, _, err = net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid game proxy address: %w", err)
+	}
+	return nil
+}
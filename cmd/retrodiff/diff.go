@@ -0,0 +1,127 @@
+package main
+
+// editKind is the kind of an edit that turns the messages of the first capture into those of the second one.
+type editKind string
+
+const (
+	editAdded   editKind = "added"
+	editRemoved editKind = "removed"
+	// editMoved is a message removed at one position and added at another one.
+	editMoved editKind = "moved"
+)
+
+// edit is a change between two sequences of message ids. AIndex and BIndex are the positions of the message in each
+// sequence, or -1 if it's missing from it.
+type edit struct {
+	Kind   editKind `json:"kind"`
+	Id     string   `json:"id"`
+	Name   string   `json:"name,omitempty"`
+	AIndex int      `json:"a_index"`
+	BIndex int      `json:"b_index"`
+}
+
+// editScript returns the shortest script of additions and removals that turns a into b, with Myers' algorithm, in
+// order of position. It gives up and returns false if more than maxEdits are needed, since its memory grows with the
+// square of the number of edits.
+func editScript(a, b []string, maxEdits int) ([]edit, bool) {
+	n, m := len(a), len(b)
+	// v holds the furthest x reached on each diagonal k = x - y, offset by max.
+	max := n + m
+	v := make([]int, 2*max+2)
+	// trace holds the diagonals -d..d of v after each step d.
+	var trace [][]int
+
+	for d := 0; d <= max; d++ {
+		if d > maxEdits {
+			return nil, false
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v[max-d:max+d+1]...))
+				return backtrack(a, b, trace), true
+			}
+		}
+		trace = append(trace, append([]int(nil), v[max-d:max+d+1]...))
+	}
+	return nil, false
+}
+
+// backtrack walks the trace of editScript back from the end of both sequences to collect the edits.
+func backtrack(a, b []string, trace [][]int) []edit {
+	var edits []edit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int {
+			return prev[k+d-1]
+		}
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		// Skip the matching messages of the snake.
+		for x > prevX && y > prevY {
+			x--
+			y--
+		}
+		if prevK == k+1 {
+			edits = append(edits, edit{Kind: editAdded, Id: b[prevY], AIndex: -1, BIndex: prevY})
+		} else {
+			edits = append(edits, edit{Kind: editRemoved, Id: a[prevX], AIndex: prevX, BIndex: -1})
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// pairMoves merges each removal with a later or earlier addition of the same message into a move.
+func pairMoves(edits []edit) []edit {
+	added := make(map[string][]int)
+	for i, e := range edits {
+		if e.Kind == editAdded {
+			added[e.Id] = append(added[e.Id], i)
+		}
+	}
+
+	paired := make(map[int]bool)
+	for i, e := range edits {
+		if e.Kind != editRemoved || len(added[e.Id]) == 0 {
+			continue
+		}
+		j := added[e.Id][0]
+		added[e.Id] = added[e.Id][1:]
+		edits[i] = edit{Kind: editMoved, Id: e.Id, AIndex: e.AIndex, BIndex: edits[j].BIndex}
+		paired[j] = true
+	}
+
+	merged := edits[:0]
+	for i, e := range edits {
+		if !paired[i] {
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
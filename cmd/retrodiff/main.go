@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/game/protocol"
+)
+
+var (
+	format   string
+	maxEdits int
+	captureA string
+	captureB string
+)
+
+// unknownId is the id of the messages that are not known by retroproto.
+const unknownId = "?"
+
+func main() {
+	os.Exit(run())
+}
+
+// run exits with 0 if the captures have the same messages, 1 if they differ and 2 on errors, like diff.
+func run() int {
+	err := loadVars()
+	if err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return 0
+		}
+		log.Println(err)
+		return 2
+	}
+
+	a, err := loadMessages(captureA)
+	if err != nil {
+		log.Printf("could not load %s: %s", captureA, err)
+		return 2
+	}
+	b, err := loadMessages(captureB)
+	if err != nil {
+		log.Printf("could not load %s: %s", captureB, err)
+		return 2
+	}
+
+	rep := report{A: captureA, B: captureB}
+	for _, dir := range []retroproxy.Direction{retroproxy.DirectionClient, retroproxy.DirectionServer} {
+		rep.Directions = append(rep.Directions, compare(dir, a[dir], b[dir]))
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rep)
+	default:
+		err = rep.print(os.Stdout)
+	}
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if !rep.identical() {
+		return 1
+	}
+	return 0
+}
+
+// loadMessages returns the ids of the messages of a capture by direction. The sessions are concatenated in the order
+// they start, and the messages of each session are in order of sequence number, so that concurrent sessions don't
+// interleave.
+func loadMessages(path string) (map[retroproxy.Direction][]string, error) {
+	f, err := retroproxy.OpenDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var order []string
+	sessions := make(map[string][]retroproxy.CaptureRecord)
+	rd := retroproxy.NewCaptureReader(bufio.NewReader(f))
+	for {
+		rec, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		// The packets injected from the admin console weren't sent by the client or the server of the session.
+		if rec.Marker != "" || rec.Injected {
+			continue
+		}
+		if _, ok := sessions[rec.SessionId]; !ok {
+			order = append(order, rec.SessionId)
+		}
+		sessions[rec.SessionId] = append(sessions[rec.SessionId], rec)
+	}
+
+	ids := make(map[retroproxy.Direction][]string)
+	for _, sessionId := range order {
+		byDir := make(map[retroproxy.Direction][]retroproxy.CaptureRecord)
+		for _, rec := range sessions[sessionId] {
+			byDir[rec.Direction] = append(byDir[rec.Direction], rec)
+		}
+		for dir, recs := range byDir {
+			// Captures made before sequence numbers were added have none, and are kept in the order of the file.
+			sort.SliceStable(recs, func(i, j int) bool {
+				return recs[i].Seq < recs[j].Seq
+			})
+			for _, rec := range recs {
+				id, _ := protocol.MessageID(dir, rec.Packet)
+				if id == "" {
+					id = unknownId
+				}
+				ids[dir] = append(ids[dir], string(id))
+			}
+		}
+	}
+	return ids, nil
+}
+
+// report is the differences between two captures.
+type report struct {
+	A          string            `json:"a"`
+	B          string            `json:"b"`
+	Directions []directionReport `json:"directions"`
+}
+
+// directionReport is the differences between the messages of two captures read from one side.
+type directionReport struct {
+	Direction retroproxy.Direction `json:"direction"`
+	AMessages int                  `json:"a_messages"`
+	BMessages int                  `json:"b_messages"`
+	// Counts are the numbers of messages of each id that differ between the captures.
+	Counts []countDiff `json:"counts"`
+	// Edits are the messages added, removed and moved in the second capture, unless there are too many of them.
+	Edits        []edit `json:"edits"`
+	TooManyEdits bool   `json:"too_many_edits,omitempty"`
+}
+
+type countDiff struct {
+	Id   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	A    int    `json:"a"`
+	B    int    `json:"b"`
+}
+
+func (r report) identical() bool {
+	for _, dr := range r.Directions {
+		if len(dr.Counts) > 0 || len(dr.Edits) > 0 || dr.TooManyEdits {
+			return false
+		}
+	}
+	return true
+}
+
+func compare(dir retroproxy.Direction, a, b []string) directionReport {
+	dr := directionReport{
+		Direction: dir,
+		AMessages: len(a),
+		BMessages: len(b),
+		Counts:    []countDiff{},
+		Edits:     []edit{},
+	}
+
+	counts := make(map[string][2]int)
+	for _, id := range a {
+		c := counts[id]
+		c[0]++
+		counts[id] = c
+	}
+	for _, id := range b {
+		c := counts[id]
+		c[1]++
+		counts[id] = c
+	}
+	for id, c := range counts {
+		if c[0] != c[1] {
+			dr.Counts = append(dr.Counts, countDiff{Id: id, Name: messageName(dir, id), A: c[0], B: c[1]})
+		}
+	}
+	sort.Slice(dr.Counts, func(i, j int) bool {
+		return dr.Counts[i].Id < dr.Counts[j].Id
+	})
+
+	edits, ok := editScript(a, b, maxEdits)
+	if !ok {
+		dr.TooManyEdits = true
+		return dr
+	}
+	for _, e := range pairMoves(edits) {
+		e.Name = messageName(dir, e.Id)
+		dr.Edits = append(dr.Edits, e)
+	}
+	return dr
+}
+
+func messageName(dir retroproxy.Direction, id string) string {
+	return protocol.Name(dir, protocol.ID(id))
+}
+
+func (r report) print(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--- %s\n+++ %s\n", r.A, r.B)
+	for _, dr := range r.Directions {
+		fmt.Fprintf(bw, "\n%s messages: %d, %d\n", dr.Direction, dr.AMessages, dr.BMessages)
+		if len(dr.Counts) == 0 && len(dr.Edits) == 0 && !dr.TooManyEdits {
+			fmt.Fprintln(bw, "  identical")
+			continue
+		}
+		if len(dr.Counts) > 0 {
+			fmt.Fprintln(bw, "  counts:")
+			for _, c := range dr.Counts {
+				fmt.Fprintf(bw, "    %-24s %6d -> %d\n", label(c.Id, c.Name), c.A, c.B)
+			}
+		}
+		if dr.TooManyEdits {
+			fmt.Fprintf(bw, "  sequence: more than %d edits, not compared\n", maxEdits)
+			continue
+		}
+		if len(dr.Edits) > 0 {
+			fmt.Fprintln(bw, "  sequence:")
+			for _, e := range dr.Edits {
+				switch e.Kind {
+				case editAdded:
+					fmt.Fprintf(bw, "    + %-24s at %d\n", label(e.Id, e.Name), e.BIndex)
+				case editRemoved:
+					fmt.Fprintf(bw, "    - %-24s at %d\n", label(e.Id, e.Name), e.AIndex)
+				case editMoved:
+					fmt.Fprintf(bw, "    ~ %-24s from %d to %d\n", label(e.Id, e.Name), e.AIndex, e.BIndex)
+				}
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// label returns how a message is shown in the summary, such as "GameActions (GA)".
+func label(id, name string) string {
+	if name == "" {
+		return id
+	}
+	return fmt.Sprintf("%s (%s)", name, id)
+}
+
+func loadVars() error {
+	flags := pflag.NewFlagSet("retrodiff", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of retrodiff: retrodiff [flags] <capture file> <capture file>")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&format, "format", "text", "Output format, text or json")
+	flags.IntVar(&maxEdits, "max-edits", 2000, "Number of edits beyond which the message sequences are not compared")
+	flags.SortFlags = false
+	err := flags.Parse(os.Args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 3 {
+		flags.Usage()
+		return errors.New("missing capture files")
+	}
+	captureA, captureB = flags.Arg(1), flags.Arg(2)
+	switch format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid format: %q", format)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Command retrogolden runs the captures of a directory through a game proxy and compares the packets that reach each
+// side with their golden captures, see package testutil, so that changes to the framing or the handling of the packets
+// can be gated in CI.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	"github.com/kralamoure/retroproxy/game"
+	"github.com/kralamoure/retroproxy/testutil"
+)
+
+var (
+	update bool
+	dir    string
+)
+
+func main() {
+	os.Exit(run())
+}
+
+// run exits with 0 if every capture matches its golden capture, 1 if some don't and 2 on errors of usage.
+func run() int {
+	err := loadVars()
+	if err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return 0
+		}
+		log.Println(err)
+		return 2
+	}
+
+	err = testutil.CheckDir(dir, update, game.Config{})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func loadVars() error {
+	flags := pflag.NewFlagSet("retrogolden", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of retrogolden: retrogolden [flags] [directory]")
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&update, "update", false, "Write the golden captures instead of comparing them")
+	flags.SortFlags = false
+	err := flags.Parse(os.Args)
+	if err != nil {
+		return err
+	}
+	switch flags.NArg() {
+	case 1:
+		dir = "testutil/testdata"
+	case 2:
+		dir = flags.Arg(1)
+	default:
+		flags.Usage()
+		return errors.New("too many arguments")
+	}
+	return nil
+}
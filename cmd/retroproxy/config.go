@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+
+	"github.com/kralamoure/retroproxy/game"
+)
+
+// loadConfigFile sets the flags that have not been set on the command line from the file at path. The file is a
+// TOML document if its extension is .toml and a YAML document otherwise, mapping long flag names to values.
+func loadConfigFile(flags *pflag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(b, &values)
+	} else {
+		err = yaml.Unmarshal(b, &values)
+	}
+	if err != nil {
+		return fmt.Errorf("could not parse config file: %w", err)
+	}
+
+	for name, v := range values {
+		flag := flags.Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("unknown config key: %q", name)
+		}
+		if cmdlineFlags[name] {
+			continue
+		}
+
+		items, ok := v.([]interface{})
+		if !ok {
+			items = []interface{}{v}
+		}
+		// Slices are replaced rather than appended to, so reloading the file doesn't duplicate their items.
+		if sv, ok := flag.Value.(pflag.SliceValue); ok {
+			strs := make([]string, len(items))
+			for i, item := range items {
+				strs[i] = fmt.Sprint(item)
+			}
+			err := sv.Replace(strs)
+			if err != nil {
+				return fmt.Errorf("invalid value for config key %q: %w", name, err)
+			}
+			continue
+		}
+		for _, item := range items {
+			err := flags.Set(name, fmt.Sprint(item))
+			if err != nil {
+				return fmt.Errorf("invalid value for config key %q: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateAddr checks that addr is a host:port address, where host may only be empty if requireHost is false.
+func validateAddr(name, addr string, requireHost bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid %s address: %w", name, err)
+	}
+	if port == "" {
+		return fmt.Errorf("invalid %s address: missing port", name)
+	}
+	if requireHost && host == "" {
+		return fmt.Errorf("invalid %s address: missing host", name)
+	}
+	return nil
+}
+
+// parseGameListener parses an additional game proxy listener of the form addr[=server_addr].
+func parseGameListener(s string) (game.ListenerConfig, error) {
+	addr, serverAddr, _ := strings.Cut(s, "=")
+	err := validateAddr("game listener", addr, false)
+	if err != nil {
+		return game.ListenerConfig{}, err
+	}
+	if serverAddr != "" {
+		err := validateAddr("game listener server", serverAddr, true)
+		if err != nil {
+			return game.ListenerConfig{}, err
+		}
+	}
+	return game.ListenerConfig{Addr: addr, ServerAddr: serverAddr}, nil
+}
+
+// resolveLocalAddr returns the local address of the connections to the servers, given as an IP or an interface name,
+// which must be assigned to one of the interfaces of the host. The port is chosen by the system.
+func resolveLocalAddr(s string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return &net.TCPAddr{IP: ip}, nil
+			}
+		}
+		return nil, fmt.Errorf("upstream local address %s is not assigned to an interface", s)
+	}
+
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream local address: %w", err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	// IPv4 is preferred, since Dofus servers are rarely reachable over IPv6.
+	var ip net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			ip = ipNet.IP
+			break
+		}
+		if ip == nil {
+			ip = ipNet.IP
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("interface %s has no address", s)
+	}
+	return &net.TCPAddr{IP: ip}, nil
+}
@@ -2,23 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime/trace"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
-
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/kralamoure/retroproxy"
 	"github.com/kralamoure/retroproxy/game"
+	"github.com/kralamoure/retroproxy/game/protocol"
 	"github.com/kralamoure/retroproxy/login"
+	"github.com/kralamoure/retroproxy/server"
 )
 
 var (
@@ -27,10 +38,114 @@ var (
 	loginProxyAddr      string
 	gameProxyAddr       string
 	gameProxyPublicAddr string
+	disableLogin        bool
+	disableGame         bool
+	ephemeralGamePorts  bool
+	publicCheckURL      string
+	gameListens         []string
+	gameListeners       []game.ListenerConfig
 	forceAdmin          bool
+	upstreamTLS         bool
+	upstreamLocalAddr   string
+	upstreamLocalTCP    *net.TCPAddr
+	upstreamTLSInsecure bool
+	upstreamProxy       string
+	upstreamAccount     string
+	upstreamPassword    string
+	breakerFailures     int
+	breakerWindow       time.Duration
+	breakerCooldown     time.Duration
+	sniffOnly           bool
+	strict              bool
+	hexDump             bool
+	hexDumpMaxPkts      int
+	proxyProtocol       bool
+	captureFile         string
+	captureFormat       string
+	captureMaxSize      int
+	captureMaxAge       time.Duration
+	captureCompress     string
+	captureMaxFiles     int
+	captureFilter       string
+	captureAnonymize    bool
+	captureTiming       bool
+	accessLogFile       string
+	ticketStore         string
+	ticketTTL           time.Duration
+	ticketPruneEvery    time.Duration
+	metricsAddr         string
+	otelEndpoint        string
+	shutdownGrace       time.Duration
+	halfCloseGrace      time.Duration
+	coalesceWindow      time.Duration
+	slowUpstream        time.Duration
+	restartListeners    bool
+	maxConnections      int
+	tcpKeepAlive        time.Duration
+	tcpNoDelay          bool
+	upstreamRetries     int
+	upstreamResume      bool
+	injectLatency       time.Duration
+	injectJitter        time.Duration
+	rateLimitBps        int
+	rateLimitBpsClient  int
+	rateLimitBpsServer  int
+	dropClientMsgs      []string
+	dropServerMsgs      []string
+	rewriteRules        []string
+	rewriteRegex        bool
+	maxPacketSize       int
+	loginMaxPacketSize  int
+	readTimeout         time.Duration
+	writeTimeout        time.Duration
+	pprofAddr           string
+	adminSocket         string
+	adminHTTPAddr       string
+	adminTLSCert        string
+	adminTLSKey         string
+	adminTLSClientCA    string
+	adminToken          string
+	shadowDir           string
+	connRate            float64
+	connBurst           int
+	allowCIDRs          []string
+	denyCIDRs           []string
+	allowedVersions     []string
+	maxAccountSessions  int
+	maxSessionsPerIP    int
+	quotaWindow         time.Duration
+	quotaBytes          int
+	quotaPackets        int
 )
 
-var logger *zap.Logger
+// autoPublicAddr is the value of --public that detects the public address of the game proxy.
+const autoPublicAddr = "auto"
+
+// publicCheckTimeout bounds the detection of the public address of the game proxy.
+const publicCheckTimeout = 5 * time.Second
+
+// healthCheckInterval is how often the health check dials the login server.
+const healthCheckInterval = 10 * time.Second
+
+// captureFlushInterval is how often the capture is written out, which bounds the packets lost if the proxy crashes.
+const captureFlushInterval = time.Second
+
+var (
+	logger   *zap.Logger
+	logLevel zap.AtomicLevel
+)
+
+var (
+	flags        *pflag.FlagSet
+	configFile   string
+	logLevelName string
+	// logSampleInitial and logSampleThereafter are the sampling of the logs: each second, the first logSampleInitial
+	// entries with the same level and message are logged, then every logSampleThereafter-th of them.
+	logSampleInitial    int
+	logSampleThereafter int
+	// cmdlineFlags are the names of the flags set on the command line, which the config file can't override.
+	cmdlineFlags = make(map[string]bool)
+)
 
 func main() {
 	os.Exit(run())
@@ -61,22 +176,153 @@ func run() int {
 		defer trace.Stop()
 	}
 
+	var logConfig zap.Config
 	if debug {
-		tmp, err := zap.NewDevelopment()
+		logConfig = zap.NewDevelopmentConfig()
+	} else {
+		logConfig = zap.NewProductionConfig()
+	}
+	logConfig.Sampling = nil
+	if logSampleInitial > 0 {
+		logConfig.Sampling = &zap.SamplingConfig{
+			Initial:    logSampleInitial,
+			Thereafter: logSampleThereafter,
+		}
+	}
+	logLevel = logConfig.Level
+	err = setLogLevel()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	logger, err = logConfig.Build()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer logger.Sync()
+
+	storer, err := newStorer(ticketStore)
+	if err != nil {
+		logger.Error("could not make ticket store", zap.Error(err))
+		return 1
+	}
+	if closer, ok := storer.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if (disableLogin || disableGame) && ticketStore == "memory" {
+		logger.Warn("a proxy is disabled but the ticket store is in memory, so it can't be shared with the other proxy")
+	}
+
+	// The public address is only sent to the clients by the login proxy.
+	publicAddr := gameProxyPublicAddr
+	if !disableLogin {
+		if publicAddr == autoPublicAddr {
+			publicAddr = detectPublicAddr()
+		}
+		logger.Info("game proxy public address", zap.String("address", publicAddr))
+	}
+
+	var dialer retroproxy.Dialer
+	forward := &net.Dialer{Timeout: 3 * time.Second, KeepAlive: keepAlivePeriod()}
+	if upstreamLocalTCP != nil {
+		forward.LocalAddr = upstreamLocalTCP
+		dialer = forward
+	}
+	if upstreamProxy != "" {
+		dialer, err = retroproxy.NewUpstreamProxyDialerFrom(upstreamProxy, forward)
 		if err != nil {
-			log.Println(err)
+			logger.Error("could not make upstream proxy dialer", zap.Error(err))
 			return 1
 		}
-		logger = tmp
-	} else {
-		tmp, err := zap.NewProduction()
+	}
+
+	// With systemd socket activation, the proxies use the listeners bound to their addresses.
+	activated, err := retroproxy.ActivatedListenersFromEnv()
+	if err != nil {
+		logger.Error("could not use socket activation", zap.Error(err))
+		return 1
+	}
+	if activated != nil {
+		defer activated.Close()
+		logger.Info("socket activated",
+			zap.Strings("addresses", activated.Addrs()),
+		)
+	}
+
+	var sessionLimiter *retroproxy.SessionLimiter
+	if maxConnections > 0 {
+		sessionLimiter = retroproxy.NewSessionLimiter(maxConnections)
+	}
+
+	var breaker *retroproxy.CircuitBreaker
+	if breakerFailures > 0 {
+		breaker = retroproxy.NewCircuitBreaker(breakerFailures, breakerWindow, breakerCooldown)
+	}
+
+	var accessLog *retroproxy.AccessLog
+	if accessLogFile != "" {
+		f, err := os.OpenFile(accessLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
-			log.Println(err)
+			logger.Error("could not open access log", zap.Error(err))
 			return 1
 		}
-		logger = tmp
+		accessLog = retroproxy.NewAccessLog(f)
+		defer func() {
+			err := accessLog.Close()
+			if err != nil {
+				logger.Error("could not close access log", zap.Error(err))
+			}
+		}()
+	}
+
+	var capture *retroproxy.Capture
+	if captureFile != "" {
+		var filter *retroproxy.CaptureFilter
+		if captureFilter != "" {
+			filter, err = retroproxy.NewCaptureFilter(captureFilter)
+			if err != nil {
+				logger.Error("could not parse capture filter", zap.Error(err))
+				return 1
+			}
+		}
+
+		// The reading tools tell the compression of a capture by its extension.
+		compression := retroproxy.Compression(captureCompress)
+		path := captureFile
+		if ext := compression.Ext(); !strings.HasSuffix(path, ext) {
+			path += ext
+			logger.Info("added extension of compression to capture file", zap.String("path", path))
+		}
+		f, err := retroproxy.NewRotatingFile(retroproxy.RotatingFileConfig{
+			Path:        path,
+			MaxSize:     int64(captureMaxSize) << 20,
+			MaxAge:      captureMaxAge,
+			Compression: compression,
+			MaxFiles:    captureMaxFiles,
+			Logger:      logger.Named("capture"),
+		})
+		if err != nil {
+			logger.Error("could not create capture file", zap.Error(err))
+			return 1
+		}
+		capture, err = retroproxy.NewCaptureFormat(f, retroproxy.CaptureFormat(captureFormat))
+		if err != nil {
+			f.Close()
+			logger.Error("could not make capture", zap.Error(err))
+			return 1
+		}
+		capture.SetFilter(filter)
+		capture.SetAnonymize(captureAnonymize)
+		capture.SetTiming(captureTiming)
+		capture.SetFlushInterval(captureFlushInterval)
+		defer func() {
+			err := capture.Close()
+			if err != nil {
+				logger.Error("could not close capture file", zap.Error(err))
+			}
+		}()
 	}
-	defer logger.Sync()
 
 	var wg sync.WaitGroup
 	defer wg.Wait()
@@ -86,77 +332,715 @@ func run() int {
 
 	errCh := make(chan error)
 
-	storer := retroproxy.NewCache(logger.Named("cache"))
+	var ipFilter *retroproxy.IPFilter
+	if len(allowCIDRs) > 0 || len(denyCIDRs) > 0 {
+		ipFilter, err = retroproxy.NewIPFilter(allowCIDRs, denyCIDRs)
+		if err != nil {
+			logger.Error("could not make ip filter", zap.Error(err))
+			return 1
+		}
+	}
 
-	loginPx, err := login.NewProxy(
-		loginProxyAddr,
-		loginServerAddr,
-		gameProxyPublicAddr,
-		storer,
-		forceAdmin,
-		logger.Named("login"),
-	)
+	if sniffOnly {
+		logger.Warn("sniff-only mode: packets are forwarded verbatim and packet mutation is disabled")
+	}
+	if upstreamAccount != "" && !sniffOnly {
+		logger.Warn("substituting the credentials of the clients: anyone who can reach the login proxy logs into the upstream account",
+			zap.String("upstream_account", upstreamAccount))
+	}
+	if len(dropClientMsgs) > 0 || len(dropServerMsgs) > 0 {
+		logger.Warn("dropping game messages, which may desync the client",
+			zap.Strings("client_messages", dropClientMsgs),
+			zap.Strings("server_messages", dropServerMsgs),
+		)
+	}
+
+	var rewriter protocol.Rewriter
+	for _, rule := range rewriteRules {
+		r, err := protocol.ParseRewriteRule(rule, rewriteRegex)
+		if err != nil {
+			logger.Error("could not parse rewrite rule", zap.Error(err))
+			return 1
+		}
+		rewriter = append(rewriter, r)
+	}
+	if len(rewriter) > 0 {
+		logger.Warn("rewriting game messages, which may desync the client", zap.Strings("rules", rewriteRules))
+	}
+
+	adminTLS, adminCert, err := newAdminTLS()
 	if err != nil {
-		logger.Error("could not make login proxy", zap.Error(err))
+		logger.Error("could not load admin tls config", zap.Error(err))
 		return 1
 	}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := loginPx.ListenAndServe(ctx)
+
+	var tracer oteltrace.Tracer
+	if otelEndpoint != "" {
+		tp, err := newTracerProvider(ctx, otelEndpoint)
 		if err != nil {
-			select {
-			case errCh <- fmt.Errorf("error while serving login proxy: %w", err):
-			case <-ctx.Done():
-			}
+			logger.Error("could not make tracer provider", zap.Error(err))
+			return 1
 		}
-	}()
+		defer func() {
+			// The spans still in the batch are exported before exiting.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := tp.Shutdown(shutdownCtx)
+			if err != nil {
+				logger.Error("could not flush traces", zap.Error(err))
+			}
+		}()
+		tracer = tp.Tracer("github.com/kralamoure/retroproxy")
+	}
 
-	gamePx, err := game.NewProxy(
-		gameProxyAddr,
-		storer,
-		logger.Named("game"),
-	)
+	// Events are only consumed by the event stream of the admin api.
+	var events *retroproxy.EventHub
+	if adminHTTPAddr != "" {
+		events = retroproxy.NewEventHub()
+	}
+
+	srv, err := server.New(server.Config{
+		Login: login.Config{
+			Addr:                loginProxyAddr,
+			ServerAddr:          loginServerAddr,
+			GamePublicAddr:      publicAddr,
+			ForceAdmin:          forceAdmin,
+			SniffOnly:           sniffOnly,
+			Strict:              strict,
+			Capture:             capture,
+			HexDump:             hexDump,
+			HexDumpMaxPkts:      hexDumpMaxPkts,
+			AccessLog:           accessLog,
+			Events:              events,
+			Tracer:              tracer,
+			UpstreamTLS:         newUpstreamTLS(),
+			Dialer:              dialer,
+			Breaker:             breaker,
+			ProxyProtocol:       proxyProtocol,
+			IPFilter:            ipFilter,
+			ConnLimiter:         newConnLimiter(),
+			SessionLimiter:      sessionLimiter,
+			MaxSessionsPerIP:    maxSessionsPerIP,
+			Quota:               quota(),
+			ReadTimeout:         readTimeout,
+			WriteTimeout:        writeTimeout,
+			MaxClientPacketSize: loginMaxPacketSize,
+			AllowedVersions:     allowedVersions,
+			UpstreamAccount:     upstreamAccount,
+			UpstreamPassword:    upstreamPassword,
+			ShutdownGrace:       shutdownGrace,
+			TCPKeepAlive:        keepAlivePeriod(),
+			TCPNagle:            !tcpNoDelay,
+			RestartListener:     restartListeners,
+			Activated:           activated,
+			Logger:              logger.Named("login"),
+		},
+		Game: game.Config{
+			Addr:               gameProxyAddr,
+			Listeners:          gameListeners,
+			Capture:            capture,
+			HexDump:            hexDump,
+			HexDumpMaxPkts:     hexDumpMaxPkts,
+			AccessLog:          accessLog,
+			Events:             events,
+			Tracer:             tracer,
+			ProxyProtocol:      proxyProtocol,
+			IPFilter:           ipFilter,
+			ConnLimiter:        newConnLimiter(),
+			SessionLimiter:     sessionLimiter,
+			MaxSessionsPerIP:   maxSessionsPerIP,
+			Quota:              quota(),
+			ReadTimeout:        readTimeout,
+			WriteTimeout:       writeTimeout,
+			ShutdownGrace:      shutdownGrace,
+			HalfCloseGrace:     halfCloseGrace,
+			CoalesceWindow:     coalesceWindow,
+			SlowUpstream:       slowUpstream,
+			TCPKeepAlive:       keepAlivePeriod(),
+			TCPNagle:           !tcpNoDelay,
+			RestartListener:    restartListeners,
+			Activated:          activated,
+			UpstreamRetries:    upstreamRetries,
+			UpstreamResume:     upstreamResume,
+			Latency:            newLatencyInjector(),
+			ClientRateLimit:    clientRateLimit(),
+			ServerRateLimit:    serverRateLimit(),
+			DropClientMessages: dropClientMsgs,
+			DropServerMessages: dropServerMsgs,
+			Dialer:             dialer,
+			Breaker:            breaker,
+			MaxPacketSize:      maxPacketSize,
+			SniffOnly:          sniffOnly,
+			Strict:             strict,
+			MaxAccountSessions: maxAccountSessions,
+			Logger:             logger.Named("game"),
+		},
+		Storer:              storer,
+		TicketMaxDur:        ticketTTL,
+		TicketPruneInterval: ticketPruneEvery,
+		Logger:              logger,
+		DisableLogin:        disableLogin,
+		DisableGame:         disableGame,
+		EphemeralGamePorts:  ephemeralGamePorts,
+	})
 	if err != nil {
-		logger.Error("could not make game proxy", zap.Error(err))
+		logger.Error("could not make server", zap.Error(err))
 		return 1
 	}
+	if len(rewriter) > 0 && !disableGame {
+		srv.Game().Use(rewriter)
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := gamePx.ListenAndServe(ctx)
-		if err != nil {
+		err := srv.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
 			select {
-			case errCh <- fmt.Errorf("error while serving game proxy: %w", err):
+			case errCh <- err:
 			case <-ctx.Done():
 			}
 		}
 	}()
+	loginPx, gamePx := srv.Login(), srv.Game()
+	// Only the enabled proxies are checked and listed, a nil proxy in an interface not being nil.
+	listeners := make(map[string]retroproxy.Listener)
+	registries := make(map[string]retroproxy.SessionRegistry)
+	// Without the login proxy there is no upstream server to check, the game servers being those of the tickets.
+	checkServer := func(ctx context.Context) error { return nil }
+	if loginPx != nil {
+		listeners["login"] = loginPx
+		registries["login"] = loginPx
+		checkServer = loginPx.CheckServer
+	}
+	if gamePx != nil {
+		listeners["game"] = gamePx
+		registries["game"] = gamePx
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		retroproxy.DeleteOldTicketsLoop(ctx, storer, 10*time.Second)
-	}()
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
 
-	select {
-	case err := <-errCh:
-		logger.Error(err.Error())
-		return 1
-	case <-ctx.Done():
+		health := retroproxy.NewHealthChecker(checkServer, healthCheckInterval, listeners)
+		mux.Handle("/healthz", health)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			health.Run(ctx)
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := serveHTTP(ctx, metricsAddr, mux, adminTLS)
+			if err != nil {
+				select {
+				case errCh <- fmt.Errorf("error while serving metrics: %w", err):
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	console := retroproxy.NewConsole(registries, logger.Named("console"))
+	console.SetEvents(events)
+	console.SetBreaker(breaker)
+	console.SetSessionLimiter(sessionLimiter)
+	console.SetShadowDir(shadowDir)
+
+	if adminSocket != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := console.ListenAndServe(ctx, adminSocket)
+			if err != nil {
+				select {
+				case errCh <- fmt.Errorf("error while serving admin console: %w", err):
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	if adminHTTPAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := serveHTTP(ctx, adminHTTPAddr, console.Handler(adminToken), adminTLS)
+			if err != nil {
+				select {
+				case errCh <- fmt.Errorf("error while serving admin api: %w", err):
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	if pprofAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := serveHTTP(ctx, pprofAddr, mux, nil)
+			if err != nil {
+				select {
+				case errCh <- fmt.Errorf("error while serving pprof: %w", err):
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	for {
+		select {
+		case err := <-errCh:
+			logger.Error(err.Error())
+			return 1
+		case <-ctx.Done():
+			return 0
+		case <-hupCh:
+			reload(loginPx, adminCert)
+		}
+	}
+}
+
+// reload reloads the admin TLS certificate and the config file, applying the log level and the login server address
+// for new sessions. loginPx is nil if the login proxy is disabled, and adminCert if the admin listeners don't serve TLS.
+func reload(loginPx *login.Proxy, adminCert *retroproxy.CertReloader) {
+	if adminCert != nil {
+		// Its errors are logged, and the previous certificate kept.
+		adminCert.Reload()
+	}
+	if configFile == "" {
+		if adminCert == nil {
+			logger.Warn("received SIGHUP but there is no config file to reload")
+		}
+		return
+	}
+
+	err := loadConfigFile(flags, configFile)
+	if err != nil {
+		logger.Error("could not reload config file", zap.Error(err))
+		return
+	}
+
+	err = setLogLevel()
+	if err != nil {
+		logger.Error("could not set log level", zap.Error(err))
 	}
-	return 0
+
+	if loginPx != nil {
+		err = loginPx.SetServerAddr(loginServerAddr)
+		if err != nil {
+			logger.Error("could not set login server address", zap.Error(err))
+		}
+	}
+
+	logger.Info("config file reloaded",
+		zap.String("path", configFile),
+	)
+}
+
+func setLogLevel() error {
+	if logLevelName == "" {
+		return nil
+	}
+	level, err := zapcore.ParseLevel(logLevelName)
+	if err != nil {
+		return err
+	}
+	logLevel.SetLevel(level)
+	return nil
 }
 
 func loadVars() error {
-	flags := pflag.NewFlagSet("retroproxy", pflag.ContinueOnError)
+	flags = pflag.NewFlagSet("retroproxy", pflag.ContinueOnError)
+	flags.StringVarP(&configFile, "config", "c", "", "Config file (YAML, or TOML with a .toml extension)")
 	flags.BoolVarP(&debug, "debug", "d", false, "Enable debug mode")
+	flags.StringVar(&logLevelName, "log-level", "", "Log level (debug by default in debug mode, info otherwise)")
+	flags.IntVar(&logSampleInitial, "log-sample-initial", 100,
+		"Log entries with the same level and message logged each second before sampling (0 disables sampling)")
+	flags.IntVar(&logSampleThereafter, "log-sample-thereafter", 100,
+		"Log every nth entry with the same level and message once sampling within a second (0 drops them)")
 	flags.StringVarP(&loginServerAddr, "server", "s",
 		"dofusretro-co-production.ankama-games.com:443", "Dofus login server address")
 	flags.StringVarP(&loginProxyAddr, "login", "l", "0.0.0.0:5555", "Dofus login proxy listener address")
 	flags.StringVarP(&gameProxyAddr, "game", "g", "0.0.0.0:5556", "Dofus game proxy listener address")
-	flags.StringVarP(&gameProxyPublicAddr, "public", "p", "127.0.0.1:5556", "Dofus game proxy public address")
+	flags.BoolVar(&disableLogin, "disable-login", false, "Disable the login proxy, for when it runs elsewhere")
+	flags.BoolVar(&disableGame, "disable-game", false, "Disable the game proxy, for when it runs elsewhere")
+	flags.StringVarP(&gameProxyPublicAddr, "public", "p", "127.0.0.1:5556",
+		"Dofus game proxy public address, or auto to detect it")
+	flags.StringVar(&publicCheckURL, "public-check-url", "",
+		"URL of a service responding with the public IP of the proxy, used by --public auto (disabled if empty)")
+	flags.StringArrayVar(&gameListens, "game-listen", nil,
+		"Other game proxy listener address, optionally followed by =<game server address> (repeatable)")
+	flags.BoolVar(&ephemeralGamePorts, "ephemeral-game-ports", false,
+		"Redirect each client to a game proxy port opened for its ticket only, on the host of --game")
 	flags.BoolVarP(&forceAdmin, "admin", "a", false, "Force admin mode on the client")
+	flags.BoolVar(&sniffOnly, "sniff-only", false, "Forward packets verbatim, without redirecting the client to the game proxy")
+	flags.BoolVar(&hexDump, "hexdump", false, "Log the packets sent by the sessions as hex dumps, at debug level")
+	flags.IntVar(&hexDumpMaxPkts, "hexdump-max-pkts", 1000, "Number of packets dumped per session (unlimited if zero)")
+	flags.BoolVar(&strict, "strict", false, "End the sessions in which a packet could not be decoded or is desynced instead of forwarding it")
+	flags.BoolVar(&upstreamTLS, "upstream-tls", false, "Connect to the Dofus login server over TLS")
+	flags.BoolVar(&upstreamTLSInsecure, "upstream-tls-insecure", false, "Skip the verification of the Dofus login server certificate")
+	flags.IntVar(&breakerFailures, "breaker-failures", 0,
+		"Consecutive failures to connect to a server after which its sessions are refused for a while (disabled if zero)")
+	flags.DurationVar(&breakerWindow, "breaker-window", time.Minute, "Time within which the failures to connect to a server count")
+	flags.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second,
+		"Time during which the sessions of a failing server are refused")
+	flags.StringVar(&upstreamAccount, "upstream-account", "",
+		"Account to log into the Dofus login server with instead of the one of the client (disabled if empty)")
+	flags.StringVar(&upstreamPassword, "upstream-password", "", "Password of the upstream account")
+	flags.StringVar(&upstreamProxy, "upstream-proxy", "",
+		"Proxy to connect to the Dofus servers through, like socks5://host:port or http://host:port (disabled if empty)")
+	flags.StringVar(&upstreamLocalAddr, "upstream-local-addr", "",
+		"Local IP or interface name that the connections to the Dofus servers originate from (disabled if empty)")
+	flags.StringVar(&ticketStore, "ticket-store", "memory", "Ticket store, either memory, file:<path> or redis://<host>:<port>")
+	flags.DurationVar(&ticketTTL, "ticket-ttl", server.DefaultTicketMaxDur,
+		"Time within which the game proxy accepts the tickets issued at login")
+	flags.DurationVar(&ticketPruneEvery, "ticket-prune-interval", retroproxy.DefaultTicketPruneInterval,
+		"How often the expired tickets are deleted from the ticket store")
+	flags.StringVar(&captureFile, "capture-file", "", "Packet capture output file")
+	flags.StringVar(&accessLogFile, "access-log", "", "File to append a JSON line to for each completed session (disabled if empty)")
+	flags.StringVar(&captureFormat, "capture-format", string(retroproxy.CaptureFormatJSON),
+		"Format of the capture file, either json or pcap")
+	flags.StringVar(&captureFilter, "capture-filter", "", "Expression selecting the captured packets, like 'dir=server && id=cMK'")
+	flags.BoolVar(&captureAnonymize, "capture-anonymize", false, "Replace names, keys and tickets in captured packets with pseudonyms")
+	flags.BoolVar(&captureTiming, "capture-timing", false,
+		"Record the time since the session started of each captured packet, and a marker when sessions start")
+	flags.IntVar(&captureMaxSize, "capture-max-size", 0, "Size in MB beyond which the capture file is rotated (disabled if zero)")
+	flags.DurationVar(&captureMaxAge, "capture-max-age", 0, "Age beyond which the capture file is rotated (disabled if zero)")
+	flags.StringVar(&captureCompress, "capture-compress", "",
+		"Compress the capture file on the fly, either with gzip or zstd (disabled if empty)")
+	flags.IntVar(&captureMaxFiles, "capture-max-files", 0, "Number of rotated capture files to keep (unlimited if zero)")
+	flags.BoolVar(&proxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol v1 or v2 header on client connections")
+	flags.StringSliceVar(&allowCIDRs, "allow-cidr", nil, "Network allowed to connect, in CIDR notation (repeatable)")
+	flags.StringSliceVar(&denyCIDRs, "deny-cidr", nil, "Network denied to connect, in CIDR notation (repeatable)")
+	flags.StringSliceVar(&dropClientMsgs, "drop-client-msg", nil,
+		"Id of a game message from the client to drop instead of forwarding, like GA (repeatable)")
+	flags.StringSliceVar(&dropServerMsgs, "drop-server-msg", nil,
+		"Id of a game message from the server to drop instead of forwarding, like cMK (repeatable)")
+	flags.StringArrayVar(&rewriteRules, "rewrite", nil,
+		"Rule of the form id:pattern=>replacement rewriting the payload of the game messages with that id (repeatable)")
+	flags.BoolVar(&rewriteRegex, "rewrite-regex", false, "Match the patterns of the rewrite rules as regular expressions")
+	flags.IntVar(&maxAccountSessions, "max-account-sessions", 0,
+		"Maximum number of concurrent game sessions of an account (disabled if zero)")
+	flags.IntVar(&maxSessionsPerIP, "max-sessions-per-ip", 0,
+		"Maximum number of concurrent sessions of each proxy from a single IP (disabled if zero)")
+	flags.DurationVar(&quotaWindow, "quota-window", time.Minute, "Window of time of --quota-bytes and --quota-packets")
+	flags.IntVar(&quotaBytes, "quota-bytes", 0,
+		"Maximum bytes a client may send in each --quota-window before its session is closed (disabled if zero)")
+	flags.IntVar(&quotaPackets, "quota-packets", 0,
+		"Maximum packets a client may send in each --quota-window before its session is closed (disabled if zero)")
+	flags.StringSliceVar(&allowedVersions, "allowed-versions", nil,
+		"Client version allowed to log in, like 1.39.8e (repeatable, all allowed if empty)")
+	flags.Float64Var(&connRate, "conn-rate", 0, "New connections allowed per second from each IP (unlimited if zero)")
+	flags.IntVar(&connBurst, "conn-burst", 10, "Burst of new connections allowed from each IP")
+	flags.IntVar(&maxConnections, "max-connections", 0,
+		"Maximum number of concurrent sessions of both proxies (unlimited if zero)")
+	flags.DurationVar(&readTimeout, "read-timeout", 0, "Idle time after which a session is closed (disabled if zero)")
+	flags.DurationVar(&writeTimeout, "write-timeout", 0,
+		"Time a blocked write may take before its session is closed (disabled if zero)")
+	flags.DurationVar(&shutdownGrace, "shutdown-grace", 0, "Time given to sessions to finish on shutdown")
+	flags.DurationVar(&halfCloseGrace, "half-close-grace", 0,
+		"Time during which game sessions keep relaying packets of the server once the client half-closed its connection")
+	flags.BoolVar(&restartListeners, "restart-listeners", false,
+		"Bind the listeners again after they fail, instead of exiting, unless their address can't be bound")
+	flags.DurationVar(&tcpKeepAlive, "tcp-keepalive", 30*time.Second,
+		"TCP keepalive period of the client and server connections (disabled if zero)")
+	flags.BoolVar(&tcpNoDelay, "tcp-nodelay", true,
+		"Send small packets right away instead of delaying them with Nagle's algorithm")
+	flags.IntVar(&upstreamRetries, "upstream-retries", 0, "Dofus game server connection retries")
+	flags.BoolVar(&upstreamResume, "upstream-resume", false,
+		"Reconnect to the Dofus game server when its connection drops, for servers that accept a ticket again")
+	flags.DurationVar(&injectLatency, "inject-latency", 0, "Delay added to the relayed game packets, for testing (disabled if zero)")
+	flags.DurationVar(&injectJitter, "inject-jitter", 0, "Maximum random delay added on top of --inject-latency, for testing")
+	flags.IntVar(&rateLimitBps, "rate-limit-bps", 0,
+		"Bytes per second relayed in each direction of a game session, for testing (disabled if zero)")
+	flags.IntVar(&rateLimitBpsClient, "rate-limit-bps-client", 0,
+		"Bytes per second relayed from the client of a game session, overriding --rate-limit-bps")
+	flags.IntVar(&rateLimitBpsServer, "rate-limit-bps-server", 0,
+		"Bytes per second relayed from the server of a game session, overriding --rate-limit-bps")
+	flags.DurationVar(&coalesceWindow, "coalesce-window", 0,
+		"Time during which movements and stats from the game server are held, forwarding only the latest (disabled if zero)")
+	flags.DurationVar(&slowUpstream, "slow-upstream-threshold", 0,
+		"Time after a packet of a game client from which the next packet of the server is logged as slow (disabled if zero)")
+	flags.IntVar(&maxPacketSize, "max-packet-size", 64*1024, "Maximum size of a Dofus game packet")
+	flags.IntVar(&loginMaxPacketSize, "login-max-packet-size", login.DefaultMaxClientPacketSize,
+		"Maximum size of a packet sent by a Dofus login client")
+	flags.StringVar(&metricsAddr, "metrics-addr", "", "Prometheus metrics listener address (disabled if empty)")
+	flags.StringVar(&otelEndpoint, "otel-endpoint", "",
+		"OTLP/HTTP endpoint to export session traces to, like http://localhost:4318 (disabled if empty)")
+	flags.StringVar(&pprofAddr, "pprof-addr", "", "pprof listener address (disabled if empty)")
+	flags.StringVar(&adminSocket, "admin-socket", "", "Admin console Unix socket path (disabled if empty)")
+	flags.StringVar(&adminHTTPAddr, "admin-http-addr", "", "Admin API listener address (disabled if empty)")
+	flags.StringVar(&adminToken, "admin-token", "", "Bearer token required by the admin API")
+	flags.StringVar(&adminTLSCert, "admin-tls-cert", "",
+		"Certificate file of the admin API and metrics listeners, which serve TLS if set")
+	flags.StringVar(&adminTLSKey, "admin-tls-key", "", "Private key file of the admin TLS certificate")
+	flags.StringVar(&adminTLSClientCA, "admin-tls-client-ca", "",
+		"CA certificates file that the client certificates of the admin API and metrics must be signed by (disabled if empty)")
+	flags.StringVar(&shadowDir, "shadow-dir", "",
+		"Directory of the capture files of the sessions shadowed from the admin console (disabled if empty)")
 	flags.SortFlags = false
-	return flags.Parse(os.Args)
+	err := flags.Parse(os.Args)
+	if err != nil {
+		return err
+	}
+	flags.Visit(func(f *pflag.Flag) {
+		cmdlineFlags[f.Name] = true
+	})
+
+	if configFile != "" {
+		err := loadConfigFile(flags, configFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, v := range []struct {
+		name        string
+		addr        string
+		requireHost bool
+	}{
+		{"server", loginServerAddr, true},
+		{"login", loginProxyAddr, false},
+		{"game", gameProxyAddr, false},
+		{"public", gameProxyPublicAddr, true},
+	} {
+		if v.name == "public" && v.addr == autoPublicAddr {
+			continue
+		}
+		err := validateAddr(v.name, v.addr, v.requireHost)
+		if err != nil {
+			return err
+		}
+	}
+
+	gameListeners = nil
+	for _, s := range gameListens {
+		l, err := parseGameListener(s)
+		if err != nil {
+			return err
+		}
+		gameListeners = append(gameListeners, l)
+	}
+
+	upstreamLocalTCP = nil
+	if upstreamLocalAddr != "" {
+		addr, err := resolveLocalAddr(upstreamLocalAddr)
+		if err != nil {
+			return err
+		}
+		upstreamLocalTCP = addr
+	}
+
+	if logSampleInitial < 0 || logSampleThereafter < 0 {
+		return errors.New("log sampling must not be negative")
+	}
+	if quotaBytes < 0 || quotaPackets < 0 {
+		return errors.New("quotas must not be negative")
+	}
+	if (quotaBytes > 0 || quotaPackets > 0) && quotaWindow <= 0 {
+		return errors.New("quota window must be positive")
+	}
+	if maxPacketSize <= 0 {
+		return errors.New("max packet size must be positive")
+	}
+	switch retroproxy.CaptureFormat(captureFormat) {
+	case retroproxy.CaptureFormatJSON:
+	case retroproxy.CaptureFormatPcap:
+		// Rotated files are split after newlines, which pcap files don't have.
+		if captureMaxSize > 0 || captureMaxAge > 0 {
+			return errors.New("pcap captures can't be rotated")
+		}
+	default:
+		return fmt.Errorf("invalid capture format: %q", captureFormat)
+	}
+	if !retroproxy.Compression(captureCompress).Valid() {
+		return fmt.Errorf("invalid capture compression: %q", captureCompress)
+	}
+	if loginMaxPacketSize <= 0 {
+		return errors.New("login max packet size must be positive")
+	}
+	if ticketTTL <= 0 {
+		return errors.New("ticket ttl must be positive")
+	}
+	if ticketPruneEvery <= 0 {
+		return errors.New("ticket prune interval must be positive")
+	}
+	if disableLogin && disableGame {
+		return errors.New("login and game proxies can't both be disabled")
+	}
+	if ephemeralGamePorts && (disableLogin || disableGame) {
+		return errors.New("ephemeral game ports need both proxies")
+	}
+
+	return nil
+}
+
+// detectPublicAddr returns the address of the game proxy with the IP detected by retroproxy.DetectPublicIP and the port
+// of its listener. If the detection fails, it falls back to the loopback IP, which is the default of --public.
+func detectPublicAddr() string {
+	host, port, _ := net.SplitHostPort(gameProxyAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), publicCheckTimeout)
+	defer cancel()
+	ip, source, err := retroproxy.DetectPublicIP(ctx, net.ParseIP(host), publicCheckURL)
+	if err != nil {
+		logger.Warn("could not detect game proxy public address, falling back to loopback", zap.Error(err))
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	logger.Info("detected game proxy public address", zap.String("ip", ip.String()), zap.String("source", source))
+	return net.JoinHostPort(ip.String(), port)
+}
+
+func newUpstreamTLS() *tls.Config {
+	if !upstreamTLS {
+		return nil
+	}
+	return &tls.Config{
+		InsecureSkipVerify: upstreamTLSInsecure,
+	}
+}
+
+// newAdminTLS returns the TLS configuration of the admin api and metrics listeners, and the reloader of their
+// certificate, or nil if they serve plain HTTP.
+func newAdminTLS() (*tls.Config, *retroproxy.CertReloader, error) {
+	if adminTLSCert == "" && adminTLSKey == "" {
+		if adminTLSClientCA != "" {
+			return nil, nil, errors.New("admin tls client ca requires an admin tls certificate")
+		}
+		return nil, nil, nil
+	}
+	if adminTLSCert == "" || adminTLSKey == "" {
+		return nil, nil, errors.New("admin tls requires both a certificate and a key")
+	}
+
+	cert, err := retroproxy.NewCertReloader(adminTLSCert, adminTLSKey, logger.Named("admin"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load admin tls certificate: %w", err)
+	}
+	c := &tls.Config{
+		GetCertificate: cert.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if adminTLSClientCA != "" {
+		b, err := os.ReadFile(adminTLSClientCA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read admin tls client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, nil, errors.New("no certificate found in admin tls client ca")
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, cert, nil
+}
+
+func newConnLimiter() *retroproxy.ConnLimiter {
+	if connRate <= 0 {
+		return nil
+	}
+	return retroproxy.NewConnLimiter(connRate, connBurst)
+}
+
+// keepAlivePeriod returns the TCP keepalive period of the proxies, which disable it with a negative one.
+func keepAlivePeriod() time.Duration {
+	if tcpKeepAlive <= 0 {
+		return -1
+	}
+	return tcpKeepAlive
+}
+
+func quota() retroproxy.Quota {
+	return retroproxy.Quota{
+		Window:     quotaWindow,
+		MaxBytes:   quotaBytes,
+		MaxPackets: quotaPackets,
+	}
+}
+
+func clientRateLimit() int {
+	if rateLimitBpsClient > 0 {
+		return rateLimitBpsClient
+	}
+	return rateLimitBps
+}
+
+func serverRateLimit() int {
+	if rateLimitBpsServer > 0 {
+		return rateLimitBpsServer
+	}
+	return rateLimitBps
+}
+
+func newLatencyInjector() *retroproxy.LatencyInjector {
+	if injectLatency <= 0 && injectJitter <= 0 {
+		return nil
+	}
+	return retroproxy.NewLatencyInjector(injectLatency, injectJitter)
+}
+
+func newStorer(spec string) (retroproxy.Storer, error) {
+	switch {
+	case spec == "memory":
+		return retroproxy.NewCache(logger.Named("cache")), nil
+	case strings.HasPrefix(spec, "file:"):
+		path := strings.TrimPrefix(spec, "file:")
+		if path == "" {
+			return nil, errors.New("ticket store file path is empty")
+		}
+		return retroproxy.NewFileCache(path, ticketTTL, logger.Named("cache"))
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return retroproxy.NewRedisCache(spec, ticketTTL, logger.Named("cache"))
+	default:
+		return nil, fmt.Errorf("invalid ticket store: %q", spec)
+	}
+}
+
+// serveHTTP serves handler on addr until ctx is done, over TLS if tlsConfig is not nil.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler, tlsConfig *tls.Config) error {
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		// Long-lived requests, such as event streams, end with ctx instead of holding up the shutdown.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			// The certificate is served by tlsConfig.
+			errCh <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errCh <- srv.ListenAndServe()
+	}()
+	logger.Info("serving http",
+		zap.String("address", addr),
+		zap.Bool("tls", tlsConfig != nil),
+	)
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kralamoure/retroproto"
+	"github.com/spf13/pflag"
+
+	"go.uber.org/zap"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+var (
+	debug       bool
+	addr        string
+	sessionId   string
+	ticket      string
+	speed       float64
+	captureFile string
+)
+
+var logger *zap.Logger
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	err := loadVars()
+	if err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return 0
+		}
+		log.Println(err)
+		return 2
+	}
+
+	if debug {
+		tmp, err := zap.NewDevelopment()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		logger = tmp
+	} else {
+		tmp, err := zap.NewProduction()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		logger = tmp
+	}
+	defer logger.Sync()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	recs, err := loadRecords()
+	if err != nil {
+		logger.Error("could not load capture", zap.Error(err))
+		return 1
+	}
+	if len(recs) == 0 {
+		logger.Error("no client packets to replay")
+		return 1
+	}
+
+	err = replay(ctx, recs)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Error("error while replaying", zap.Error(err))
+		return 1
+	}
+	return 0
+}
+
+// loadRecords returns the client packets of the replayed session. Unless a session is chosen, it's the first one that
+// sends a ticket, which is a game session.
+func loadRecords() ([]retroproxy.CaptureRecord, error) {
+	f, err := retroproxy.OpenDecompressed(captureFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []retroproxy.CaptureRecord
+	rd := retroproxy.NewCaptureReader(bufio.NewReader(f))
+	for {
+		rec, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if rec.Direction != retroproxy.DirectionClient {
+			continue
+		}
+		if sessionId == "" && strings.HasPrefix(rec.Packet, string(retroproto.AccountSendTicket)) {
+			sessionId = rec.SessionId
+		}
+		if rec.SessionId == sessionId {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+func replay(ctx context.Context, recs []retroproxy.CaptureRecord) error {
+	conn, err := (&net.Dialer{Timeout: 3 * time.Second}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	logger.Info("connected to proxy",
+		zap.String("address", conn.RemoteAddr().String()),
+		zap.String("session_id", sessionId),
+	)
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	helloCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- receivePkts(conn, helloCh)
+	}()
+
+	select {
+	case <-helloCh:
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for i, rec := range recs {
+		if i > 0 {
+			delay := time.Duration(float64(rec.Time-recs[i-1].Time) / speed)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case err := <-errCh:
+				timer.Stop()
+				return err
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+
+		pkt := rec.Packet
+		if i == 0 && ticket != "" && strings.HasPrefix(pkt, string(retroproto.AccountSendTicket)) {
+			pkt = fmt.Sprint(retroproto.AccountSendTicket, ticket)
+		}
+		_, err := fmt.Fprint(conn, pkt+"\n\x00")
+		if err != nil {
+			return err
+		}
+		logger.Debug("sent packet",
+			zap.String("packet", pkt),
+		)
+	}
+	logger.Info("replay finished, waiting for the connection to close",
+		zap.Int("packets", len(recs)),
+	)
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// receivePkts logs the packets received from the proxy, closing helloCh on the hello message of the game server.
+func receivePkts(conn net.Conn, helloCh chan struct{}) error {
+	rd := bufio.NewReader(conn)
+	hello := false
+	for {
+		pkt, err := rd.ReadString('\x00')
+		if err != nil {
+			return err
+		}
+		pkt = strings.TrimSuffix(pkt, "\x00")
+		if !hello && strings.HasPrefix(pkt, string(retroproto.AksHelloGame)) {
+			hello = true
+			close(helloCh)
+		}
+		logger.Debug("received packet",
+			zap.String("packet", pkt),
+		)
+	}
+}
+
+func loadVars() error {
+	flags := pflag.NewFlagSet("retroreplay", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of retroreplay: retroreplay [flags] <capture file>")
+		flags.PrintDefaults()
+	}
+	flags.BoolVarP(&debug, "debug", "d", false, "Enable debug mode")
+	flags.StringVarP(&addr, "game", "g", "127.0.0.1:5556", "Dofus game proxy address")
+	flags.StringVar(&sessionId, "session", "", "Id of the captured session to replay (first game session if empty)")
+	flags.StringVar(&ticket, "ticket", "", "Ticket to send instead of the captured one")
+	flags.Float64Var(&speed, "speed", 1, "Replay speed multiplier")
+	flags.SortFlags = false
+	err := flags.Parse(os.Args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("missing capture file")
+	}
+	captureFile = flags.Arg(1)
+	if speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package retroproxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the compression of the files written by a RotatingFile.
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// Ext returns the extension of the files compressed with c, such as ".gz", or an empty string.
+func (c Compression) Ext() string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// Valid reports whether c is a known compression.
+func (c Compression) Valid() bool {
+	switch c {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return true
+	}
+	return false
+}
+
+// CompressionByPath returns the compression of the file at path, as told by its extension.
+func CompressionByPath(path string) Compression {
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		if strings.HasSuffix(path, c.Ext()) {
+			return c
+		}
+	}
+	return CompressionNone
+}
+
+// compressWriter is a writer compressing what's written to it.
+type compressWriter interface {
+	io.WriteCloser
+	// Flush writes the data compressed so far, so that it can be decompressed even if the writer is never closed.
+	Flush() error
+}
+
+func newCompressWriter(w io.Writer, c Compression) (compressWriter, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("invalid compression: %q", c)
+}
+
+// OpenDecompressed opens the file at path for reading, decompressing it if its extension is the one of a Compression.
+func OpenDecompressed(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	switch CompressionByPath(path) {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressReader{Reader: zr, closers: []io.Closer{zr, f}}, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressReader{Reader: zr, closers: []io.Closer{zr.IOReadCloser(), f}}, nil
+	}
+	return f, nil
+}
+
+// decompressReader reads from a decompressor, and closes it along with the file it reads from.
+type decompressReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *decompressReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package retroproxy
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ConnLimiter limits the rate of new connections from each source IP with a token bucket. It is safe for concurrent
+// use.
+type ConnLimiter struct {
+	limit rate.Limit
+	burst int
+
+	buckets   map[string]*connBucket
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+type connBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewConnLimiter makes a ConnLimiter that allows perSecond connections per second from each IP, with bursts of up to
+// burst connections.
+func NewConnLimiter(perSecond float64, burst int) *ConnLimiter {
+	return &ConnLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		buckets: make(map[string]*connBucket),
+	}
+}
+
+// Allow reports whether a new connection from ip is allowed, consuming a token if it is.
+func (l *ConnLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &connBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[ip] = b
+	}
+	b.lastSeen = now
+	return b.limiter.AllowN(now, 1)
+}
+
+// sweep evicts the buckets that have been idle long enough to be full again, as they are no different from new ones.
+func (l *ConnLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Minute
+	if l.limit > 0 {
+		refill = time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	}
+	for ip, b := range l.buckets {
+		if now.Sub(b.lastSeen) > refill {
+			delete(l.buckets, ip)
+		}
+	}
+}
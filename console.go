@@ -0,0 +1,569 @@
+package retroproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kralamoure/dofus/dofustyp"
+	"github.com/kralamoure/retroproto/msgsvr"
+	"go.uber.org/zap"
+)
+
+const (
+	// statsTopMessages is how many of the most received messages the stats show.
+	statsTopMessages = 10
+	// shadowBufferSize is how many packets an observer of a shadowed session may lag behind before it misses some.
+	shadowBufferSize = 1024
+)
+
+var (
+	// errSessionNotFound is returned for the commands about a session that no proxy has.
+	errSessionNotFound = errors.New("session not found")
+	// errNotSupported is returned for the commands that the proxy of a session doesn't support.
+	errNotSupported = errors.New("not supported")
+)
+
+// Console serves text commands over a Unix domain socket, one command per line, to inspect and control the sessions
+// of the proxies at runtime.
+type Console struct {
+	logger     Logger
+	registries map[string]SessionRegistry
+	events     *EventHub
+	breaker    *CircuitBreaker
+	limiter    *SessionLimiter
+	shadowDir  string
+	startedAt  time.Time
+
+	mu sync.Mutex
+	// shadowFiles are the sessions shadowed to a file, by id.
+	shadowFiles map[string]*shadowFile // guarded by mu
+}
+
+// shadowFile is a session shadowed to a file.
+type shadowFile struct {
+	path string
+	stop func()
+}
+
+// NewConsole returns a Console for the proxies of registries, keyed by proxy name.
+func NewConsole(registries map[string]SessionRegistry, logger Logger) *Console {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &Console{
+		logger:     logger,
+		registries: registries,
+		startedAt:  time.Now(),
+	}
+}
+
+// SetEvents sets the hub whose events are streamed by the HTTP API. It must not be called after Handler.
+func (c *Console) SetEvents(h *EventHub) {
+	c.events = h
+}
+
+// SetBreaker sets the circuit breaker whose circuits are shown by the stats command. It must not be called after
+// ListenAndServe or Handler.
+func (c *Console) SetBreaker(b *CircuitBreaker) {
+	c.breaker = b
+}
+
+// SetSessionLimiter sets the session limiter of the proxies, whose count and maximum are shown by the stats command.
+// It must not be called after ListenAndServe or Handler.
+func (c *Console) SetSessionLimiter(l *SessionLimiter) {
+	c.limiter = l
+}
+
+// SetShadowDir sets the directory where the shadow command writes the captures of the sessions it shadows, which is
+// disabled if dir is empty. It must not be called after ListenAndServe or Handler.
+func (c *Console) SetShadowDir(dir string) {
+	c.shadowDir = dir
+}
+
+// ListenAndServe listens on the Unix domain socket at path and serves the commands of its clients until ctx is done.
+// A stale socket file at path is removed first.
+func (c *Console) ListenAndServe(ctx context.Context, path string) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		return err
+	}
+	c.logger.Info("listening",
+		zap.String("address", path),
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.serveConn(ctx, conn)
+		}()
+	}
+}
+
+func (c *Console) serveConn(ctx context.Context, conn net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	rc := &rpcConn{w: conn}
+	defer rc.close()
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		if isRPC(sc.Text()) {
+			resp := c.handleRPC(sc.Bytes(), rc)
+			if resp != nil {
+				rc.Write(resp)
+			}
+			continue
+		}
+		args := strings.Fields(sc.Text())
+		if len(args) == 0 {
+			continue
+		}
+		c.logger.Debug("received command",
+			zap.Strings("args", args),
+		)
+		if args[0] == "quit" {
+			return
+		}
+		// The output is written at once, so that it doesn't interleave with the events of a subscription.
+		var buf bytes.Buffer
+		err := c.run(&buf, args)
+		if err != nil {
+			fmt.Fprintf(&buf, "error: %s\n", err)
+		}
+		rc.Write(buf.Bytes())
+	}
+}
+
+func (c *Console) run(w io.Writer, args []string) error {
+	switch args[0] {
+	case "help":
+		fmt.Fprint(w, "commands:\n"+
+			"  sessions   list the active sessions\n"+
+			"  kick <id>  close a session\n"+
+			"  stats      show the number of active sessions of each proxy, the failing servers and the most received\n"+
+			"             messages\n"+
+			"  messages [n]\n"+
+			"             list the n most received messages (10 by default)\n"+
+			"  broadcast <text>\n"+
+			"             send a chat message to the clients of all sessions\n"+
+			"  shadow <id>\n"+
+			"             write the packets of a session to a capture file until it ends\n"+
+			"  unshadow <id>\n"+
+			"             stop writing the packets of a session to a capture file\n"+
+			"  sendToServer <id> <packet>\n"+
+			"             send a packet to the server of a session as if its client sent it\n"+
+			"  quit       close the console\n"+
+			"lines starting with { or [ are JSON-RPC 2.0 requests, with the methods listSessions, stats, kick,\n"+
+			"sendToClient, sendToServer, broadcast, subscribeEvents and unsubscribeEvents\n")
+	case "sessions":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PROXY\tID\tADDRESS\tACCOUNT\tCHARACTER\tMAP\tRATE\tCONNECTED")
+		for _, name := range c.names() {
+			for _, si := range c.registries[name].Sessions() {
+				mapId := ""
+				if si.MapId != 0 {
+					mapId = fmt.Sprint(si.MapId)
+				}
+				rate := ""
+				if si.ClientRate != 0 || si.ServerRate != 0 {
+					// Bytes per second relayed from the client and from the server.
+					rate = fmt.Sprintf("%.0f/%.0f", si.ClientRate, si.ServerRate)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name, si.Id, si.ClientAddress, si.Account,
+					si.Character, mapId, rate, time.Since(si.ConnectedAt).Round(time.Second))
+			}
+		}
+		tw.Flush()
+	case "kick":
+		if len(args) != 2 {
+			return errors.New("usage: kick <id>")
+		}
+		name, ok := c.kick(args[1])
+		if !ok {
+			return fmt.Errorf("session not found: %s", args[1])
+		}
+		fmt.Fprintf(w, "kicked %s session %s\n", name, args[1])
+	case "shadow":
+		if len(args) != 2 {
+			return errors.New("usage: shadow <id>")
+		}
+		path, err := c.shadowToFile(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "shadowing session %s to %s\n", args[1], path)
+	case "unshadow":
+		if len(args) != 2 {
+			return errors.New("usage: unshadow <id>")
+		}
+		if !c.unshadowFile(args[1]) {
+			return fmt.Errorf("session not shadowed: %s", args[1])
+		}
+		fmt.Fprintf(w, "stopped shadowing session %s\n", args[1])
+	case "sendToServer":
+		if len(args) < 3 {
+			return errors.New("usage: sendToServer <id> <packet>")
+		}
+		pkt := strings.Join(args[2:], " ")
+		err := validInjectedPacket(pkt)
+		if err != nil {
+			return err
+		}
+		name, err := c.sendToServer(args[1], pkt)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "sent packet to %s server of session %s\n", name, args[1])
+	case "broadcast":
+		if len(args) < 2 {
+			return errors.New("usage: broadcast <text>")
+		}
+		text := strings.Join(args[1:], " ")
+		err := validBroadcastText(text)
+		if err != nil {
+			return err
+		}
+		n, err := c.broadcast(text)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "sent to %d sessions\n", n)
+	case "stats":
+		for _, name := range c.names() {
+			fmt.Fprintf(w, "%s_sessions %d\n", name, len(c.registries[name].Sessions()))
+			if rr, ok := c.registries[name].(RTTReporter); ok {
+				fmt.Fprintf(w, "%s_rtt_avg %s\n", name, rr.AverageRTT().Round(time.Microsecond))
+			}
+			if cr, ok := c.registries[name].(CoalesceReporter); ok {
+				fmt.Fprintf(w, "%s_coalesced %d\n", name, cr.Coalesced())
+			}
+		}
+		if c.limiter != nil {
+			fmt.Fprintf(w, "sessions %d\nmax_sessions %d\n", c.limiter.Count(), c.limiter.Max())
+		}
+		if c.breaker != nil {
+			for _, ci := range c.breaker.Circuits() {
+				fmt.Fprintf(w, "circuit %s %s %d\n", ci.Address, ci.State, ci.Failures)
+			}
+		}
+		for _, mc := range TopMessages(statsTopMessages) {
+			fmt.Fprintf(w, "message %s %s %s %d\n", mc.Proxy, mc.Direction, mc.Id, mc.Count)
+		}
+		fmt.Fprintf(w, "uptime %s\n", time.Since(c.startedAt).Round(time.Second))
+	case "messages":
+		n := statsTopMessages
+		if len(args) > 2 {
+			return errors.New("usage: messages [n]")
+		}
+		if len(args) == 2 {
+			var err error
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return errors.New("usage: messages [n]")
+			}
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PROXY\tDIRECTION\tID\tNAME\tCOUNT")
+		for _, mc := range TopMessages(n) {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", mc.Proxy, mc.Direction, mc.Id, mc.Name, mc.Count)
+		}
+		tw.Flush()
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+	return nil
+}
+
+func (c *Console) names() []string {
+	names := make([]string, 0, len(c.registries))
+	for name := range c.registries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sessions returns the active sessions of the proxies, of the given account and character if they're not empty.
+// The filters ignore case, like the server does.
+func (c *Console) sessions(account, character string) []consoleSession {
+	sessions := []consoleSession{}
+	for _, name := range c.names() {
+		for _, si := range c.registries[name].Sessions() {
+			if account != "" && !strings.EqualFold(si.Account, account) {
+				continue
+			}
+			if character != "" && !strings.EqualFold(si.Character, character) {
+				continue
+			}
+			sessions = append(sessions, consoleSession{Proxy: name, SessionInfo: si})
+		}
+	}
+	return sessions
+}
+
+// findSession returns the name of the proxy that has the session with the given id.
+func (c *Console) findSession(id string) (name string, ok bool) {
+	for _, name := range c.names() {
+		for _, si := range c.registries[name].Sessions() {
+			if si.Id == id {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// sendToClient sends pkt to the client of the session with the given id and returns the name of its proxy.
+func (c *Console) sendToClient(id, pkt string) (string, error) {
+	name, ok := c.findSession(id)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errSessionNotFound, id)
+	}
+	sender, ok := c.registries[name].(ClientSender)
+	if !ok {
+		return "", fmt.Errorf("%w: %s proxy can't send packets to clients", errNotSupported, name)
+	}
+	if !sender.SendToClient(id, pkt) {
+		return "", errors.New("could not send packet")
+	}
+	return name, nil
+}
+
+// sendToServer sends pkt to the server of the session with the given id, as if its client sent it, and returns the
+// name of its proxy.
+func (c *Console) sendToServer(id, pkt string) (string, error) {
+	name, ok := c.findSession(id)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errSessionNotFound, id)
+	}
+	sender, ok := c.registries[name].(ServerSender)
+	if !ok {
+		return "", fmt.Errorf("%w: %s proxy can't send packets to servers", errNotSupported, name)
+	}
+	if !sender.SendToServer(id, pkt) {
+		return "", errors.New("could not send packet")
+	}
+	return name, nil
+}
+
+// validInjectedPacket returns an error if pkt can't be sent as a single packet, without its terminator.
+func validInjectedPacket(pkt string) error {
+	if pkt == "" {
+		return errors.New("packet is empty")
+	}
+	if strings.ContainsAny(pkt, "\x00\n") {
+		return errors.New("packet contains a terminator")
+	}
+	return nil
+}
+
+// validBroadcastText returns an error if text can't be sent in a single chat message, like validInjectedPacket, or
+// contains a |, which separates the fields of the message and would cut the text short or forge other fields.
+func validBroadcastText(text string) error {
+	if text == "" {
+		return errors.New("text is empty")
+	}
+	if strings.ContainsAny(text, "\x00\n") {
+		return errors.New("text contains a terminator")
+	}
+	if strings.ContainsRune(text, '|') {
+		return errors.New("text contains a |")
+	}
+	return nil
+}
+
+// kick closes the session with the given id in whichever proxy has it and returns the name of that proxy.
+func (c *Console) kick(id string) (name string, ok bool) {
+	for _, name := range c.names() {
+		if c.registries[name].Kick(id) {
+			c.logger.Info("kicked session",
+				zap.String("proxy", name),
+				zap.String("session_id", id),
+			)
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// shadow starts shadowing the session with the given id in whichever proxy has it, like SessionShadower.Shadow, and
+// returns the name of that proxy.
+func (c *Console) shadow(id string, size int) (name string, ch <-chan CaptureRecord, stop func(), ok bool) {
+	for _, name := range c.names() {
+		shadower, ok := c.registries[name].(SessionShadower)
+		if !ok {
+			continue
+		}
+		ch, stop, ok := shadower.Shadow(id, size)
+		if ok {
+			return name, ch, stop, true
+		}
+	}
+	return "", nil, nil, false
+}
+
+// shadowToFile writes the packets of the session with the given id to a capture file in the shadow directory, until
+// the session ends or unshadowFile is called, and returns the path of the file.
+func (c *Console) shadowToFile(id string) (string, error) {
+	if c.shadowDir == "" {
+		return "", errors.New("shadowing to a file is disabled")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sf, ok := c.shadowFiles[id]; ok {
+		return "", fmt.Errorf("session already shadowed to %s", sf.path)
+	}
+	name, ch, stop, ok := c.shadow(id, shadowBufferSize)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errSessionNotFound, id)
+	}
+	// The id is the one of an active session, so it can't escape the directory.
+	path := filepath.Join(c.shadowDir, id+".jsonl")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		stop()
+		return "", err
+	}
+	sf := &shadowFile{path: path, stop: stop}
+	if c.shadowFiles == nil {
+		c.shadowFiles = make(map[string]*shadowFile)
+	}
+	c.shadowFiles[id] = sf
+	c.logger.Info("shadowing session to file",
+		zap.String("proxy", name),
+		zap.String("session_id", id),
+		zap.String("path", path),
+	)
+
+	capture := NewCapture(f)
+	go func() {
+		for rec := range ch {
+			err := capture.writeRecord(rec)
+			// The file is flushed whenever the session is idle, so that it can be followed live.
+			if err == nil && len(ch) == 0 {
+				err = capture.flush()
+			}
+			if err != nil {
+				c.logger.Error("could not write packet to shadow capture",
+					zap.Error(err),
+					zap.String("session_id", id),
+				)
+				sf.stop()
+				break
+			}
+		}
+		err := capture.Close()
+		if err != nil {
+			c.logger.Error("could not close shadow capture",
+				zap.Error(err),
+				zap.String("session_id", id),
+			)
+		}
+
+		c.mu.Lock()
+		if c.shadowFiles[id] == sf {
+			delete(c.shadowFiles, id)
+		}
+		c.mu.Unlock()
+		c.logger.Info("stopped shadowing session to file",
+			zap.String("session_id", id),
+		)
+	}()
+	return path, nil
+}
+
+// unshadowFile stops writing the packets of the session with the given id to a file, and reports whether it was.
+func (c *Console) unshadowFile(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sf, ok := c.shadowFiles[id]
+	if !ok {
+		return false
+	}
+	delete(c.shadowFiles, id)
+	sf.stop()
+	return true
+}
+
+// broadcast sends text as an admin chat message to the clients of the sessions of the proxies that can send packets to
+// their clients, and returns the number of sessions it was sent to.
+func (c *Console) broadcast(text string) (n int, err error) {
+	msg := msgsvr.ChatMessageSuccess{
+		ChatChannel: dofustyp.ChatChannelAdmin,
+		Message:     text,
+	}
+	extra, err := msg.Serialized()
+	if err != nil {
+		return 0, err
+	}
+	pkt := string(msg.MessageId()) + extra
+
+	for _, name := range c.names() {
+		sender, ok := c.registries[name].(ClientSender)
+		if !ok {
+			continue
+		}
+		for _, si := range c.registries[name].Sessions() {
+			if sender.SendToClient(si.Id, pkt) {
+				n++
+			}
+		}
+	}
+	c.logger.Info("broadcast chat message",
+		zap.String("text", text),
+		zap.Int("sessions", n),
+	)
+	return n, nil
+}
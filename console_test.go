@@ -0,0 +1,78 @@
+package retroproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// clientRegistry is a session registry with one session, which records the packets sent to its client.
+type clientRegistry struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (r *clientRegistry) Sessions() []SessionInfo {
+	return []SessionInfo{{Id: "s1"}}
+}
+
+func (r *clientRegistry) Kick(id string) bool {
+	return false
+}
+
+func (r *clientRegistry) SendToClient(id string, pkt string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, pkt)
+	return true
+}
+
+func TestBroadcastRejectsInvalidText(t *testing.T) {
+	for _, text := range []string{"restart\nin 5 minutes", "restart\x00in 5 minutes", "restart|in 5 minutes"} {
+		reg := &clientRegistry{}
+		c := NewConsole(map[string]SessionRegistry{"game": reg}, nil)
+		quoted, _ := json.Marshal(text)
+
+		if err := c.run(io.Discard, []string{"broadcast", text}); err == nil {
+			t.Errorf("broadcast command accepted %q", text)
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/broadcast", strings.NewReader(`{"text":`+string(quoted)+`}`))
+		c.Handler("").ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("broadcast endpoint answered %q with status %d, want %d", text, w.Code, http.StatusBadRequest)
+		}
+
+		var resp struct {
+			Error *rpcError `json:"error"`
+		}
+		req := `{"jsonrpc":"2.0","id":1,"method":"broadcast","params":{"text":` + string(quoted) + `}}`
+		if err := json.Unmarshal(c.handleRPC([]byte(req), nil), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error == nil || resp.Error.Code != rpcInvalidParams {
+			t.Errorf("broadcast method answered %q with error %+v, want code %d", text, resp.Error, rpcInvalidParams)
+		}
+
+		if len(reg.sent) != 0 {
+			t.Errorf("sent %q to the clients", reg.sent)
+		}
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	reg := &clientRegistry{}
+	c := NewConsole(map[string]SessionRegistry{"game": reg}, nil)
+	if err := c.run(io.Discard, []string{"broadcast", "restart", "in", "5", "minutes"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cMK@|0||restart in 5 minutes|"}; !reflect.DeepEqual(reg.sent, want) {
+		t.Errorf("sent %q to the clients, want %q", reg.sent, want)
+	}
+}
@@ -0,0 +1,304 @@
+package retroproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// consoleSession is a session of the HTTP API of a Console.
+type consoleSession struct {
+	Proxy string `json:"proxy"`
+	SessionInfo
+}
+
+// consoleStats is the response of the stats endpoint of the HTTP API of a Console.
+type consoleStats struct {
+	Sessions map[string]int `json:"sessions"`
+	// RTTAverageSeconds is the average round-trip time of the proxies that measure it.
+	RTTAverageSeconds map[string]float64 `json:"rtt_average_seconds"`
+	// Coalesced is the number of packets dropped by the proxies that coalesce packets, because a newer packet
+	// superseded them.
+	Coalesced map[string]uint64 `json:"coalesced"`
+	// TotalSessions and MaxSessions are the sessions counted by the session limiter of the proxies, if they have one.
+	TotalSessions int `json:"total_sessions,omitempty"`
+	MaxSessions   int `json:"max_sessions,omitempty"`
+	// Circuits are the circuits of the servers that recently failed, if the proxies have a circuit breaker.
+	Circuits []CircuitInfo `json:"circuits,omitempty"`
+	// Messages are the most received messages.
+	Messages      []MessageCount `json:"messages"`
+	UptimeSeconds int64          `json:"uptime_seconds"`
+}
+
+// Handler returns an HTTP handler serving the commands of the console as a JSON API:
+//
+//	GET    /sessions[?account=...][&character=...]
+//	GET    /stats
+//	POST   /sessions/{id}/kick
+//	GET    /sessions/{id}/shadow
+//	POST   /sessions/{id}/shadow
+//	DELETE /sessions/{id}/shadow
+//	POST   /broadcast {"text": "..."}
+//	GET    /events
+//	POST   /rpc
+//
+// The events endpoint is only served if the console has an event hub. It streams the events of the hub as
+// Server-Sent Events, each one a JSON Event, along with an EventStats event every 10 seconds.
+// Getting the shadow of a session streams its packets the same way, each one a JSON CaptureRecord, until it ends.
+// Posting and deleting it start and stop writing them to a capture file, like the shadow and unshadow commands.
+// The rpc endpoint serves the methods of the console as JSON-RPC 2.0, including batches, except for the subscription
+// to the events, which is only served over the admin socket.
+// If token is not empty, requests must carry it as a bearer token.
+func (c *Console) Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			c.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		c.writeJSON(w, http.StatusOK, c.sessions(r.URL.Query().Get("account"), r.URL.Query().Get("character")))
+	})
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		id, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+		if !ok || id == "" {
+			c.writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		switch action {
+		case "kick":
+		case "shadow":
+			c.serveShadow(w, r, id)
+			return
+		default:
+			c.writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if r.Method != http.MethodPost {
+			c.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		name, ok := c.kick(id)
+		if !ok {
+			c.writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		c.writeJSON(w, http.StatusOK, map[string]string{"proxy": name, "id": id})
+	})
+	mux.HandleFunc("/broadcast", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			c.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var body struct {
+			Text string `json:"text"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || body.Text == "" {
+			c.writeError(w, http.StatusBadRequest, "invalid body")
+			return
+		}
+		if err := validBroadcastText(body.Text); err != nil {
+			c.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		n, err := c.broadcast(body.Text)
+		if err != nil {
+			c.writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.writeJSON(w, http.StatusOK, map[string]int{"sessions": n})
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			c.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		c.writeJSON(w, http.StatusOK, c.stats())
+	})
+	mux.HandleFunc("/rpc", c.serveRPC)
+	if c.events != nil {
+		mux.HandleFunc("/events", c.serveEvents)
+	}
+
+	if token == "" {
+		return mux
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			c.writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (c *Console) stats() consoleStats {
+	stats := consoleStats{
+		Sessions:          make(map[string]int, len(c.registries)),
+		RTTAverageSeconds: make(map[string]float64),
+		Coalesced:         make(map[string]uint64),
+		Messages:          TopMessages(statsTopMessages),
+		UptimeSeconds:     int64(time.Since(c.startedAt).Seconds()),
+	}
+	for name, r := range c.registries {
+		stats.Sessions[name] = len(r.Sessions())
+		if rr, ok := r.(RTTReporter); ok {
+			stats.RTTAverageSeconds[name] = rr.AverageRTT().Seconds()
+		}
+		if cr, ok := r.(CoalesceReporter); ok {
+			stats.Coalesced[name] = cr.Coalesced()
+		}
+	}
+	if c.limiter != nil {
+		stats.TotalSessions = c.limiter.Count()
+		stats.MaxSessions = c.limiter.Max()
+	}
+	if c.breaker != nil {
+		stats.Circuits = c.breaker.Circuits()
+	}
+	return stats
+}
+
+// serveEvents streams the events of the hub of the console until the client goes away.
+func (c *Console) serveEvents(w http.ResponseWriter, r *http.Request) {
+	const (
+		statsInterval = 10 * time.Second
+		// bufferSize is how many events a client may lag behind before it misses some.
+		bufferSize = 256
+	)
+
+	if r.Method != http.MethodGet {
+		c.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		c.writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	events, unsubscribe := c.events.Subscribe(bufferSize)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	e := Event{Type: EventStats, Time: time.Now(), Data: c.stats()}
+	for {
+		b, err := json.Marshal(e)
+		if err != nil {
+			c.logger.Error("could not marshal event", zap.Error(err))
+			return
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case e = <-events:
+		case <-ticker.C:
+			e = Event{Type: EventStats, Time: time.Now(), Data: c.stats()}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveShadow serves the shadow of the session with the given id.
+func (c *Console) serveShadow(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		c.streamShadow(w, r, id)
+	case http.MethodPost:
+		path, err := c.shadowToFile(id)
+		if errors.Is(err, errSessionNotFound) {
+			c.writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		if err != nil {
+			c.writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		c.writeJSON(w, http.StatusOK, map[string]string{"id": id, "path": path})
+	case http.MethodDelete:
+		if !c.unshadowFile(id) {
+			c.writeError(w, http.StatusNotFound, "session not shadowed")
+			return
+		}
+		c.writeJSON(w, http.StatusOK, map[string]string{"id": id})
+	default:
+		c.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// streamShadow streams the packets of the session with the given id until it ends or the client goes away.
+func (c *Console) streamShadow(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		c.writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	name, records, stop, ok := c.shadow(id, shadowBufferSize)
+	if !ok {
+		c.writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	defer stop()
+	c.logger.Info("streaming shadow of session",
+		zap.String("proxy", name),
+		zap.String("session_id", id),
+	)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case rec, ok := <-records:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(rec)
+			if err != nil {
+				c.logger.Error("could not marshal packet", zap.Error(err))
+				return
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (c *Console) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		c.logger.Debug("could not write response", zap.Error(err))
+	}
+}
+
+func (c *Console) writeError(w http.ResponseWriter, status int, msg string) {
+	c.writeJSON(w, status, map[string]string{"error": msg})
+}
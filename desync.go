@@ -0,0 +1,25 @@
+package retroproxy
+
+import (
+	"unicode/utf8"
+)
+
+// Desynced reports whether pkt, a packet whose message id is not known, doesn't look like a message either, which
+// likely means the framing of the connection is off, such as after a partial read, a packet handler that broke a packet
+// or encrypted traffic. Messages start with a letter and hold printable UTF-8 text, so that unknown but well-formed
+// messages are not reported.
+func Desynced(pkt string) bool {
+	if pkt == "" || !utf8.ValidString(pkt) {
+		return true
+	}
+	if c := pkt[0]; !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+		return true
+	}
+	for _, r := range pkt {
+		// Newlines and tabs separate the fields of some messages, such as the credentials of the login protocol.
+		if r < 0x20 && r != '\n' && r != '\t' || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
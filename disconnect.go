@@ -0,0 +1,45 @@
+package retroproxy
+
+// DisconnectReason is why a session ended.
+type DisconnectReason string
+
+const (
+	// DisconnectClientClosed is the normal end of a session, closed by the client.
+	DisconnectClientClosed DisconnectReason = "client_closed"
+	// DisconnectServerClosed is a session closed by the server.
+	DisconnectServerClosed DisconnectReason = "server_closed"
+	// DisconnectRedirected is a login session that ended with the client redirected to the game proxy.
+	DisconnectRedirected DisconnectReason = "redirected"
+	// DisconnectIdleTimeout is a session closed because one of its connections was idle for too long.
+	DisconnectIdleTimeout DisconnectReason = "idle_timeout"
+	// DisconnectWriteTimeout is a session closed because a write to one of its connections blocked for too long.
+	DisconnectWriteTimeout DisconnectReason = "write_timeout"
+	// DisconnectCircuitOpen is a session refused because connecting to its server kept failing.
+	DisconnectCircuitOpen DisconnectReason = "circuit_open"
+	// DisconnectUpstreamError is a session closed because of a failure to connect to or to read from the server.
+	DisconnectUpstreamError DisconnectReason = "upstream_error"
+	// DisconnectRefused is a session refused by a policy of the proxy, such as a client version that is not allowed.
+	DisconnectRefused DisconnectReason = "refused"
+	// DisconnectHandlerError is a session closed because of an error returned by a packet handler.
+	DisconnectHandlerError DisconnectReason = "handler_error"
+	// DisconnectPanic is a session closed because handling one of its packets panicked, such as in a packet handler.
+	DisconnectPanic DisconnectReason = "panic"
+	// DisconnectQuotaExceeded is a session closed because its client sent more than its quota of bytes or packets.
+	DisconnectQuotaExceeded DisconnectReason = "quota_exceeded"
+	// DisconnectKicked is a session closed from the admin console.
+	DisconnectKicked DisconnectReason = "kicked"
+	// DisconnectShutdown is a session closed because the proxy is shutting down.
+	DisconnectShutdown DisconnectReason = "shutdown"
+	// DisconnectError is a session closed because of any other error, such as an invalid packet.
+	DisconnectError DisconnectReason = "error"
+)
+
+// Failed reports whether r is an error rather than an expected end of a session.
+func (r DisconnectReason) Failed() bool {
+	switch r {
+	case DisconnectWriteTimeout, DisconnectCircuitOpen, DisconnectUpstreamError, DisconnectHandlerError, DisconnectPanic,
+		DisconnectError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package retroproxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors wrapped by the errors that end the sessions of the proxies, so that embedders can tell their causes apart with
+// errors.Is, such as from the Err of the EventError events.
+var (
+	// ErrTicketNotFound is a ticket presented to the game proxy that is not in the ticket store, because it's unknown or
+	// was already used.
+	ErrTicketNotFound = errors.New("ticket not found or already used")
+	// ErrTicketExpired is a ticket presented to the game proxy after its maximum age.
+	ErrTicketExpired = errors.New("ticket expired")
+	// ErrUpstreamDial is a failure to connect to the server of a session, including when its circuit breaker is open.
+	ErrUpstreamDial = errors.New("could not connect to server")
+	// ErrProtocol is a packet that the proxy can't relay, such as a malformed one in strict mode or one that a client
+	// sent out of order.
+	ErrProtocol = errors.New("protocol error")
+)
+
+// SessionError is an error that ended a session of a proxy.
+type SessionError struct {
+	// Proxy is either "login" or "game".
+	Proxy     string
+	SessionId string
+	Err       error
+}
+
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("%s session %s: %v", e.Proxy, e.SessionId, e.Err)
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,105 @@
+package retroproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// EventSessionConnected is published when a client connects. Its data is a SessionEventData.
+	EventSessionConnected EventType = "session_connected"
+	// EventSessionDisconnected is published when a session ends. Its data is a SessionEventData.
+	EventSessionDisconnected EventType = "session_disconnected"
+	// EventChat is published for each chat message received by a game client. Its data is a ChatEventData.
+	EventChat EventType = "chat"
+	// EventError is published when a session ends because of an unexpected error. Its data is an ErrorEventData.
+	EventError EventType = "error"
+	// EventStats is published periodically to the event streams of the admin console.
+	EventStats EventType = "stats"
+)
+
+// Event is something that happened in a proxy.
+type Event struct {
+	Type      EventType `json:"type"`
+	Time      time.Time `json:"time"`
+	Proxy     string    `json:"proxy,omitempty"`
+	SessionId string    `json:"session_id,omitempty"`
+	// Seq is the sequence number of the packet the event comes from, if any, as in CaptureRecord.
+	Seq  uint64      `json:"seq,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// SessionEventData is the data of the EventSessionConnected and EventSessionDisconnected events.
+type SessionEventData struct {
+	ClientAddress string `json:"client_address"`
+	// Reason is only set when the session ends.
+	Reason DisconnectReason `json:"reason,omitempty"`
+}
+
+// ChatEventData is the data of the EventChat events.
+type ChatEventData struct {
+	Channel string `json:"channel"`
+	Sender  string `json:"sender"`
+	Message string `json:"message"`
+}
+
+// ErrorEventData is the data of the EventError events.
+type ErrorEventData struct {
+	Error string `json:"error"`
+	// Err is the error itself, a *SessionError, for the subscribers that inspect it with errors.Is or errors.As.
+	Err error `json:"-"`
+}
+
+// EventHub fans out published events to its subscribers. Publishing never blocks: a subscriber whose buffer is full
+// misses the event. A nil *EventHub discards every event. It is safe for concurrent use.
+type EventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subs: make(map[chan Event]struct{})}
+}
+
+// Publish sends e to every subscriber that has room for it, setting its time if it's zero.
+func (h *EventHub) Publish(e Event) {
+	if h == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			MetricEventsDropped.Inc()
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now on, buffering up to size of them, and a
+// function that ends the subscription and closes the channel.
+func (h *EventHub) Subscribe(size int) (<-chan Event, func()) {
+	ch := make(chan Event, size)
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
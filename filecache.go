@@ -0,0 +1,111 @@
+package retroproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FileCache is an implementation of Storer for an in-memory cache that is persisted to a file, so tickets survive a
+// restart of the proxy.
+type FileCache struct {
+	logger Logger
+	path   string
+	cache  *Cache
+	mu     sync.Mutex // serializes writes to the file
+}
+
+// NewFileCache makes a FileCache backed by the file at path, loading the tickets it contains that are not older than
+// maxDur.
+func NewFileCache(path string, maxDur time.Duration, logger Logger) (*FileCache, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	r := &FileCache{
+		logger: logger,
+		path:   path,
+		cache:  NewCache(logger),
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		var tickets map[string]Ticket
+		err := json.Unmarshal(b, &tickets)
+		if err != nil {
+			return nil, err
+		}
+		for id, t := range tickets {
+			r.cache.SetTicket(id, t)
+		}
+		r.cache.DeleteOldTickets(maxDur)
+	}
+
+	return r, nil
+}
+
+func (r *FileCache) SetTicket(id string, t Ticket) {
+	r.cache.SetTicket(id, t)
+	r.save()
+}
+
+// UseTicket gets and deletes the ticket atomically, like Cache, and saves the file before returning it, so that the ticket
+// isn't loaded again if the proxy restarts.
+func (r *FileCache) UseTicket(id string) (Ticket, bool) {
+	t, ok := r.cache.UseTicket(id)
+	if ok {
+		r.save()
+	}
+	return t, ok
+}
+
+func (r *FileCache) DeleteOldTickets(maxDur time.Duration) {
+	if r.cache.deleteOldTickets(maxDur) > 0 {
+		r.save()
+	}
+}
+
+func (r *FileCache) save() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.writeFile(r.cache.snapshot())
+	if err != nil {
+		r.logger.Error("could not save tickets",
+			zap.Error(err),
+			zap.String("path", r.path),
+		)
+	}
+}
+
+// writeFile replaces the file atomically, so a crash never leaves it partially written.
+func (r *FileCache) writeFile(tickets map[string]Ticket) error {
+	b, err := json.Marshal(tickets)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), r.path)
+}
@@ -0,0 +1,31 @@
+package game
+
+import (
+	"testing"
+
+	"github.com/kralamoure/retroproxy/internal/gametest"
+)
+
+// BenchmarkRelay relays a packet of the client to the server and its answer back, once per iteration. The
+// allocations include those of the stub client and server, which are the same for each iteration.
+func BenchmarkRelay(b *testing.B) {
+	srv, err := gametest.New(gametest.Config{
+		Script:   []gametest.Step{gametest.TicketStep, {Replies: []string{"BN"}, Repeat: true}},
+		NoRecord: true,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Close()
+	px := startProxy(b, srv, Config{})
+	c := dial(b, px)
+	send(b, c, "ATt1")
+	expectPkt(b, c, "ATK0")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		send(b, c, "BD")
+		expectPkt(b, c, "BN")
+	}
+}
@@ -0,0 +1,154 @@
+package game
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kralamoure/retroproto"
+	"github.com/kralamoure/retroproto/enum"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// coalesceQueueSize is how many packets a coalescer holds before the relay of the server waits.
+const coalesceQueueSize = 1024
+
+// coalesceKey returns the key of a packet of the server that is superseded by the next packet with the same key, if
+// it's safe to drop it then:
+//   - the movements of the actors (GameActions of the movement type), by actor, except those with an action id, which
+//     the client acknowledges once done.
+//   - the stats of the character (AccountStats), which are all sent in each packet.
+func coalesceKey(pkt string) (string, bool) {
+	id, ok := retroproto.MsgSvrIdByPkt(pkt)
+	if !ok {
+		return "", false
+	}
+	switch id {
+	case retroproto.GameActions:
+		// "<action id>;<action type>;<actor id>;<params>"
+		sli := strings.SplitN(strings.TrimPrefix(pkt, string(id)), ";", 4)
+		if len(sli) != 4 || sli[0] != "" || sli[1] != strconv.Itoa(enum.GameActionType.Movement) {
+			return "", false
+		}
+		return string(id) + sli[2], true
+	case retroproto.AccountStats:
+		return string(id), true
+	}
+	return "", false
+}
+
+// coalescer forwards the packets of the server to the client, holding those that are safe to coalesce for a window
+// and forwarding only the latest one of each key. The held packets are forwarded before any other packet, so that the
+// order of the packets that are not superseded is kept.
+type coalescer struct {
+	window time.Duration
+	send   func(ctx context.Context, pkt string) error
+	// coalesced is called with the number of packets dropped each time the held packets are forwarded.
+	coalesced func(n int)
+	pkts      chan string
+}
+
+// newCoalescer returns a coalescer that forwards its packets with send, which is only called by coalescer.run.
+func newCoalescer(window time.Duration, send func(ctx context.Context, pkt string) error, coalesced func(n int)) *coalescer {
+	return &coalescer{
+		window:    window,
+		send:      send,
+		coalesced: coalesced,
+		pkts:      make(chan string, coalesceQueueSize),
+	}
+}
+
+// push queues pkt to be forwarded.
+func (c *coalescer) push(ctx context.Context, pkt string) error {
+	select {
+	case c.pkts <- pkt:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run forwards the queued packets until ctx is done or sending fails. The packets still held are discarded.
+func (c *coalescer) run(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	var held []string
+	// keys are the indexes in held of the packets of each key.
+	keys := make(map[string]int)
+	dropped := 0
+	flush := func() error {
+		if len(held) == 0 {
+			return nil
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if dropped > 0 {
+			c.coalesced(dropped)
+		}
+		for _, pkt := range held {
+			err := c.send(ctx, pkt)
+			if err != nil {
+				return err
+			}
+		}
+		held, dropped = held[:0], 0
+		for k := range keys {
+			delete(keys, k)
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case pkt := <-c.pkts:
+			key, ok := coalesceKey(pkt)
+			if !ok {
+				err := flush()
+				if err != nil {
+					return err
+				}
+				err = c.send(ctx, pkt)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if i, ok := keys[key]; ok {
+				held[i] = pkt
+				dropped++
+				continue
+			}
+			keys[key] = len(held)
+			held = append(held, pkt)
+			if len(held) == 1 {
+				timer.Reset(c.window)
+			}
+		case <-timer.C:
+			err := flush()
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Coalesced returns the number of packets of the server that were dropped because a newer packet superseded them,
+// when the proxy coalesces packets. See retroproxy.CoalesceReporter.
+func (p *Proxy) Coalesced() uint64 {
+	return p.coalesced.Load()
+}
+
+func (p *Proxy) countCoalesced(n int) {
+	p.coalesced.Add(uint64(n))
+	retroproxy.MetricCoalesced.WithLabelValues(metricLabel).Add(float64(n))
+}
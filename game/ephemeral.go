@@ -0,0 +1,113 @@
+package game
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ephemeralListeners tracks the ephemeral listeners of a Proxy and their sessions while it's serving.
+type ephemeralListeners struct {
+	mu sync.Mutex
+	// ctx is the context of the sessions of the proxy, or nil if it's not serving.
+	ctx context.Context
+	// stopped is closed once new ephemeral listeners are refused, which closes those that are still open.
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (e *ephemeralListeners) start(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ctx = ctx
+	e.stopped = make(chan struct{})
+}
+
+// stop refuses new ephemeral listeners and closes the open ones. The sessions they accepted keep going.
+func (e *ephemeralListeners) stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ctx == nil {
+		return
+	}
+	e.ctx = nil
+	close(e.stopped)
+}
+
+// wait waits for stop to be called, then for the ephemeral listeners and their sessions to finish.
+func (e *ephemeralListeners) wait() {
+	e.mu.Lock()
+	stopped := e.stopped
+	e.mu.Unlock()
+	<-stopped
+	e.wg.Wait()
+}
+
+// ListenEphemeral opens a listener on a port chosen by the system, on the host of the first listener of the proxy. It
+// accepts a single connection, whose client must present ticket, and is closed after ttl if no client connected to it
+// by then, unless ttl is zero. It returns the port of the listener. The proxy must be serving.
+func (p *Proxy) ListenEphemeral(ticket string, ttl time.Duration) (int, error) {
+	base := p.listeners[0]
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: base.addr.IP, Zone: base.addr.Zone})
+	if err != nil {
+		return 0, err
+	}
+	l := &listener{
+		addr:       ln.Addr().(*net.TCPAddr),
+		serverHost: base.serverHost,
+		serverPort: base.serverPort,
+		ticket:     ticket,
+	}
+
+	e := &p.ephemeral
+	e.mu.Lock()
+	ctx, stopped := e.ctx, e.stopped
+	if ctx == nil {
+		e.mu.Unlock()
+		ln.Close()
+		return 0, errors.New("proxy is not serving")
+	}
+	e.wg.Add(1)
+	e.mu.Unlock()
+
+	p.logger.Debug("listening on ephemeral port",
+		zap.String("address", l.addr.String()),
+	)
+	go func() {
+		defer e.wg.Done()
+		p.serveEphemeral(ctx, ln, l, ttl, stopped)
+	}()
+	return l.addr.Port, nil
+}
+
+// serveEphemeral accepts a single connection with ln, closes it and handles the connection until its session ends.
+func (p *Proxy) serveEphemeral(ctx context.Context, ln *net.TCPListener, l *listener, ttl time.Duration, stopped <-chan struct{}) {
+	if ttl > 0 {
+		ln.SetDeadline(time.Now().Add(ttl))
+	}
+	accepted := make(chan struct{})
+	go func() {
+		select {
+		case <-stopped:
+			ln.Close()
+		case <-accepted:
+		}
+	}()
+	tcpConn, err := ln.AcceptTCP()
+	close(accepted)
+	ln.Close()
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			p.logger.Debug("ephemeral port expired",
+				zap.String("address", l.addr.String()),
+			)
+		}
+		return
+	}
+	p.serveConn(ctx, tcpConn, l)
+}
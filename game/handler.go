@@ -0,0 +1,97 @@
+package game
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// PacketHandler intercepts the packets relayed by a game proxy session.
+//
+// HandlePacket is called with each packet that is about to be forwarded, where dir is the side the packet comes from.
+// The returned out packet is forwarded instead of pkt, so a handler that only observes must return pkt unchanged.
+// If drop is true, the packet is not forwarded and the remaining handlers are skipped.
+// A non-nil error ends the session.
+//
+// In sniff-only mode, the out, drop and err results are ignored.
+type PacketHandler interface {
+	HandlePacket(dir retroproxy.Direction, pkt string) (out string, drop bool, err error)
+}
+
+// PacketHandlerFunc is an adapter to allow the use of ordinary functions as packet handlers.
+type PacketHandlerFunc func(dir retroproxy.Direction, pkt string) (out string, drop bool, err error)
+
+func (f PacketHandlerFunc) HandlePacket(dir retroproxy.Direction, pkt string) (out string, drop bool, err error) {
+	return f(dir, pkt)
+}
+
+// ContextPacketHandler is a PacketHandler that is also given the context of the session, which is canceled when the
+// session ends, so that the work of the handler for the session can stop then, including the goroutines it starts.
+// The proxy calls HandlePacketContext instead of HandlePacket for the handlers that implement it.
+type ContextPacketHandler interface {
+	PacketHandler
+	HandlePacketContext(ctx context.Context, dir retroproxy.Direction, pkt string) (out string, drop bool, err error)
+}
+
+// ContextPacketHandlerFunc is an adapter to allow the use of ordinary functions as context packet handlers.
+type ContextPacketHandlerFunc func(ctx context.Context, dir retroproxy.Direction, pkt string) (string, bool, error)
+
+func (f ContextPacketHandlerFunc) HandlePacket(dir retroproxy.Direction, pkt string) (string, bool, error) {
+	return f(context.Background(), dir, pkt)
+}
+
+func (f ContextPacketHandlerFunc) HandlePacketContext(ctx context.Context, dir retroproxy.Direction,
+	pkt string) (string, bool, error) {
+	return f(ctx, dir, pkt)
+}
+
+// Use registers handlers, which are called in order of registration.
+// It must not be called after ListenAndServe.
+func (p *Proxy) Use(handlers ...PacketHandler) {
+	p.handlers = append(p.handlers, handlers...)
+}
+
+func (s *session) runHandlers(dir retroproxy.Direction, pkt string) (string, bool, error) {
+	if s.proxy.sniffOnly {
+		// Handlers only observe in sniff-only mode, so they can neither change nor drop the packet nor end the session.
+		for _, h := range s.proxy.handlers {
+			_, _, err := s.handlePacket(h, dir, pkt)
+			if err != nil {
+				s.logger.Debug("error from packet handler in sniff-only mode",
+					zap.Error(err),
+				)
+			}
+		}
+		return pkt, false, nil
+	}
+
+	in := pkt
+	for _, h := range s.proxy.handlers {
+		out, drop, err := s.handlePacket(h, dir, pkt)
+		if err != nil {
+			return "", false, fmt.Errorf("%w: %w", errHandler, err)
+		}
+		if drop {
+			return "", true, nil
+		}
+		pkt = out
+	}
+	if pkt != in {
+		err := s.checkHandled(dir, in, pkt)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	return pkt, false, nil
+}
+
+// handlePacket calls h with pkt, and with the context of the session if it's a ContextPacketHandler.
+func (s *session) handlePacket(h PacketHandler, dir retroproxy.Direction, pkt string) (string, bool, error) {
+	if ch, ok := h.(ContextPacketHandler); ok {
+		return ch.HandlePacketContext(s.ctx, dir, pkt)
+	}
+	return h.HandlePacket(dir, pkt)
+}
@@ -0,0 +1,387 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/kralamoure/retro/retrotyp"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// CharacterEventKind is the kind of a CharacterEvent.
+type CharacterEventKind string
+
+const (
+	// CharacterInventory is the whole inventory of the character, sent once it's selected
+	// (AccountCharacterSelectedSuccess, "ASK|<id>|<name>|<level>|<class>|<sex>|<gfx>|<color 1>|<color 2>|<color 3>|
+	// <item>;...").
+	CharacterInventory CharacterEventKind = "inventory"
+	// CharacterItemsAdd is items added to the inventory (ItemsAddSuccess, "OAKO<item>;...").
+	CharacterItemsAdd CharacterEventKind = "items_add"
+	// CharacterItemRemove is an item removed from the inventory (ItemsRemove, "OR<item id>").
+	CharacterItemRemove CharacterEventKind = "item_remove"
+	// CharacterItemQuantity is the new quantity of an item of the inventory (ItemsQuantity,
+	// "OQ<item id>|<quantity>").
+	CharacterItemQuantity CharacterEventKind = "item_quantity"
+	// CharacterItemMove is an item of the inventory moved to another position, such as when it's equipped
+	// (ItemsMovement, "OM<item id>|<position>", where the position is empty for the items that are not equipped).
+	CharacterItemMove CharacterEventKind = "item_move"
+	// CharacterWeight is the weight of the inventory (ItemsWeight, "Ow<weight>|<max weight>").
+	CharacterWeight CharacterEventKind = "weight"
+	// CharacterStats is the characteristics of the character (AccountStats, "As<xp>,<xp low>,<xp high>|<kamas>|...").
+	CharacterStats CharacterEventKind = "stats"
+)
+
+// CharacterEvent is a message of the server about the inventory or the characteristics of the character of the client,
+// from which tools can mirror its state. Which fields are set depends on its kind.
+type CharacterEvent struct {
+	Kind CharacterEventKind
+	// Items is set for CharacterInventory and CharacterItemsAdd.
+	Items []Item
+	// Item is set for CharacterItemRemove, with only its id, CharacterItemQuantity, with its id and quantity, and
+	// CharacterItemMove, with its id and position.
+	Item Item
+	// Weight and MaxWeight are set for CharacterWeight.
+	Weight    int
+	MaxWeight int
+	// Stats is set for CharacterStats.
+	Stats Stats
+}
+
+// NoPosition is the position of the items of the inventory that are not equipped.
+const NoPosition = -1
+
+// Item is an item of the inventory of a character.
+type Item struct {
+	Id         int
+	TemplateId int
+	Quantity   int
+	// Position is where the item is equipped, or NoPosition.
+	Position int
+	Effects  []ItemEffect
+}
+
+// ItemEffect is an effect of an item, "<effect id>#<param 1>#<param 2>#<param 3>#<text>", where the numbers are
+// hexadecimal. What the params mean depends on the effect: for most, the first two are the bounds of a roll and the
+// third its value, and the text is the dice formula of the roll, like "1d5+2".
+type ItemEffect struct {
+	Id     int
+	Params [3]int
+	Text   string
+}
+
+// Stats are the characteristics of a character.
+type Stats struct {
+	XP     int
+	XPLow  int
+	XPHigh int
+	Kamas  int
+	// BonusPoints and SpellPoints are the points the character can spend on its characteristics and spells.
+	BonusPoints     int
+	SpellPoints     int
+	LifePoints      int
+	MaxLifePoints   int
+	Energy          int
+	MaxEnergy       int
+	Initiative      int
+	Prospecting     int
+	Characteristics map[retrotyp.CharacteristicId]retrotyp.Characteristic
+}
+
+// statsCharacteristics are the characteristics of AccountStats, in the order they're sent after the prospecting.
+var statsCharacteristics = []retrotyp.CharacteristicId{
+	retrotyp.CharacteristicIdAP,
+	retrotyp.CharacteristicIdMP,
+	retrotyp.CharacteristicIdStrength,
+	retrotyp.CharacteristicIdVitality,
+	retrotyp.CharacteristicIdWisdom,
+	retrotyp.CharacteristicIdChance,
+	retrotyp.CharacteristicIdAgility,
+	retrotyp.CharacteristicIdIntelligence,
+	retrotyp.CharacteristicIdRange,
+	retrotyp.CharacteristicIdMaxSummonedCreaturesBoost,
+	retrotyp.CharacteristicIdDamages,
+	retrotyp.CharacteristicIdPhysicalDamages,
+	retrotyp.CharacteristicIdWeaponDamagesPercent,
+	retrotyp.CharacteristicIdDamagesPercent,
+	retrotyp.CharacteristicIdHeals,
+	retrotyp.CharacteristicIdTrapDamages,
+	retrotyp.CharacteristicIdTrapDamagesPercent,
+	retrotyp.CharacteristicIdDamagesReflection,
+	retrotyp.CharacteristicIdCriticalHits,
+	retrotyp.CharacteristicIdCriticalFailures,
+	retrotyp.CharacteristicIdDodgeAP,
+	retrotyp.CharacteristicIdDodgeMP,
+	retrotyp.CharacteristicIdNeutralResistance,
+	retrotyp.CharacteristicIdNeutralResistancePercent,
+	retrotyp.CharacteristicIdNeutralResistancePVP,
+	retrotyp.CharacteristicIdNeutralResistancePercentPVP,
+	retrotyp.CharacteristicIdEarthResistance,
+	retrotyp.CharacteristicIdEarthResistancePercent,
+	retrotyp.CharacteristicIdEarthResistancePVP,
+	retrotyp.CharacteristicIdEarthResistancePercentPVP,
+	retrotyp.CharacteristicIdWaterResistance,
+	retrotyp.CharacteristicIdWaterResistancePercent,
+	retrotyp.CharacteristicIdWaterResistancePVP,
+	retrotyp.CharacteristicIdWaterResistancePercentPVP,
+	retrotyp.CharacteristicIdAirResistance,
+	retrotyp.CharacteristicIdAirResistancePercent,
+	retrotyp.CharacteristicIdAirResistancePVP,
+	retrotyp.CharacteristicIdAirResistancePercentPVP,
+	retrotyp.CharacteristicIdFireResistance,
+	retrotyp.CharacteristicIdFireResistancePercent,
+	retrotyp.CharacteristicIdFireResistancePVP,
+	retrotyp.CharacteristicIdFireResistancePercentPVP,
+}
+
+var (
+	errInvalidItem  = errors.New("invalid item")
+	errInvalidStats = errors.New("invalid stats")
+)
+
+// DecodeCharacterEvent decodes pkt if it is a message about the inventory or the characteristics of the character,
+// where dir is the side the packet comes from.
+func DecodeCharacterEvent(dir retroproxy.Direction, pkt string) (e CharacterEvent, ok bool, err error) {
+	if dir != retroproxy.DirectionServer {
+		return CharacterEvent{}, false, nil
+	}
+
+	id, payload := MessageID(dir, pkt)
+	switch id {
+	case ServerAccountCharacterSelectedSuccess:
+		fields := strings.SplitN(payload, "|", 11)
+		if len(fields) != 11 {
+			return CharacterEvent{}, false, errInvalidItem
+		}
+		items, err := decodeItems(fields[10])
+		if err != nil {
+			return CharacterEvent{}, false, err
+		}
+		return CharacterEvent{Kind: CharacterInventory, Items: items}, true, nil
+	case ServerItemsAddSuccess:
+		// Only items are added with this message, "O" being the kind of what is added.
+		if !strings.HasPrefix(payload, "O") {
+			return CharacterEvent{}, false, nil
+		}
+		items, err := decodeItems(payload[1:])
+		if err != nil {
+			return CharacterEvent{}, false, err
+		}
+		return CharacterEvent{Kind: CharacterItemsAdd, Items: items}, true, nil
+	case ServerItemsRemove:
+		itemId, err := strconv.Atoi(payload)
+		if err != nil {
+			return CharacterEvent{}, false, err
+		}
+		return CharacterEvent{Kind: CharacterItemRemove, Item: Item{Id: itemId}}, true, nil
+	case ServerItemsQuantity:
+		before, after, _ := strings.Cut(payload, "|")
+		ints, err := atois([]string{before, after})
+		if err != nil {
+			return CharacterEvent{}, false, err
+		}
+		return CharacterEvent{Kind: CharacterItemQuantity, Item: Item{Id: ints[0], Quantity: ints[1]}}, true, nil
+	case ServerItemsMovement:
+		before, after, _ := strings.Cut(payload, "|")
+		itemId, err := strconv.Atoi(before)
+		if err != nil {
+			return CharacterEvent{}, false, err
+		}
+		e := CharacterEvent{Kind: CharacterItemMove, Item: Item{Id: itemId, Position: NoPosition}}
+		if after != "" {
+			e.Item.Position, err = strconv.Atoi(after)
+			if err != nil {
+				return CharacterEvent{}, false, err
+			}
+		}
+		return e, true, nil
+	case ServerItemsWeight:
+		before, after, _ := strings.Cut(payload, "|")
+		ints, err := atois([]string{before, after})
+		if err != nil {
+			return CharacterEvent{}, false, err
+		}
+		return CharacterEvent{Kind: CharacterWeight, Weight: ints[0], MaxWeight: ints[1]}, true, nil
+	case ServerAccountStats:
+		stats, err := decodeStats(payload)
+		if err != nil {
+			return CharacterEvent{}, false, err
+		}
+		return CharacterEvent{Kind: CharacterStats, Stats: stats}, true, nil
+	}
+	return CharacterEvent{}, false, nil
+}
+
+// decodeItems decodes a list of items separated by semicolons, which may end with one.
+func decodeItems(s string) ([]Item, error) {
+	items := make([]Item, 0, strings.Count(s, ";")+1)
+	for rest := s; rest != ""; {
+		var field string
+		field, rest, _ = strings.Cut(rest, ";")
+		if field == "" {
+			continue
+		}
+		item, err := decodeItem(field)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// decodeItem decodes "<id>~<template id>~<quantity>~<position>~<effect>,...", where the numbers are hexadecimal and the
+// position is empty for the items that are not equipped.
+func decodeItem(s string) (Item, error) {
+	fields := strings.SplitN(s, "~", 5)
+	if len(fields) != 5 {
+		return Item{}, errInvalidItem
+	}
+
+	item := Item{Position: NoPosition}
+	var err error
+	if item.Id, err = atoiHex(fields[0]); err != nil {
+		return Item{}, err
+	}
+	if item.TemplateId, err = atoiHex(fields[1]); err != nil {
+		return Item{}, err
+	}
+	if item.Quantity, err = atoiHex(fields[2]); err != nil {
+		return Item{}, err
+	}
+	if fields[3] != "" {
+		if item.Position, err = atoiHex(fields[3]); err != nil {
+			return Item{}, err
+		}
+	}
+	if fields[4] != "" {
+		item.Effects = make([]ItemEffect, 0, strings.Count(fields[4], ",")+1)
+		for rest := fields[4]; rest != ""; {
+			var field string
+			field, rest, _ = strings.Cut(rest, ",")
+			effect, err := decodeItemEffect(field)
+			if err != nil {
+				return Item{}, err
+			}
+			item.Effects = append(item.Effects, effect)
+		}
+	}
+	return item, nil
+}
+
+// decodeItemEffect decodes an ItemEffect. The params that are left out are zero.
+func decodeItemEffect(s string) (ItemEffect, error) {
+	var fields [5]string
+	n := 0
+	for rest := s; n < len(fields) && rest != ""; n++ {
+		if n == len(fields)-1 {
+			fields[n] = rest
+			break
+		}
+		fields[n], rest, _ = strings.Cut(rest, "#")
+	}
+	if fields[0] == "" {
+		return ItemEffect{}, errInvalidItem
+	}
+
+	var effect ItemEffect
+	var err error
+	if effect.Id, err = atoiHex(fields[0]); err != nil {
+		return ItemEffect{}, err
+	}
+	for i := range effect.Params {
+		if fields[i+1] == "" {
+			continue
+		}
+		if effect.Params[i], err = atoiHex(fields[i+1]); err != nil {
+			return ItemEffect{}, err
+		}
+	}
+	effect.Text = fields[4]
+	return effect, nil
+}
+
+// decodeStats decodes the payload of AccountStats, "<xp>,<xp low>,<xp high>|<kamas>|<bonus points>|<spell points>|
+// <alignment>|<life points>,<max life points>|<energy>,<max energy>|<initiative>|<prospecting>|
+// <base>,<equipment>,<feat>,<boost>|...", with a field of the last form for each characteristic of
+// statsCharacteristics. Empty numbers are zero, and the alignment is ignored.
+func decodeStats(payload string) (Stats, error) {
+	fields := strings.Split(payload, "|")
+	if len(fields) < 9+len(statsCharacteristics) {
+		return Stats{}, errInvalidStats
+	}
+
+	var stats Stats
+	xp := strings.Split(fields[0], ",")
+	lifePoints := strings.Split(fields[5], ",")
+	energy := strings.Split(fields[6], ",")
+	if len(xp) != 3 || len(lifePoints) != 2 || len(energy) != 2 {
+		return Stats{}, errInvalidStats
+	}
+	for _, v := range []struct {
+		dst *int
+		s   string
+	}{
+		{&stats.XP, xp[0]},
+		{&stats.XPLow, xp[1]},
+		{&stats.XPHigh, xp[2]},
+		{&stats.Kamas, fields[1]},
+		{&stats.BonusPoints, fields[2]},
+		{&stats.SpellPoints, fields[3]},
+		{&stats.LifePoints, lifePoints[0]},
+		{&stats.MaxLifePoints, lifePoints[1]},
+		{&stats.Energy, energy[0]},
+		{&stats.MaxEnergy, energy[1]},
+		{&stats.Initiative, fields[7]},
+		{&stats.Prospecting, fields[8]},
+	} {
+		if v.s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v.s)
+		if err != nil {
+			return Stats{}, err
+		}
+		*v.dst = n
+	}
+
+	stats.Characteristics = make(map[retrotyp.CharacteristicId]retrotyp.Characteristic, len(statsCharacteristics))
+	for i, id := range statsCharacteristics {
+		values := strings.Split(fields[9+i], ",")
+		if len(values) < 4 {
+			return Stats{}, errInvalidStats
+		}
+		ints, err := atois(values[:4])
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.Characteristics[id] = retrotyp.Characteristic{
+			Id:        id,
+			Base:      ints[0],
+			Equipment: ints[1],
+			Feat:      ints[2],
+			Boost:     ints[3],
+		}
+	}
+	return stats, nil
+}
+
+// atoiHex converts a hexadecimal number to an int.
+func atoiHex(s string) (int, error) {
+	n, err := strconv.ParseInt(s, 16, 0)
+	return int(n), err
+}
+
+// CharacterHandler is a packet handler that calls itself with each message about the inventory or the characteristics
+// of the character relayed by the game proxy. Packets that cannot be decoded are still forwarded.
+type CharacterHandler func(e CharacterEvent)
+
+func (h CharacterHandler) HandlePacket(dir retroproxy.Direction, pkt string) (string, bool, error) {
+	e, ok, err := DecodeCharacterEvent(dir, pkt)
+	if err == nil && ok {
+		h(e)
+	}
+	return pkt, false, nil
+}
@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kralamoure/retro/retrotyp"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+func TestDecodeCharacterEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		pkt     string
+		want    CharacterEvent
+		wantOk  bool
+		wantErr bool
+	}{
+		{
+			name: "inventory",
+			pkt:  "ASK|1234|Bob|50|8|0|80|ffffff|-1|-1|4d2~2bd~1~~7d#b#0#0#0d0+11,76#5#a#0#1d6+4;4d3~97~1~1~64#3#7#0#1d5+2;4d4~1ed~c~~;",
+			want: CharacterEvent{Kind: CharacterInventory, Items: []Item{
+				{Id: 1234, TemplateId: 701, Quantity: 1, Position: NoPosition, Effects: []ItemEffect{
+					{Id: 125, Params: [3]int{11, 0, 0}, Text: "0d0+11"},
+					{Id: 118, Params: [3]int{5, 10, 0}, Text: "1d6+4"},
+				}},
+				{Id: 1235, TemplateId: 151, Quantity: 1, Position: 1, Effects: []ItemEffect{
+					{Id: 100, Params: [3]int{3, 7, 0}, Text: "1d5+2"},
+				}},
+				{Id: 1236, TemplateId: 493, Quantity: 12, Position: NoPosition},
+			}},
+			wantOk: true,
+		},
+		{
+			name:   "empty inventory",
+			pkt:    "ASK|1234|Bob|1|8|0|80|ffffff|-1|-1|",
+			want:   CharacterEvent{Kind: CharacterInventory, Items: []Item{}},
+			wantOk: true,
+		},
+		{
+			name: "items added",
+			pkt:  "OAKO4d5~1ed~3~~",
+			want: CharacterEvent{Kind: CharacterItemsAdd, Items: []Item{
+				{Id: 1237, TemplateId: 493, Quantity: 3, Position: NoPosition},
+			}},
+			wantOk: true,
+		},
+		{
+			name:   "item removed",
+			pkt:    "OR1235",
+			want:   CharacterEvent{Kind: CharacterItemRemove, Item: Item{Id: 1235}},
+			wantOk: true,
+		},
+		{
+			name:   "item quantity",
+			pkt:    "OQ1236|11",
+			want:   CharacterEvent{Kind: CharacterItemQuantity, Item: Item{Id: 1236, Quantity: 11}},
+			wantOk: true,
+		},
+		{
+			name:   "item equipped",
+			pkt:    "OM1234|0",
+			want:   CharacterEvent{Kind: CharacterItemMove, Item: Item{Id: 1234, Position: 0}},
+			wantOk: true,
+		},
+		{
+			name:   "item unequipped",
+			pkt:    "OM1234|",
+			want:   CharacterEvent{Kind: CharacterItemMove, Item: Item{Id: 1234, Position: NoPosition}},
+			wantOk: true,
+		},
+		{
+			name:   "weight",
+			pkt:    "Ow245|1450",
+			want:   CharacterEvent{Kind: CharacterWeight, Weight: 245, MaxWeight: 1450},
+			wantOk: true,
+		},
+		{
+			name: "other added object",
+			pkt:  "OAKG12",
+		},
+		{
+			name:    "malformed item",
+			pkt:     "OAKO4d5~1ed~3",
+			wantErr: true,
+		},
+		{
+			name:    "malformed effect",
+			pkt:     "OAKO4d5~1ed~3~~xx#1",
+			wantErr: true,
+		},
+		{
+			name:    "malformed selection",
+			pkt:     "ASK|1234|Bob|50",
+			wantErr: true,
+		},
+		{
+			name:    "malformed stats",
+			pkt:     "As1250,1000,1500|5430",
+			wantErr: true,
+		},
+		{
+			name: "chat message",
+			pkt:  "cMK|123|Bob|hello|",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := DecodeCharacterEvent(retroproxy.DirectionServer, tt.pkt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %t, want %t", ok, tt.wantOk)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCharacterStats(t *testing.T) {
+	// The AP, MP, strength and vitality of the character, followed by its other characteristics, all zero.
+	pkt := "As1250,1000,1500|5430|5|3|0~0,0,0,0,0,0|120,150|8500,10000|310|120|" +
+		"6,1,0,0,7|3,0,0,1,4|10,25,0,0,35|100,12,0,0,112|" +
+		strings.Repeat("0,0,0,0,0|", len(statsCharacteristics)-4)
+
+	got, ok, err := DecodeCharacterEvent(retroproxy.DirectionServer, pkt)
+	if err != nil || !ok {
+		t.Fatalf("DecodeCharacterEvent() ok = %t, err = %v", ok, err)
+	}
+	if got.Kind != CharacterStats {
+		t.Fatalf("kind %q, want %q", got.Kind, CharacterStats)
+	}
+	stats := got.Stats
+	characteristics := stats.Characteristics
+	stats.Characteristics = nil
+	want := Stats{
+		XP:            1250,
+		XPLow:         1000,
+		XPHigh:        1500,
+		Kamas:         5430,
+		BonusPoints:   5,
+		SpellPoints:   3,
+		LifePoints:    120,
+		MaxLifePoints: 150,
+		Energy:        8500,
+		MaxEnergy:     10000,
+		Initiative:    310,
+		Prospecting:   120,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+
+	if len(characteristics) != len(statsCharacteristics) {
+		t.Errorf("%d characteristics, want %d", len(characteristics), len(statsCharacteristics))
+	}
+	for _, c := range []retrotyp.Characteristic{
+		{Id: retrotyp.CharacteristicIdAP, Base: 6, Equipment: 1},
+		{Id: retrotyp.CharacteristicIdMP, Base: 3, Boost: 1},
+		{Id: retrotyp.CharacteristicIdStrength, Base: 10, Equipment: 25},
+		{Id: retrotyp.CharacteristicIdVitality, Base: 100, Equipment: 12},
+		{Id: retrotyp.CharacteristicIdFireResistancePercentPVP},
+	} {
+		if got := characteristics[c.Id]; got != c {
+			t.Errorf("characteristic %v = %+v, want %+v", c.Id, got, c)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"strings"
+
+	"github.com/kralamoure/dofus/dofustyp"
+	"github.com/kralamoure/retroproto/msgcli"
+	"github.com/kralamoure/retroproto/msgsvr"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// ChatMessage is a chat message either received by the client (ChatMessageSuccess) or sent by it (ChatSend).
+type ChatMessage struct {
+	Direction retroproxy.Direction
+	Channel   dofustyp.ChatChannel
+	// SenderId and SenderName are only known for received messages, and SenderName is empty for system messages.
+	SenderId   int
+	SenderName string
+	// Receiver is the character name of the recipient of a sent private message.
+	Receiver string
+	Text     string
+}
+
+// DecodeChatMessage decodes pkt if it is a chat message, where dir is the side the packet comes from.
+func DecodeChatMessage(dir retroproxy.Direction, pkt string) (msg ChatMessage, ok bool, err error) {
+	id, payload := MessageID(dir, pkt)
+	switch {
+	case dir == retroproxy.DirectionServer && id == ServerChatMessageSuccess:
+		m := &msgsvr.ChatMessageSuccess{}
+		err := m.Deserialize(payload)
+		if err != nil {
+			return ChatMessage{}, false, err
+		}
+		return ChatMessage{
+			Direction:  dir,
+			Channel:    m.ChatChannel,
+			SenderId:   m.Id,
+			SenderName: m.Name,
+			Text:       m.Message,
+		}, true, nil
+	case dir == retroproxy.DirectionClient && id == ClientChatSend:
+		// msgcli.ChatSend takes the two bytes of the ¤ that the client sends for the newbies channel for the name of
+		// the receiver of a private message.
+		if strings.HasPrefix(payload, "¤|") {
+			payload = string(dofustyp.ChatChannelNewbies) + strings.TrimPrefix(payload, "¤")
+		}
+		m := &msgcli.ChatSend{}
+		err := m.Deserialize(payload)
+		if err != nil {
+			return ChatMessage{}, false, err
+		}
+		return ChatMessage{
+			Direction: dir,
+			Channel:   m.ChatChannel,
+			Receiver:  m.PrivateReceiver,
+			Text:      m.Message,
+		}, true, nil
+	}
+	return ChatMessage{}, false, nil
+}
+
+// ChatHandler is a packet handler that calls itself with each chat message relayed by the game proxy.
+// Chat packets that cannot be decoded are still forwarded.
+type ChatHandler func(msg ChatMessage)
+
+func (h ChatHandler) HandlePacket(dir retroproxy.Direction, pkt string) (string, bool, error) {
+	msg, ok, err := DecodeChatMessage(dir, pkt)
+	if err == nil && ok {
+		h(msg)
+	}
+	return pkt, false, nil
+}
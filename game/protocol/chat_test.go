@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/kralamoure/dofus/dofustyp"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+func TestDecodeChatMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     retroproxy.Direction
+		pkt     string
+		want    ChatMessage
+		wantOk  bool
+		wantErr bool
+	}{
+		{
+			name:   "public message",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "cMK|123|Bob|hello|",
+			want:   ChatMessage{Channel: dofustyp.ChatChannelPublic, SenderId: 123, SenderName: "Bob", Text: "hello"},
+			wantOk: true,
+		},
+		{
+			name:   "guild message",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "cMK%|456|Alice|meet at the bank|",
+			want:   ChatMessage{Channel: dofustyp.ChatChannelGuild, SenderId: 456, SenderName: "Alice", Text: "meet at the bank"},
+			wantOk: true,
+		},
+		{
+			name:   "private message",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "cMKF|789|Élodie|ça va ?|",
+			want:   ChatMessage{Channel: dofustyp.ChatChannelPrivate, SenderId: 789, SenderName: "Élodie", Text: "ça va ?"},
+			wantOk: true,
+		},
+		{
+			name:   "system message",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "cMK@|0||The server restarts in 5 minutes|",
+			want:   ChatMessage{Channel: dofustyp.ChatChannelAdmin, Text: "The server restarts in 5 minutes"},
+			wantOk: true,
+		},
+		{
+			name:    "malformed message",
+			dir:     retroproxy.DirectionServer,
+			pkt:     "cMK|Bob|hello|",
+			wantErr: true,
+		},
+		{
+			name:   "sent public message",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "BM*|hello everyone|",
+			want:   ChatMessage{Channel: dofustyp.ChatChannelPublic, Text: "hello everyone"},
+			wantOk: true,
+		},
+		{
+			name:   "sent newbies message",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "BM¤|salut|",
+			want:   ChatMessage{Channel: dofustyp.ChatChannelNewbies, Text: "salut"},
+			wantOk: true,
+		},
+		{
+			name:   "sent private message",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "BMÉlodie|<b>hi</b>|",
+			want:   ChatMessage{Channel: dofustyp.ChatChannelPrivate, Receiver: "Élodie", Text: "&lt;b&gt;hi&lt;/b&gt;"},
+			wantOk: true,
+		},
+		{
+			name:    "sent message without channel",
+			dir:     retroproxy.DirectionClient,
+			pkt:     "BM|hello|",
+			wantErr: true,
+		},
+		{
+			name: "other message",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "GA;1;123;aaN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := DecodeChatMessage(tt.dir, tt.pkt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %t, want %t", ok, tt.wantOk)
+			}
+			if tt.wantOk {
+				tt.want.Direction = tt.dir
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
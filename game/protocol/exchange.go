@@ -0,0 +1,314 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// ExchangeType is the type of an exchange, as sent in the requests and openings of exchanges.
+type ExchangeType int
+
+const (
+	// ExchangeTypeNPCShop is the shop of an NPC, where the client buys and sells items.
+	ExchangeTypeNPCShop ExchangeType = 0
+	// ExchangeTypePlayer is an exchange between two players.
+	ExchangeTypePlayer ExchangeType = 1
+	// ExchangeTypeNPC is an exchange with an NPC, which gives items in return for others.
+	ExchangeTypeNPC ExchangeType = 2
+)
+
+// ExchangeEventKind is the kind of an ExchangeEvent.
+type ExchangeEventKind string
+
+const (
+	// ExchangeRequest is a request of a player to exchange with another (ExchangeRequestSuccess,
+	// "ERK<player id>|<partner id>|<exchange type>", or ExchangeRequest, "ER<exchange type>|<partner id>", sent by the
+	// client).
+	ExchangeRequest ExchangeEventKind = "request"
+	// ExchangeOpen is the opening of an exchange (ExchangeCreateSuccess, "ECK<exchange type>|<partner id>"), where the
+	// partner id is only sent for the exchanges with an NPC.
+	ExchangeOpen ExchangeEventKind = "open"
+	// ExchangeClose is the end of an exchange (ExchangeLeaveSuccess, "EV", or "EVa" once a player exchange is done,
+	// or ExchangeLeave, "EV", sent by the client).
+	ExchangeClose ExchangeEventKind = "close"
+	// ExchangeReady is a player accepting or no longer accepting the terms of a player exchange (ExchangeReady,
+	// "EK<1 or 0><player id>", or ExchangeRequestReady, "EK", sent by the client).
+	ExchangeReady ExchangeEventKind = "ready"
+	// ExchangeItemMove is an item put in or taken out of an exchange, by the client (ExchangeLocalMovementSuccess,
+	// "EMKO<+ or -><item id>|<quantity>") or by its partner (ExchangeLocalDistantSuccess,
+	// "EmKO<+ or -><item id>|<quantity>|<template id>|<effects>"), or asked by the client (ExchangeMovementItems,
+	// "EMO<+ or -><item id>|<quantity>").
+	ExchangeItemMove ExchangeEventKind = "item_move"
+	// ExchangeKamasMove is the kamas offered in an exchange, by the client (ExchangeLocalMovementSuccess,
+	// "EMKG<kamas>") or by its partner (ExchangeLocalDistantSuccess, "EmKG<kamas>"), or asked by the client
+	// (ExchangeMovementKamas, "EMG<kamas>"). It's the whole amount offered, not the difference with the previous one.
+	ExchangeKamasMove ExchangeEventKind = "kamas_move"
+	// ExchangeList is the items sold by the NPC of a shop (ExchangeList, "EL<template id>;<effects>|...").
+	ExchangeList ExchangeEventKind = "list"
+	// ExchangeBuy is an item bought from an NPC shop by the client (ExchangeMovementBuy,
+	// "EB<template id>|<quantity>").
+	ExchangeBuy ExchangeEventKind = "buy"
+	// ExchangeSell is an item of the client sold to an NPC shop (ExchangeMovementSell, "ES<item id>|<quantity>").
+	ExchangeSell ExchangeEventKind = "sell"
+)
+
+// ExchangeEvent is an exchange or trade message, sent by the client or the server. Which fields are set depends on its
+// kind and direction.
+type ExchangeEvent struct {
+	Kind      ExchangeEventKind
+	Direction retroproxy.Direction
+	// Type is set for ExchangeRequest and ExchangeOpen.
+	Type ExchangeType
+	// PlayerId is set for ExchangeRequest and ExchangeReady sent by the server, and is the player requesting the
+	// exchange or accepting it.
+	PlayerId int
+	// PartnerId is set for ExchangeRequest, and for ExchangeOpen with an NPC.
+	PartnerId int
+	// Ready is set for ExchangeReady sent by the server.
+	Ready bool
+	// Done is set for ExchangeClose if the player exchange was carried out rather than canceled.
+	Done bool
+	// Distant is set for ExchangeItemMove and ExchangeKamasMove if it was the partner of the client that moved.
+	Distant bool
+	// Item is set for ExchangeItemMove, ExchangeBuy and ExchangeSell.
+	Item ExchangeItem
+	// Removed is set for ExchangeItemMove if the item was taken out of the exchange.
+	Removed bool
+	// Kamas is set for ExchangeKamasMove.
+	Kamas int
+	// Items is set for ExchangeList.
+	Items []ExchangeItem
+}
+
+// ExchangeItem is an item of an ExchangeEvent. Which fields are set depends on the message.
+type ExchangeItem struct {
+	// Id is the unique id of the item, unknown for the items of NPC shops.
+	Id int
+	// TemplateId is the id of the kind of the item, only sent for the items of the partner and of NPC shops.
+	TemplateId int
+	Quantity   int
+	// Effects are the encoded effects of the item, as sent with its template id.
+	Effects string
+}
+
+var errInvalidExchange = errors.New("invalid exchange message")
+
+// DecodeExchangeEvent decodes pkt if it is an exchange message, where dir is the side the packet comes from. The
+// exchanges with NPCs and with other players are decoded, not the other kinds of exchanges such as crafts or storages,
+// which share some of the messages.
+func DecodeExchangeEvent(dir retroproxy.Direction, pkt string) (e ExchangeEvent, ok bool, err error) {
+	switch dir {
+	case retroproxy.DirectionServer:
+		e, ok, err = decodeServerExchangeEvent(pkt)
+	case retroproxy.DirectionClient:
+		e, ok, err = decodeClientExchangeEvent(pkt)
+	}
+	if err != nil || !ok {
+		return ExchangeEvent{}, false, err
+	}
+	e.Direction = dir
+	return e, true, nil
+}
+
+func decodeServerExchangeEvent(pkt string) (ExchangeEvent, bool, error) {
+	// The leave message carries no success suffix, so it isn't one retroproto knows.
+	if pkt == "EV" || pkt == "EVa" {
+		return ExchangeEvent{Kind: ExchangeClose, Done: pkt == "EVa"}, true, nil
+	}
+
+	id, payload := MessageID(retroproxy.DirectionServer, pkt)
+	switch id {
+	case ServerExchangeRequestSuccess:
+		fields := strings.Split(payload, "|")
+		if len(fields) != 3 {
+			return ExchangeEvent{}, false, errInvalidExchange
+		}
+		ints, err := atois(fields)
+		if err != nil {
+			return ExchangeEvent{}, false, err
+		}
+		return ExchangeEvent{Kind: ExchangeRequest, PlayerId: ints[0], PartnerId: ints[1], Type: ExchangeType(ints[2])},
+			true, nil
+	case ServerExchangeCreateSuccess:
+		before, after, _ := strings.Cut(payload, "|")
+		typ, err := strconv.Atoi(before)
+		if err != nil {
+			return ExchangeEvent{}, false, err
+		}
+		e := ExchangeEvent{Kind: ExchangeOpen, Type: ExchangeType(typ)}
+		switch e.Type {
+		case ExchangeTypeNPCShop, ExchangeTypeNPC:
+			e.PartnerId, err = strconv.Atoi(after)
+			if err != nil {
+				return ExchangeEvent{}, false, err
+			}
+		case ExchangeTypePlayer:
+		default:
+			return ExchangeEvent{}, false, nil
+		}
+		return e, true, nil
+	case ServerExchangeLeaveSuccess:
+		return ExchangeEvent{Kind: ExchangeClose, Done: payload == "a"}, true, nil
+	case ServerExchangeReady:
+		if len(payload) < 2 {
+			return ExchangeEvent{}, false, errInvalidExchange
+		}
+		playerId, err := strconv.Atoi(payload[1:])
+		if err != nil {
+			return ExchangeEvent{}, false, err
+		}
+		return ExchangeEvent{Kind: ExchangeReady, PlayerId: playerId, Ready: payload[0] == '1'}, true, nil
+	case ServerExchangeLocalMovementSuccess, ServerExchangeLocalDistantSuccess:
+		e, err := decodeExchangeMove(payload)
+		if err != nil {
+			return ExchangeEvent{}, false, err
+		}
+		e.Distant = id == ServerExchangeLocalDistantSuccess
+		return e, true, nil
+	case ServerExchangeList:
+		// The other lists, such as the items of a storage, start with the kind of each entry.
+		if payload != "" && (payload[0] < '0' || payload[0] > '9') {
+			return ExchangeEvent{}, false, nil
+		}
+		e := ExchangeEvent{Kind: ExchangeList, Items: make([]ExchangeItem, 0, strings.Count(payload, "|")+1)}
+		for rest := payload; rest != ""; {
+			var field string
+			field, rest, _ = strings.Cut(rest, "|")
+			templateId, effects, _ := strings.Cut(field, ";")
+			item := ExchangeItem{Effects: effects}
+			var err error
+			item.TemplateId, err = strconv.Atoi(templateId)
+			if err != nil {
+				return ExchangeEvent{}, false, err
+			}
+			e.Items = append(e.Items, item)
+		}
+		return e, true, nil
+	}
+	return ExchangeEvent{}, false, nil
+}
+
+func decodeClientExchangeEvent(pkt string) (ExchangeEvent, bool, error) {
+	id, payload := MessageID(retroproxy.DirectionClient, pkt)
+	switch id {
+	case ClientExchangeRequest:
+		fields := strings.Split(payload, "|")
+		if len(fields) < 2 {
+			return ExchangeEvent{}, false, errInvalidExchange
+		}
+		// The request of a shop of a player also has the cell of the shop, which is ignored.
+		ints, err := atois(fields[:2])
+		if err != nil {
+			return ExchangeEvent{}, false, err
+		}
+		return ExchangeEvent{Kind: ExchangeRequest, Type: ExchangeType(ints[0]), PartnerId: ints[1]}, true, nil
+	case ClientExchangeLeave:
+		return ExchangeEvent{Kind: ExchangeClose}, true, nil
+	case ClientExchangeRequestReady:
+		return ExchangeEvent{Kind: ExchangeReady}, true, nil
+	case ClientExchangeMovementItems:
+		return decodeExchangeItemMove(payload)
+	case ClientExchangeMovementKamas:
+		kamas, err := strconv.Atoi(payload)
+		if err != nil {
+			return ExchangeEvent{}, false, err
+		}
+		return ExchangeEvent{Kind: ExchangeKamasMove, Kamas: kamas}, true, nil
+	case ClientExchangeMovementBuy, ClientExchangeMovementSell:
+		before, after, _ := strings.Cut(payload, "|")
+		ints, err := atois([]string{before, after})
+		if err != nil {
+			return ExchangeEvent{}, false, err
+		}
+		if id == ClientExchangeMovementBuy {
+			return ExchangeEvent{Kind: ExchangeBuy, Item: ExchangeItem{TemplateId: ints[0], Quantity: ints[1]}}, true, nil
+		}
+		return ExchangeEvent{Kind: ExchangeSell, Item: ExchangeItem{Id: ints[0], Quantity: ints[1]}}, true, nil
+	}
+	return ExchangeEvent{}, false, nil
+}
+
+// decodeExchangeMove decodes the payload of a movement of the server, "O<item move>" or "G<kamas>".
+func decodeExchangeMove(payload string) (ExchangeEvent, error) {
+	if payload == "" {
+		return ExchangeEvent{}, errInvalidExchange
+	}
+	switch payload[0] {
+	case 'O':
+		e, _, err := decodeExchangeItemMove(payload[1:])
+		return e, err
+	case 'G':
+		kamas, err := strconv.Atoi(payload[1:])
+		if err != nil {
+			return ExchangeEvent{}, err
+		}
+		return ExchangeEvent{Kind: ExchangeKamasMove, Kamas: kamas}, nil
+	}
+	return ExchangeEvent{}, errInvalidExchange
+}
+
+// decodeExchangeItemMove decodes "<+ or -><item id>|<quantity>|<template id>|<effects>", where only the item id is
+// required.
+func decodeExchangeItemMove(s string) (ExchangeEvent, bool, error) {
+	if len(s) < 2 || (s[0] != '+' && s[0] != '-') {
+		return ExchangeEvent{}, false, errInvalidExchange
+	}
+	e := ExchangeEvent{Kind: ExchangeItemMove, Removed: s[0] == '-'}
+
+	var fields [4]string
+	n := 0
+	for rest := s[1:]; n < len(fields) && rest != ""; n++ {
+		if n == len(fields)-1 {
+			// The effects may contain the separator.
+			fields[n] = rest
+			break
+		}
+		fields[n], rest, _ = strings.Cut(rest, "|")
+	}
+
+	var err error
+	e.Item.Id, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return ExchangeEvent{}, false, err
+	}
+	if fields[1] != "" {
+		if e.Item.Quantity, err = strconv.Atoi(fields[1]); err != nil {
+			return ExchangeEvent{}, false, err
+		}
+	}
+	if fields[2] != "" {
+		if e.Item.TemplateId, err = strconv.Atoi(fields[2]); err != nil {
+			return ExchangeEvent{}, false, err
+		}
+	}
+	e.Item.Effects = fields[3]
+	return e, true, nil
+}
+
+// atois converts each of fields to an int.
+func atois(fields []string) ([]int, error) {
+	ints := make([]int, len(fields))
+	for i, field := range fields {
+		var err error
+		ints[i], err = strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ints, nil
+}
+
+// ExchangeHandler is a packet handler that calls itself with each exchange message relayed by the game proxy.
+// Exchange packets that cannot be decoded are still forwarded.
+type ExchangeHandler func(e ExchangeEvent)
+
+func (h ExchangeHandler) HandlePacket(dir retroproxy.Direction, pkt string) (string, bool, error) {
+	e, ok, err := DecodeExchangeEvent(dir, pkt)
+	if err == nil && ok {
+		h(e)
+	}
+	return pkt, false, nil
+}
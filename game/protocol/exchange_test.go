@@ -0,0 +1,221 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+func TestDecodeExchangeEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     retroproxy.Direction
+		pkt     string
+		want    ExchangeEvent
+		wantOk  bool
+		wantErr bool
+	}{
+		// A trade between two players.
+		{
+			name:   "trade request",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "ER1|5678",
+			want:   ExchangeEvent{Kind: ExchangeRequest, Type: ExchangeTypePlayer, PartnerId: 5678},
+			wantOk: true,
+		},
+		{
+			name:   "trade request success",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "ERK1234|5678|1",
+			want:   ExchangeEvent{Kind: ExchangeRequest, Type: ExchangeTypePlayer, PlayerId: 1234, PartnerId: 5678},
+			wantOk: true,
+		},
+		{
+			name:   "trade open",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "ECK1",
+			want:   ExchangeEvent{Kind: ExchangeOpen, Type: ExchangeTypePlayer},
+			wantOk: true,
+		},
+		{
+			name:   "item put in",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "EMO+4321|2",
+			want:   ExchangeEvent{Kind: ExchangeItemMove, Item: ExchangeItem{Id: 4321, Quantity: 2}},
+			wantOk: true,
+		},
+		{
+			name:   "item put in success",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "EMKO+4321|2",
+			want:   ExchangeEvent{Kind: ExchangeItemMove, Item: ExchangeItem{Id: 4321, Quantity: 2}},
+			wantOk: true,
+		},
+		{
+			name: "item of the partner",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "EmKO+8765|1|2473|7d#b#0#0#0d0+11,7e#a#0#0#0d0+10",
+			want: ExchangeEvent{Kind: ExchangeItemMove, Distant: true, Item: ExchangeItem{
+				Id: 8765, Quantity: 1, TemplateId: 2473, Effects: "7d#b#0#0#0d0+11,7e#a#0#0#0d0+10",
+			}},
+			wantOk: true,
+		},
+		{
+			name:   "item taken out",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "EMKO-4321",
+			want:   ExchangeEvent{Kind: ExchangeItemMove, Removed: true, Item: ExchangeItem{Id: 4321}},
+			wantOk: true,
+		},
+		{
+			name:   "kamas offered",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "EMG1500",
+			want:   ExchangeEvent{Kind: ExchangeKamasMove, Kamas: 1500},
+			wantOk: true,
+		},
+		{
+			name:   "kamas of the partner",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "EmKG250",
+			want:   ExchangeEvent{Kind: ExchangeKamasMove, Distant: true, Kamas: 250},
+			wantOk: true,
+		},
+		{
+			name:   "ready",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "EK",
+			want:   ExchangeEvent{Kind: ExchangeReady},
+			wantOk: true,
+		},
+		{
+			name:   "partner ready",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "EK15678",
+			want:   ExchangeEvent{Kind: ExchangeReady, PlayerId: 5678, Ready: true},
+			wantOk: true,
+		},
+		{
+			name:   "partner no longer ready",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "EK05678",
+			want:   ExchangeEvent{Kind: ExchangeReady, PlayerId: 5678},
+			wantOk: true,
+		},
+		{
+			name:   "trade done",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "EVa",
+			want:   ExchangeEvent{Kind: ExchangeClose, Done: true},
+			wantOk: true,
+		},
+		{
+			name:   "trade canceled",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "EV",
+			want:   ExchangeEvent{Kind: ExchangeClose},
+			wantOk: true,
+		},
+		{
+			name:   "leave",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "EV",
+			want:   ExchangeEvent{Kind: ExchangeClose},
+			wantOk: true,
+		},
+
+		// A visit to the shop of an NPC.
+		{
+			name:   "shop request",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "ER0|-3",
+			want:   ExchangeEvent{Kind: ExchangeRequest, Type: ExchangeTypeNPCShop, PartnerId: -3},
+			wantOk: true,
+		},
+		{
+			name:   "shop open",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "ECK0|-3",
+			want:   ExchangeEvent{Kind: ExchangeOpen, Type: ExchangeTypeNPCShop, PartnerId: -3},
+			wantOk: true,
+		},
+		{
+			name: "shop list",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "EL1734;|311;64#1#0#0#0d0+1|6",
+			want: ExchangeEvent{Kind: ExchangeList, Items: []ExchangeItem{
+				{TemplateId: 1734},
+				{TemplateId: 311, Effects: "64#1#0#0#0d0+1"},
+				{TemplateId: 6},
+			}},
+			wantOk: true,
+		},
+		{
+			name:   "buy",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "EB311|10",
+			want:   ExchangeEvent{Kind: ExchangeBuy, Item: ExchangeItem{TemplateId: 311, Quantity: 10}},
+			wantOk: true,
+		},
+		{
+			name:   "sell",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "ES4321|3",
+			want:   ExchangeEvent{Kind: ExchangeSell, Item: ExchangeItem{Id: 4321, Quantity: 3}},
+			wantOk: true,
+		},
+
+		// Other and malformed messages.
+		{
+			name: "storage list",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "ELO4321~311~1~~",
+		},
+		{
+			name: "craft open",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "ECK3|12;11",
+		},
+		{
+			name:    "malformed request success",
+			dir:     retroproxy.DirectionServer,
+			pkt:     "ERK1234|5678",
+			wantErr: true,
+		},
+		{
+			name:    "malformed item move",
+			dir:     retroproxy.DirectionServer,
+			pkt:     "EMKO4321|2",
+			wantErr: true,
+		},
+		{
+			name:    "malformed kamas",
+			dir:     retroproxy.DirectionServer,
+			pkt:     "EMKGx",
+			wantErr: true,
+		},
+		{
+			name: "chat message",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "cMK|123|Bob|hello|",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := DecodeExchangeEvent(tt.dir, tt.pkt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %t, want %t", ok, tt.wantOk)
+			}
+			if tt.wantOk {
+				tt.want.Direction = tt.dir
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// FightEventKind is the kind of a FightEvent, named after the message it comes from.
+type FightEventKind string
+
+const (
+	// FightTurnStart is the start of the turn of a fighter (GameTurnStart, "GTS<fighter id>|<duration in ms>").
+	FightTurnStart FightEventKind = "turn_start"
+	// FightTurnFinish is the end of the turn of a fighter (GameTurnFinish, "GTF<fighter id>").
+	FightTurnFinish FightEventKind = "turn_finish"
+	// FightTurnReady is a fighter ready for the next turn (GameTurnReady, "GTR<fighter id>").
+	FightTurnReady FightEventKind = "turn_ready"
+	// FightTurnMiddle is the state of the fighters between two turns (GameTurnMiddle,
+	// "GTM|<fighter id>;<dead>;<life points>;<action points>;<movement points>;<cell id>;;<max life points>|...").
+	FightTurnMiddle FightEventKind = "turn_middle"
+	// FightTurnList is the order of the turns of the fighters (GameTurnList, "GTL|<fighter id>|...").
+	FightTurnList FightEventKind = "turn_list"
+	// FightTeam is a change of the members of a team (GameTeam, "Gt<team id>|<+ or -><fighter id>;<name>;<level>|...").
+	FightTeam FightEventKind = "team"
+	// FightActionsStart is the start of a sequence of actions of a fighter (GameActionsStart, "GAS<fighter id>").
+	FightActionsStart FightEventKind = "actions_start"
+	// FightActionsFinish is the end of a sequence of actions of a fighter (GameActionsFinish,
+	// "GAF<action type>|<fighter id>").
+	FightActionsFinish FightEventKind = "actions_finish"
+	// FightAction is an action of a fighter (GameActions, "GA<action id>;<action type>;<fighter id>;<params>").
+	// Actions are also sent outside of fights, such as movements on a map.
+	FightAction FightEventKind = "action"
+)
+
+// FightEvent is a fight message sent by the server. Which fields are set depends on its kind.
+type FightEvent struct {
+	Kind FightEventKind
+	// FighterId is set for all kinds but FightTurnMiddle, FightTurnList and FightTeam.
+	FighterId int
+	// TurnDuration is set for FightTurnStart.
+	TurnDuration time.Duration
+	// TeamId is set for FightTeam.
+	TeamId int
+	// ActionType is set for FightAction and FightActionsFinish, and ActionId and ActionParams for FightAction only.
+	ActionId     int
+	ActionType   int
+	ActionParams string
+	// Fighters is set for FightTurnMiddle, FightTurnList, where only their ids are known, and FightTeam.
+	Fighters []Fighter
+}
+
+// Fighter is a fighter of a FightEvent.
+type Fighter struct {
+	Id int
+	// Name, Level and Removed are only set for FightTeam, where Removed means the fighter left the team.
+	Name    string
+	Level   int
+	Removed bool
+	// Dead, LifePoints, MaxLifePoints, ActionPoints, MovementPoints and CellId are only set for FightTurnMiddle, and
+	// only Dead is for dead fighters.
+	Dead           bool
+	LifePoints     int
+	MaxLifePoints  int
+	ActionPoints   int
+	MovementPoints int
+	CellId         int
+}
+
+var errInvalidFighter = errors.New("invalid fighter")
+
+// DecodeFightEvent decodes pkt if it is a fight message sent by the server, where dir is the side the packet comes
+// from. Fights are made of many small packets, so the payload is parsed in place and only Fighters is allocated.
+func DecodeFightEvent(dir retroproxy.Direction, pkt string) (e FightEvent, ok bool, err error) {
+	if dir != retroproxy.DirectionServer {
+		return FightEvent{}, false, nil
+	}
+
+	id, payload := MessageID(dir, pkt)
+	switch id {
+	case ServerGameTurnStart:
+		before, after, _ := strings.Cut(payload, "|")
+		fighterId, err := strconv.Atoi(before)
+		if err != nil {
+			return FightEvent{}, false, err
+		}
+		e := FightEvent{Kind: FightTurnStart, FighterId: fighterId}
+		if after != "" {
+			ms, err := strconv.Atoi(after)
+			if err != nil {
+				return FightEvent{}, false, err
+			}
+			e.TurnDuration = time.Duration(ms) * time.Millisecond
+		}
+		return e, true, nil
+	case ServerGameTurnFinish, ServerGameTurnReady, ServerGameActionsStart:
+		kind := FightTurnFinish
+		switch id {
+		case ServerGameTurnReady:
+			kind = FightTurnReady
+		case ServerGameActionsStart:
+			kind = FightActionsStart
+		}
+		fighterId, err := strconv.Atoi(payload)
+		if err != nil {
+			return FightEvent{}, false, err
+		}
+		return FightEvent{Kind: kind, FighterId: fighterId}, true, nil
+	case ServerGameActionsFinish:
+		before, after, _ := strings.Cut(payload, "|")
+		actionType, err := strconv.Atoi(before)
+		if err != nil {
+			return FightEvent{}, false, err
+		}
+		fighterId, err := strconv.Atoi(after)
+		if err != nil {
+			return FightEvent{}, false, err
+		}
+		return FightEvent{Kind: FightActionsFinish, FighterId: fighterId, ActionType: actionType}, true, nil
+	case ServerGameActions:
+		// The action id is empty for the actions that the client doesn't have to acknowledge, and the fighter id is
+		// empty for the cancellation of an action ("GA;0").
+		actionId, rest, _ := strings.Cut(payload, ";")
+		actionType, rest, _ := strings.Cut(rest, ";")
+		fighterId, params, _ := strings.Cut(rest, ";")
+		e := FightEvent{Kind: FightAction, ActionParams: params}
+		if actionId != "" {
+			e.ActionId, err = strconv.Atoi(actionId)
+			if err != nil {
+				return FightEvent{}, false, err
+			}
+		}
+		e.ActionType, err = strconv.Atoi(actionType)
+		if err != nil {
+			return FightEvent{}, false, err
+		}
+		if fighterId != "" {
+			e.FighterId, err = strconv.Atoi(fighterId)
+			if err != nil {
+				return FightEvent{}, false, err
+			}
+		}
+		return e, true, nil
+	case ServerGameTurnList:
+		e := FightEvent{Kind: FightTurnList, Fighters: make([]Fighter, 0, strings.Count(payload, "|"))}
+		for rest := strings.TrimPrefix(payload, "|"); rest != ""; {
+			var field string
+			field, rest, _ = strings.Cut(rest, "|")
+			fighterId, err := strconv.Atoi(field)
+			if err != nil {
+				return FightEvent{}, false, err
+			}
+			e.Fighters = append(e.Fighters, Fighter{Id: fighterId})
+		}
+		return e, true, nil
+	case ServerGameTurnMiddle:
+		e := FightEvent{Kind: FightTurnMiddle, Fighters: make([]Fighter, 0, strings.Count(payload, "|"))}
+		for rest := strings.TrimPrefix(payload, "|"); rest != ""; {
+			var field string
+			field, rest, _ = strings.Cut(rest, "|")
+			f, err := decodeTurnMiddleFighter(field)
+			if err != nil {
+				return FightEvent{}, false, err
+			}
+			e.Fighters = append(e.Fighters, f)
+		}
+		return e, true, nil
+	case ServerGameTeam:
+		teamId, rest, _ := strings.Cut(payload, "|")
+		e := FightEvent{Kind: FightTeam, Fighters: make([]Fighter, 0, strings.Count(rest, "|")+1)}
+		e.TeamId, err = strconv.Atoi(teamId)
+		if err != nil {
+			return FightEvent{}, false, err
+		}
+		for rest != "" {
+			var field string
+			field, rest, _ = strings.Cut(rest, "|")
+			f, err := decodeTeamFighter(field)
+			if err != nil {
+				return FightEvent{}, false, err
+			}
+			e.Fighters = append(e.Fighters, f)
+		}
+		return e, true, nil
+	}
+	return FightEvent{}, false, nil
+}
+
+// decodeTurnMiddleFighter decodes a fighter of a GameTurnMiddle message,
+// "<fighter id>;<dead>;<life points>;<action points>;<movement points>;<cell id>;;<max life points>", where only the
+// id and the dead flag are sent for dead fighters.
+func decodeTurnMiddleFighter(s string) (Fighter, error) {
+	var fields [8]string
+	n := 0
+	for ; n < len(fields) && s != ""; n++ {
+		fields[n], s, _ = strings.Cut(s, ";")
+	}
+	if n < 2 {
+		return Fighter{}, errInvalidFighter
+	}
+
+	var f Fighter
+	var err error
+	f.Id, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return Fighter{}, err
+	}
+	f.Dead = fields[1] == "1"
+	if f.Dead {
+		return f, nil
+	}
+	if n < len(fields) {
+		return Fighter{}, errInvalidFighter
+	}
+	if f.LifePoints, err = strconv.Atoi(fields[2]); err != nil {
+		return Fighter{}, err
+	}
+	if f.ActionPoints, err = strconv.Atoi(fields[3]); err != nil {
+		return Fighter{}, err
+	}
+	if f.MovementPoints, err = strconv.Atoi(fields[4]); err != nil {
+		return Fighter{}, err
+	}
+	if f.CellId, err = strconv.Atoi(fields[5]); err != nil {
+		return Fighter{}, err
+	}
+	if f.MaxLifePoints, err = strconv.Atoi(fields[7]); err != nil {
+		return Fighter{}, err
+	}
+	return f, nil
+}
+
+// decodeTeamFighter decodes a fighter of a GameTeam message, "<+ or -><fighter id>;<name>;<level>".
+func decodeTeamFighter(s string) (Fighter, error) {
+	if len(s) < 2 || (s[0] != '+' && s[0] != '-') {
+		return Fighter{}, errInvalidFighter
+	}
+	f := Fighter{Removed: s[0] == '-'}
+
+	id, rest, _ := strings.Cut(s[1:], ";")
+	name, level, _ := strings.Cut(rest, ";")
+	var err error
+	f.Id, err = strconv.Atoi(id)
+	if err != nil {
+		return Fighter{}, err
+	}
+	f.Name = name
+	if level != "" {
+		f.Level, err = strconv.Atoi(level)
+		if err != nil {
+			return Fighter{}, err
+		}
+	}
+	return f, nil
+}
+
+// FightHandler is a packet handler that calls itself with each fight message relayed by the game proxy.
+// Fight packets that cannot be decoded are still forwarded.
+type FightHandler func(e FightEvent)
+
+func (h FightHandler) HandlePacket(dir retroproxy.Direction, pkt string) (string, bool, error) {
+	e, ok, err := DecodeFightEvent(dir, pkt)
+	if err == nil && ok {
+		h(e)
+	}
+	return pkt, false, nil
+}
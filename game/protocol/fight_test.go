@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+func TestDecodeFightEvent(t *testing.T) {
+	tests := []struct {
+		pkt     string
+		want    FightEvent
+		wantOk  bool
+		wantErr bool
+	}{
+		{
+			pkt:    "GTS1234|29000",
+			want:   FightEvent{Kind: FightTurnStart, FighterId: 1234, TurnDuration: 29 * time.Second},
+			wantOk: true,
+		},
+		{
+			pkt:    "GTS-1",
+			want:   FightEvent{Kind: FightTurnStart, FighterId: -1},
+			wantOk: true,
+		},
+		{pkt: "GTF1234", want: FightEvent{Kind: FightTurnFinish, FighterId: 1234}, wantOk: true},
+		{pkt: "GTR-2", want: FightEvent{Kind: FightTurnReady, FighterId: -2}, wantOk: true},
+		{
+			pkt: "GTM|1234;0;250;6;3;281;;320|-1;1|-2;0;48;7;4;310;;60",
+			want: FightEvent{Kind: FightTurnMiddle, Fighters: []Fighter{
+				{Id: 1234, LifePoints: 250, MaxLifePoints: 320, ActionPoints: 6, MovementPoints: 3, CellId: 281},
+				{Id: -1, Dead: true},
+				{Id: -2, LifePoints: 48, MaxLifePoints: 60, ActionPoints: 7, MovementPoints: 4, CellId: 310},
+			}},
+			wantOk: true,
+		},
+		{pkt: "GTM|1234;0;250", wantErr: true},
+		{
+			pkt:    "GTL|1234|-1|-2",
+			want:   FightEvent{Kind: FightTurnList, Fighters: []Fighter{{Id: 1234}, {Id: -1}, {Id: -2}}},
+			wantOk: true,
+		},
+		{
+			pkt: "Gt1234|+1234;Bob;42|-5678;Alice;12",
+			want: FightEvent{Kind: FightTeam, TeamId: 1234, Fighters: []Fighter{
+				{Id: 1234, Name: "Bob", Level: 42},
+				{Id: 5678, Name: "Alice", Level: 12, Removed: true},
+			}},
+			wantOk: true,
+		},
+		{pkt: "Gt1234|1234;Bob;42", wantErr: true},
+		{pkt: "GAS1234", want: FightEvent{Kind: FightActionsStart, FighterId: 1234}, wantOk: true},
+		{pkt: "GAF2|1234", want: FightEvent{Kind: FightActionsFinish, FighterId: 1234, ActionType: 2}, wantOk: true},
+		{
+			pkt:    "GA0;300;1234;161,310,2208,4,79,0,1",
+			want:   FightEvent{Kind: FightAction, ActionType: 300, FighterId: 1234, ActionParams: "161,310,2208,4,79,0,1"},
+			wantOk: true,
+		},
+		{
+			pkt:    "GA42;100;1234;-2,-12",
+			want:   FightEvent{Kind: FightAction, ActionId: 42, ActionType: 100, FighterId: 1234, ActionParams: "-2,-12"},
+			wantOk: true,
+		},
+		{pkt: "GA;0", want: FightEvent{Kind: FightAction}, wantOk: true},
+		{pkt: "GA;x;1234;", wantErr: true},
+		{pkt: "GTSx", wantErr: true},
+		{pkt: "cMK|123|Bob|hello|"},
+	}
+	for _, tt := range tests {
+		got, ok, err := DecodeFightEvent(retroproxy.DirectionServer, tt.pkt)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("DecodeFightEvent(%q) error = %v, want error %t", tt.pkt, err, tt.wantErr)
+			continue
+		}
+		if ok != tt.wantOk {
+			t.Errorf("DecodeFightEvent(%q) ok = %t, want %t", tt.pkt, ok, tt.wantOk)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("DecodeFightEvent(%q) = %+v, want %+v", tt.pkt, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeFightEventFromClient(t *testing.T) {
+	_, ok, err := DecodeFightEvent(retroproxy.DirectionClient, "GTR")
+	if ok || err != nil {
+		t.Errorf("decoded a packet of the client: ok = %t, err = %v", ok, err)
+	}
+}
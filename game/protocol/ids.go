@@ -0,0 +1,515 @@
+// Code generated by genids; DO NOT EDIT.
+
+package protocol
+
+// Ids of the messages sent by the client.
+const (
+	ClientAksPing                              ID = "ping"
+	ClientAksQuickPing                         ID = "qping"
+	ClientAksRPong                             ID = "rpong"
+	ClientBasicsAuthorizedCommand              ID = "BA"
+	ClientBasicsAuthorizedMoveCommand          ID = "BaM"
+	ClientBasicsAuthorizedKickCommand          ID = "BaK"
+	ClientBasicsWhoIs                          ID = "BW"
+	ClientBasicsKick                           ID = "BQ"
+	ClientBasicsAway                           ID = "BYA"
+	ClientBasicsInvisible                      ID = "BYI"
+	ClientBasicsGetDate                        ID = "BD"
+	ClientBasicsFileCheckAnswer                ID = "BC"
+	ClientBasicsSanctionMe                     ID = "BK"
+	ClientBasicsRequestAveragePing             ID = "Bp"
+	ClientAccountVersion                       ID = "version"
+	ClientAccountCredential                    ID = "credential"
+	ClientAccountSetNickname                   ID = "nickname"
+	ClientAccountGetCharacters                 ID = "AL"
+	ClientAccountGetCharactersForced           ID = "ALf"
+	ClientAccountGetServersList                ID = "Ax"
+	ClientAccountSetServer                     ID = "AX"
+	ClientAccountSearchForFriend               ID = "AF"
+	ClientAccountSetCharacter                  ID = "AS"
+	ClientAccountAddCharacter                  ID = "AA"
+	ClientAccountDeleteCharacter               ID = "AD"
+	ClientAccountResetCharacter                ID = "AR"
+	ClientAccountBoost                         ID = "AB"
+	ClientAccountSendTicket                    ID = "AT"
+	ClientAccountRequestRescue                 ID = "Ar"
+	ClientAccountGetGifts                      ID = "Ag"
+	ClientAccountAttributeGiftToCharacter      ID = "AG"
+	ClientAccountQueuePosition                 ID = "Af"
+	ClientAccountGetRandomCharacterName        ID = "AP"
+	ClientAccountUseKey                        ID = "Ak"
+	ClientAccountRequestRegionalVersion        ID = "AV"
+	ClientAccountSendIdentity                  ID = "Ai"
+	ClientAccountValidCharacterMigration       ID = "AM"
+	ClientAccountDeleteCharacterMigration      ID = "AM-"
+	ClientAccountAskCharacterMigration         ID = "AM?"
+	ClientAccountConfiguredPort                ID = "Ap"
+	ClientGameCreate                           ID = "GC"
+	ClientGameRequestLeave                     ID = "GQ"
+	ClientGameSetPlayerPosition                ID = "Gp"
+	ClientGameRequestReady                     ID = "GR"
+	ClientGameGetMapData                       ID = "GD"
+	ClientGameGetExtraInformations             ID = "GI"
+	ClientGameTurnEnd                          ID = "Gt"
+	ClientGameTurnOk                           ID = "GT"
+	ClientGameAskDisablePVPMode                ID = "GP*"
+	ClientGameEnabledPVPMode                   ID = "GP"
+	ClientGameFreeMySoul                       ID = "GF"
+	ClientGameSetFlag                          ID = "Gf"
+	ClientGameShowFightChallengeTarget         ID = "Gdi"
+	ClientGameActionsSendActions               ID = "GA"
+	ClientGameActionAck                        ID = "GKK"
+	ClientGameActionCancel                     ID = "GKE"
+	ClientChatSend                             ID = "BM"
+	ClientChatReportMessage                    ID = "BR"
+	ClientChatRequestSubscribeChannelAdd       ID = "cC+"
+	ClientChatRequestSubscribeChannelRemove    ID = "cC-"
+	ClientChatUseSmiley                        ID = "BS"
+	ClientDialogBeginning                      ID = "DB"
+	ClientDialogCreate                         ID = "DC"
+	ClientDialogRequestLeave                   ID = "DV"
+	ClientDialogResponse                       ID = "DR"
+	ClientInfosGetMaps                         ID = "IM"
+	ClientInfosSendScreenInfo                  ID = "Ir"
+	ClientSpellsMoveToUsed                     ID = "SM"
+	ClientSpellsBoost                          ID = "SB"
+	ClientSpellsForget                         ID = "SF"
+	ClientItemsRequestMovement                 ID = "OM"
+	ClientItemsDrop                            ID = "OD"
+	ClientItemsDestroy                         ID = "Od"
+	ClientItemsUseConfirm                      ID = "Ou"
+	ClientItemsUseNoConfirm                    ID = "OU"
+	ClientItemsDissociate                      ID = "Ox"
+	ClientItemsSetSkin                         ID = "Os"
+	ClientItemsFeed                            ID = "Of"
+	ClientFriendsGetFriendsList                ID = "FL"
+	ClientFriendsAddFriend                     ID = "FA"
+	ClientFriendsRemoveFriend                  ID = "FD"
+	ClientFriendsJoin                          ID = "FJ"
+	ClientFriendsJoinFriend                    ID = "FJF"
+	ClientFriendsCompass                       ID = "FJC"
+	ClientFriendsSetNotifyWhenConnect          ID = "FO"
+	ClientEnemiesGetEnemiesList                ID = "iL"
+	ClientEnemiesAddEnemy                      ID = "iA"
+	ClientEnemiesRemoveEnemy                   ID = "iD"
+	ClientKeyRequestLeave                      ID = "KV"
+	ClientKeySendKey                           ID = "KK"
+	ClientJobChangeJobStats                    ID = "JO"
+	ClientExchangeLeave                        ID = "EV"
+	ClientExchangeRequest                      ID = "ER"
+	ClientExchangeShop                         ID = "Es"
+	ClientExchangeAccept                       ID = "EA"
+	ClientExchangeRequestReady                 ID = "EK"
+	ClientExchangeMovementItems                ID = "EMO"
+	ClientExchangeMovementPay                  ID = "EP"
+	ClientExchangeMovementKamas                ID = "EMG"
+	ClientExchangeMovementSell                 ID = "ES"
+	ClientExchangeMovementBuy                  ID = "EB"
+	ClientExchangeOfflineExchange              ID = "EQ"
+	ClientExchangeRequestAskOfflineExchange    ID = "Eq"
+	ClientExchangeBigStoreType                 ID = "EHT"
+	ClientExchangeBigStoreItemList             ID = "EHl"
+	ClientExchangeBigStoreBuy                  ID = "EHB"
+	ClientExchangeBigStoreSearch               ID = "EHS"
+	ClientExchangeSetPublicMode                ID = "EW"
+	ClientExchangeGetCrafterForJob             ID = "EJF"
+	ClientExchangePutInShedFromInventory       ID = "Erp"
+	ClientExchangePutInInventoryFromShed       ID = "Erg"
+	ClientExchangePutInCertificateFromShed     ID = "Erc"
+	ClientExchangePutInShedFromCertificate     ID = "ErC"
+	ClientExchangePutInMountParkFromShed       ID = "Efp"
+	ClientExchangePutInShedFromMountPark       ID = "Efg"
+	ClientExchangeKillMountInPark              ID = "Eff"
+	ClientExchangeKillMount                    ID = "Erf"
+	ClientExchangeGetItemMiddlePriceInBigStore ID = "EHP"
+	ClientExchangeReplayCraft                  ID = "EL"
+	ClientExchangeRepeatCraft                  ID = "EMR"
+	ClientExchangeStopRepeatCraft              ID = "EMr"
+	ClientHousesKick                           ID = "hQ"
+	ClientHousesRequestLeave                   ID = "hV"
+	ClientHousesSell                           ID = "hS"
+	ClientHousesBuy                            ID = "hB"
+	ClientHousesState                          ID = "hG"
+	ClientHousesShare                          ID = "hG+"
+	ClientHousesUnShare                        ID = "hG-"
+	ClientEmotesUseEmote                       ID = "eU"
+	ClientEmotesSetDirection                   ID = "eD"
+	ClientDocumentsRequestLeave                ID = "dV"
+	ClientGuildCreate                          ID = "gC"
+	ClientGuildRequestLeave                    ID = "gV"
+	ClientGuildLeaveTaxInterface               ID = "gITV"
+	ClientGuildInvite                          ID = "gJR"
+	ClientGuildAcceptInvitation                ID = "gJK"
+	ClientGuildRefuseInvitation                ID = "gJE"
+	ClientGuildGetInfosGeneral                 ID = "gIG"
+	ClientGuildGetInfosMembers                 ID = "gIM"
+	ClientGuildGetInfosBoosts                  ID = "gIB"
+	ClientGuildGetInfosTaxCollector            ID = "gIT"
+	ClientGuildGetInfosMountPark               ID = "gIF"
+	ClientGuildGetInfosGuildHouses             ID = "gIH"
+	ClientGuildBan                             ID = "gK"
+	ClientGuildChangeMemberProfile             ID = "gP"
+	ClientGuildBoostCharacteristic             ID = "gB"
+	ClientGuildBoostSpell                      ID = "gb"
+	ClientGuildHireTaxCollector                ID = "gH"
+	ClientGuildJoinTaxCollector                ID = "gTJ"
+	ClientGuildLeaveTaxCollector               ID = "gTV"
+	ClientGuildRemoveTaxCollector              ID = "gF"
+	ClientGuildTeleportToGuildHouse            ID = "gh"
+	ClientGuildTeleportToGuildFarm             ID = "gf"
+	ClientWaypointsRequestLeave                ID = "WV"
+	ClientWaypointsUse                         ID = "WU"
+	ClientSubwayRequestLeave                   ID = "Wv"
+	ClientSubwayUse                            ID = "Wu"
+	ClientSubwayRequestPrismLeave              ID = "Ww"
+	ClientSubwayPrismUse                       ID = "Wp"
+	ClientConquestGetAlignedBonus              ID = "CB"
+	ClientConquestPrismInfosJoin               ID = "CIJ"
+	ClientConquestPrismInfosLeave              ID = "CIV"
+	ClientConquestPrismFightJoin               ID = "CFJ"
+	ClientConquestPrismFightLeave              ID = "CFV"
+	ClientConquestWorldInfosJoin               ID = "CWJ"
+	ClientConquestWorldInfosLave               ID = "CWV"
+	ClientConquestSwitchPlaces                 ID = "CFS"
+	ClientConquestRequestBalance               ID = "Cb"
+	ClientFightsGetList                        ID = "fL"
+	ClientFightsGetDetails                     ID = "fD"
+	ClientFightsBlockSpectators                ID = "fS"
+	ClientFightsBlockJoinerExceptParty         ID = "fP"
+	ClientFightsBlockJoiner                    ID = "fN"
+	ClientFightsNeedHelp                       ID = "fH"
+	ClientTutorialEnd                          ID = "TV"
+	ClientQuestGetList                         ID = "QL"
+	ClientQuestGetStep                         ID = "QS"
+	ClientPartyInvite                          ID = "PI"
+	ClientPartyRefuseInvitation                ID = "PR"
+	ClientPartyAcceptInvitation                ID = "PA"
+	ClientPartyRequestLeave                    ID = "PV"
+	ClientPartyRequestFollow                   ID = "PF"
+	ClientPartyWhere                           ID = "PW"
+	ClientPartyFollowAll                       ID = "PG"
+	ClientMountRename                          ID = "Rn"
+	ClientMountFree                            ID = "Rf"
+	ClientMountSetXP                           ID = "Rx"
+	ClientMountRide                            ID = "Rr"
+	ClientMountRequestData                     ID = "Rd"
+	ClientMountParkMountData                   ID = "Rp"
+	ClientMountRemoveObjectInPark              ID = "Ro"
+	ClientMountMountParkSell                   ID = "Rs"
+	ClientMountRequestMountParkBuy             ID = "Rb"
+	ClientMountRequestLeave                    ID = "Rv"
+	ClientMountCastrate                        ID = "Rc"
+)
+
+// Ids of the messages sent by the server.
+const (
+	ServerAksHelloConnect                           ID = "HC"
+	ServerAksHelloGame                              ID = "HG"
+	ServerAksPong                                   ID = "p"
+	ServerAksQuickPong                              ID = "q"
+	ServerAksRPing                                  ID = "rping"
+	ServerAksServerMessage                          ID = "M"
+	ServerAksServerWillDisconnect                   ID = "k"
+	ServerBasicsNothing                             ID = "BN"
+	ServerBasicsAuthorizedCommandError              ID = "BAE"
+	ServerBasicsAuthorizedCommandSuccess            ID = "BAT"
+	ServerBasicsAuthorizedLine                      ID = "BAL"
+	ServerBasicsAuthorizedCommandPrompt             ID = "BAP"
+	ServerBasicsAuthorizedCommandClear              ID = "BAC"
+	ServerBasicsAuthorizedInterfaceOpen             ID = "BAIO"
+	ServerBasicsAuthorizedInterfaceClose            ID = "BAIC"
+	ServerBasicsTime                                ID = "BT"
+	ServerBasicsDate                                ID = "BD"
+	ServerBasicsWhoIsError                          ID = "BWE"
+	ServerBasicsWhoIsSuccess                        ID = "BWK"
+	ServerBasicsSubscriberRestrictionAdd            ID = "BP+"
+	ServerBasicsSubscriberRestrictionRemove         ID = "BP-"
+	ServerBasicsFileCheck                           ID = "BC"
+	ServerBasicsAveragePing                         ID = "Bp"
+	ServerAccountCommunity                          ID = "Ac"
+	ServerAccountPseudo                             ID = "Ad"
+	ServerAccountLoginSuccess                       ID = "AlK"
+	ServerAccountLoginError                         ID = "AlE"
+	ServerAccountCharactersListError                ID = "ALE"
+	ServerAccountCharactersListSuccess              ID = "ALK"
+	ServerAccountServersListError                   ID = "AxE"
+	ServerAccountServersListSuccess                 ID = "AxK"
+	ServerAccountCharacterAddError                  ID = "AAE"
+	ServerAccountCharacterAddSuccess                ID = "AAK"
+	ServerAccountTicketResponseError                ID = "ATE"
+	ServerAccountTicketResponseSuccess              ID = "ATK"
+	ServerAccountSelectServerError                  ID = "AXE"
+	ServerAccountSelectServerSuccess                ID = "AXK"
+	ServerAccountSelectServerPlainSuccess           ID = "AYK"
+	ServerAccountCharacterSelectedError             ID = "ASE"
+	ServerAccountCharacterSelectedSuccess           ID = "ASK"
+	ServerAccountStats                              ID = "As"
+	ServerAccountNewLevel                           ID = "AN"
+	ServerAccountRestrictions                       ID = "AR"
+	ServerAccountHosts                              ID = "AH"
+	ServerAccountRescue                             ID = "Ar"
+	ServerAccountGiftsList                          ID = "Ag"
+	ServerAccountGiftStoredError                    ID = "AGE"
+	ServerAccountGiftStoredSuccess                  ID = "AGK"
+	ServerAccountQueue                              ID = "Aq"
+	ServerAccountNewQueue                           ID = "Af"
+	ServerAccountRegionalVersion                    ID = "AV"
+	ServerAccountCharacterNameGeneratedError        ID = "APE"
+	ServerAccountCharacterNameGeneratedSuccess      ID = "APK"
+	ServerAccountKey                                ID = "AK"
+	ServerAccountSecretQuestion                     ID = "AQ"
+	ServerAccountCharacterDeleteError               ID = "ADE"
+	ServerAccountCharacterDeleteSuccess             ID = "ADK"
+	ServerAccountCharacterMigrationAskConfirm       ID = "AM?"
+	ServerAccountCharacterMigrationError            ID = "AME"
+	ServerAccountCharacterMigrationSuccess          ID = "AMK"
+	ServerAccountFriendServerList                   ID = "AF"
+	ServerAccountMiniClipInfo                       ID = "Am"
+	ServerGameCreateError                           ID = "GCE"
+	ServerGameCreateSuccess                         ID = "GCK"
+	ServerGameJoin                                  ID = "GJ"
+	ServerGamePositionStart                         ID = "GP"
+	ServerGameReady                                 ID = "GR"
+	ServerGameStartToPlay                           ID = "GS"
+	ServerGameEnd                                   ID = "GE"
+	ServerGameMovementRemove                        ID = "GM|-"
+	ServerGameMovement                              ID = "GM"
+	ServerGameChallenge                             ID = "Gc"
+	ServerGameTeam                                  ID = "Gt"
+	ServerGameLeave                                 ID = "GV"
+	ServerGameFlag                                  ID = "Gf"
+	ServerGamePlayersCoordinates                    ID = "GIC"
+	ServerGameEffect                                ID = "GIE"
+	ServerGameClearAllEffect                        ID = "GIe"
+	ServerGamePVP                                   ID = "GIP"
+	ServerGameMapData                               ID = "GDM"
+	ServerGameMapLoaded                             ID = "GDK"
+	ServerGameCellData                              ID = "GDC"
+	ServerGameZoneData                              ID = "GDZ"
+	ServerGameCellObject                            ID = "GDO"
+	ServerGameFrameObject2                          ID = "GDF"
+	ServerGameFrameObjectExternal                   ID = "GDE"
+	ServerGameFightChallenge                        ID = "Gd"
+	ServerGameFightChallengeUpdateError             ID = "GdO"
+	ServerGameFightChallengeUpdateSuccess           ID = "GdK"
+	ServerGameTurnStart                             ID = "GTS"
+	ServerGameTurnFinish                            ID = "GTF"
+	ServerGameTurnList                              ID = "GTL"
+	ServerGameTurnMiddle                            ID = "GTM"
+	ServerGameTurnReady                             ID = "GTR"
+	ServerGameExtraClip                             ID = "GX"
+	ServerGameFightOption                           ID = "Go"
+	ServerGameGameOver                              ID = "GO"
+	ServerGameActions                               ID = "GA"
+	ServerGameActionsStart                          ID = "GAS"
+	ServerGameActionsFinish                         ID = "GAF"
+	ServerChatMessageError                          ID = "cME"
+	ServerChatMessageSuccess                        ID = "cMK"
+	ServerChatServerMessage                         ID = "cs"
+	ServerChatSmiley                                ID = "cS"
+	ServerChatSubscribeChannelAdd                   ID = "cC+"
+	ServerChatSubscribeChannelRemove                ID = "cC-"
+	ServerDialogCustomAction                        ID = "DA"
+	ServerDialogCreateError                         ID = "DCE"
+	ServerDialogCreateSuccess                       ID = "DCK"
+	ServerDialogQuestion                            ID = "DQ"
+	ServerDialogLeave                               ID = "DV"
+	ServerDialogPause                               ID = "DP"
+	ServerInfosInfoMaps                             ID = "IM"
+	ServerInfosCompass                              ID = "IC"
+	ServerInfosInfoCoordinatesPHighlight            ID = "IH"
+	ServerInfosMessage                              ID = "Im"
+	ServerInfosQuantity                             ID = "IQ"
+	ServerInfosLifeRestoreTimerStart                ID = "ILS"
+	ServerInfosLifeRestoreTimerFinish               ID = "ILF"
+	ServerSpellsList                                ID = "SL"
+	ServerSpellsChangeOption                        ID = "SLo"
+	ServerSpellsUpgradeSpellError                   ID = "SUE"
+	ServerSpellsUpgradeSpellSuccess                 ID = "SUK"
+	ServerSpellsSpellBoost                          ID = "SB"
+	ServerSpellsSpellForgetShow                     ID = "SF+"
+	ServerSpellsSpellForgetClose                    ID = "SF-"
+	ServerItemsAccessories                          ID = "Oa"
+	ServerItemsDropError                            ID = "ODE"
+	ServerItemsDropSuccess                          ID = "ODK"
+	ServerItemsAddError                             ID = "OAE"
+	ServerItemsAddSuccess                           ID = "OAK"
+	ServerItemsChange                               ID = "OC"
+	ServerItemsRemove                               ID = "OR"
+	ServerItemsQuantity                             ID = "OQ"
+	ServerItemsMovement                             ID = "OM"
+	ServerItemsTool                                 ID = "OT"
+	ServerItemsWeight                               ID = "Ow"
+	ServerItemsItemSetAdd                           ID = "OS+"
+	ServerItemsItemSetRemove                        ID = "OS-"
+	ServerItemsItemUseCondition                     ID = "OK"
+	ServerItemsItemFound                            ID = "OF"
+	ServerFriendsAddFriendError                     ID = "FAE"
+	ServerFriendsAddFriendSuccess                   ID = "FAK"
+	ServerFriendsRemoveFriendError                  ID = "FDE"
+	ServerFriendsRemoveFriendSuccess                ID = "FDK"
+	ServerFriendsFriendsList                        ID = "FL"
+	ServerFriendsSpouse                             ID = "FS"
+	ServerFriendsNotifyChange                       ID = "FO"
+	ServerEnemiesAddEnemyError                      ID = "iAE"
+	ServerEnemiesAddEnemySuccess                    ID = "iAK"
+	ServerEnemiesRemoveEnemyError                   ID = "iDE"
+	ServerEnemiesRemoveEnemySuccess                 ID = "iDK"
+	ServerEnemiesEnemiesList                        ID = "iL"
+	ServerKeyCreate                                 ID = "KC"
+	ServerKeyKeyError                               ID = "KKE"
+	ServerKeyKeySuccess                             ID = "KKK"
+	ServerKeyLeave                                  ID = "KL"
+	ServerJobSkills                                 ID = "JS"
+	ServerJobXP                                     ID = "JX"
+	ServerJobLevel                                  ID = "JN"
+	ServerJobRemove                                 ID = "JR"
+	ServerJobOptions                                ID = "JO"
+	ServerExchangeRequestError                      ID = "ERE"
+	ServerExchangeRequestSuccess                    ID = "ERK"
+	ServerExchangeReady                             ID = "EK"
+	ServerExchangeLeaveError                        ID = "EVE"
+	ServerExchangeLeaveSuccess                      ID = "EVK"
+	ServerExchangeCreateError                       ID = "ECE"
+	ServerExchangeCreateSuccess                     ID = "ECK"
+	ServerExchangeCraftError                        ID = "EcE"
+	ServerExchangeCraftSuccess                      ID = "EcK"
+	ServerExchangeLocalMovementError                ID = "EME"
+	ServerExchangeLocalMovementSuccess              ID = "EMK"
+	ServerExchangeLocalDistantError                 ID = "EmE"
+	ServerExchangeLocalDistantSuccess               ID = "EmK"
+	ServerExchangeCoopMovementError                 ID = "ErE"
+	ServerExchangeCoopMovementSuccess               ID = "ErK"
+	ServerExchangePayMovementError                  ID = "EpE"
+	ServerExchangePayMovementSuccess                ID = "EpK"
+	ServerExchangeStorageMovementError              ID = "EsE"
+	ServerExchangeStorageMovementSuccess            ID = "EsK"
+	ServerExchangePlayerShopMovementError           ID = "EiE"
+	ServerExchangePlayerShopMovementSuccess         ID = "EiK"
+	ServerExchangeCraftPublicMode                   ID = "EW"
+	ServerExchangeMountStorageAdd                   ID = "Ee"
+	ServerExchangeMountStorageRemove                ID = "Ee-"
+	ServerExchangeMountPark                         ID = "Ef"
+	ServerExchangeMountPods                         ID = "Ew"
+	ServerExchangeList                              ID = "EL"
+	ServerExchangeSellError                         ID = "ESE"
+	ServerExchangeSellSuccess                       ID = "ESK"
+	ServerExchangeBuyError                          ID = "EBE"
+	ServerExchangeBuySuccess                        ID = "EBK"
+	ServerExchangeAskOfflineExchange                ID = "Eq"
+	ServerExchangeSearchError                       ID = "EHSE"
+	ServerExchangeSearchSuccess                     ID = "EHSK"
+	ServerExchangeBigStoreTypeItemsList             ID = "EHL"
+	ServerExchangeBigStoreTypeItemsMovementAdd      ID = "EHM+"
+	ServerExchangeBigStoreTypeItemsMovementRemove   ID = "EHM-"
+	ServerExchangeBigStoreItemsList                 ID = "EHl"
+	ServerExchangeBigStoreItemsMovementAdd          ID = "EHm+"
+	ServerExchangeBigStoreItemsMovementRemove       ID = "EHm-"
+	ServerExchangeBigStoreItemMiddlePriceInBigStore ID = "EHP"
+	ServerExchangeCrafterReferenceAdd               ID = "EHj+"
+	ServerExchangeCrafterReferenceRemove            ID = "EHj-"
+	ServerExchangeCraftLoop                         ID = "EA"
+	ServerExchangeCraftLoopEnd                      ID = "Ea"
+	ServerHousesListAdd                             ID = "hL+"
+	ServerHousesListRemove                          ID = "hL-"
+	ServerHousesProperties                          ID = "hP"
+	ServerHousesLockedProperty                      ID = "hX"
+	ServerHousesCreate                              ID = "hC"
+	ServerHousesSellError                           ID = "hSE"
+	ServerHousesSellSuccess                         ID = "hSK"
+	ServerHousesBuyError                            ID = "hBE"
+	ServerHousesBuySuccess                          ID = "hBK"
+	ServerHousesLeave                               ID = "hV"
+	ServerHousesGuildInfos                          ID = "hG"
+	ServerStoragesListAdd                           ID = "sL+"
+	ServerStoragesListRemove                        ID = "sL-"
+	ServerStoragesLockedProperty                    ID = "sX"
+	ServerEmotesUseError                            ID = "eUE"
+	ServerEmotesUseSuccess                          ID = "eUK"
+	ServerEmotesList                                ID = "eL"
+	ServerEmotesAdd                                 ID = "eA"
+	ServerEmotesRemove                              ID = "eR"
+	ServerEmotesDirection                           ID = "eD"
+	ServerDocumentsCreateError                      ID = "dCE"
+	ServerDocumentsCreateSuccess                    ID = "dCK"
+	ServerDocumentsLeave                            ID = "dV"
+	ServerGuildNew                                  ID = "gn"
+	ServerGuildCreateError                          ID = "gCE"
+	ServerGuildCreateSuccess                        ID = "gCK"
+	ServerGuildStats                                ID = "gS"
+	ServerGuildInfosGeneral                         ID = "gIG"
+	ServerGuildInfosMembers                         ID = "gIM"
+	ServerGuildInfosBoosts                          ID = "gIB"
+	ServerGuildInfosMountPark                       ID = "gIF"
+	ServerGuildInfosTaxCollectorsMovement           ID = "gITM"
+	ServerGuildInfosTaxCollectorsPlayers            ID = "gITP"
+	ServerGuildInfosTaxCollectorsAttackers          ID = "gITp"
+	ServerGuildInfosHouses                          ID = "gIH"
+	ServerGuildJoinError                            ID = "gJE"
+	ServerGuildJoinSuccess                          ID = "gJK"
+	ServerGuildJoinDistantSuccess                   ID = "gJC"
+	ServerGuildRequestLocal                         ID = "gJR"
+	ServerGuildRequestDistant                       ID = "gJr"
+	ServerGuildLeave                                ID = "gV"
+	ServerGildBanError                              ID = "gKE"
+	ServerGildBanSuccess                            ID = "gKK"
+	ServerGildHireTaxCollectorError                 ID = "gHE"
+	ServerGildHireTaxCollectorSuccess               ID = "gHK"
+	ServerGildTaxCollectorAttacked                  ID = "gA"
+	ServerGildTaxCollectorInfo                      ID = "gT"
+	ServerGildUserInterfaceOpen                     ID = "gU"
+	ServerWaypointsCreate                           ID = "WC"
+	ServerWaypointsLeave                            ID = "WV"
+	ServerWaypointsUseError                         ID = "WU"
+	ServerSubwayCreate                              ID = "Wc"
+	ServerSubwayLeave                               ID = "Wv"
+	ServerSubwayUseError                            ID = "Wu"
+	ServerSubwayPrismCreate                         ID = "Wp"
+	ServerSubwayPrismLeave                          ID = "Ww"
+	ServerSubareasList                              ID = "al"
+	ServerSubareasAlignmentModification             ID = "am"
+	ServerConquestAreaAlignmentChanged              ID = "aM"
+	ServerConquestPrismInfosJoined                  ID = "CIJ"
+	ServerConquestPrismInfosClosing                 ID = "CIV"
+	ServerConquestConquestBonus                     ID = "CB"
+	ServerConquestPrismAttacked                     ID = "CA"
+	ServerConquestPrismSurvived                     ID = "CS"
+	ServerConquestPrismDead                         ID = "CD"
+	ServerConquestPrismFightAddPlayerAdd            ID = "CP+"
+	ServerConquestPrismFightAddPlayerRemove         ID = "CP-"
+	ServerConquestPrismFightAddEnemyAdd             ID = "Cp+"
+	ServerConquestPrismFightAddEnemyRemove          ID = "Cp-"
+	ServerConquestWorldData                         ID = "CW"
+	ServerConquestConquestBalance                   ID = "Cb"
+	ServerSpecializationSet                         ID = "ZS"
+	ServerSpecializationChange                      ID = "ZC"
+	ServerFightsCount                               ID = "fC"
+	ServerFightsList                                ID = "fL"
+	ServerFightsDetails                             ID = "fD"
+	ServerTutorialCreate                            ID = "TC"
+	ServerTutorialShowTip                           ID = "TT"
+	ServerTutorialGameBegin                         ID = "TB"
+	ServerQuestsList                                ID = "QL"
+	ServerQuestsStep                                ID = "QS"
+	ServerPartyInviteError                          ID = "PIE"
+	ServerPartyInviteSuccess                        ID = "PIK"
+	ServerPartyLeader                               ID = "PL"
+	ServerPartyRefuse                               ID = "PR"
+	ServerPartyAccept                               ID = "PA"
+	ServerPartyCreateError                          ID = "PCE"
+	ServerPartyCreateSuccess                        ID = "PCS"
+	ServerPartyLeave                                ID = "PV"
+	ServerPartyFollowError                          ID = "PFE"
+	ServerPartyFollowSuccess                        ID = "PFK"
+	ServerPartyMovement                             ID = "PM"
+	ServerMountEquipError                           ID = "ReE"
+	ServerMountEquipSuccess                         ID = "Re+"
+	ServerMountUnequip                              ID = "Re-"
+	ServerMountXP                                   ID = "Rx"
+	ServerMountName                                 ID = "Rn"
+	ServerMountData                                 ID = "Rd"
+	ServerMountMountPark                            ID = "Rp"
+	ServerMountMountParkBuy                         ID = "RD"
+	ServerMountLeave                                ID = "Rv"
+	ServerMountRidingState                          ID = "Rr"
+)
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kralamoure/retroproto"
+)
+
+// TestIDsUnique checks the constants of ids.go, which genids only checks when it's run: the ids of each side must be
+// unique, and match the messages known by retroproto.
+func TestIDsUnique(t *testing.T) {
+	f, err := parser.ParseFile(token.NewFileSet(), "ids.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]map[string]string{"Client": {}, "Server": {}}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			name := vs.Names[0].Name
+			lit, ok := vs.Values[0].(*ast.BasicLit)
+			if !ok {
+				t.Fatalf("%s is not a literal", name)
+			}
+			id, err := strconv.Unquote(lit.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			side := "Client"
+			if strings.HasPrefix(name, "Server") {
+				side = "Server"
+			} else if !strings.HasPrefix(name, "Client") {
+				t.Fatalf("%s has no side prefix", name)
+			}
+			if other, ok := ids[side][id]; ok {
+				t.Errorf("%s and %s have the same id %q", other, name, id)
+			}
+			ids[side][id] = name
+		}
+	}
+
+	if got, want := len(ids["Client"]), len(retroproto.MsgCliIds); got != want {
+		t.Errorf("%d client ids, want %d: run go generate", got, want)
+	}
+	if got, want := len(ids["Server"]), len(retroproto.MsgSvrIds); got != want {
+		t.Errorf("%d server ids, want %d: run go generate", got, want)
+	}
+	for _, id := range retroproto.MsgCliIds {
+		if _, ok := ids["Client"][string(id)]; !ok {
+			t.Errorf("no constant for client id %q: run go generate", id)
+		}
+	}
+	for _, id := range retroproto.MsgSvrIds {
+		if _, ok := ids["Server"][string(id)]; !ok {
+			t.Errorf("no constant for server id %q: run go generate", id)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Command genids generates the message id constants of the protocol package from the ids known by retroproto.
+//
+// It fails if two messages of a side have the same id, or two messages the same name, so that the constants and the
+// lookups by id are unambiguous.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/kralamoure/retroproto"
+)
+
+// message is a message id and its name.
+type message struct {
+	id   string
+	name string
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("genids: ")
+
+	var client, server []message
+	for _, id := range retroproto.MsgCliIds {
+		name, _ := retroproto.MsgCliNameByID(id)
+		client = append(client, message{id: string(id), name: name})
+	}
+	for _, id := range retroproto.MsgSvrIds {
+		name, _ := retroproto.MsgSvrNameByID(id)
+		server = append(server, message{id: string(id), name: name})
+	}
+
+	names := make(map[string]struct{})
+	for side, msgs := range map[string][]message{"client": client, "server": server} {
+		ids := make(map[string]string)
+		for _, m := range msgs {
+			if other, ok := ids[m.id]; ok {
+				log.Fatalf("%s messages %s and %s have the same id %q", side, other, m.name, m.id)
+			}
+			ids[m.id] = m.name
+			if _, ok := names[m.name]; ok {
+				log.Fatalf("two messages are named %s", m.name)
+			}
+			names[m.name] = struct{}{}
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by genids; DO NOT EDIT.\n\npackage protocol\n")
+	writeConsts(&buf, "Client", "client", client)
+	writeConsts(&buf, "Server", "server", server)
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile("ids.go", src, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeConsts writes the constants of the messages sent by the side, whose names start with prefix.
+func writeConsts(buf *bytes.Buffer, prefix, side string, msgs []message) {
+	fmt.Fprintf(buf, "\n// Ids of the messages sent by the %s.\nconst (\n", side)
+	for _, m := range msgs {
+		fmt.Fprintf(buf, "\t%s%s ID = %s\n", prefix, m.name, strconv.Quote(m.id))
+	}
+	buf.WriteString(")\n")
+}
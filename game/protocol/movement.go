@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/kralamoure/retroproto"
+	"github.com/kralamoure/retroproto/enum"
+	"github.com/kralamoure/retroproto/msgcli"
+	"github.com/kralamoure/retroproto/typ"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// PathStep is a cell of a movement path and the direction the actor faces when reaching it.
+type PathStep struct {
+	Direction int
+	CellId    int
+}
+
+// DecodePath decodes a compressed movement path, where each step is a direction and a cell id encoded with three
+// characters of the Dofus base 64 alphabet. Only the cells where the actor changes direction are part of the path.
+func DecodePath(path string) ([]PathStep, error) {
+	if path == "" || len(path)%3 != 0 {
+		return nil, errors.New("invalid path length")
+	}
+
+	steps := make([]PathStep, 0, len(path)/3)
+	for i := 0; i < len(path); i += 3 {
+		dirAndCell := &typ.CommonDirAndCell{}
+		err := dirAndCell.Deserialize(path[i : i+3])
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, PathStep{
+			Direction: dirAndCell.DirId,
+			CellId:    dirAndCell.CellId,
+		})
+	}
+	return steps, nil
+}
+
+// Movement is the movement of an actor, either requested by the client (GameActionsSendActions), notified by the server
+// (GameActions) or, for actors added to the map (GameMovement), their position as a single step path.
+type Movement struct {
+	Direction retroproxy.Direction
+	// ActorId is the sprite id of the actor, only known for packets sent by the server.
+	ActorId int
+	Path    []PathStep
+}
+
+// Cells returns the cell ids of the path of the movement.
+func (m Movement) Cells() []int {
+	cells := make([]int, len(m.Path))
+	for i, step := range m.Path {
+		cells[i] = step.CellId
+	}
+	return cells
+}
+
+// DecodeMovements decodes pkt if it is a movement packet, where dir is the side the packet comes from.
+func DecodeMovements(dir retroproxy.Direction, pkt string) (moves []Movement, ok bool, err error) {
+	id, payload := MessageID(dir, pkt)
+	switch {
+	case dir == retroproxy.DirectionClient && id == ClientGameActionsSendActions:
+		m := &msgcli.GameActionsSendActions{}
+		err := m.Deserialize(payload)
+		if errors.Is(err, retroproto.ErrNotImplemented) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if m.ActionType != enum.GameActionType.Movement {
+			return nil, false, nil
+		}
+		move := Movement{Direction: dir}
+		for _, v := range m.ActionMovement.DirAndCells {
+			move.Path = append(move.Path, PathStep{Direction: v.DirId, CellId: v.CellId})
+		}
+		return []Movement{move}, true, nil
+	case dir == retroproxy.DirectionServer && id == ServerGameActions:
+		// retroproto doesn't deserialize GameActions, which is "<action id>;<action type>;<actor id>;<params>".
+		sli := strings.SplitN(payload, ";", 4)
+		if len(sli) != 4 || sli[1] != strconv.Itoa(enum.GameActionType.Movement) {
+			return nil, false, nil
+		}
+		actorId, err := strconv.Atoi(sli[2])
+		if err != nil {
+			return nil, false, err
+		}
+		path, err := DecodePath(sli[3])
+		if err != nil {
+			return nil, false, err
+		}
+		return []Movement{{Direction: dir, ActorId: actorId, Path: path}}, true, nil
+	case dir == retroproxy.DirectionServer && id == ServerGameMovement:
+		// Only the heads of the sprites ("+<cell id>;<direction>;<bonus>;<actor id>;...") are decoded, since
+		// msgsvr.GameMovement doesn't handle removed sprites.
+		for _, sprite := range strings.Split(strings.TrimPrefix(payload, "|"), "|") {
+			if len(sprite) < 2 || (sprite[0] != '+' && sprite[0] != '~') {
+				continue
+			}
+			sli := strings.SplitN(sprite[1:], ";", 5)
+			if len(sli) < 4 {
+				return nil, false, errors.New("invalid sprite")
+			}
+			cellId, err := strconv.Atoi(sli[0])
+			if err != nil {
+				return nil, false, err
+			}
+			direction, err := strconv.Atoi(sli[1])
+			if err != nil {
+				return nil, false, err
+			}
+			actorId, err := strconv.Atoi(sli[3])
+			if err != nil {
+				return nil, false, err
+			}
+			moves = append(moves, Movement{
+				Direction: dir,
+				ActorId:   actorId,
+				Path:      []PathStep{{Direction: direction, CellId: cellId}},
+			})
+		}
+		return moves, len(moves) > 0, nil
+	}
+	return nil, false, nil
+}
+
+// MovementHandler is a packet handler that calls itself with each movement relayed by the game proxy.
+// Movement packets that cannot be decoded are still forwarded.
+type MovementHandler func(move Movement)
+
+func (h MovementHandler) HandlePacket(dir retroproxy.Direction, pkt string) (string, bool, error) {
+	moves, ok, err := DecodeMovements(dir, pkt)
+	if err == nil && ok {
+		for _, move := range moves {
+			h(move)
+		}
+	}
+	return pkt, false, nil
+}
@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+func TestDecodePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []PathStep
+		wantErr bool
+	}{
+		{path: "aaN", want: []PathStep{{Direction: 0, CellId: 39}}},
+		{path: "hbc", want: []PathStep{{Direction: 7, CellId: 66}}},
+		{path: "aaNdfY", want: []PathStep{{Direction: 0, CellId: 39}, {Direction: 3, CellId: 370}}},
+		{path: "", wantErr: true},
+		{path: "aaNd", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := DecodePath(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("DecodePath(%q) error = %v, want error %t", tt.path, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("DecodePath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeMovements(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     retroproxy.Direction
+		pkt     string
+		want    []Movement
+		wantOk  bool
+		wantErr bool
+	}{
+		{
+			name:   "movement request",
+			dir:    retroproxy.DirectionClient,
+			pkt:    "GA001aaNdfY",
+			want:   []Movement{{Direction: retroproxy.DirectionClient, Path: []PathStep{{0, 39}, {3, 370}}}},
+			wantOk: true,
+		},
+		{
+			name:   "movement action",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "GA0;1;123;aaNdfY",
+			want:   []Movement{{Direction: retroproxy.DirectionServer, ActorId: 123, Path: []PathStep{{0, 39}, {3, 370}}}},
+			wantOk: true,
+		},
+		{
+			name:   "movement action without id",
+			dir:    retroproxy.DirectionServer,
+			pkt:    "GA;1;-1;hbc",
+			want:   []Movement{{Direction: retroproxy.DirectionServer, ActorId: -1, Path: []PathStep{{7, 66}}}},
+			wantOk: true,
+		},
+		{
+			name: "other action",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "GA;2;123;",
+		},
+		{
+			name:    "movement action with invalid actor",
+			dir:     retroproxy.DirectionServer,
+			pkt:     "GA;1;x;aaN",
+			wantErr: true,
+		},
+		{
+			name: "sprites",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "GM|+370;3;0;123;Bob;9;90^100;0;0,0,0,123;ffffff;-1;-1;0,0,0,0,0;;;;;;;|-45|~66;7;0;-1;Boss",
+			want: []Movement{
+				{Direction: retroproxy.DirectionServer, ActorId: 123, Path: []PathStep{{3, 370}}},
+				{Direction: retroproxy.DirectionServer, ActorId: -1, Path: []PathStep{{7, 66}}},
+			},
+			wantOk: true,
+		},
+		{
+			name: "removed sprite",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "GM|-45",
+		},
+		{
+			name:    "invalid sprite",
+			dir:     retroproxy.DirectionServer,
+			pkt:     "GM|+370;3",
+			wantErr: true,
+		},
+		{
+			name: "chat message",
+			dir:  retroproxy.DirectionServer,
+			pkt:  "cMK|123|Bob|hello|",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := DecodeMovements(tt.dir, tt.pkt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %t, want %t", ok, tt.wantOk)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMovementHandler(t *testing.T) {
+	var got []int
+	h := MovementHandler(func(move Movement) {
+		got = append(got, move.Cells()...)
+	})
+	for _, pkt := range []string{"GA0;1;123;aaNdfY", "GA0;1;123;!!!", "cMK|123|Bob|hello|"} {
+		out, drop, err := h.HandlePacket(retroproxy.DirectionServer, pkt)
+		if out != pkt || drop || err != nil {
+			t.Errorf("HandlePacket(%q) = %q, %t, %v, want the packet forwarded", pkt, out, drop, err)
+		}
+	}
+	if want := []int{39, 370}; !reflect.DeepEqual(got, want) {
+		t.Errorf("handler got cells %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+// Package protocol provides helpers for handlers to identify the messages relayed by the game proxy.
+package protocol
+
+import (
+	"strings"
+
+	"github.com/kralamoure/retroproto"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+//go:generate go run ./internal/genids
+
+// ID is the header of a Dofus message, such as "GDM" or "cMK". The ids of the messages known by retroproto, of both the
+// login and the game protocols, are the constants of ids.go, named after the side that sends them and the message,
+// such as ClientChatSend or ServerGameMapData.
+type ID string
+
+// Name returns the name of the message with id sent by the dir side, such as "GameMapData" for the "GDM" message of
+// the server, or an empty string if the message is unknown.
+func Name(dir retroproxy.Direction, id ID) string {
+	var name string
+	var ok bool
+	switch dir {
+	case retroproxy.DirectionServer:
+		name, ok = retroproto.MsgSvrNameByID(retroproto.MsgSvrId(id))
+	case retroproxy.DirectionClient:
+		name, ok = retroproto.MsgCliNameByID(retroproto.MsgCliId(id))
+	}
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+// MessageID returns the id of the message in pkt and its payload, where dir is the side the packet comes from.
+// If the message is unknown, or pkt is empty, id is empty and payload is pkt.
+func MessageID(dir retroproxy.Direction, pkt string) (id ID, payload string) {
+	var ok bool
+	switch dir {
+	case retroproxy.DirectionServer:
+		var svrId retroproto.MsgSvrId
+		svrId, ok = retroproto.MsgSvrIdByPkt(pkt)
+		id = ID(svrId)
+	case retroproxy.DirectionClient:
+		var cliId retroproto.MsgCliId
+		cliId, ok = retroproto.MsgCliIdByPkt(pkt)
+		id = ID(cliId)
+	}
+	if !ok {
+		return "", pkt
+	}
+	return id, strings.TrimPrefix(pkt, string(id))
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// RewriteRule replaces the occurrences of a pattern in the payload of the messages with an id, whichever side they
+// come from. The id itself is never rewritten.
+type RewriteRule struct {
+	Id          ID
+	Pattern     string
+	Replacement string
+	// re is the compiled pattern of a rule that matches a regular expression, in which case Replacement may refer to
+	// its submatches, such as $1.
+	re *regexp.Regexp
+}
+
+// ParseRewriteRule parses a rule of the form "id:pattern=>replacement", such as "cMK:hello=>goodbye". If regex is
+// true, the pattern is a regular expression.
+func ParseRewriteRule(s string, regex bool) (RewriteRule, error) {
+	id, rest, ok := strings.Cut(s, ":")
+	if !ok || id == "" {
+		return RewriteRule{}, fmt.Errorf("missing message id in rewrite rule %q", s)
+	}
+	pattern, replacement, ok := strings.Cut(rest, "=>")
+	if !ok {
+		return RewriteRule{}, fmt.Errorf("missing \"=>\" in rewrite rule %q", s)
+	}
+	if pattern == "" {
+		return RewriteRule{}, fmt.Errorf("empty pattern in rewrite rule %q", s)
+	}
+	// The packets are framed by these characters, so a replacement containing them would split the packet.
+	if strings.ContainsAny(replacement, "\x00\n") {
+		return RewriteRule{}, errors.New("replacement of rewrite rule contains a packet terminator")
+	}
+
+	r := RewriteRule{Id: ID(id), Pattern: pattern, Replacement: replacement}
+	if regex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return RewriteRule{}, fmt.Errorf("invalid pattern in rewrite rule %q: %w", s, err)
+		}
+		r.re = re
+	}
+	return r, nil
+}
+
+func (r RewriteRule) apply(payload string) string {
+	if r.re != nil {
+		return r.re.ReplaceAllString(payload, r.Replacement)
+	}
+	return strings.ReplaceAll(payload, r.Pattern, r.Replacement)
+}
+
+// Rewriter is a packet handler that applies its rules in order to the packets relayed by the game proxy.
+type Rewriter []RewriteRule
+
+func (rw Rewriter) HandlePacket(dir retroproxy.Direction, pkt string) (string, bool, error) {
+	id, payload := MessageID(dir, pkt)
+	if id == "" {
+		return pkt, false, nil
+	}
+	rewritten := false
+	for _, r := range rw {
+		if r.Id != id {
+			continue
+		}
+		payload = r.apply(payload)
+		rewritten = true
+	}
+	if !rewritten {
+		return pkt, false, nil
+	}
+	// Submatches of a pattern can't contain a terminator since the packet has none, so the rewritten packet is framed
+	// as a single one when it's sent.
+	return string(id) + payload, false, nil
+}
@@ -1,93 +1,440 @@
 package game
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/kralamoure/retroproto/msgsvr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/kralamoure/retroproxy"
 )
 
+// metricLabel is the value of the proxy label of the metrics.
+const metricLabel = "game"
+
+// The counters of the packets and bytes read from each side are looked up once, rather than for each packet.
+var (
+	clientPacketsMetric = retroproxy.MetricPackets.WithLabelValues(metricLabel, string(retroproxy.DirectionClient))
+	serverPacketsMetric = retroproxy.MetricPackets.WithLabelValues(metricLabel, string(retroproxy.DirectionServer))
+	clientBytesMetric   = retroproxy.MetricBytes.WithLabelValues(metricLabel, string(retroproxy.DirectionClient))
+	serverBytesMetric   = retroproxy.MetricBytes.WithLabelValues(metricLabel, string(retroproxy.DirectionServer))
+)
+
 type Proxy struct {
-	logger *zap.Logger
-	addr   *net.TCPAddr
-	storer retroproxy.Storer
+	logger         retroproxy.Logger
+	listeners      []*listener
+	storer         retroproxy.Storer
+	capture        *retroproxy.Capture
+	hexDump        bool
+	hexDumpMaxPkts int
+	accessLog      *retroproxy.AccessLog
+	events         *retroproxy.EventHub
+	tracer         trace.Tracer
+	handlers       []PacketHandler
+	// ticketHooks are called with each ticket used by a client.
+	ticketHooks []TicketHook
+	// ticketMaxAge is the age after which tickets are refused, or zero.
+	ticketMaxAge time.Duration
+
+	proxyProtocol   bool
+	ipFilter        *retroproxy.IPFilter
+	connLimiter     *retroproxy.ConnLimiter
+	sessionLimiter  *retroproxy.SessionLimiter
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	shutdownGrace   time.Duration
+	halfCloseGrace  time.Duration
+	tcpKeepAlive    time.Duration
+	tcpNagle        bool
+	restartListener bool
+	activated       *retroproxy.ActivatedListeners
+	upstreamRetries int
+	upstreamResume  bool
+	latency         *retroproxy.LatencyInjector
+	clientRateLimit int
+	serverRateLimit int
+	// dropMessages are the ids of the messages that are not forwarded, by the side they're read from.
+	dropMessages  map[retroproxy.Direction]map[string]struct{}
+	dialer        retroproxy.Dialer
+	breaker       *retroproxy.CircuitBreaker
+	maxPacketSize int
+	sniffOnly     bool
+	strict        bool
+	// maxAccountSessions is the maximum number of concurrent sessions of an account, or zero.
+	maxAccountSessions int
+	// maxIPSessions is the maximum number of concurrent sessions from a source IP, or zero.
+	maxIPSessions int
+	quota         retroproxy.Quota
+	// slowUpstream is the gap after a packet of the client from which the next packet of the server is logged as slow,
+	// or zero.
+	slowUpstream time.Duration
+	// coalesceWindow is how long the packets of the server that are safe to coalesce are held, or zero.
+	coalesceWindow time.Duration
+	coalesced      atomic.Uint64
+
+	ephemeral ephemeralListeners
+	listening atomic.Bool
+	sessions  map[*session]struct{}
+	rttAvg    time.Duration // guarded by mu
+	// accountSessions is the number of sessions of each account, counted when maxAccountSessions is set.
+	accountSessions map[string]int // guarded by mu
+	// ipSessions is the number of sessions from each source IP, counted when maxIPSessions is set.
+	ipSessions map[string]int // guarded by mu
+	mu         sync.Mutex
+}
+
+// listener is an address the proxy listens on.
+type listener struct {
+	addr *net.TCPAddr
+	// serverHost and serverPort are the address of the game server of the sessions of the listener, if it has one.
+	serverHost string
+	serverPort string
+	ln         *retroproxy.SupervisedListener
+	// ticket, if not empty, is the only ticket accepted by the listener, which is an ephemeral listener.
+	ticket string
+}
 
-	ln       *net.TCPListener
-	sessions map[*session]struct{}
-	mu       sync.Mutex
+// ListenerConfig is the configuration of an additional listener of a Proxy.
+type ListenerConfig struct {
+	Addr string
+	// ServerAddr, if not empty, is the address of the game server the clients of the listener are connected to,
+	// whatever their ticket says, so that a listener can front each server.
+	ServerAddr string
 }
 
-func NewProxy(addr string, storer retroproxy.Storer, logger *zap.Logger) (*Proxy, error) {
-	if storer == nil {
+// Config is the configuration of a Proxy.
+type Config struct {
+	// Addr is the address of the listener. It may be empty if there are other Listeners.
+	Addr string
+	// Listeners are the other addresses the proxy listens on.
+	Listeners []ListenerConfig
+	// Activated, if not nil, has the listeners inherited from systemd socket activation, which the proxy uses for the
+	// addresses they're bound to instead of binding them itself.
+	Activated *retroproxy.ActivatedListeners
+	// RestartListener makes the proxy bind its listeners again after accepting fails, with a backoff, instead of
+	// returning the error. Errors that retrying won't fix, such as the address being in use, are still returned.
+	RestartListener bool
+	// Storer is where the proxy looks up the tickets issued by the login proxy.
+	Storer retroproxy.Storer
+	// TicketMaxAge, if positive, is the age after which tickets are refused, even if the store didn't delete them yet,
+	// so that a ticket can only be used within that time after the login.
+	TicketMaxAge time.Duration
+	// Capture, if not nil, receives every packet read by the proxy.
+	Capture *retroproxy.Capture
+	// HexDump logs the packets sent by the sessions as hex dumps at debug level, up to HexDumpMaxPkts packets per
+	// session unless it's zero.
+	HexDump        bool
+	HexDumpMaxPkts int
+	// AccessLog, if not nil, receives a record of each completed session.
+	AccessLog *retroproxy.AccessLog
+	// Events, if not nil, receives the events of the sessions.
+	Events *retroproxy.EventHub
+	// Tracer, if not nil, records a trace of each session, with spans for the connection to the server, the ticket exchange and the first map load.
+	Tracer trace.Tracer
+	// ProxyProtocol makes the proxy expect a PROXY protocol header on each connection, whose source address is then
+	// used as the client address.
+	ProxyProtocol bool
+	// IPFilter, if not nil, decides which source IPs may connect.
+	IPFilter *retroproxy.IPFilter
+	// ConnLimiter, if not nil, limits the rate of new connections from each source IP.
+	ConnLimiter *retroproxy.ConnLimiter
+	// SessionLimiter, if not nil, caps the number of concurrent sessions, which may be shared with other proxies.
+	// Connections beyond it are closed right away.
+	SessionLimiter *retroproxy.SessionLimiter
+	// ReadTimeout is how long a connection may stay idle before the session is closed. Zero disables it.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long a write to a connection may block before the session is closed. Zero disables it.
+	WriteTimeout time.Duration
+	// ShutdownGrace is how long sessions are given to finish after the listener is closed. Zero closes them right away.
+	ShutdownGrace time.Duration
+	// HalfCloseGrace is how long a session keeps relaying the packets of the server once its client closed the write
+	// side of its connection, since some clients still read after a half-close. The proxy then closes the write side
+	// of the server connection too, and the session ends as soon as the server closes its side or writing to the
+	// client fails. Zero closes the session right away.
+	HalfCloseGrace time.Duration
+	// TCPKeepAlive is the keepalive period of the client connections and of the connections to the servers made by
+	// the default Dialer. Zero leaves the defaults of the system, and a negative value disables keepalive.
+	TCPKeepAlive time.Duration
+	// TCPNagle enables Nagle's algorithm on the client connections and on the connections to the servers, which
+	// sends fewer packets at the cost of latency. Go disables it by default.
+	TCPNagle bool
+	// UpstreamRetries is how many times connecting to the game server is retried before giving up.
+	UpstreamRetries int
+	// Breaker, if not nil, refuses the sessions whose server keeps failing to connect.
+	Breaker *retroproxy.CircuitBreaker
+	// Dialer, if not nil, connects to the game servers instead of a direct connection, such as through an upstream
+	// proxy.
+	Dialer retroproxy.Dialer
+	// MaxPacketSize is the size beyond which an unterminated packet closes the session. Zero means 64 KiB.
+	MaxPacketSize int
+	// SniffOnly makes the proxy forward packets verbatim: handlers only observe and packets cannot be injected.
+	SniffOnly bool
+	// Strict ends the sessions in which a packet could not be decoded or looks like a protocol desync. Otherwise, such
+	// packets are logged and forwarded as they are.
+	Strict bool
+	// UpstreamResume makes the proxy reconnect to the game server when the connection drops while the client stays
+	// connected, by sending the ticket of the session again. It only works with servers that accept a ticket more than
+	// once, see resume.go.
+	UpstreamResume bool
+	// Latency, if not nil, delays the packets relayed in both directions, to test clients under poor network
+	// conditions.
+	Latency *retroproxy.LatencyInjector
+	// ClientRateLimit and ServerRateLimit are the bytes per second relayed from the client and from the server of each
+	// session, to test clients with a low bandwidth. Zero disables them.
+	ClientRateLimit int
+	ServerRateLimit int
+	// DropClientMessages and DropServerMessages are the ids of the messages that are not forwarded when they're read
+	// from the client and from the server, such as "GA" or "cMK", to test how the client copes with missing packets.
+	// Dropping messages that the protocol relies on may desync the client. They have no effect in sniff-only mode.
+	DropClientMessages []string
+	DropServerMessages []string
+	// MaxAccountSessions is the maximum number of concurrent sessions of an account, as carried by the metadata of
+	// their tickets. Sessions beyond it are refused, as are their tickets. Zero disables it.
+	MaxAccountSessions int
+	// MaxSessionsPerIP is the maximum number of concurrent sessions from a single source IP, counted from when their
+	// connection is accepted, which bounds multi-boxing from one machine unlike ConnLimiter. Connections beyond it are
+	// closed right away. Zero disables it.
+	MaxSessionsPerIP int
+	// Quota is the bytes and packets that each session may read from its client in a window of time, beyond which the
+	// session is closed.
+	Quota retroproxy.Quota
+	// SlowUpstream is how long the server may take to send a packet after a packet of the client was forwarded to it
+	// before the gap is logged, to surface a lagging server. Zero disables it.
+	SlowUpstream time.Duration
+	// CoalesceWindow is how long the high-frequency packets of the server that are safe to coalesce, such as the
+	// movements of the other actors, are held before being forwarded, only the latest one of each actor being
+	// forwarded. It saves bandwidth for clients on poor links at the cost of freshness. Zero disables it, and it has no
+	// effect in sniff-only mode.
+	CoalesceWindow time.Duration
+	Logger         retroproxy.Logger
+}
+
+// NewProxy returns a Proxy listening on addr, see New for the other options. It's kept for the callers of the
+// constructor that came before Config. A *zap.Logger, which may be nil, is passed with retroproxy.ZapLogger.
+func NewProxy(addr string, storer retroproxy.Storer, capture *retroproxy.Capture,
+	logger retroproxy.Logger) (*Proxy, error) {
+	return New(Config{
+		Addr:    addr,
+		Storer:  storer,
+		Capture: capture,
+		Logger:  logger,
+	})
+}
+
+// New returns a Proxy configured with c.
+func New(c Config) (*Proxy, error) {
+	if c.Storer == nil {
 		return nil, errors.New("storer is nil")
 	}
+
+	logger := c.Logger
 	if logger == nil {
 		logger = zap.NewNop()
 	}
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
-	if err != nil {
-		return nil, err
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 3 * time.Second, KeepAlive: c.TCPKeepAlive}
 	}
+
+	maxPacketSize := c.MaxPacketSize
+	if maxPacketSize <= 0 {
+		maxPacketSize = bufio.MaxScanTokenSize
+	}
+
+	listenerConfigs := c.Listeners
+	if c.Addr != "" {
+		listenerConfigs = append([]ListenerConfig{{Addr: c.Addr}}, listenerConfigs...)
+	}
+	if len(listenerConfigs) == 0 {
+		return nil, errors.New("no listener address")
+	}
+	var listeners []*listener
+	for _, lc := range listenerConfigs {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", lc.Addr)
+		if err != nil {
+			return nil, err
+		}
+		l := &listener{addr: tcpAddr}
+		if lc.ServerAddr != "" {
+			l.serverHost, l.serverPort, err = net.SplitHostPort(lc.ServerAddr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid server address of listener %s: %w", lc.Addr, err)
+			}
+		}
+		listeners = append(listeners, l)
+	}
+
 	return &Proxy{
-		logger: logger,
-		addr:   tcpAddr,
-		storer: storer,
+		logger:          logger,
+		listeners:       listeners,
+		storer:          c.Storer,
+		ticketMaxAge:    c.TicketMaxAge,
+		capture:         c.Capture,
+		hexDump:         c.HexDump,
+		hexDumpMaxPkts:  c.HexDumpMaxPkts,
+		accessLog:       c.AccessLog,
+		events:          c.Events,
+		tracer:          retroproxy.TracerOrNoop(c.Tracer),
+		proxyProtocol:   c.ProxyProtocol,
+		ipFilter:        c.IPFilter,
+		connLimiter:     c.ConnLimiter,
+		sessionLimiter:  c.SessionLimiter,
+		readTimeout:     c.ReadTimeout,
+		writeTimeout:    c.WriteTimeout,
+		shutdownGrace:   c.ShutdownGrace,
+		halfCloseGrace:  c.HalfCloseGrace,
+		tcpKeepAlive:    c.TCPKeepAlive,
+		tcpNagle:        c.TCPNagle,
+		restartListener: c.RestartListener,
+		activated:       c.Activated,
+		upstreamRetries: c.UpstreamRetries,
+		upstreamResume:  c.UpstreamResume,
+		latency:         c.Latency,
+		clientRateLimit: c.ClientRateLimit,
+		serverRateLimit: c.ServerRateLimit,
+		dropMessages: map[retroproxy.Direction]map[string]struct{}{
+			retroproxy.DirectionClient: stringSet(c.DropClientMessages),
+			retroproxy.DirectionServer: stringSet(c.DropServerMessages),
+		},
+		dialer:        dialer,
+		breaker:       c.Breaker,
+		maxPacketSize: maxPacketSize,
+		sniffOnly:     c.SniffOnly,
+		strict:        c.Strict,
+
+		maxAccountSessions: c.MaxAccountSessions,
+		maxIPSessions:      c.MaxSessionsPerIP,
+		quota:              c.Quota,
+		slowUpstream:       c.SlowUpstream,
+		coalesceWindow:     c.CoalesceWindow,
 	}, nil
 }
 
 func (p *Proxy) ListenAndServe(ctx context.Context) error {
 	var wg sync.WaitGroup
 	defer wg.Wait()
+	defer p.ephemeral.wg.Wait()
 
-	ln, err := net.ListenTCP("tcp4", p.addr)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		ln.Close()
-		p.logger.Info("stopped listening",
+	defer p.closeListeners()
+	for _, l := range p.listeners {
+		ln, err := p.activated.Listen(l.addr, p.restartListener, p.logger)
+		if err != nil {
+			return err
+		}
+		l.ln = ln
+		p.logger.Info("listening",
 			zap.String("address", ln.Addr().String()),
 		)
-	}()
-	p.logger.Info("listening",
-		zap.String("address", ln.Addr().String()),
-	)
-	p.ln = ln
+	}
+	p.listening.Store(true)
+	defer p.listening.Store(false)
 
-	errCh := make(chan error)
+	// Sessions are not bound to ctx, so they can be drained after it's done.
+	sessionsCtx, cancelSessions := context.WithCancel(context.Background())
+	defer cancelSessions()
+
+	p.ephemeral.start(sessionsCtx)
+	defer p.ephemeral.stop()
+
+	// Each accept loop sends at most one error, so none of them blocks once ListenAndServe returned on the first one,
+	// which closes the other listeners.
+	errCh := make(chan error, len(p.listeners))
+	var acceptLoops sync.WaitGroup
+	for _, l := range p.listeners {
+		l := l
+		wg.Add(1)
+		acceptLoops.Add(1)
+		go func() {
+			defer wg.Done()
+			defer acceptLoops.Done()
+			err := p.acceptLoop(sessionsCtx, l)
+			if err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	acceptLoopsDone := make(chan struct{})
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := p.acceptLoop(ctx)
-		if err != nil {
-			select {
-			case errCh <- err:
-			case <-ctx.Done():
-			}
-		}
+		acceptLoops.Wait()
+		p.ephemeral.wait()
+		close(acceptLoopsDone)
 	}()
 
 	select {
 	case <-ctx.Done():
+		for _, l := range p.listeners {
+			l.ln.Close()
+		}
+		p.ephemeral.stop()
+		p.drainSessions(acceptLoopsDone)
 		return ctx.Err()
 	case err := <-errCh:
 		return err
 	}
 }
 
-func (p *Proxy) acceptLoop(ctx context.Context) error {
+// closeListeners closes the listeners that were opened by ListenAndServe.
+func (p *Proxy) closeListeners() {
+	for _, l := range p.listeners {
+		if l.ln == nil {
+			continue
+		}
+		l.ln.Close()
+		p.logger.Info("stopped listening",
+			zap.String("address", l.ln.Addr().String()),
+		)
+	}
+}
+
+// drainSessions waits for the sessions to finish by themselves until done is closed or the shutdown grace period
+// expires, whichever happens first.
+func (p *Proxy) drainSessions(done <-chan struct{}) {
+	if p.shutdownGrace <= 0 {
+		return
+	}
+
+	n := p.sessionCount()
+	if n == 0 {
+		return
+	}
+	p.logger.Info("draining sessions",
+		zap.Int("active_sessions", n),
+		zap.Duration("shutdown_grace", p.shutdownGrace),
+	)
+
+	timer := time.NewTimer(p.shutdownGrace)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		p.logger.Warn("shutdown grace period expired, closing remaining sessions",
+			zap.Int("active_sessions", p.sessionCount()),
+		)
+	}
+}
+
+func (p *Proxy) acceptLoop(ctx context.Context, l *listener) error {
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
 	for {
-		conn, err := p.ln.AcceptTCP()
+		tcpConn, err := l.ln.AcceptTCP()
 		if err != nil {
 			return err
 		}
@@ -95,47 +442,280 @@ func (p *Proxy) acceptLoop(ctx context.Context) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := p.handleClientConn(ctx, conn)
-			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
-				p.logger.Debug("error while handling client connection",
-					zap.Error(err),
-					zap.String("client_address", conn.RemoteAddr().String()),
-				)
-			}
+			p.serveConn(ctx, tcpConn, l)
 		}()
 	}
 }
 
-func (p *Proxy) handleClientConn(ctx context.Context, conn *net.TCPConn) error {
-	var wg sync.WaitGroup
-	defer wg.Wait()
+// serveConn handles a connection accepted by l until its session ends.
+func (p *Proxy) serveConn(ctx context.Context, tcpConn *net.TCPConn, l *listener) {
+	conn, ok := p.acceptConn(tcpConn)
+	if !ok {
+		return
+	}
+	if p.sessionLimiter != nil {
+		if !p.sessionLimiter.Acquire() {
+			conn.Close()
+			p.logger.Debug("connection refused, too many sessions",
+				zap.String("client_address", conn.RemoteAddr().String()),
+				zap.Int("max_sessions", p.sessionLimiter.Max()),
+			)
+			return
+		}
+		defer p.sessionLimiter.Release()
+	}
+	if p.maxIPSessions > 0 {
+		ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		if !p.acquireIP(ip) {
+			conn.Close()
+			p.logger.Info("connection refused, too many sessions from ip",
+				zap.String("client_address", conn.RemoteAddr().String()),
+				zap.Int("max_sessions_per_ip", p.maxIPSessions),
+			)
+			return
+		}
+		defer p.releaseIP(ip)
+	}
+	s, err := p.newSession(conn, l)
+	if err != nil {
+		conn.Close()
+		p.logger.Error("could not make session",
+			zap.Error(err),
+			zap.String("client_address", conn.RemoteAddr().String()),
+		)
+		return
+	}
+	err = p.handleClientConn(ctx, s)
+	if err != nil && !(errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) || errors.Is(err, errAccountLimit) || errors.Is(err, errIdleTimeout) || errors.Is(err, errWriteTimeout)) {
+		s.logger.Debug("error while handling client connection",
+			zap.Error(err),
+		)
+		s.publish(retroproxy.EventError, 0, retroproxy.ErrorEventData{
+			Error: err.Error(),
+			Err:   &retroproxy.SessionError{Proxy: metricLabel, SessionId: s.id, Err: err},
+		})
+	}
+}
 
-	defer func() {
+// acceptConn reads the PROXY protocol header of tcpConn if the proxy expects one and runs the access checks of the
+// proxy. It returns the connection to make a session with, or false if tcpConn was closed.
+func (p *Proxy) acceptConn(tcpConn *net.TCPConn) (net.Conn, bool) {
+	if p.tcpKeepAlive != 0 {
+		err := retroproxy.SetKeepAlive(tcpConn, p.tcpKeepAlive)
+		if err != nil {
+			p.logger.Debug("could not set tcp keepalive",
+				zap.Error(err),
+				zap.String("client_address", tcpConn.RemoteAddr().String()),
+			)
+		}
+	}
+	if p.tcpNagle {
+		err := tcpConn.SetNoDelay(false)
+		if err != nil {
+			p.logger.Debug("could not enable nagle's algorithm",
+				zap.Error(err),
+				zap.String("client_address", tcpConn.RemoteAddr().String()),
+			)
+		}
+	}
+	var conn net.Conn = tcpConn
+	if p.proxyProtocol {
+		var err error
+		conn, err = retroproxy.ReadProxyProtocol(tcpConn)
+		if err != nil {
+			tcpConn.Close()
+			p.logger.Debug("invalid proxy protocol header",
+				zap.Error(err),
+				zap.String("client_address", tcpConn.RemoteAddr().String()),
+			)
+			return nil, false
+		}
+	}
+
+	if !p.allowConn(conn) {
 		conn.Close()
-		p.logger.Info("client disconnected",
+		return nil, false
+	}
+	return conn, true
+}
+
+// allowConn reports whether conn passes the access checks of the proxy.
+func (p *Proxy) allowConn(conn net.Conn) bool {
+	ip := conn.RemoteAddr().(*net.TCPAddr).IP
+	if p.ipFilter != nil {
+		allowed, rule := p.ipFilter.Check(ip)
+		if !allowed {
+			p.logger.Debug("connection denied",
+				zap.String("client_address", conn.RemoteAddr().String()),
+				zap.String("rule", rule),
+			)
+			return false
+		}
+	}
+	if p.connLimiter != nil && !p.connLimiter.Allow(ip.String()) {
+		p.logger.Info("connection rate limit exceeded",
 			zap.String("client_address", conn.RemoteAddr().String()),
 		)
-	}()
-	p.logger.Info("client connected",
-		zap.String("client_address", conn.RemoteAddr().String()),
-	)
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) newSession(conn net.Conn, l *listener) (*session, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
 
 	s := &session{
+		id: id.String(),
+		logger: retroproxy.NewFieldsLogger(p.logger,
+			zap.String("session_id", id.String()),
+			zap.String("client_address", conn.RemoteAddr().String()),
+		),
 		proxy:               p,
+		listener:            l,
 		clientConn:          conn,
 		ticketCh:            make(chan retroproxy.Ticket),
 		connectedToServerCh: make(chan struct{}),
 		firstPkt:            true,
+		connectedAt:         time.Now(),
+	}
+	s.clientWriter = newFrameWriter(s.writePktToClient)
+	if p.coalesceWindow > 0 && !p.sniffOnly {
+		s.coalescer = newCoalescer(p.coalesceWindow, s.throttleToClient, p.countCoalesced)
+	}
+	s.serverWriter = newFrameWriter(s.writeFrameToServer)
+	if p.hexDump {
+		s.hexDumper = retroproxy.NewHexDumper(s.logger, p.hexDumpMaxPkts)
+	}
+	s.quota = p.quota.NewCounter()
+	if p.clientRateLimit > 0 {
+		s.clientThrottle = retroproxy.NewThrottle(p.clientRateLimit)
 	}
+	if p.serverRateLimit > 0 {
+		s.serverThrottle = retroproxy.NewThrottle(p.serverRateLimit)
+	}
+	return s, nil
+}
 
-	p.trackSession(s, true)
-	defer p.trackSession(s, false)
+func (p *Proxy) handleClientConn(ctx context.Context, s *session) (err error) {
+	if p.accessLog != nil {
+		// It's deferred first, so that it runs once the goroutines of the session are done with its counters.
+		defer func() {
+			s.logAccess(err)
+		}()
+	}
+
+	// The observers shadowing the session are let go once its goroutines are done reading packets.
+	defer s.shadows.Close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, s.span = p.tracer.Start(ctx, "game session", trace.WithAttributes(
+		attribute.String("session.id", s.id),
+		attribute.String("client.address", s.clientConn.RemoteAddr().String()),
+	))
+	defer s.span.End()
+
+	defer func() {
+		// The last packets of the session, such as the refusal of its ticket, are written before closing it.
+		s.serverWriter.close(writerDrainTimeout)
+		s.clientWriter.close(writerDrainTimeout)
+		s.clientConn.Close()
+		reason := s.disconnectReason(err)
+		retroproxy.RecordDisconnect(s.span, reason, err)
+		retroproxy.MetricDisconnects.WithLabelValues(metricLabel, string(reason)).Inc()
+		s.logger.Info("client disconnected",
+			zap.String("reason", string(reason)),
+		)
+		s.publish(retroproxy.EventSessionDisconnected, 0, retroproxy.SessionEventData{
+			ClientAddress: s.clientConn.RemoteAddr().String(),
+			Reason:        reason,
+		})
+	}()
+	s.logger.Info("client connected")
+	if p.capture != nil {
+		err := p.capture.Mark(s.id, s.connectedAt, retroproxy.MarkerSessionStart)
+		if err != nil {
+			s.logger.Error("could not write marker to capture",
+				zap.Error(err),
+			)
+		}
+		defer func() {
+			err := p.capture.EndSession(s.id)
+			if err != nil {
+				s.logger.Error("could not write end of session to capture",
+					zap.Error(err),
+				)
+			}
+		}()
+	}
+	s.publish(retroproxy.EventSessionConnected, 0, retroproxy.SessionEventData{
+		ClientAddress: s.clientConn.RemoteAddr().String(),
+	})
+	retroproxy.MetricConnections.WithLabelValues(metricLabel).Inc()
+	retroproxy.MetricActiveConnections.WithLabelValues(metricLabel).Inc()
+	defer retroproxy.MetricActiveConnections.WithLabelValues(metricLabel).Dec()
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	s.ctx, s.cancel = ctx, cancel
+
+	p.trackSession(s, true)
+	defer p.trackSession(s, false)
 
 	errCh := make(chan error)
 
+	for _, w := range []*frameWriter{s.clientWriter, s.serverWriter} {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := w.run()
+			if err != nil {
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	if s.coalescer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.coalescer.run(ctx)
+			if err != nil {
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	if p.latency != nil {
+		s.toServer = p.latency.NewQueue(s.sendPktToServer)
+		s.toClient = p.latency.NewQueue(s.sendPktToClient)
+		for _, q := range []*retroproxy.DelayQueue{s.toServer, s.toClient} {
+			q := q
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := q.Run(ctx)
+				if err != nil {
+					select {
+					case errCh <- err:
+					case <-ctx.Done():
+					}
+				}
+			}()
+		}
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -160,7 +740,7 @@ func (p *Proxy) handleClientConn(ctx context.Context, conn *net.TCPConn) error {
 		}
 	}()
 
-	err := s.sendMsgToClient(&msgsvr.AksHelloGame{})
+	err = s.sendMsgToClient(&msgsvr.AksHelloGame{})
 	if err != nil {
 		return err
 	}
@@ -185,3 +765,235 @@ func (p *Proxy) trackSession(s *session, add bool) {
 		delete(p.sessions, s)
 	}
 }
+
+func stringSet(ss []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(ss))
+	for _, s := range ss {
+		set[s] = struct{}{}
+	}
+	return set
+}
+
+// acquireAccount counts a session of account and reports whether it's within the limit of sessions per account.
+// The sessions beyond the limit are not counted.
+func (p *Proxy) acquireAccount(account string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.accountSessions[account] >= p.maxAccountSessions {
+		return false
+	}
+	if p.accountSessions == nil {
+		p.accountSessions = make(map[string]int)
+	}
+	p.accountSessions[account]++
+	return true
+}
+
+// releaseAccount uncounts a session of account.
+func (p *Proxy) releaseAccount(account string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.accountSessions[account]--
+	if p.accountSessions[account] <= 0 {
+		delete(p.accountSessions, account)
+	}
+}
+
+// acquireIP counts a session from ip and reports whether it's within the limit of sessions per IP. The sessions beyond
+// the limit are not counted.
+func (p *Proxy) acquireIP(ip string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ipSessions[ip] >= p.maxIPSessions {
+		return false
+	}
+	if p.ipSessions == nil {
+		p.ipSessions = make(map[string]int)
+	}
+	p.ipSessions[ip]++
+	return true
+}
+
+// releaseIP uncounts a session from ip.
+func (p *Proxy) releaseIP(ip string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ipSessions[ip]--
+	if p.ipSessions[ip] <= 0 {
+		delete(p.ipSessions, ip)
+	}
+}
+
+func (p *Proxy) sessionCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// Listening reports whether the listener of the proxy is up.
+func (p *Proxy) Listening() bool {
+	return p.listening.Load()
+}
+
+// Addr returns the address of the first listener of the proxy, which has the port picked by the system if it was
+// configured with port 0, or nil if the proxy is not listening.
+func (p *Proxy) Addr() net.Addr {
+	if !p.listening.Load() {
+		return nil
+	}
+	return p.listeners[0].ln.Addr()
+}
+
+// Sessions returns the active sessions of the proxy.
+func (p *Proxy) Sessions() []retroproxy.SessionInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	infos := make([]retroproxy.SessionInfo, 0, len(p.sessions))
+	for s := range p.sessions {
+		s.mu.Lock()
+		si := retroproxy.SessionInfo{
+			Id:            s.id,
+			ClientAddress: s.clientConn.RemoteAddr().String(),
+			ConnectedAt:   s.connectedAt,
+			Account:       s.account,
+			Character:     s.character,
+			MapId:         s.mapId,
+		}
+		s.mu.Unlock()
+		if s.clientThrottle != nil {
+			si.ClientRate = s.clientThrottle.Rate()
+		}
+		if s.serverThrottle != nil {
+			si.ServerRate = s.serverThrottle.Rate()
+		}
+		infos = append(infos, si)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// Shadow returns a channel receiving the packets read by the session with the given id from now on, and a function
+// that stops shadowing it. See retroproxy.SessionShadower.
+func (p *Proxy) Shadow(id string, size int) (<-chan retroproxy.CaptureRecord, func(), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for s := range p.sessions {
+		if s.id == id {
+			ch, stop := s.shadows.Add(size)
+			s.logger.Info("shadowing session")
+			return ch, stop, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Kick closes the session with the given id and reports whether it was found.
+func (p *Proxy) Kick(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for s := range p.sessions {
+		if s.id == id {
+			s.logger.Info("kicking session")
+			s.kicked.Store(true)
+			s.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// SendToClient sends pkt to the client of the session with the given id and reports whether it was sent, which it
+// never is in sniff-only mode.
+func (p *Proxy) SendToClient(id string, pkt string) bool {
+	p.mu.Lock()
+	var found *session
+	for s := range p.sessions {
+		if s.id == id {
+			found = s
+			break
+		}
+	}
+	p.mu.Unlock()
+	if found == nil {
+		return false
+	}
+	if p.sniffOnly {
+		found.logger.Warn("not injecting packet to client in sniff-only mode")
+		return false
+	}
+	found.logger.Info("injecting packet to client")
+	err := found.sendPktToClient(pkt)
+	if err != nil {
+		found.logger.Warn("could not inject packet to client",
+			zap.Error(err),
+		)
+		return false
+	}
+	return true
+}
+
+// SendToServer sends pkt to the server of the session with the given id as if its client sent it, through the same
+// writer as the packets of the client, and reports whether it was sent. It never is in sniff-only mode, nor before the
+// session is connected to its server. The packet is recorded as injected in the capture.
+func (p *Proxy) SendToServer(id string, pkt string) bool {
+	p.mu.Lock()
+	var found *session
+	for s := range p.sessions {
+		if s.id == id {
+			found = s
+			break
+		}
+	}
+	p.mu.Unlock()
+	if found == nil {
+		return false
+	}
+	if p.sniffOnly {
+		found.logger.Warn("not injecting packet to server in sniff-only mode")
+		return false
+	}
+	select {
+	case <-found.connectedToServerCh:
+	default:
+		found.logger.Warn("not injecting packet to server before connecting to it")
+		return false
+	}
+	found.logger.Info("injecting packet to server",
+		zap.String("packet", pkt),
+	)
+	err := found.sendPktToServer(pkt)
+	if err != nil {
+		found.logger.Warn("could not inject packet to server",
+			zap.Error(err),
+		)
+		return false
+	}
+	found.observeInjectedPkt(retroproxy.DirectionClient, pkt)
+	return true
+}
+
+// observeRTT records a round-trip time between a client and the server.
+func (p *Proxy) observeRTT(rtt time.Duration) {
+	// rttWeight is the weight of a new sample in the moving average.
+	const rttWeight = 0.1
+
+	retroproxy.MetricUpstreamRTT.WithLabelValues(metricLabel).Observe(rtt.Seconds())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rttAvg == 0 {
+		p.rttAvg = rtt
+	} else {
+		p.rttAvg = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(p.rttAvg))
+	}
+}
+
+// AverageRTT returns an exponential moving average of the round-trip time between the clients and the server, as
+// measured by their pings, or zero if none was measured yet.
+func (p *Proxy) AverageRTT() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rttAvg
+}
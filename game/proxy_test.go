@@ -0,0 +1,243 @@
+package game
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/internal/gametest"
+)
+
+// testTimeout bounds each read and wait of the tests.
+const testTimeout = 3 * time.Second
+
+// startProxy starts a game proxy configured with c on a local port, unless c has an address, with a ticket store
+// holding the ticket "t1" of srv, and returns it once it listens. It's stopped at the end of the test.
+func startProxy(t testing.TB, srv *gametest.Server, c Config, handlers ...PacketHandler) *Proxy {
+	t.Helper()
+	storer := retroproxy.NewCache(nil)
+	storer.SetTicket("t1", srv.Ticket("original"))
+	if c.Addr == "" {
+		c.Addr = "127.0.0.1:0"
+	}
+	c.Storer = storer
+	px, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	px.Use(handlers...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- px.ListenAndServe(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-errCh
+	})
+	deadline := time.Now().Add(testTimeout)
+	for px.Addr() == nil {
+		select {
+		case err := <-errCh:
+			t.Fatalf("could not start game proxy: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("game proxy didn't listen in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return px
+}
+
+// dial connects a client to px and reads the hello of the proxy.
+func dial(t testing.TB, px *Proxy) *gametest.Client {
+	t.Helper()
+	c, err := gametest.Dial(px.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	expectPkt(t, c, "HG")
+	return c
+}
+
+func expectPkt(t testing.TB, c *gametest.Client, want string) {
+	t.Helper()
+	got, err := c.Read(testTimeout)
+	if err != nil {
+		t.Fatalf("could not read %q: %v", want, err)
+	}
+	if got != want {
+		t.Fatalf("got packet %q, want %q", got, want)
+	}
+}
+
+func send(t testing.TB, c *gametest.Client, pkt string) {
+	t.Helper()
+	err := c.Send(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyRelaysSession(t *testing.T) {
+	srv, err := gametest.NewServer(
+		gametest.TicketStep,
+		gametest.Step{Prefix: "BD", Replies: []string{"BN"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	type handled struct {
+		dir retroproxy.Direction
+		pkt string
+	}
+	var mu sync.Mutex
+	var seen []handled
+	px := startProxy(t, srv, Config{}, PacketHandlerFunc(func(dir retroproxy.Direction, pkt string) (string, bool, error) {
+		mu.Lock()
+		seen = append(seen, handled{dir, pkt})
+		mu.Unlock()
+		return pkt, false, nil
+	}))
+
+	c := dial(t, px)
+	send(t, c, "ATt1")
+	// The proxy presents the original ticket to the server, and relays its response.
+	expectPkt(t, c, "ATK0")
+	send(t, c, "BD")
+	expectPkt(t, c, "BN")
+
+	got := srv.WaitReceived(2, testTimeout)
+	if want := []string{"AToriginal", "BD"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %q, want %q", got, want)
+	}
+	if err := srv.Err(); err != nil {
+		t.Error(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	wantSeen := []handled{
+		{retroproxy.DirectionServer, "ATK0"},
+		{retroproxy.DirectionClient, "BD"},
+		{retroproxy.DirectionServer, "BN"},
+	}
+	if !reflect.DeepEqual(seen, wantSeen) {
+		t.Errorf("handler saw %v, want %v", seen, wantSeen)
+	}
+}
+
+func TestProxyIPv6(t *testing.T) {
+	if ln, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		ln.Close()
+	}
+	srv, err := gametest.New(gametest.Config{Addr: "[::1]:0", Script: []gametest.Step{gametest.TicketStep}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	px := startProxy(t, srv, Config{Addr: "[::1]:0"})
+	if ip := px.Addr().(*net.TCPAddr).IP; !ip.Equal(net.IPv6loopback) {
+		t.Fatalf("proxy listens on %v, want %v", ip, net.IPv6loopback)
+	}
+
+	// The client connects over IPv6, and so does the proxy to the server of the ticket.
+	c := dial(t, px)
+	send(t, c, "ATt1")
+	expectPkt(t, c, "ATK0")
+	if got, want := srv.WaitReceived(1, testTimeout), []string{"AToriginal"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %q, want %q", got, want)
+	}
+}
+
+func TestProxyListenerFailure(t *testing.T) {
+	px, err := New(Config{
+		Addr:      "127.0.0.1:0",
+		Listeners: []ListenerConfig{{Addr: "127.0.0.1:0"}},
+		Storer:    retroproxy.NewCache(nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- px.ListenAndServe(ctx)
+	}()
+	deadline := time.Now().Add(testTimeout)
+	for px.Addr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("game proxy didn't listen in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The failure of one listener stops the proxy, along with the accept loop of the other one.
+	px.listeners[1].ln.Close()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("ListenAndServe() = %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("ListenAndServe didn't return after a listener failed")
+	}
+}
+
+func TestProxyHalfClose(t *testing.T) {
+	const halfCloseGrace = time.Minute
+	srv, err := gametest.NewServer(
+		gametest.TicketStep,
+		gametest.Step{Prefix: "BD", Replies: []string{"BN"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	t.Run("half-close", func(t *testing.T) {
+		px := startProxy(t, srv, Config{HalfCloseGrace: halfCloseGrace})
+		c := dial(t, px)
+		send(t, c, "ATt1")
+		expectPkt(t, c, "ATK0")
+		send(t, c, "BD")
+		if err := c.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		// The server still answers, then closes its side once it sees the end of the client's.
+		expectPkt(t, c, "BN")
+		if pkt, err := c.Read(testTimeout); !errors.Is(err, io.EOF) {
+			t.Fatalf("read packet %q (%v), want session closed", pkt, err)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		px := startProxy(t, srv, Config{HalfCloseGrace: halfCloseGrace})
+		c := dial(t, px)
+		send(t, c, "ATt1")
+		expectPkt(t, c, "ATK0")
+		c.Close()
+		// The session doesn't wait for the grace period once the server closed its side.
+		deadline := time.Now().Add(testTimeout)
+		for len(px.Sessions()) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("session still open after the client closed its connection")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package game
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kralamoure/retroproto"
+	"go.uber.org/zap"
+)
+
+// Resuming a session relies on these assumptions about the game server, which the official servers don't hold to, so
+// it's opt-in:
+//   - The ticket of the session can be sent again after the connection dropped, and the server accepts it for as long
+//     as the character of the account is still in game, like some emulators do while the server keeps it logged in.
+//   - The server resumes the game state of the character without the client selecting it again, so the packets of the
+//     client can be relayed right after the ticket is accepted.
+//
+// The hello and the ticket response of the new connection are not relayed, since the client already got them. If
+// the server doesn't accept the ticket, the session is closed as if resuming was disabled.
+
+const (
+	// maxResumes is how many times a session can be resumed.
+	maxResumes = 3
+	// maxPendingPkts is how many packets of the client can be queued while the session resumes.
+	maxPendingPkts = 64
+	// resumeTimeout bounds the handshake with the server when resuming.
+	resumeTimeout = 10 * time.Second
+)
+
+var (
+	errTicketRefused  = errors.New("server refused ticket")
+	errTooManyPending = errors.New("too many packets queued while resuming")
+)
+
+// resumable reports whether the session can be resumed after its server connection ended with err.
+func resumable(err error) bool {
+	return errors.Is(err, errUpstream) && !errors.Is(err, bufio.ErrTooLong)
+}
+
+// queuePkt queues a packet of the client until the session is resumed. serverMu must be held.
+func (s *session) queuePkt(rawPacket string) error {
+	if len(s.pending) >= maxPendingPkts {
+		return errTooManyPending
+	}
+	s.pending = append(s.pending, rawPacket)
+	return nil
+}
+
+// resume connects to the game server again and sends it the ticket of the session, then sends the packets of the
+// client that were queued meanwhile. It returns the new server connection.
+func (s *session) resume(ctx context.Context) (net.Conn, error) {
+	s.serverMu.Lock()
+	s.resuming = true
+	s.serverMu.Unlock()
+
+	conn, err := s.dialServer(ctx, s.ticket.Addr())
+	if err != nil {
+		return nil, err
+	}
+	err = s.resumeHandshake(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	s.serverConn, s.serverAddr = conn, conn.RemoteAddr().String()
+	s.resuming = false
+	pending := s.pending
+	s.pending = nil
+	for _, pkt := range pending {
+		err := s.writePktToServer(pkt)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// resumeHandshake waits for the hello of the server on conn and sends it the ticket of the session.
+func (s *session) resumeHandshake(ctx context.Context, conn net.Conn) error {
+	deadline := time.Now().Add(resumeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err := conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	pkt, err := s.readResumePkt(conn)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(pkt, string(retroproto.AksHelloGame)) {
+		return fmt.Errorf("unexpected packet instead of hello: %q", pkt)
+	}
+
+	_, err = fmt.Fprint(conn, string(retroproto.AccountSendTicket)+s.ticket.Original+"\n\x00")
+	if err != nil {
+		return err
+	}
+
+	pkt, err = s.readResumePkt(conn)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(pkt, string(retroproto.AccountTicketResponseSuccess)):
+	case strings.HasPrefix(pkt, string(retroproto.AccountTicketResponseError)):
+		return errTicketRefused
+	default:
+		return fmt.Errorf("unexpected packet instead of ticket response: %q", pkt)
+	}
+
+	return conn.SetDeadline(time.Time{})
+}
+
+// readResumePkt reads a single packet from conn. It reads byte by byte, so that the packets that follow are left
+// for the scanner of the relay.
+func (s *session) readResumePkt(conn net.Conn) (string, error) {
+	var sb strings.Builder
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\x00' {
+			break
+		}
+		if sb.Len() >= s.proxy.maxPacketSize {
+			return "", bufio.ErrTooLong
+		}
+		sb.WriteByte(b[0])
+	}
+	s.logger.Debug("received packet from server while resuming",
+		zap.String("packet", sb.String()),
+	)
+	return sb.String(), nil
+}
@@ -0,0 +1,46 @@
+package game
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// scanBufSize is the initial size of the buffers of the scanners, which is enough for most messages.
+const scanBufSize = 4096
+
+// scanBufPool holds the buffers of the scanners of finished sessions. Tokens are always copied into strings before
+// being handled, so a buffer is not referenced anymore once its scanner is done.
+var scanBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, scanBufSize)
+		return &b
+	},
+}
+
+// newScanner returns a scanner of Dofus messages of up to maxSize bytes read from r, with a pooled buffer that must be
+// released with the returned function once the scanner is not used anymore.
+func newScanner(r io.Reader, maxSize int) (sc *bufio.Scanner, release func()) {
+	buf := scanBufPool.Get().(*[]byte)
+	sc = bufio.NewScanner(r)
+	if maxSize < len(*buf) {
+		sc.Buffer((*buf)[:maxSize:maxSize], maxSize)
+	} else {
+		sc.Buffer(*buf, maxSize)
+	}
+	sc.Split(scanDofusMessages)
+	return sc, func() {
+		scanBufPool.Put(buf)
+	}
+}
+
+// scanDofusMessages is a split function for a bufio.Scanner that returns each message of a Dofus stream without its
+// null terminator. Client messages keep the newline that precedes the terminator. Incomplete data at EOF is discarded.
+func scanDofusMessages(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\x00'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	// Request more data, or stop if there is none left to complete the message.
+	return 0, nil, nil
+}
@@ -0,0 +1,163 @@
+package game
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/internal/gametest"
+)
+
+func TestOversizedPacket(t *testing.T) {
+	const maxPacketSize = 64
+	oversized := "BM*|" + strings.Repeat("a", 2*maxPacketSize)
+
+	for _, dir := range []retroproxy.Direction{retroproxy.DirectionClient, retroproxy.DirectionServer} {
+		t.Run(string(dir), func(t *testing.T) {
+			step := gametest.Step{Prefix: "BD", Replies: []string{"BN"}}
+			if dir == retroproxy.DirectionServer {
+				step.Replies = []string{oversized}
+			}
+			srv, err := gametest.NewServer(gametest.TicketStep, step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			core, logs := observer.New(zapcore.DebugLevel)
+			px := startProxy(t, srv, Config{MaxPacketSize: maxPacketSize, Logger: zap.New(core)})
+
+			c := dial(t, px)
+			send(t, c, "ATt1")
+			expectPkt(t, c, "ATK0")
+			if dir == retroproxy.DirectionClient {
+				send(t, c, oversized)
+			} else {
+				send(t, c, "BD")
+			}
+			// The session is closed without relaying the packet.
+			if pkt, err := c.Read(testTimeout); err == nil {
+				t.Fatalf("read packet %q, want session closed", pkt)
+			}
+
+			tooLarge := waitLog(t, logs, "packet too large, closing session")
+			if got := tooLarge.ContextMap()["direction"]; got != string(dir) {
+				t.Errorf("logged direction %v, want %s", got, dir)
+			}
+			sessionErr := waitLog(t, logs, "error while handling client connection")
+			if err := loggedError(sessionErr); !errors.Is(err, bufio.ErrTooLong) {
+				t.Errorf("session ended with %v, want %v", err, bufio.ErrTooLong)
+			}
+		})
+	}
+}
+
+func TestScanDofusMessages(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		atEOF       bool
+		wantAdvance int
+		wantToken   []byte
+	}{
+		{name: "empty", data: ""},
+		{name: "message", data: "BD\x00", wantAdvance: 3, wantToken: []byte("BD")},
+		{name: "client message", data: "BD\n\x00", wantAdvance: 4, wantToken: []byte("BD\n")},
+		{name: "empty message", data: "\x00BD\x00", wantAdvance: 1, wantToken: []byte{}},
+		{name: "several messages", data: "BD\x00BN\x00", wantAdvance: 3, wantToken: []byte("BD")},
+		{name: "partial message", data: "BD\x00B", wantAdvance: 3, wantToken: []byte("BD")},
+		{name: "incomplete message", data: "BD"},
+		// Nothing is returned for the data left without a terminator at EOF, so the scanner drops it.
+		{name: "incomplete message at EOF", data: "BD", atEOF: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			advance, token, err := scanDofusMessages([]byte(tt.data), tt.atEOF)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if advance != tt.wantAdvance || !reflect.DeepEqual(token, tt.wantToken) {
+				t.Errorf("got %d, %q, want %d, %q", advance, token, tt.wantAdvance, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestScanner(t *testing.T) {
+	tests := []struct {
+		name string
+		r    io.Reader
+		want []string
+	}{
+		{
+			name: "several messages in one read",
+			r:    strings.NewReader("BD\n\x00BN\x00GDM|7411\x00"),
+			want: []string{"BD\n", "BN", "GDM|7411"},
+		},
+		{
+			name: "message split across reads",
+			r:    io.MultiReader(strings.NewReader("BD\x00GDM|7"), strings.NewReader("411\x00")),
+			want: []string{"BD", "GDM|7411"},
+		},
+		{
+			name: "one byte per read",
+			r:    iotest.OneByteReader(strings.NewReader("BD\x00GDM|7411\x00BN\x00")),
+			want: []string{"BD", "GDM|7411", "BN"},
+		},
+		{
+			name: "incomplete message at EOF",
+			r:    iotest.OneByteReader(strings.NewReader("BD\x00GDM|7411")),
+			want: []string{"BD"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, release := newScanner(tt.r, 64)
+			defer release()
+			var got []string
+			for sc.Scan() {
+				got = append(got, sc.Text())
+			}
+			if err := sc.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scanned %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// waitLog waits for the first entry of logs with msg.
+func waitLog(t *testing.T, logs *observer.ObservedLogs, msg string) observer.LoggedEntry {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if entries := logs.FilterMessage(msg).All(); len(entries) > 0 {
+			return entries[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q not logged", msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// loggedError returns the error of the zap.Error field of e, or nil.
+func loggedError(e observer.LoggedEntry) error {
+	for _, f := range e.Context {
+		if err, ok := f.Interface.(error); ok && f.Key == "error" {
+			return err
+		}
+	}
+	return nil
+}
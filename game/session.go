@@ -3,143 +3,517 @@ package game
 import (
 	"bufio"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kralamoure/retroproto"
 	"github.com/kralamoure/retroproto/msgcli"
 	"github.com/kralamoure/retroproto/msgsvr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/kralamoure/retroproxy"
 )
 
+var (
+	errIdleTimeout  = errors.New("idle timeout")
+	errWriteTimeout = errors.New("write timeout")
+	errCircuitOpen  = errors.New("circuit breaker open")
+	errAccountLimit = errors.New("too many sessions for account")
+	errQuota        = errors.New("quota exceeded")
+	// errUpstream wraps the errors of the connection with the server.
+	errUpstream = errors.New("upstream error")
+	// errHandler wraps the errors returned by packet handlers.
+	errHandler = errors.New("packet handler error")
+	// errMalformed wraps the errors of the packets that could not be decoded, in strict mode.
+	errMalformed = errors.New("malformed packet")
+	// errDesync is wrapped in strict mode for the packets that don't look like messages.
+	errDesync = errors.New("protocol desync")
+	// errPanic wraps the values of the panics recovered while handling packets.
+	errPanic = errors.New("panic")
+)
+
 type session struct {
-	proxy      *Proxy
-	clientConn *net.TCPConn
-	serverConn *net.TCPConn
+	id     string
+	logger *retroproxy.FieldsLogger
+	proxy  *Proxy
+	// listener is the one the client connected to.
+	listener   *listener
+	clientConn net.Conn
+	// serverConn is the connection with the server. Its replacement when the session resumes is guarded by serverMu.
+	serverConn net.Conn
+	// serverAddr is the address of serverConn, for the logs, and is replaced along with it.
+	serverAddr string
+	// clientFrame and serverFrame are the buffers in which the frames written to each side are made. clientFrame is
+	// only used by the client writer, and serverFrame is guarded by serverMu.
+	clientFrame []byte
+	serverFrame []byte
 
 	ticket              retroproxy.Ticket
 	ticketCh            chan retroproxy.Ticket
 	connectedToServerCh chan struct{}
 
 	firstPkt bool
+
+	// coalescer holds the packets of the server that are safe to coalesce when the proxy coalesces them.
+	coalescer *coalescer
+	// toServer and toClient delay the relayed packets when the proxy injects latency.
+	toServer *retroproxy.DelayQueue
+	toClient *retroproxy.DelayQueue
+	// clientThrottle and serverThrottle limit the bytes relayed from each side when the proxy throttles sessions.
+	clientThrottle *retroproxy.Throttle
+	serverThrottle *retroproxy.Throttle
+	// quota counts what the client sent in the current window when the proxy has a quota. It's only used by the
+	// goroutine reading from the client.
+	quota *retroproxy.QuotaCounter
+	// hexDumper logs the packets sent by the session when the proxy dumps them.
+	hexDumper *retroproxy.HexDumper
+	// countedAccount is the account the session is counted for in the sessions per account of the proxy, if any. It's
+	// only used by the goroutine reading from the client.
+	countedAccount string
+
+	connectedAt time.Time
+	// ctx is the context of the session, which cancel cancels when the session ends. It's given to the packet handlers
+	// that implement ContextPacketHandler.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// span is the root span of the trace of the session. handshakeSpan and mapLoadSpan end with packets of the server,
+	// and are only used by the goroutine reading from the server.
+	span          trace.Span
+	handshakeSpan trace.Span
+	mapLoadSpan   trace.Span
+	kicked        atomic.Bool
+	// shadows are the observers of the packets of the session, from the admin console.
+	shadows retroproxy.Shadows
+
+	// clientSeq and serverSeq are the sequence numbers of the last packets read from each side, starting at 1. Each
+	// one is only used by the goroutine reading from its side.
+	clientSeq uint64
+	serverSeq uint64
+	// clientBytes and serverBytes count the bytes read from each side, like the sequence numbers.
+	clientBytes uint64
+	serverBytes uint64
+	// lastClientPkt and lastServerPkt are the last packets read from each side, like the sequence numbers.
+	lastClientPkt string
+	lastServerPkt string
+
+	// clientHalfClosed is set once the client closed the write side of its connection, while the session waits for
+	// the half-close grace period.
+	clientHalfClosed atomic.Bool
+
+	// pingSentAt is the time in Unix nanoseconds at which the last ping of the client that has not been answered yet
+	// was forwarded, or zero.
+	pingSentAt atomic.Int64
+
+	// requestMu guards requestSentAt and requestId, which are the time at which the first packet of the client that the
+	// server has not sent a packet since was forwarded, or zero, and the id of its message. They're only set when the
+	// proxy logs slow upstream responses.
+	requestMu     sync.Mutex
+	requestSentAt time.Time
+	requestId     retroproto.MsgCliId
+
+	// clientWriter and serverWriter write the packets sent to each side, since packets can be injected by other
+	// goroutines than the relay ones.
+	clientWriter *frameWriter
+	serverWriter *frameWriter
+
+	// serverMu guards the server connection while the session resumes, and the fields below.
+	serverMu sync.Mutex
+	// resuming is true while the session reconnects to the server, and pending holds the packets of the client sent
+	// meanwhile.
+	resuming bool
+	pending  []string
+
+	// mu guards the fields below, which are read by the session registry of the proxy.
+	mu        sync.Mutex
+	account   string
+	character string
+	mapId     int
 }
 
 func (s *session) connectToServer(ctx context.Context) error {
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	var t retroproxy.Ticket
+	select {
+	case t = <-s.ticketCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if s.listener.serverHost != "" {
+		t.Host, t.Port = s.listener.serverHost, s.listener.serverPort
+	}
+	s.ticket = t
 
-	errCh := make(chan error)
+	conn, err := s.dialServer(ctx, t.Addr())
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", errUpstream, retroproxy.ErrUpstreamDial, err)
+	}
+	s.logger.Info("connected to server",
+		zap.String("server_address", conn.RemoteAddr().String()),
+	)
+	s.serverConn, s.serverAddr = conn, conn.RemoteAddr().String()
+	close(s.connectedToServerCh)
 
-	select {
-	case t := <-s.ticketCh:
-		s.ticket = t
+	_, s.handshakeSpan = s.proxy.tracer.Start(ctx, "ticket exchange")
+	defer func() {
+		// The spans of a session that ends too soon are still exported.
+		s.handshakeSpan.End()
+		if s.mapLoadSpan != nil {
+			s.mapLoadSpan.End()
+		}
+	}()
 
-		conn, err := net.DialTimeout("tcp4", net.JoinHostPort(t.Host, t.Port), 3*time.Second)
-		if err != nil {
+	for resumes := 0; ; resumes++ {
+		err := s.relayFromServer(ctx, conn)
+		// The server closing the connection after the client half-closed it is the end of the session.
+		if !s.proxy.upstreamResume || !resumable(err) || ctx.Err() != nil || s.clientHalfClosed.Load() {
 			return err
 		}
-		defer conn.Close()
-		tcpConn, ok := conn.(*net.TCPConn)
-		if !ok {
-			return errors.New("could not assert server connection as a tcp connection")
+		if resumes >= maxResumes {
+			s.logger.Warn("too many resumes, closing session",
+				zap.Int("max_resumes", maxResumes),
+			)
+			return err
 		}
-		s.proxy.logger.Info("connected to server",
-			zap.String("server_address", tcpConn.RemoteAddr().String()),
-			zap.String("client_address", s.clientConn.RemoteAddr().String()),
-		)
-		s.serverConn = tcpConn
-		close(s.connectedToServerCh)
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err = s.receivePktsFromServer(ctx)
-			if err != nil {
-				select {
-				case errCh <- err:
-				case <-ctx.Done():
-				}
-			}
-		}()
-	case <-ctx.Done():
-		return ctx.Err()
+		s.logger.Warn("lost connection to server, resuming session",
+			zap.Error(err),
+		)
+		conn, err = s.resume(ctx)
+		if err != nil {
+			s.logger.Warn("could not resume session, closing session",
+				zap.Error(err),
+			)
+			return fmt.Errorf("%w: %w", errUpstream, err)
+		}
+		s.span.AddEvent("resumed", trace.WithAttributes(attribute.Int("resumes", resumes+1)))
+		s.logger.Info("resumed session",
+			zap.String("server_address", conn.RemoteAddr().String()),
+		)
 	}
+}
+
+// relayFromServer relays the packets read from conn, the current server connection, until reading fails or ctx is
+// done, and closes it.
+func (s *session) relayFromServer(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.receivePktsFromServer(ctx)
+	}()
 
 	select {
 	case err := <-errCh:
 		return err
 	case <-ctx.Done():
+		conn.Close()
+		<-errCh
 		return ctx.Err()
 	}
 }
 
-func (s *session) receivePktsFromServer(ctx context.Context) error {
-	rd := bufio.NewReader(s.serverConn)
+// dialServer connects to the server at addr, retrying with exponential backoff up to the configured number of
+// retries.
+func (s *session) dialServer(ctx context.Context, addr string) (net.Conn, error) {
+	const (
+		initialBackoff = 500 * time.Millisecond
+		maxBackoff     = 8 * time.Second
+	)
+
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		if s.proxy.breaker != nil && !s.proxy.breaker.Allow(addr) {
+			s.logger.Warn("circuit breaker open, closing session",
+				zap.String("server_address", addr),
+			)
+			return nil, errCircuitOpen
+		}
+		_, span := s.proxy.tracer.Start(ctx, "dial server", trace.WithAttributes(
+			attribute.String("server.address", addr),
+			attribute.Int("attempt", attempt+1),
+		))
+		conn, err := s.proxy.dialer.DialContext(ctx, "tcp", addr)
+		retroproxy.RecordError(span, err)
+		span.End()
+		s.recordDial(ctx, addr, err)
+		if err == nil {
+			if s.proxy.tcpNagle {
+				err := retroproxy.SetNoDelay(conn, false)
+				if err != nil {
+					s.logger.Debug("could not enable nagle's algorithm", zap.Error(err))
+				}
+			}
+			return conn, nil
+		}
+		if attempt >= s.proxy.upstreamRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		s.logger.Warn("could not connect to server, retrying",
+			zap.Error(err),
+			zap.String("server_address", addr),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// recordDial reports the result of a connection attempt to addr to the circuit breaker of the proxy, unless the
+// attempt was canceled.
+func (s *session) recordDial(ctx context.Context, addr string, err error) {
+	switch {
+	case s.proxy.breaker == nil || ctx.Err() != nil:
+	case err == nil:
+		s.proxy.breaker.Success(addr)
+	case s.proxy.breaker.Failure(addr):
+		s.logger.Error("circuit breaker opened",
+			zap.String("server_address", addr),
+			zap.Duration("cooldown", s.proxy.breaker.Cooldown()),
+		)
+	}
+}
+
+func (s *session) receivePktsFromServer(ctx context.Context) (err error) {
+	defer s.recoverPanic(retroproxy.DirectionServer, &err)
+	sc, release := newScanner(s.serverConn, s.proxy.maxPacketSize)
+	defer release()
 	for {
-		pkt, err := rd.ReadString('\x00')
+		err := s.setReadDeadline(s.serverConn)
 		if err != nil {
 			return err
 		}
-		pkt = strings.TrimSuffix(pkt, "\x00")
+		if !sc.Scan() {
+			break
+		}
+		serverBytesMetric.Add(float64(len(sc.Bytes()) + 1))
+		s.serverBytes += uint64(len(sc.Bytes()) + 1)
+		pkt := sc.Text()
 		if pkt == "" {
 			continue
 		}
+		s.observePkt(retroproxy.DirectionServer, pkt)
+		if s.proxy.slowUpstream > 0 {
+			s.checkSlowUpstream()
+		}
 		err = s.handlePktFromServer(ctx, pkt)
+		s.lastServerPkt = pkt
 		if err != nil {
 			return err
 		}
 	}
+	err = sc.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	return s.readError(retroproxy.DirectionServer, err)
 }
 
-func (s *session) receivePktsFromClient(ctx context.Context) error {
-	rd := bufio.NewReader(s.clientConn)
+func (s *session) receivePktsFromClient(ctx context.Context) (err error) {
+	defer s.recoverPanic(retroproxy.DirectionClient, &err)
+	sc, release := newScanner(s.clientConn, s.proxy.maxPacketSize)
+	defer release()
+	defer func() {
+		if s.countedAccount != "" {
+			s.proxy.releaseAccount(s.countedAccount)
+		}
+	}()
 	for {
-		pkt, err := rd.ReadString('\x00')
+		err := s.setReadDeadline(s.clientConn)
 		if err != nil {
 			return err
 		}
-		pkt = strings.TrimSuffix(pkt, "\n\x00")
+		if !sc.Scan() {
+			break
+		}
+		clientBytesMetric.Add(float64(len(sc.Bytes()) + 1))
+		s.clientBytes += uint64(len(sc.Bytes()) + 1)
+		pkt := strings.TrimSuffix(sc.Text(), "\n")
 		if pkt == "" {
 			continue
 		}
+		s.observePkt(retroproxy.DirectionClient, pkt)
+		if s.quota != nil && !s.quota.Add(len(sc.Bytes())+1, time.Now()) {
+			return s.quotaExceeded()
+		}
 		err = s.handlePktFromClient(ctx, pkt)
+		s.lastClientPkt = pkt
 		s.firstPkt = false
 		if err != nil {
 			return err
 		}
 	}
+	err = sc.Err()
+	if err != nil {
+		return s.readError(retroproxy.DirectionClient, err)
+	}
+	if s.proxy.halfCloseGrace > 0 {
+		s.waitHalfCloseGrace(ctx)
+	}
+	return io.EOF
+}
+
+// waitHalfCloseGrace passes on the half-close of the client to the server once the client closed the write side of its
+// connection, and keeps the session open so that the packets of the server still reach the client. The session ends
+// when the server closes its side, when writing to the client fails, or after the half-close grace period, whichever
+// happens first.
+func (s *session) waitHalfCloseGrace(ctx context.Context) {
+	select {
+	case <-s.connectedToServerCh:
+	default:
+		// There is no server whose packets could still be relayed.
+		return
+	}
+	s.logger.Debug("client closed its side of the connection, still relaying packets of server",
+		zap.Duration("half_close_grace", s.proxy.halfCloseGrace),
+	)
+	s.clientHalfClosed.Store(true)
+	s.closeServerWrite()
+	timer := time.NewTimer(s.proxy.halfCloseGrace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// closeServerWrite writes the packets of the client that are left, then closes the write side of the server connection,
+// so that the server knows the client is done.
+func (s *session) closeServerWrite() {
+	s.serverWriter.close(writerDrainTimeout)
+
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	conn, ok := s.serverConn.(interface{ CloseWrite() error })
+	if !ok {
+		return
+	}
+	err := conn.CloseWrite()
+	if err != nil {
+		s.logger.Debug("could not close write side of server connection",
+			zap.Error(err),
+		)
+	}
 }
 
 func (s *session) handlePktFromServer(ctx context.Context, packet string) error {
 	id, ok := retroproto.MsgSvrIdByPkt(packet)
+	retroproxy.CountMessage(metricLabel, retroproxy.DirectionServer, string(id))
 	name, _ := retroproto.MsgSvrNameByID(id)
-	s.proxy.logger.Info("received packet from server",
-		zap.String("server_address", s.serverConn.RemoteAddr().String()),
-		zap.String("client_address", s.clientConn.RemoteAddr().String()),
+	s.logger.Info("received packet from server",
+		zap.String("server_address", s.serverAddr),
+		zap.Uint64("seq", s.serverSeq),
 		zap.String("message_name", name),
 		zap.String("packet", packet),
 	)
+	if !ok {
+		err := s.desync(retroproxy.DirectionServer, packet, s.lastServerPkt, false)
+		if err != nil {
+			return err
+		}
+	}
 	if ok {
 		switch id {
+		case retroproto.AksPong, retroproto.AksQuickPong:
+			sentAt := s.pingSentAt.Swap(0)
+			if sentAt != 0 {
+				rtt := time.Since(time.Unix(0, sentAt))
+				s.logger.Debug("measured round-trip time",
+					zap.Duration("rtt", rtt),
+				)
+				s.proxy.observeRTT(rtt)
+			}
 		case retroproto.AksHelloGame:
 			err := s.sendMsgToServer(&msgcli.AccountSendTicket{Ticket: s.ticket.Original})
 			if err != nil {
 				return err
 			}
 			return nil
+		case retroproto.AccountTicketResponseSuccess, retroproto.AccountTicketResponseError:
+			s.handshakeSpan.SetAttributes(attribute.Bool("accepted", id == retroproto.AccountTicketResponseSuccess))
+			s.handshakeSpan.End()
+		case retroproto.AccountCharacterSelectedSuccess:
+			if s.mapLoadSpan == nil {
+				_, s.mapLoadSpan = s.proxy.tracer.Start(ctx, "first map load")
+			}
+			// The message starts with a separator that msgsvr.AccountCharacterSelectedSuccess doesn't expect.
+			msg := &msgsvr.AccountCharacterSelectedSuccess{}
+			err := msg.Deserialize(strings.TrimPrefix(packet, string(id)+"|"))
+			if err != nil {
+				if err := s.malformed(retroproxy.DirectionServer, packet, err); err != nil {
+					return err
+				}
+				break
+			}
+			s.mu.Lock()
+			s.character = msg.Name
+			s.mu.Unlock()
+			s.logger.Set(zap.String("character", msg.Name))
+			s.span.AddEvent("character selected", trace.WithAttributes(attribute.String("character", msg.Name)))
+		case retroproto.ChatMessageSuccess:
+			if s.proxy.events == nil {
+				break
+			}
+			msg := &msgsvr.ChatMessageSuccess{}
+			err := msg.Deserialize(strings.TrimPrefix(packet, string(id)))
+			if err != nil {
+				if err := s.malformed(retroproxy.DirectionServer, packet, err); err != nil {
+					return err
+				}
+				break
+			}
+			s.publish(retroproxy.EventChat, s.serverSeq, retroproxy.ChatEventData{
+				Channel: string(msg.ChatChannel),
+				Sender:  msg.Name,
+				Message: msg.Message,
+			})
+		case retroproto.GameMapData:
+			if s.mapLoadSpan != nil {
+				s.mapLoadSpan.End()
+			}
+			msg := &msgsvr.GameMapData{}
+			err := msg.Deserialize(strings.TrimPrefix(packet, string(id)))
+			if err != nil {
+				if err := s.malformed(retroproxy.DirectionServer, packet, err); err != nil {
+					return err
+				}
+				break
+			}
+			s.mu.Lock()
+			s.mapId = msg.Id
+			s.mu.Unlock()
+			s.logger.Set(zap.Int("map_id", msg.Id))
+			s.span.AddEvent("map loaded", trace.WithAttributes(attribute.Int("map_id", msg.Id)))
 		case retroproto.GameMovement:
 			extra := strings.TrimPrefix(packet, string(id))
 
 			msg := &msgsvr.GameMovement{}
 			err := msg.Deserialize(extra)
 			if err != nil {
-				return err
+				if err := s.malformed(retroproxy.DirectionServer, packet, err); err != nil {
+					return err
+				}
+				break
 			}
 
 			for _, sprite := range msg.Sprites {
@@ -149,7 +523,7 @@ func (s *session) handlePktFromServer(ctx context.Context, packet string) error
 				if sprite.Type < 1 {
 					continue
 				}
-				s.proxy.logger.Debug("character spotted",
+				s.logger.Debug("character spotted",
 					zap.String("character_name", sprite.Character.Name),
 					zap.Int("character_level", sprite.Character.Level),
 				)
@@ -157,45 +531,46 @@ func (s *session) handlePktFromServer(ctx context.Context, packet string) error
 		}
 	}
 
-	s.sendPktToClient(packet)
-
-	return nil
+	if s.dropped(retroproxy.DirectionServer, string(id), packet) {
+		return nil
+	}
+	packet, drop, err := s.runHandlers(retroproxy.DirectionServer, packet)
+	if err != nil {
+		return err
+	}
+	if drop {
+		return nil
+	}
+	return s.forwardToClient(ctx, packet)
 }
 
 func (s *session) handlePktFromClient(ctx context.Context, rawPacket string) error {
-	packet := rawPacket
-
-	// unknownToken seems to wrap a base64 encoded string sent by the client as the prefix of some types of packet.
-	// That mechanism was introduced by a new client version, but it's not clear to me which version or why.
-	// Maybe it's some kind of signature mechanism.
-	const unknownToken = "ù"
-	if strings.HasPrefix(packet, unknownToken) {
-		const index = 2
-		substrings := strings.SplitN(packet, unknownToken, index+1)
-		if len(substrings) != index+1 {
-			s.proxy.logger.Warn("invalid packet but won't discard it")
-		} else {
-			packet = substrings[index]
-		}
-	}
+	packet := s.trimUnknownToken(rawPacket)
 
 	id, ok := retroproto.MsgCliIdByPkt(packet)
+	retroproxy.CountMessage(metricLabel, retroproxy.DirectionClient, string(id))
 	name, _ := retroproto.MsgCliNameByID(id)
-	s.proxy.logger.Info("received packet from client",
-		zap.String("client_address", s.clientConn.RemoteAddr().String()),
+	s.logger.Info("received packet from client",
+		zap.Uint64("seq", s.clientSeq),
 		zap.String("message_name", name),
 		zap.String("packet", packet),
 		zap.String("raw_packet", rawPacket),
 	)
-	if s.firstPkt && !ok {
-		return errors.New("invalid first packet")
+	if s.firstPkt && id != retroproto.AccountSendTicket {
+		return fmt.Errorf("%w: invalid first packet", retroproxy.ErrProtocol)
+	}
+	if !ok {
+		err := s.desync(retroproxy.DirectionClient, packet, s.lastClientPkt, false)
+		if err != nil {
+			return err
+		}
 	}
 	if ok {
 		extra := strings.TrimPrefix(packet, string(id))
 		switch id {
 		case retroproto.AccountSendTicket:
 			if !s.firstPkt {
-				return errors.New("unexpected packet")
+				return fmt.Errorf("%w: unexpected packet", retroproxy.ErrProtocol)
 			}
 			msg := &msgcli.AccountSendTicket{}
 			err := msg.Deserialize(extra)
@@ -203,13 +578,70 @@ func (s *session) handlePktFromClient(ctx context.Context, rawPacket string) err
 				return err
 			}
 
+			// A ticket presented on the ephemeral port of another ticket is left in the store for its own port.
+			if s.listener.ticket != "" && msg.Ticket != s.listener.ticket {
+				err := s.sendMsgToClient(&msgsvr.AccountTicketResponseError{})
+				if err != nil {
+					return err
+				}
+				return fmt.Errorf("%w: ephemeral port of another ticket", retroproxy.ErrTicketNotFound)
+			}
+
 			t, ok := s.proxy.storer.UseTicket(msg.Ticket)
-			if !ok {
+			// The ticket is deleted even if it's expired, so it can't be tried again before the store prunes it.
+			age := time.Since(t.IssuedAt)
+			if ok && s.proxy.ticketMaxAge > 0 && age > s.proxy.ticketMaxAge {
+				s.logger.Info("ticket expired, closing session",
+					zap.Duration("ticket_age", age),
+					zap.Duration("ticket_max_age", s.proxy.ticketMaxAge),
+				)
 				err := s.sendMsgToClient(&msgsvr.AccountTicketResponseError{})
 				if err != nil {
 					return err
 				}
-				return errors.New("ticket not found")
+				return fmt.Errorf("%w: issued %s ago", retroproxy.ErrTicketExpired, age.Round(time.Millisecond))
+			}
+			if !ok || t.Host == "" || t.Port == "" {
+				err := s.sendMsgToClient(&msgsvr.AccountTicketResponseError{})
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return retroproxy.ErrTicketNotFound
+				}
+				return errors.New("ticket has no game server address")
+			}
+
+			for _, hook := range s.proxy.ticketHooks {
+				err := hook(t)
+				if err == nil {
+					continue
+				}
+				s.logger.Info("ticket refused by hook", zap.Error(err))
+				if err := s.sendMsgToClient(&msgsvr.AccountTicketResponseError{}); err != nil {
+					return err
+				}
+				return fmt.Errorf("%w: %w", errHandler, err)
+			}
+			if account := t.MetadataValue(retroproxy.TicketAccount); account != "" {
+				s.logger.Set(zap.String("account", account))
+				s.span.SetAttributes(attribute.String("account", account))
+				s.mu.Lock()
+				s.account = account
+				s.mu.Unlock()
+
+				if s.proxy.maxAccountSessions > 0 {
+					if !s.proxy.acquireAccount(account) {
+						s.logger.Info("too many sessions for account, closing session",
+							zap.Int("max_account_sessions", s.proxy.maxAccountSessions),
+						)
+						if err := s.sendMsgToClient(&msgsvr.AccountTicketResponseError{}); err != nil {
+							return err
+						}
+						return errAccountLimit
+					}
+					s.countedAccount = account
+				}
 			}
 
 			select {
@@ -225,17 +657,201 @@ func (s *session) handlePktFromClient(ctx context.Context, rawPacket string) err
 	case <-ctx.Done():
 		return ctx.Err()
 	}
-	s.sendPktToServer(rawPacket)
+	if s.dropped(retroproxy.DirectionClient, string(id), packet) {
+		return nil
+	}
+	rawPacket, drop, err := s.runHandlers(retroproxy.DirectionClient, rawPacket)
+	if err != nil {
+		return err
+	}
+	if drop {
+		return nil
+	}
+	if id == retroproto.AksPing || id == retroproto.AksQuickPing {
+		s.pingSentAt.Store(time.Now().UnixNano())
+	}
+	err = s.forwardToServer(ctx, rawPacket)
+	if err != nil {
+		return err
+	}
+	if s.proxy.slowUpstream > 0 {
+		s.requestMu.Lock()
+		if s.requestSentAt.IsZero() {
+			s.requestSentAt, s.requestId = time.Now(), id
+		}
+		s.requestMu.Unlock()
+	}
 	return nil
 }
 
+// checkSlowUpstream logs the gap between the first packet of the client forwarded since the last packet of the server
+// and the current one when it's longer than the slow upstream threshold of the proxy. It's called by the goroutine
+// reading from the server for each of its packets.
+func (s *session) checkSlowUpstream() {
+	s.requestMu.Lock()
+	sentAt, id := s.requestSentAt, s.requestId
+	s.requestSentAt = time.Time{}
+	s.requestMu.Unlock()
+	if sentAt.IsZero() {
+		return
+	}
+	gap := time.Since(sentAt)
+	if gap <= s.proxy.slowUpstream {
+		return
+	}
+	s.logger.Warn("slow upstream response",
+		zap.String("message_id", string(id)),
+		zap.Duration("gap", gap),
+		zap.Duration("slow_upstream_threshold", s.proxy.slowUpstream),
+	)
+}
+
+// recoverPanic ends the session with an error wrapped with errPanic, instead of crashing the process, if the goroutine
+// reading from the dir side panics, such as in a packet handler. It must be deferred by that goroutine.
+func (s *session) recoverPanic(dir retroproxy.Direction, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	retroproxy.MetricPanics.WithLabelValues(metricLabel).Inc()
+	s.logger.Error("recovered from panic, closing session",
+		zap.String("direction", string(dir)),
+		zap.Any("panic", r),
+		zap.Stack("stack"),
+	)
+	*err = fmt.Errorf("%w: %v", errPanic, r)
+}
+
+// trimUnknownToken returns the packet wrapped in rawPacket, a packet of the client, without the token that prefixes
+// some types of packet.
+func (s *session) trimUnknownToken(rawPacket string) string {
+	// unknownToken seems to wrap a base64 encoded string sent by the client as the prefix of some types of packet.
+	// That mechanism was introduced by a new client version, but it's not clear to me which version or why.
+	// Maybe it's some kind of signature mechanism.
+	const unknownToken = "ù"
+	if !strings.HasPrefix(rawPacket, unknownToken) {
+		return rawPacket
+	}
+	const index = 2
+	substrings := strings.SplitN(rawPacket, unknownToken, index+1)
+	if len(substrings) != index+1 {
+		s.logger.Warn("invalid packet but won't discard it")
+		return rawPacket
+	}
+	return substrings[index]
+}
+
+// malformed logs a packet read from the dir side that could not be decoded, with a hex dump since it may hold
+// unprintable bytes. In strict mode, it returns err wrapped with errMalformed and retroproxy.ErrProtocol to end the
+// session. Otherwise, it returns nil and the packet is forwarded as it is.
+func (s *session) malformed(dir retroproxy.Direction, pkt string, err error) error {
+	s.logger.Warn("malformed packet",
+		zap.String("direction", string(dir)),
+		zap.String("hex_dump", hex.Dump([]byte(pkt))),
+		zap.Error(err),
+	)
+	if s.proxy.strict {
+		return fmt.Errorf("%w: %w: %w", retroproxy.ErrProtocol, errMalformed, err)
+	}
+	return nil
+}
+
+// desync flags pkt, a packet from the dir side whose message id is unknown, if it doesn't look like a message either,
+// which likely means the framing is off. prev is the packet before it: the previous one read from the dir side or, if
+// handled is true, the one that the packet handlers made pkt from. Both are logged with hex dumps, and the desync is
+// counted. In strict mode, it returns errDesync wrapped with retroproxy.ErrProtocol to end the session.
+func (s *session) desync(dir retroproxy.Direction, pkt string, prev string, handled bool) error {
+	if !retroproxy.Desynced(pkt) {
+		return nil
+	}
+	retroproxy.MetricDesyncs.WithLabelValues(metricLabel, string(dir)).Inc()
+	s.logger.Warn("protocol desync",
+		zap.String("direction", string(dir)),
+		zap.Bool("handled", handled),
+		zap.String("hex_dump", hex.Dump([]byte(pkt))),
+		zap.String("previous_hex_dump", hex.Dump([]byte(prev))),
+	)
+	if s.proxy.strict {
+		return fmt.Errorf("%w: %w", retroproxy.ErrProtocol, errDesync)
+	}
+	return nil
+}
+
+// checkHandled flags out, the packet that the packet handlers made from in, a packet from the dir side, if they broke
+// it, since the other side would be desynced. See desync.
+func (s *session) checkHandled(dir retroproxy.Direction, in string, out string) error {
+	var ok bool
+	switch dir {
+	case retroproxy.DirectionServer:
+		_, ok = retroproto.MsgSvrIdByPkt(out)
+	case retroproxy.DirectionClient:
+		out = s.trimUnknownToken(out)
+		_, ok = retroproto.MsgCliIdByPkt(out)
+	}
+	if ok {
+		return nil
+	}
+	return s.desync(dir, out, in, true)
+}
+
+// dropped reports whether the proxy is configured to drop the messages with id read from the dir side, and logs pkt
+// if it is.
+func (s *session) dropped(dir retroproxy.Direction, id string, pkt string) bool {
+	if _, ok := s.proxy.dropMessages[dir][id]; !ok || id == "" || s.proxy.sniffOnly {
+		return false
+	}
+	s.logger.Debug("dropped message",
+		zap.String("direction", string(dir)),
+		zap.String("packet", pkt),
+	)
+	return true
+}
+
+// forwardToServer sends a packet relayed from the client to the server once the throttle of the session lets it
+// through, and through the delay queue of the session if the proxy injects latency.
+func (s *session) forwardToServer(ctx context.Context, rawPacket string) error {
+	if s.clientThrottle != nil {
+		err := s.clientThrottle.Wait(ctx, len(rawPacket)+len("\n\x00"))
+		if err != nil {
+			return err
+		}
+	}
+	if s.toServer != nil {
+		return s.toServer.Push(ctx, rawPacket)
+	}
+	return s.sendPktToServer(rawPacket)
+}
+
+// forwardToClient sends a packet relayed from the server to the client, through the coalescer of the session if the
+// proxy coalesces packets.
+func (s *session) forwardToClient(ctx context.Context, pkt string) error {
+	if s.coalescer != nil {
+		return s.coalescer.push(ctx, pkt)
+	}
+	return s.throttleToClient(ctx, pkt)
+}
+
+// throttleToClient sends a packet relayed from the server to the client once the throttle of the session lets it
+// through, and through the delay queue of the session if the proxy injects latency.
+func (s *session) throttleToClient(ctx context.Context, pkt string) error {
+	if s.serverThrottle != nil {
+		err := s.serverThrottle.Wait(ctx, len(pkt)+len("\x00"))
+		if err != nil {
+			return err
+		}
+	}
+	if s.toClient != nil {
+		return s.toClient.Push(ctx, pkt)
+	}
+	return s.sendPktToClient(pkt)
+}
+
 func (s *session) sendMsgToServer(msg retroproto.MsgCli) error {
 	pkt, err := msg.Serialized()
 	if err != nil {
 		return err
 	}
-	s.sendPktToServer(fmt.Sprint(msg.MessageId(), pkt))
-	return nil
+	return s.sendPktToServer(fmt.Sprint(msg.MessageId(), pkt))
 }
 
 func (s *session) sendMsgToClient(msg retroproto.MsgSvr) error {
@@ -243,45 +859,276 @@ func (s *session) sendMsgToClient(msg retroproto.MsgSvr) error {
 	if err != nil {
 		return err
 	}
-	s.sendPktToClient(fmt.Sprint(msg.MessageId(), pkt))
-	return nil
+	return s.sendPktToClient(fmt.Sprint(msg.MessageId(), pkt))
 }
 
-func (s *session) sendPktToServer(rawPacket string) {
-	packet := rawPacket
+// sendPktToServer pushes rawPacket to the server writer.
+func (s *session) sendPktToServer(rawPacket string) error {
+	return s.serverWriter.push(rawPacket)
+}
 
-	// unknownToken seems to wrap a base64 encoded string sent by the client as the prefix of some types of packet.
-	// That mechanism was introduced by a new client version, but it's not clear to me which version or why.
-	// Maybe it's some kind of signature mechanism.
-	const unknownToken = "ù"
-	if strings.HasPrefix(packet, unknownToken) {
-		const index = 2
-		substrings := strings.SplitN(packet, unknownToken, index+1)
-		if len(substrings) != index+1 {
-			s.proxy.logger.Warn("invalid packet but won't discard it")
-		} else {
-			packet = substrings[index]
-		}
+// writeFrameToServer writes a packet pushed to the server writer, or queues it while the session resumes.
+func (s *session) writeFrameToServer(rawPacket string) error {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+
+	if s.resuming {
+		return s.queuePkt(rawPacket)
 	}
+	err := s.writePktToServer(rawPacket)
+	if err != nil && s.proxy.upstreamResume && errors.Is(err, errUpstream) {
+		// The server reader notices the broken connection too, and resumes the session.
+		s.logger.Warn("could not send packet to server, queuing it for resume",
+			zap.Error(err),
+		)
+		s.resuming = true
+		s.serverConn.Close()
+		return s.queuePkt(rawPacket)
+	}
+	return err
+}
+
+// writePktToServer writes rawPacket to the server connection. serverMu must be held.
+func (s *session) writePktToServer(rawPacket string) error {
+	packet := s.trimUnknownToken(rawPacket)
 
 	id, _ := retroproto.MsgCliIdByPkt(packet)
 	name, _ := retroproto.MsgCliNameByID(id)
-	s.proxy.logger.Info("sent packet to server",
-		zap.String("server_address", s.serverConn.RemoteAddr().String()),
+	s.logger.Info("sent packet to server",
+		zap.String("server_address", s.serverAddr),
 		zap.String("message_name", name),
 		zap.String("packet", packet),
 		zap.String("raw_packet", rawPacket),
 	)
-	fmt.Fprint(s.serverConn, rawPacket+"\n\x00")
+	err := s.setWriteDeadline(s.serverConn)
+	if err != nil {
+		return err
+	}
+	s.serverFrame = append(append(s.serverFrame[:0], rawPacket...), '\n', '\x00')
+	if s.hexDumper != nil {
+		s.hexDumper.Dump(retroproxy.DirectionClient, string(s.serverFrame))
+	}
+	_, err = s.serverConn.Write(s.serverFrame)
+	if err != nil {
+		return s.writeError(retroproxy.DirectionServer, err)
+	}
+	return nil
+}
+
+// sendPktToClient pushes pkt to the client writer.
+func (s *session) sendPktToClient(pkt string) error {
+	return s.clientWriter.push(pkt)
 }
 
-func (s *session) sendPktToClient(pkt string) {
+// writePktToClient writes a packet pushed to the client writer.
+func (s *session) writePktToClient(pkt string) error {
 	id, _ := retroproto.MsgSvrIdByPkt(pkt)
 	name, _ := retroproto.MsgSvrNameByID(id)
-	s.proxy.logger.Info("sent packet to client",
-		zap.String("client_address", s.clientConn.RemoteAddr().String()),
+	s.logger.Info("sent packet to client",
 		zap.String("message_name", name),
 		zap.String("packet", pkt),
 	)
-	fmt.Fprint(s.clientConn, pkt+"\x00")
+	err := s.setWriteDeadline(s.clientConn)
+	if err != nil {
+		return err
+	}
+	s.clientFrame = append(append(s.clientFrame[:0], pkt...), '\x00')
+	if s.hexDumper != nil {
+		s.hexDumper.Dump(retroproxy.DirectionServer, string(s.clientFrame))
+	}
+	_, err = s.clientConn.Write(s.clientFrame)
+	if err != nil {
+		return s.writeError(retroproxy.DirectionClient, err)
+	}
+	return nil
+}
+
+// publish publishes an event of the session to the event hub of the proxy, where seq is the sequence number of the
+// packet it comes from, or zero.
+func (s *session) publish(typ retroproxy.EventType, seq uint64, data interface{}) {
+	s.proxy.events.Publish(retroproxy.Event{
+		Type:      typ,
+		Proxy:     metricLabel,
+		SessionId: s.id,
+		Seq:       seq,
+		Data:      data,
+	})
+}
+
+// observePkt gives a sequence number to a packet read from the dir side and records it. Packets dropped by handlers
+// are numbered too, so that the numbers match those of the capture.
+func (s *session) observePkt(dir retroproxy.Direction, pkt string) {
+	if dir == retroproxy.DirectionClient {
+		clientPacketsMetric.Inc()
+	} else {
+		serverPacketsMetric.Inc()
+	}
+
+	seq := &s.serverSeq
+	if dir == retroproxy.DirectionClient {
+		seq = &s.clientSeq
+	}
+	*seq++
+
+	s.shadows.Write(dir, s.id, *seq, pkt)
+	if s.proxy.capture == nil {
+		return
+	}
+	err := s.proxy.capture.Write(dir, s.id, s.connectedAt, *seq, pkt)
+	if err != nil {
+		s.logger.Error("could not write packet to capture",
+			zap.Error(err),
+		)
+	}
+}
+
+// observeInjectedPkt records pkt, a packet injected into the session as if its dir side sent it. Unlike the packets
+// read from that side, it has no sequence number.
+func (s *session) observeInjectedPkt(dir retroproxy.Direction, pkt string) {
+	s.shadows.WriteInjected(dir, s.id, pkt)
+	if s.proxy.capture == nil {
+		return
+	}
+	err := s.proxy.capture.WriteInjected(dir, s.id, s.connectedAt, pkt)
+	if err != nil {
+		s.logger.Error("could not write packet to capture",
+			zap.Error(err),
+		)
+	}
+}
+
+// setReadDeadline refreshes the read deadline of conn if a read timeout is configured.
+func (s *session) setReadDeadline(conn net.Conn) error {
+	if s.proxy.readTimeout <= 0 {
+		return nil
+	}
+	return conn.SetReadDeadline(time.Now().Add(s.proxy.readTimeout))
+}
+
+// setWriteDeadline refreshes the write deadline of conn if a write timeout is configured.
+func (s *session) setWriteDeadline(conn net.Conn) error {
+	if s.proxy.writeTimeout <= 0 {
+		return nil
+	}
+	return conn.SetWriteDeadline(time.Now().Add(s.proxy.writeTimeout))
+}
+
+// writeError converts a write timeout of the connection with the dir side to errWriteTimeout, the other errors of the
+// client connection to io.EOF once the client half-closed it, and wraps the other errors of the server connection
+// with errUpstream.
+func (s *session) writeError(dir retroproxy.Direction, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		s.logger.Info("write timeout",
+			zap.String("direction", string(dir)),
+			zap.Duration("write_timeout", s.proxy.writeTimeout),
+		)
+		return errWriteTimeout
+	}
+	if dir == retroproxy.DirectionClient && s.clientHalfClosed.Load() {
+		// The client closed the whole connection rather than half of it.
+		return io.EOF
+	}
+	if dir == retroproxy.DirectionServer {
+		err = fmt.Errorf("%w: %w", errUpstream, err)
+	}
+	return err
+}
+
+// readError converts a read timeout of the connection with the dir side to errIdleTimeout, logs oversized packets and
+// wraps the other errors of the server connection with errUpstream.
+func (s *session) readError(dir retroproxy.Direction, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		s.logger.Info("idle timeout",
+			zap.String("direction", string(dir)),
+			zap.Duration("read_timeout", s.proxy.readTimeout),
+		)
+		return errIdleTimeout
+	}
+	if dir == retroproxy.DirectionServer {
+		err = fmt.Errorf("%w: %w", errUpstream, err)
+	}
+	if errors.Is(err, bufio.ErrTooLong) {
+		s.logger.Error("packet too large, closing session",
+			zap.String("direction", string(dir)),
+			zap.Int("max_packet_size", s.proxy.maxPacketSize),
+		)
+	}
+	return err
+}
+
+// quotaExceeded logs that the client went over the quota of the proxy and returns errQuota.
+func (s *session) quotaExceeded() error {
+	s.logger.Info("quota exceeded, closing session",
+		zap.Duration("quota_window", s.proxy.quota.Window),
+		zap.Int("bytes", s.quota.Bytes()),
+		zap.Int("packets", s.quota.Packets()),
+		zap.Int("max_bytes", s.proxy.quota.MaxBytes),
+		zap.Int("max_packets", s.proxy.quota.MaxPackets),
+	)
+	return errQuota
+}
+
+// disconnectReason returns why the session ended with err.
+func (s *session) disconnectReason(err error) retroproxy.DisconnectReason {
+	switch {
+	case s.kicked.Load():
+		return retroproxy.DisconnectKicked
+	case errors.Is(err, errIdleTimeout):
+		return retroproxy.DisconnectIdleTimeout
+	case errors.Is(err, errWriteTimeout):
+		return retroproxy.DisconnectWriteTimeout
+	case errors.Is(err, errCircuitOpen):
+		return retroproxy.DisconnectCircuitOpen
+	case errors.Is(err, errAccountLimit):
+		return retroproxy.DisconnectRefused
+	case errors.Is(err, errQuota):
+		return retroproxy.DisconnectQuotaExceeded
+	case errors.Is(err, errHandler):
+		return retroproxy.DisconnectHandlerError
+	case errors.Is(err, errPanic):
+		return retroproxy.DisconnectPanic
+	case errors.Is(err, errUpstream) && errors.Is(err, io.EOF):
+		return retroproxy.DisconnectServerClosed
+	case errors.Is(err, errUpstream):
+		return retroproxy.DisconnectUpstreamError
+	case err == nil || errors.Is(err, io.EOF):
+		return retroproxy.DisconnectClientClosed
+	case errors.Is(err, context.Canceled):
+		return retroproxy.DisconnectShutdown
+	default:
+		return retroproxy.DisconnectError
+	}
+}
+
+// logAccess writes the session, which ended with err, to the access log of the proxy.
+func (s *session) logAccess(err error) {
+	clientIP, _, _ := net.SplitHostPort(s.clientConn.RemoteAddr().String())
+	rec := retroproxy.AccessRecord{
+		Time:          time.Now(),
+		Proxy:         metricLabel,
+		SessionId:     s.id,
+		ClientIP:      clientIP,
+		ClientBytes:   s.clientBytes,
+		ServerBytes:   s.serverBytes,
+		ClientPackets: s.clientSeq,
+		ServerPackets: s.serverSeq,
+		DurationMs:    time.Since(s.connectedAt).Milliseconds(),
+		Reason:        s.disconnectReason(err),
+	}
+	if s.ticket.Host != "" {
+		rec.ServerAddress = s.ticket.Addr()
+	}
+	s.mu.Lock()
+	rec.Account = s.account
+	rec.Character = s.character
+	s.mu.Unlock()
+
+	err = s.proxy.accessLog.Write(rec)
+	if err != nil {
+		s.logger.Error("could not write to access log",
+			zap.Error(err),
+		)
+	}
 }
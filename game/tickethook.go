@@ -0,0 +1,16 @@
+package game
+
+import (
+	"github.com/kralamoure/retroproxy"
+)
+
+// TicketHook is called with each ticket used by a client, before the session connects to the game server of the
+// ticket. It can read the metadata attached to the ticket by the login proxy to make policy decisions: a non-nil
+// error refuses the session.
+type TicketHook func(t retroproxy.Ticket) error
+
+// OnTicket registers hooks, which are called in order of registration.
+// It must not be called after ListenAndServe.
+func (p *Proxy) OnTicket(hooks ...TicketHook) {
+	p.ticketHooks = append(p.ticketHooks, hooks...)
+}
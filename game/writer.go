@@ -0,0 +1,116 @@
+package game
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// writerQueueSize is how many frames a frameWriter holds before the goroutines pushing to it wait.
+	writerQueueSize = 1024
+	// writerDrainTimeout bounds how long the end of a session waits for its last frames to be written, such as the
+	// ticket response refusing the client.
+	writerDrainTimeout = 3 * time.Second
+)
+
+var errWriterClosed = errors.New("writer closed")
+
+// frameWriter is the single goroutine writing to a connection of a session. The relay loops, the delay queues and the
+// packets injected by the proxy all push their frames to it, so that the writes never interleave and keep the order in
+// which the frames were pushed.
+type frameWriter struct {
+	write     func(frame string) error
+	frames    chan string
+	closing   chan struct{}
+	closeOnce sync.Once
+	// done is closed once run returns, after err is set.
+	done chan struct{}
+	err  error
+}
+
+// newFrameWriter returns a frameWriter that writes its frames with write, which is only called by frameWriter.run.
+func newFrameWriter(write func(frame string) error) *frameWriter {
+	return &frameWriter{
+		write:   write,
+		frames:  make(chan string, writerQueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// push queues frame to be written, waiting while the queue is full. It fails once the writer is closed, or with the
+// error of the write that stopped it.
+func (w *frameWriter) push(frame string) error {
+	select {
+	case <-w.closing:
+		return errWriterClosed
+	case <-w.done:
+		return w.stopErr()
+	default:
+	}
+	select {
+	case w.frames <- frame:
+		return nil
+	case <-w.closing:
+		return errWriterClosed
+	case <-w.done:
+		return w.stopErr()
+	}
+}
+
+// stopErr returns why the writer stopped. done must be closed.
+func (w *frameWriter) stopErr() error {
+	if w.err != nil {
+		return w.err
+	}
+	return errWriterClosed
+}
+
+// run writes the pushed frames until a write fails or the writer is closed, in which case it writes the frames left in
+// the queue first. It returns the error of the write that failed, if any.
+func (w *frameWriter) run() (err error) {
+	defer func() {
+		w.err = err
+		close(w.done)
+	}()
+	for {
+		select {
+		case frame := <-w.frames:
+			err := w.write(frame)
+			if err != nil {
+				return err
+			}
+		case <-w.closing:
+			return w.drain()
+		}
+	}
+}
+
+func (w *frameWriter) drain() error {
+	for {
+		select {
+		case frame := <-w.frames:
+			err := w.write(frame)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// close stops the writer once the frames pushed so far are written, waiting for it for up to timeout. The connection
+// must be closed afterwards, which unblocks a write that takes longer.
+func (w *frameWriter) close(timeout time.Duration) {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+	})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+	}
+}
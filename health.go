@@ -0,0 +1,117 @@
+package retroproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Listener is a proxy whose listener can be checked by a HealthChecker.
+type Listener interface {
+	// Listening reports whether the listener of the proxy is up.
+	Listening() bool
+}
+
+// HealthChecker reports whether the proxies can serve clients: their listeners must be up and the upstream server
+// reachable. The upstream server is checked periodically and the result is cached, so that probes don't dial it.
+// It is safe for concurrent use.
+type HealthChecker struct {
+	check     func(ctx context.Context) error
+	interval  time.Duration
+	listeners map[string]Listener
+
+	mu        sync.Mutex
+	err       error
+	checkedAt time.Time
+}
+
+// NewHealthChecker returns a HealthChecker that checks the upstream server with check every interval, and the
+// listeners of the proxies in listeners, keyed by name.
+func NewHealthChecker(check func(ctx context.Context) error, interval time.Duration, listeners map[string]Listener) *HealthChecker {
+	return &HealthChecker{
+		check:     check,
+		interval:  interval,
+		listeners: listeners,
+		err:       errNotChecked,
+	}
+}
+
+var errNotChecked = errors.New("upstream not checked yet")
+
+// Run checks the upstream server right away and then every interval, until ctx is done.
+func (h *HealthChecker) Run(ctx context.Context) error {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, h.interval)
+		err := h.check(checkCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		h.mu.Lock()
+		h.err = err
+		h.checkedAt = time.Now()
+		h.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Healthy returns nil if the listeners are up and the last check of the upstream server succeeded, or why not.
+func (h *HealthChecker) Healthy() error {
+	names := make([]string, 0, len(h.listeners))
+	for name := range h.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !h.listeners[name].Listening() {
+			return fmt.Errorf("%s listener is down", name)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil {
+		return fmt.Errorf("upstream unreachable: %w", h.err)
+	}
+	return nil
+}
+
+// healthResponse is the body of the responses of the health check handler.
+type healthResponse struct {
+	Status    string     `json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+// ServeHTTP responds with 200 if the proxies are healthy, or with 503 and the reason otherwise.
+func (h *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: "ok"}
+	status := http.StatusOK
+	if err := h.Healthy(); err != nil {
+		resp = healthResponse{Status: "unavailable", Reason: err.Error()}
+		status = http.StatusServiceUnavailable
+	}
+	h.mu.Lock()
+	if !h.checkedAt.IsZero() {
+		checkedAt := h.checkedAt
+		resp.CheckedAt = &checkedAt
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
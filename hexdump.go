@@ -0,0 +1,41 @@
+package retroproxy
+
+import (
+	"encoding/hex"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// HexDumper logs the packets sent by a session as hex and ASCII dumps at debug level, up to a number of packets so
+// that busy sessions don't flood the logs. It is safe for concurrent use.
+type HexDumper struct {
+	logger Logger
+	max    int64
+	n      atomic.Int64
+}
+
+// NewHexDumper returns a HexDumper that logs to l up to max packets, or all of them if max is zero.
+func NewHexDumper(l Logger, max int) *HexDumper {
+	return &HexDumper{
+		logger: l,
+		max:    int64(max),
+	}
+}
+
+// Dump logs the bytes of a packet relayed from the dir side as they're written, with their terminator.
+func (d *HexDumper) Dump(dir Direction, b string) {
+	n := d.n.Add(1)
+	if d.max > 0 && n > d.max {
+		if n == d.max+1 {
+			d.logger.Debug("reached maximum number of hex dumps of session",
+				zap.Int64("max_packets", d.max),
+			)
+		}
+		return
+	}
+	d.logger.Debug("packet hex dump",
+		zap.String("direction", string(dir)),
+		zap.String("hex_dump", hex.Dump([]byte(b))),
+	)
+}
@@ -0,0 +1,53 @@
+package gametest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Client is a game client for tests, which sends and reads packets with the terminators of the game protocol.
+type Client struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// Dial connects a Client to the game proxy at addr.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// Send sends pkt to the proxy.
+func (c *Client) Send(pkt string) error {
+	_, err := fmt.Fprint(c.conn, pkt+"\n\x00")
+	return err
+}
+
+// Read reads the next packet sent by the proxy, without its terminator, waiting for up to timeout.
+func (c *Client) Read(timeout time.Duration) (string, error) {
+	err := c.conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return "", err
+	}
+	pkt, err := c.rd.ReadString('\x00')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(pkt, "\x00"), nil
+}
+
+// CloseWrite closes the write side of the connection with the proxy, which still reads the packets it sends.
+func (c *Client) CloseWrite() error {
+	return c.conn.(*net.TCPConn).CloseWrite()
+}
+
+// Close closes the connection with the proxy.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,277 @@
+// Package gametest provides a stub game server for the tests and tools that run the game proxy, which plays a scripted
+// exchange with each connection and records the packets it receives, so that they can relay sessions without a real
+// Dofus server.
+package gametest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kralamoure/retroproto"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// Step is a packet that the client is expected to send, and the packets that the server sends back.
+type Step struct {
+	// Prefix is the prefix of the expected packet. An empty prefix matches any packet.
+	Prefix  string
+	Replies []string
+	// Repeat makes the step match every packet that follows instead of only the next one, such as to answer each
+	// packet of a benchmark.
+	Repeat bool
+}
+
+// TicketStep is the first step of most scripts: it accepts the ticket of the client.
+var TicketStep = Step{
+	Prefix:  string(retroproto.AccountSendTicket),
+	Replies: []string{string(retroproto.AccountTicketResponseSuccess) + "0"},
+}
+
+// Config configures a Server.
+type Config struct {
+	// Script is played with each connection.
+	Script []Step
+	// ChunkSize, if not zero, is the size of the writes of the server, small enough to split packets across the reads
+	// of the proxy.
+	ChunkSize int
+	// NoRecord makes the server not record the packets it receives, for long runs such as benchmarks.
+	NoRecord bool
+	// Addr is the address the server listens on, "127.0.0.1:0" if it's empty.
+	Addr string
+	// Hello, if not empty, replaces the hello of the game protocol, such as to stand in for a login server with the
+	// AksHelloConnect message of its key.
+	Hello string
+}
+
+// Server is a stub game server listening on a local port. It sends its hello to each connection, then goes through its
+// script: each packet received must start with the prefix of the current step, and is answered with its replies.
+// The packets received after the end of the script are only recorded. It is safe for concurrent use.
+type Server struct {
+	ln        net.Listener
+	script    []Step
+	chunkSize int
+	noRecord  bool
+	hello     string
+	wg        sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	received []string
+	err      error
+}
+
+// NewServer starts a Server playing script with each connection.
+func NewServer(script ...Step) (*Server, error) {
+	return New(Config{Script: script})
+}
+
+// New starts a Server configured with c.
+func New(c Config) (*Server, error) {
+	addr := c.Addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:        ln,
+		script:    c.Script,
+		chunkSize: c.ChunkSize,
+		noRecord:  c.NoRecord,
+		hello:     c.Hello,
+		conns:     make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.serve()
+	}()
+	return s, nil
+}
+
+// Addr returns the address of the listener of the server.
+func (s *Server) Addr() *net.TCPAddr {
+	return s.ln.Addr().(*net.TCPAddr)
+}
+
+// Ticket returns a ticket leading the game proxy to the server, to be stored in its ticket store under original.
+func (s *Server) Ticket(original string) retroproxy.Ticket {
+	return retroproxy.Ticket{
+		Host:     s.Addr().IP.String(),
+		Port:     strconv.Itoa(s.Addr().Port),
+		Original: original,
+		IssuedAt: time.Now(),
+	}
+}
+
+// Received returns the packets received by the server so far, from all connections, without their terminator.
+func (s *Server) Received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// WaitReceived waits until the server received n packets or timeout expires, and returns the packets received.
+func (s *Server) WaitReceived(n int, timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+	for {
+		received := s.Received()
+		if len(received) >= n || time.Now().After(deadline) {
+			return received
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// WaitPacket waits until the server received pkt, and returns the packets received before it. It fails once ctx is
+// done, or as soon as a packet didn't match its step of the script.
+func (s *Server) WaitPacket(ctx context.Context, pkt string) ([]string, error) {
+	for {
+		received := s.Received()
+		for i, p := range received {
+			if p == pkt {
+				return received[:i], nil
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("packet %q not received: %w", pkt, ctx.Err())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// Err returns the first packet that didn't match its step of the script, as an error, or nil.
+func (s *Server) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops the server and closes its connections, waiting for their goroutines to return.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	bw := bufio.NewWriter(conn)
+	hello := s.hello
+	if hello == "" {
+		hello = string(retroproto.AksHelloGame)
+	}
+	err := s.write(bw, hello)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return
+	}
+
+	rd := bufio.NewReader(conn)
+	step := 0
+	for {
+		pkt, err := rd.ReadString('\x00')
+		if err != nil {
+			return
+		}
+		pkt = strings.TrimSuffix(strings.TrimSuffix(pkt, "\x00"), "\n")
+		if !s.noRecord {
+			s.mu.Lock()
+			s.received = append(s.received, pkt)
+			s.mu.Unlock()
+		}
+		if step < len(s.script) {
+			st := s.script[step]
+			if !strings.HasPrefix(pkt, st.Prefix) {
+				s.mu.Lock()
+				if s.err == nil {
+					s.err = fmt.Errorf("step %d: got packet %q, want prefix %q", step, pkt, st.Prefix)
+				}
+				s.mu.Unlock()
+				return
+			}
+			if !st.Repeat {
+				step++
+			}
+			for _, reply := range st.Replies {
+				err := s.write(bw, reply)
+				if err != nil {
+					return
+				}
+			}
+		}
+		// Replies are flushed once the packets of the client that were read together are all answered.
+		if rd.Buffered() == 0 {
+			err := bw.Flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// write writes pkt and its terminator to bw, flushing each chunk of chunkSize bytes if the server splits its writes.
+func (s *Server) write(bw *bufio.Writer, pkt string) error {
+	data := pkt + "\x00"
+	if s.chunkSize <= 0 {
+		_, err := bw.WriteString(data)
+		return err
+	}
+	for len(data) > 0 {
+		n := s.chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err := bw.WriteString(data[:n])
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package retroproxy
+
+import (
+	"net"
+)
+
+// IPFilter decides which source IPs may connect to a proxy. Deny rules take precedence over allow rules, and an empty
+// allowlist allows every IP that isn't denied.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter makes an IPFilter from lists of CIDR notation networks.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	for _, v := range allow {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		f.allow = append(f.allow, n)
+	}
+	for _, v := range deny {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		f.deny = append(f.deny, n)
+	}
+	return f, nil
+}
+
+// Check reports whether ip is allowed, along with the rule that decided it, which is empty if no rule matched.
+func (f *IPFilter) Check(ip net.IP) (allowed bool, rule string) {
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false, "deny " + n.String()
+		}
+	}
+	if len(f.allow) == 0 {
+		return true, ""
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true, "allow " + n.String()
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,110 @@
+package retroproxy
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LatencyInjector delays packets to test clients under poor network conditions. Each packet is delayed by a fixed
+// latency plus a random jitter. It is safe for concurrent use.
+type LatencyInjector struct {
+	latency time.Duration
+	jitter  time.Duration
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewLatencyInjector returns a LatencyInjector that delays packets by latency plus up to jitter.
+func NewLatencyInjector(latency, jitter time.Duration) *LatencyInjector {
+	return &LatencyInjector{
+		latency: latency,
+		jitter:  jitter,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// delay returns the delay of a packet.
+func (l *LatencyInjector) delay() time.Duration {
+	if l.jitter <= 0 {
+		return l.latency
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latency + time.Duration(l.rand.Int63n(int64(l.jitter)+1))
+}
+
+// delayQueueSize is how many packets a DelayQueue holds before Push blocks.
+const delayQueueSize = 1024
+
+// DelayQueue sends packets once the delay given by its LatencyInjector expires. Packets are sent in the order they
+// were pushed: a packet whose delay would expire before the one of the previous packet waits for it.
+type DelayQueue struct {
+	injector *LatencyInjector
+	send     func(pkt string) error
+	pkts     chan delayedPkt
+	// last is when the last pushed packet is sent. It's only used by the pushing goroutine.
+	last time.Time
+}
+
+type delayedPkt struct {
+	pkt    string
+	sendAt time.Time
+}
+
+// NewQueue returns a DelayQueue that sends its packets with send, which is only called by DelayQueue.Run.
+func (l *LatencyInjector) NewQueue(send func(pkt string) error) *DelayQueue {
+	return &DelayQueue{
+		injector: l,
+		send:     send,
+		pkts:     make(chan delayedPkt, delayQueueSize),
+	}
+}
+
+// Push queues pkt to be sent after its delay. It must be called by a single goroutine.
+func (q *DelayQueue) Push(ctx context.Context, pkt string) error {
+	sendAt := time.Now().Add(q.injector.delay())
+	if sendAt.Before(q.last) {
+		sendAt = q.last
+	}
+	q.last = sendAt
+
+	select {
+	case q.pkts <- delayedPkt{pkt: pkt, sendAt: sendAt}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run sends the queued packets until ctx is done or sending fails. The packets left in the queue are discarded.
+func (q *DelayQueue) Run(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	for {
+		var p delayedPkt
+		select {
+		case p = <-q.pkts:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if d := time.Until(p.sendAt); d > 0 {
+			timer.Reset(d)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err := q.send(p.pkt)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package retroproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// minRestartBackoff and maxRestartBackoff bound the wait before a SupervisedListener binds again, which doubles
+	// with each restart until a connection is accepted.
+	minRestartBackoff = 100 * time.Millisecond
+	maxRestartBackoff = 5 * time.Second
+)
+
+// SupervisedListener is a TCP listener that can bind its address again when accepting fails, instead of failing the
+// proxy. It is safe for concurrent use.
+type SupervisedListener struct {
+	addr    *net.TCPAddr
+	restart bool
+	logger  Logger
+	done    chan struct{}
+
+	mu     sync.Mutex
+	ln     *net.TCPListener
+	closed bool
+}
+
+// ListenSupervised listens on addr. If restart is true, the listener binds again after accepting fails, and only
+// fails itself if binding fails with a permanent error, such as the address being in use.
+func ListenSupervised(addr *net.TCPAddr, restart bool, logger Logger) (*SupervisedListener, error) {
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &SupervisedListener{
+		// The listener binds the same port again, even if addr let the system choose it.
+		addr:    ln.Addr().(*net.TCPAddr),
+		restart: restart,
+		logger:  logger,
+		done:    make(chan struct{}),
+		ln:      ln,
+	}, nil
+}
+
+// AcceptTCP waits for the next connection, restarting the listener as needed.
+func (l *SupervisedListener) AcceptTCP() (*net.TCPConn, error) {
+	backoff := minRestartBackoff
+	for {
+		l.mu.Lock()
+		ln := l.ln
+		l.mu.Unlock()
+
+		conn, err := ln.AcceptTCP()
+		if err == nil {
+			return conn, nil
+		}
+		if !l.restart || l.isClosed() {
+			return nil, err
+		}
+
+		l.logger.Warn("listener failed, restarting it",
+			zap.String("address", l.addr.String()),
+			zap.Error(err),
+			zap.Duration("backoff", backoff),
+		)
+		err = l.rebind(ln, backoff)
+		if err != nil {
+			return nil, err
+		}
+		backoff *= 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// rebind closes ln and binds the address again after backoff, retrying until it succeeds, the listener is closed or
+// binding fails with a permanent error.
+func (l *SupervisedListener) rebind(ln *net.TCPListener, backoff time.Duration) error {
+	ln.Close()
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-l.done:
+			timer.Stop()
+			return net.ErrClosed
+		}
+
+		newLn, err := net.ListenTCP("tcp", l.addr)
+		if err == nil {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.closed {
+				newLn.Close()
+				return net.ErrClosed
+			}
+			l.ln = newLn
+			l.logger.Info("restarted listener",
+				zap.String("address", newLn.Addr().String()),
+			)
+			return nil
+		}
+		if permanentListenError(err) {
+			return fmt.Errorf("could not restart listener: %w", err)
+		}
+		l.logger.Warn("could not restart listener, retrying",
+			zap.String("address", l.addr.String()),
+			zap.Error(err),
+		)
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// permanentListenError reports whether binding an address failed for a reason that retrying won't fix.
+func permanentListenError(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EACCES)
+}
+
+func (l *SupervisedListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// Addr returns the address the listener is bound to.
+func (l *SupervisedListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ln.Addr()
+}
+
+// Close closes the listener, which is not restarted anymore.
+func (l *SupervisedListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	return l.ln.Close()
+}
+
+// SetKeepAlive enables TCP keepalive on conn with the given period, or disables it if period is negative.
+func SetKeepAlive(conn *net.TCPConn, period time.Duration) error {
+	if period < 0 {
+		return conn.SetKeepAlive(false)
+	}
+	err := conn.SetKeepAlive(true)
+	if err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(period)
+}
+
+// SetNoDelay sets whether the TCP connection of conn sends small writes right away, or delays them with Nagle's
+// algorithm. It unwraps the connections that have a NetConn method, such as TLS ones, and leaves the others unchanged.
+func SetNoDelay(conn net.Conn, noDelay bool) error {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c.SetNoDelay(noDelay)
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package retroproxy
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Logger is the logger used by the proxies and the ticket stores. *zap.Logger implements it, so any zap core can be
+// used, but other logging systems can be plugged in with an adapter.
+type Logger interface {
+	Debug(msg string, fields ...zap.Field)
+	Info(msg string, fields ...zap.Field)
+	Warn(msg string, fields ...zap.Field)
+	Error(msg string, fields ...zap.Field)
+}
+
+// ZapLogger returns l as a Logger, or a no-op one if l is nil, since a nil *zap.Logger would make a non-nil Logger
+// that panics when used.
+func ZapLogger(l *zap.Logger) Logger {
+	if l == nil {
+		return zap.NewNop()
+	}
+	return l
+}
+
+// WithFields returns a Logger that adds fields to every entry logged by l.
+func WithFields(l Logger, fields ...zap.Field) Logger {
+	if zl, ok := l.(*zap.Logger); ok {
+		return zl.With(fields...)
+	}
+	return &fieldsLogger{logger: l, fields: fields}
+}
+
+type fieldsLogger struct {
+	logger Logger
+	fields []zap.Field
+}
+
+func (l *fieldsLogger) Debug(msg string, fields ...zap.Field) {
+	l.logger.Debug(msg, l.with(fields)...)
+}
+
+func (l *fieldsLogger) Info(msg string, fields ...zap.Field) {
+	l.logger.Info(msg, l.with(fields)...)
+}
+
+func (l *fieldsLogger) Warn(msg string, fields ...zap.Field) {
+	l.logger.Warn(msg, l.with(fields)...)
+}
+
+func (l *fieldsLogger) Error(msg string, fields ...zap.Field) {
+	l.logger.Error(msg, l.with(fields)...)
+}
+
+func (l *fieldsLogger) with(fields []zap.Field) []zap.Field {
+	return append(l.fields[:len(l.fields):len(l.fields)], fields...)
+}
+
+// FieldsLogger is a Logger that adds fields to every entry, which can be changed while it's in use. It is safe for
+// concurrent use.
+type FieldsLogger struct {
+	logger Logger
+	fields []zap.Field
+	mu     sync.Mutex
+}
+
+func NewFieldsLogger(l Logger, fields ...zap.Field) *FieldsLogger {
+	return &FieldsLogger{logger: l, fields: fields}
+}
+
+// Set replaces the field with the same key as f, or adds f if there is none.
+func (l *FieldsLogger) Set(f zap.Field) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fields := make([]zap.Field, 0, len(l.fields)+1)
+	for _, v := range l.fields {
+		if v.Key != f.Key {
+			fields = append(fields, v)
+		}
+	}
+	l.fields = append(fields, f)
+}
+
+func (l *FieldsLogger) Debug(msg string, fields ...zap.Field) {
+	l.logger.Debug(msg, l.with(fields)...)
+}
+
+func (l *FieldsLogger) Info(msg string, fields ...zap.Field) {
+	l.logger.Info(msg, l.with(fields)...)
+}
+
+func (l *FieldsLogger) Warn(msg string, fields ...zap.Field) {
+	l.logger.Warn(msg, l.with(fields)...)
+}
+
+func (l *FieldsLogger) Error(msg string, fields ...zap.Field) {
+	l.logger.Error(msg, l.with(fields)...)
+}
+
+func (l *FieldsLogger) with(fields []zap.Field) []zap.Field {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Set never modifies l.fields in place, so the copy can be shared.
+	return append(l.fields[:len(l.fields):len(l.fields)], fields...)
+}
@@ -0,0 +1,17 @@
+package retroproxy
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestZapLoggerNil(t *testing.T) {
+	var zl *zap.Logger
+	l := ZapLogger(zl)
+	if l == nil {
+		t.Fatal("got a nil Logger")
+	}
+	// It would panic if it was the nil *zap.Logger.
+	l.Info("logged")
+}
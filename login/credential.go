@@ -0,0 +1,77 @@
+package login
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kralamoure/retroproto"
+
+	"github.com/kralamoure/retroproxy"
+)
+
+// passwordAlphabet is the alphabet of the passwords encrypted by the client, as in retroproto.EncryptPassword.
+const passwordAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_"
+
+// passwordCryptoMethod is the crypto method of the AccountCredential messages whose password DecryptPassword decrypts.
+const passwordCryptoMethod = 1
+
+// Credential is the username and the decrypted password sent by a client to log in.
+type Credential struct {
+	Username string
+	Password string
+}
+
+// CredentialHook is called with the credential of each client that logs in, along with its session, before it's sent
+// to the server. Hooks only observe: the packet sent to the server is the one of the client.
+type CredentialHook func(c Credential, si retroproxy.SessionInfo)
+
+// OnCredential registers hooks, which are called in order of registration. The proxy only decrypts the passwords of
+// the clients if there are hooks. It must not be called after ListenAndServe.
+func (p *Proxy) OnCredential(hooks ...CredentialHook) {
+	p.credentialHooks = append(p.credentialHooks, hooks...)
+}
+
+// loggedPacket returns pkt, a packet of the client whose message id is id, as it's logged: the password hash of
+// AccountCredential messages is redacted, since the key it's encrypted with is logged too.
+func loggedPacket(id retroproto.MsgCliId, pkt string) string {
+	if id != retroproto.AccountCredential {
+		return pkt
+	}
+	// "<username>\n#<crypto method><hash>"
+	username, hash, ok := strings.Cut(pkt, "\n")
+	if !ok || len(hash) < 2 {
+		return pkt
+	}
+	return username + "\n" + hash[:2] + "redacted"
+}
+
+// DecryptPassword returns the password that the client encrypted into hash with key, the salt of the AksHelloConnect
+// message of the server. It reverses retroproto.EncryptPassword, which is the crypto method 1 of the AccountCredential
+// messages.
+func DecryptPassword(hash string, key string) (string, error) {
+	if len(hash)%2 != 0 {
+		return "", errors.New("encrypted password has an odd length")
+	}
+	if len(hash)/2 > len(key) {
+		return "", errors.New("encrypted password is longer than its key")
+	}
+
+	n := len(passwordAlphabet)
+	var sb strings.Builder
+	for i := 0; i < len(hash)/2; i++ {
+		high := strings.IndexByte(passwordAlphabet, hash[2*i])
+		low := strings.IndexByte(passwordAlphabet, hash[2*i+1])
+		if high < 0 || low < 0 {
+			return "", errors.New("encrypted password has an invalid character")
+		}
+		// Each character of the password is split in two halves, shifted by the character of the key.
+		shift := int(key[i]) % n
+		high = (high - shift + n) % n
+		low = (low - shift + n) % n
+		if high > 15 || low > 15 {
+			return "", errors.New("encrypted password does not match its key")
+		}
+		sb.WriteByte(byte(high<<4 | low))
+	}
+	return sb.String(), nil
+}
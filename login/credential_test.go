@@ -0,0 +1,51 @@
+package login
+
+import (
+	"testing"
+
+	"github.com/kralamoure/retroproto"
+)
+
+// testKey is a key of an AksHelloConnect message.
+const testKey = "ysdxbvhwxpthmgfzifcbfiybdnyajzfq"
+
+func TestDecryptPassword(t *testing.T) {
+	for _, password := range []string{
+		"",
+		"hunter2",
+		"Passw0rd-_!",
+		"mot de passe été",
+		"пароль",
+		testKey,
+	} {
+		hash := retroproto.EncryptPassword(password, testKey)
+		got, err := DecryptPassword(hash, testKey)
+		if err != nil {
+			t.Errorf("DecryptPassword(%q) of %q: %v", hash, password, err)
+			continue
+		}
+		if got != password {
+			t.Errorf("DecryptPassword(%q) = %q, want %q", hash, got, password)
+		}
+	}
+}
+
+func TestDecryptPasswordError(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+		key  string
+	}{
+		{name: "odd length", hash: retroproto.EncryptPassword("hunter2", testKey)[1:], key: testKey},
+		{name: "invalid character", hash: "ab*d", key: testKey},
+		{name: "longer than its key", hash: retroproto.EncryptPassword("hunter2", testKey), key: "abc"},
+		{name: "bad key", hash: "__", key: "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := DecryptPassword(tt.hash, tt.key); err == nil {
+				t.Errorf("DecryptPassword(%q, %q) = %q, want error", tt.hash, tt.key, got)
+			}
+		})
+	}
+}
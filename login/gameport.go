@@ -0,0 +1,12 @@
+package login
+
+// GamePortFunc returns the port of the game proxy that the client holding ticket is redirected to, such as an
+// ephemeral listener the game proxy opened for that ticket.
+type GamePortFunc func(ticket string) (string, error)
+
+// SetGamePort makes the proxy redirect each client to the port returned by f, after storing its ticket, instead of the
+// port of the game public address. That port is still used for the clients for which f fails.
+// It must not be called after ListenAndServe.
+func (p *Proxy) SetGamePort(f GamePortFunc) {
+	p.gamePortFunc = f
+}
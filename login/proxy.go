@@ -2,94 +2,346 @@ package login
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gofrs/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/kralamoure/retroproxy"
 )
 
+// metricLabel is the value of the proxy label of the metrics.
+const metricLabel = "login"
+
+// DefaultMaxClientPacketSize is the maximum size of the packets of the clients by default. The packets of the login
+// protocol are small, so larger ones are almost certainly malicious.
+const DefaultMaxClientPacketSize = 1024
+
 type Proxy struct {
-	logger     *zap.Logger
-	addr       *net.TCPAddr
-	serverAddr *net.TCPAddr
-	storer     retroproxy.Storer
-	forceAdmin bool
+	logger         retroproxy.Logger
+	addr           *net.TCPAddr
+	server         atomic.Pointer[server]
+	storer         retroproxy.Storer
+	forceAdmin     bool
+	sniffOnly      bool
+	strict         bool
+	capture        *retroproxy.Capture
+	hexDump        bool
+	hexDumpMaxPkts int
+	accessLog      *retroproxy.AccessLog
+	events         *retroproxy.EventHub
+	tracer         trace.Tracer
+	upstreamTLS    *tls.Config
+	dialer         retroproxy.Dialer
+	breaker        *retroproxy.CircuitBreaker
+	ticketHooks    []TicketHook
+	// credentialHooks are called with the credential of each client.
+	credentialHooks []CredentialHook
+	// upstreamAccount and upstreamPassword replace the credentials of the clients, if upstreamAccount is not empty.
+	upstreamAccount  string
+	upstreamPassword string
+	// resolveServerAddr is false if the login server address is resolved by the dialer.
+	resolveServerAddr bool
+
+	// maxClientPacketSize is the maximum size of the packets read from the clients, with their terminator.
+	maxClientPacketSize int
+
+	proxyProtocol   bool
+	ipFilter        *retroproxy.IPFilter
+	connLimiter     *retroproxy.ConnLimiter
+	sessionLimiter  *retroproxy.SessionLimiter
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	shutdownGrace   time.Duration
+	tcpKeepAlive    time.Duration
+	tcpNagle        bool
+	restartListener bool
+	activated       *retroproxy.ActivatedListeners
+	// maxIPSessions is the maximum number of concurrent sessions from a source IP, or zero.
+	maxIPSessions int
+	quota         retroproxy.Quota
+
+	allowedVersions map[string]struct{}
+	// requiredVersion is the version that refused clients are asked for.
+	requiredVersion string
 
 	gameHost string
 	gamePort string
+	// gamePortFunc, if not nil, returns the game port of each ticket instead of gamePort.
+	gamePortFunc GamePortFunc
 
-	ln       *net.TCPListener
-	sessions map[*session]struct{}
-	mu       sync.Mutex
+	ln        *retroproxy.SupervisedListener
+	listening atomic.Bool
+	sessions  map[*session]struct{}
+	// ipSessions is the number of sessions from each source IP, counted when maxIPSessions is set.
+	ipSessions map[string]int // guarded by mu
+	mu         sync.Mutex
 
 	cache proxyCache
 }
 
 type proxyCache struct {
-	serverPort     int
 	uuidByUsername map[string]string // guarded by proxy mu
 }
 
-func NewProxy(addr, serverAddr, gamePublicAddr string, storer retroproxy.Storer, forceAdmin bool, logger *zap.Logger) (*Proxy, error) {
-	if storer == nil {
-		return nil, errors.New("storer is nil")
-	}
+// server is the login server that new sessions connect to.
+type server struct {
+	// addr is the address to dial, which is resolved unless the proxy dials through an upstream proxy.
+	addr string
+	host string
+	port int
+}
 
-	if logger == nil {
-		logger = zap.NewNop()
+func resolveServer(addr string, resolve bool) (*server, error) {
+	dialAddr := addr
+	if resolve {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		dialAddr = tcpAddr.String()
 	}
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
+	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	tcpServerAddr, err := net.ResolveTCPAddr("tcp4", serverAddr)
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
 		return nil, err
 	}
 
-	_, serverPortStr, err := net.SplitHostPort(serverAddr)
+	return &server{addr: dialAddr, host: host, port: port}, nil
+}
+
+// Config is the configuration of a Proxy.
+type Config struct {
+	// Addr is the address of the listener.
+	Addr string
+	// ServerAddr is the address of the login server.
+	ServerAddr string
+	// GamePublicAddr is the address of the game proxy that clients are redirected to. Its host must be an IPv4 address
+	// or a host name, since clients can't parse IPv6 addresses.
+	GamePublicAddr string
+	// Storer is where the proxy stores the tickets for the game proxy.
+	Storer retroproxy.Storer
+	// ForceAdmin forces admin mode on the client.
+	ForceAdmin bool
+	// SniffOnly makes the proxy forward packets verbatim, so the client is not redirected to the game proxy and
+	// ForceAdmin has no effect.
+	SniffOnly bool
+	// Strict ends the sessions in which a packet could not be decoded or looks like a protocol desync. Otherwise, such
+	// packets are logged and forwarded as they are.
+	Strict bool
+	// UpstreamAccount and UpstreamPassword, if not empty, replace the credentials sent by every client, so that the
+	// clients log in to that account without knowing its password. The password is encrypted with the key of each
+	// session, as the client does. Anyone who can reach the proxy can then use the account. It has no effect in
+	// sniff-only mode.
+	UpstreamAccount  string
+	UpstreamPassword string
+	// Capture, if not nil, receives every packet read by the proxy.
+	Capture *retroproxy.Capture
+	// HexDump logs the packets sent by the sessions as hex dumps at debug level, up to HexDumpMaxPkts packets per
+	// session unless it's zero.
+	HexDump        bool
+	HexDumpMaxPkts int
+	// AccessLog, if not nil, receives a record of each completed session.
+	AccessLog *retroproxy.AccessLog
+	// Events, if not nil, receives the events of the sessions.
+	Events *retroproxy.EventHub
+	// Tracer, if not nil, records a trace of each session, with spans for the connection to the server, the login handshake.
+	Tracer trace.Tracer
+	// UpstreamTLS, if not nil, is used to connect to the login server over TLS. Its ServerName defaults to the host of
+	// the login server address.
+	UpstreamTLS *tls.Config
+	// Breaker, if not nil, refuses the sessions whose server keeps failing to connect.
+	Breaker *retroproxy.CircuitBreaker
+	// Dialer, if not nil, connects to the login server instead of a direct connection, such as through an upstream
+	// proxy. The address of the login server is then resolved by the dialer.
+	Dialer retroproxy.Dialer
+	// ProxyProtocol makes the proxy expect a PROXY protocol header on each connection, whose source address is then
+	// used as the client address.
+	ProxyProtocol bool
+	// IPFilter, if not nil, decides which source IPs may connect.
+	IPFilter *retroproxy.IPFilter
+	// ConnLimiter, if not nil, limits the rate of new connections from each source IP.
+	ConnLimiter *retroproxy.ConnLimiter
+	// SessionLimiter, if not nil, caps the number of concurrent sessions, which may be shared with other proxies.
+	// Connections beyond it are closed right away.
+	SessionLimiter *retroproxy.SessionLimiter
+	// MaxSessionsPerIP is the maximum number of concurrent sessions from a single source IP, counted from when their
+	// connection is accepted. Connections beyond it are closed right away. Zero disables it.
+	MaxSessionsPerIP int
+	// Quota is the bytes and packets that each session may read from its client in a window of time, beyond which the
+	// session is closed.
+	Quota retroproxy.Quota
+	// ReadTimeout is how long a connection may stay idle before the session is closed. Zero disables it.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long a write to a connection may block before the session is closed. Zero disables it.
+	WriteTimeout time.Duration
+	// MaxClientPacketSize is the maximum size in bytes of the packets read from the clients, which are closed if they
+	// send a larger one, before they could even log in. Zero means DefaultMaxClientPacketSize.
+	MaxClientPacketSize int
+	// ShutdownGrace is how long sessions are given to finish after the listener is closed. Zero closes them right away.
+	ShutdownGrace time.Duration
+	// TCPKeepAlive is the keepalive period of the client connections and of the connections to the servers made by
+	// the default Dialer. Zero leaves the defaults of the system, and a negative value disables keepalive.
+	TCPKeepAlive time.Duration
+	// TCPNagle enables Nagle's algorithm on the client connections and on the connections to the servers, which
+	// sends fewer packets at the cost of latency. Go disables it by default.
+	TCPNagle bool
+	// Activated, if not nil, has the listeners inherited from systemd socket activation, one of which the proxy uses if
+	// it's bound to Addr instead of binding it itself.
+	Activated *retroproxy.ActivatedListeners
+	// RestartListener makes the proxy bind its listener again after accepting fails, with a backoff, instead of
+	// returning the error. Errors that retrying won't fix, such as the address being in use, are still returned.
+	RestartListener bool
+	// AllowedVersions, if not empty, are the client versions allowed to log in, as sent by the client, such as
+	// "1.39.8e". Other clients are refused with a bad version error that asks for the first one.
+	AllowedVersions []string
+	Logger          retroproxy.Logger
+}
+
+// NewProxy returns a Proxy listening on addr and relaying to the login server at serverAddr, see New for the other
+// options. It's kept for the callers of the constructor that came before Config. A *zap.Logger, which may be nil,
+// is passed with retroproxy.ZapLogger.
+func NewProxy(addr, serverAddr, gamePublicAddr string, storer retroproxy.Storer, forceAdmin bool,
+	capture *retroproxy.Capture, logger retroproxy.Logger) (*Proxy, error) {
+	return New(Config{
+		Addr:           addr,
+		ServerAddr:     serverAddr,
+		GamePublicAddr: gamePublicAddr,
+		Storer:         storer,
+		ForceAdmin:     forceAdmin,
+		Capture:        capture,
+		Logger:         logger,
+	})
+}
+
+// New returns a Proxy configured with c.
+func New(c Config) (*Proxy, error) {
+	if c.Storer == nil {
+		return nil, errors.New("storer is nil")
+	}
+
+	logger := c.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", c.Addr)
 	if err != nil {
 		return nil, err
 	}
 
-	serverPort, err := strconv.Atoi(serverPortStr)
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 3 * time.Second, KeepAlive: c.TCPKeepAlive}
+	}
+
+	if (c.UpstreamAccount == "") != (c.UpstreamPassword == "") {
+		return nil, errors.New("upstream account and password must be set together")
+	}
+
+	srv, err := resolveServer(c.ServerAddr, c.Dialer == nil)
 	if err != nil {
 		return nil, err
 	}
 
-	gameHost, gamePort, err := net.SplitHostPort(gamePublicAddr)
+	gameHost, gamePort, err := net.SplitHostPort(c.GamePublicAddr)
 	if err != nil {
 		return nil, err
 	}
+	// Clients split the address they are redirected to on its first colon, so it can't be an IPv6 address.
+	if strings.Contains(gameHost, ":") {
+		return nil, errors.New("game public address can't be an ipv6 address, use a host name instead")
+	}
 
-	return &Proxy{
-		logger:     logger,
-		addr:       tcpAddr,
-		serverAddr: tcpServerAddr,
-		gameHost:   gameHost,
-		gamePort:   gamePort,
-		storer:     storer,
-		forceAdmin: forceAdmin,
+	p := &Proxy{
+		logger:            logger,
+		addr:              tcpAddr,
+		gameHost:          gameHost,
+		gamePort:          gamePort,
+		storer:            c.Storer,
+		forceAdmin:        c.ForceAdmin,
+		sniffOnly:         c.SniffOnly,
+		strict:            c.Strict,
+		upstreamAccount:   c.UpstreamAccount,
+		upstreamPassword:  c.UpstreamPassword,
+		capture:           c.Capture,
+		hexDump:           c.HexDump,
+		hexDumpMaxPkts:    c.HexDumpMaxPkts,
+		accessLog:         c.AccessLog,
+		events:            c.Events,
+		tracer:            retroproxy.TracerOrNoop(c.Tracer),
+		upstreamTLS:       c.UpstreamTLS,
+		dialer:            dialer,
+		breaker:           c.Breaker,
+		resolveServerAddr: c.Dialer == nil,
+		proxyProtocol:     c.ProxyProtocol,
+		ipFilter:          c.IPFilter,
+		connLimiter:       c.ConnLimiter,
+		sessionLimiter:    c.SessionLimiter,
+		maxIPSessions:     c.MaxSessionsPerIP,
+		quota:             c.Quota,
+		readTimeout:       c.ReadTimeout,
+		writeTimeout:      c.WriteTimeout,
+		shutdownGrace:     c.ShutdownGrace,
+		tcpKeepAlive:      c.TCPKeepAlive,
+		tcpNagle:          c.TCPNagle,
+		restartListener:   c.RestartListener,
+		activated:         c.Activated,
 		cache: proxyCache{
-			serverPort:     serverPort,
 			uuidByUsername: make(map[string]string),
 		},
-	}, nil
+	}
+	p.maxClientPacketSize = c.MaxClientPacketSize
+	if p.maxClientPacketSize <= 0 {
+		p.maxClientPacketSize = DefaultMaxClientPacketSize
+	}
+	if len(c.AllowedVersions) > 0 {
+		p.allowedVersions = make(map[string]struct{}, len(c.AllowedVersions))
+		for _, v := range c.AllowedVersions {
+			p.allowedVersions[v] = struct{}{}
+		}
+		p.requiredVersion = c.AllowedVersions[0]
+	}
+	p.server.Store(srv)
+	return p, nil
+}
+
+// SetServerAddr changes the address of the login server for new sessions. Sessions already connected are not
+// affected.
+func (p *Proxy) SetServerAddr(addr string) error {
+	srv, err := resolveServer(addr, p.resolveServerAddr)
+	if err != nil {
+		return err
+	}
+	p.server.Store(srv)
+	p.logger.Info("login server address changed",
+		zap.String("server_address", srv.addr),
+	)
+	return nil
 }
 
 func (p *Proxy) ListenAndServe(ctx context.Context) error {
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
-	ln, err := net.ListenTCP("tcp4", p.addr)
+	ln, err := p.activated.Listen(p.addr, p.restartListener, p.logger)
 	if err != nil {
 		return err
 	}
@@ -103,12 +355,20 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		zap.String("address", ln.Addr().String()),
 	)
 	p.ln = ln
+	p.listening.Store(true)
+	defer p.listening.Store(false)
+
+	// Sessions are not bound to ctx, so they can be drained after it's done.
+	sessionsCtx, cancelSessions := context.WithCancel(context.Background())
+	defer cancelSessions()
 
 	errCh := make(chan error)
+	acceptLoopDone := make(chan struct{})
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := p.acceptLoop(ctx)
+		defer close(acceptLoopDone)
+		err := p.acceptLoop(sessionsCtx)
 		if err != nil {
 			select {
 			case errCh <- err:
@@ -119,18 +379,48 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 
 	select {
 	case <-ctx.Done():
+		ln.Close()
+		p.drainSessions(acceptLoopDone)
 		return ctx.Err()
 	case err := <-errCh:
 		return err
 	}
 }
 
+// drainSessions waits for the sessions to finish by themselves until done is closed or the shutdown grace period
+// expires, whichever happens first.
+func (p *Proxy) drainSessions(done <-chan struct{}) {
+	if p.shutdownGrace <= 0 {
+		return
+	}
+
+	n := p.sessionCount()
+	if n == 0 {
+		return
+	}
+	p.logger.Info("draining sessions",
+		zap.Int("active_sessions", n),
+		zap.Duration("shutdown_grace", p.shutdownGrace),
+	)
+
+	timer := time.NewTimer(p.shutdownGrace)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		p.logger.Warn("shutdown grace period expired, closing remaining sessions",
+			zap.Int("active_sessions", p.sessionCount()),
+		)
+	}
+}
+
 func (p *Proxy) acceptLoop(ctx context.Context) error {
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
 	for {
-		conn, err := p.ln.AcceptTCP()
+		tcpConn, err := p.ln.AcceptTCP()
 		if err != nil {
 			return err
 		}
@@ -138,57 +428,222 @@ func (p *Proxy) acceptLoop(ctx context.Context) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := p.handleClientConn(ctx, conn)
-			if err != nil && !(errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) || errors.Is(err, errEndOfService)) {
-				p.logger.Debug("error while handling client connection",
+			conn, ok := p.acceptConn(tcpConn)
+			if !ok {
+				return
+			}
+			if p.sessionLimiter != nil {
+				if !p.sessionLimiter.Acquire() {
+					conn.Close()
+					p.logger.Debug("connection refused, too many sessions",
+						zap.String("client_address", conn.RemoteAddr().String()),
+						zap.Int("max_sessions", p.sessionLimiter.Max()),
+					)
+					return
+				}
+				defer p.sessionLimiter.Release()
+			}
+			if p.maxIPSessions > 0 {
+				ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+				if !p.acquireIP(ip) {
+					conn.Close()
+					p.logger.Info("connection refused, too many sessions from ip",
+						zap.String("client_address", conn.RemoteAddr().String()),
+						zap.Int("max_sessions_per_ip", p.maxIPSessions),
+					)
+					return
+				}
+				defer p.releaseIP(ip)
+			}
+			s, err := p.newSession(conn)
+			if err != nil {
+				conn.Close()
+				p.logger.Error("could not make session",
 					zap.Error(err),
 					zap.String("client_address", conn.RemoteAddr().String()),
 				)
+				return
+			}
+			err = p.handleClientConn(ctx, s)
+			if err != nil && !(errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) || errors.Is(err, errEndOfService) || errors.Is(err, errBadVersion) || errors.Is(err, errIdleTimeout) || errors.Is(err, errWriteTimeout)) {
+				s.logger.Debug("error while handling client connection",
+					zap.Error(err),
+				)
+				s.publish(retroproxy.EventError, 0, retroproxy.ErrorEventData{
+					Error: err.Error(),
+					Err:   &retroproxy.SessionError{Proxy: metricLabel, SessionId: s.id, Err: err},
+				})
 			}
 		}()
 	}
 }
 
-func (p *Proxy) handleClientConn(ctx context.Context, conn *net.TCPConn) error {
-	var wg sync.WaitGroup
-	defer wg.Wait()
+// acceptConn reads the PROXY protocol header of tcpConn if the proxy expects one and runs the access checks of the
+// proxy. It returns the connection to make a session with, or false if tcpConn was closed.
+func (p *Proxy) acceptConn(tcpConn *net.TCPConn) (net.Conn, bool) {
+	if p.tcpKeepAlive != 0 {
+		err := retroproxy.SetKeepAlive(tcpConn, p.tcpKeepAlive)
+		if err != nil {
+			p.logger.Debug("could not set tcp keepalive",
+				zap.Error(err),
+				zap.String("client_address", tcpConn.RemoteAddr().String()),
+			)
+		}
+	}
+	if p.tcpNagle {
+		err := tcpConn.SetNoDelay(false)
+		if err != nil {
+			p.logger.Debug("could not enable nagle's algorithm",
+				zap.Error(err),
+				zap.String("client_address", tcpConn.RemoteAddr().String()),
+			)
+		}
+	}
+	var conn net.Conn = tcpConn
+	if p.proxyProtocol {
+		var err error
+		conn, err = retroproxy.ReadProxyProtocol(tcpConn)
+		if err != nil {
+			tcpConn.Close()
+			p.logger.Debug("invalid proxy protocol header",
+				zap.Error(err),
+				zap.String("client_address", tcpConn.RemoteAddr().String()),
+			)
+			return nil, false
+		}
+	}
 
-	defer func() {
+	if !p.allowConn(conn) {
 		conn.Close()
-		p.logger.Info("client disconnected",
+		return nil, false
+	}
+	return conn, true
+}
+
+// allowConn reports whether conn passes the access checks of the proxy.
+func (p *Proxy) allowConn(conn net.Conn) bool {
+	ip := conn.RemoteAddr().(*net.TCPAddr).IP
+	if p.ipFilter != nil {
+		allowed, rule := p.ipFilter.Check(ip)
+		if !allowed {
+			p.logger.Debug("connection denied",
+				zap.String("client_address", conn.RemoteAddr().String()),
+				zap.String("rule", rule),
+			)
+			return false
+		}
+	}
+	if p.connLimiter != nil && !p.connLimiter.Allow(ip.String()) {
+		p.logger.Info("connection rate limit exceeded",
 			zap.String("client_address", conn.RemoteAddr().String()),
 		)
-	}()
-	p.logger.Info("client connected",
-		zap.String("client_address", conn.RemoteAddr().String()),
-	)
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) newSession(conn net.Conn) (*session, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
 
 	s := &session{
-		proxy:      p,
-		clientConn: conn,
-		serverIdCh: make(chan int),
+		id: id.String(),
+		logger: retroproxy.WithFields(p.logger,
+			zap.String("session_id", id.String()),
+			zap.String("client_address", conn.RemoteAddr().String()),
+		),
+		proxy:       p,
+		server:      p.server.Load(),
+		clientConn:  conn,
+		serverIdCh:  make(chan int),
+		connectedAt: time.Now(),
+		quota:       p.quota.NewCounter(),
+	}
+	if p.hexDump {
+		s.hexDumper = retroproxy.NewHexDumper(s.logger, p.hexDumpMaxPkts)
 	}
+	return s, nil
+}
+
+func (p *Proxy) handleClientConn(ctx context.Context, s *session) (err error) {
+	if p.accessLog != nil {
+		// It's deferred first, so that it runs once the goroutines of the session are done with its counters.
+		defer func() {
+			s.logAccess(err)
+		}()
+	}
+
+	// The observers shadowing the session are let go once its goroutines are done reading packets.
+	defer s.shadows.Close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, s.span = p.tracer.Start(ctx, "login session", trace.WithAttributes(
+		attribute.String("session.id", s.id),
+		attribute.String("client.address", s.clientConn.RemoteAddr().String()),
+	))
+	defer s.span.End()
+
+	defer func() {
+		s.clientConn.Close()
+		reason := s.disconnectReason(err)
+		retroproxy.RecordDisconnect(s.span, reason, err)
+		retroproxy.MetricDisconnects.WithLabelValues(metricLabel, string(reason)).Inc()
+		s.logger.Info("client disconnected",
+			zap.String("reason", string(reason)),
+		)
+		s.publish(retroproxy.EventSessionDisconnected, 0, retroproxy.SessionEventData{
+			ClientAddress: s.clientConn.RemoteAddr().String(),
+			Reason:        reason,
+		})
+	}()
+	s.logger.Info("client connected")
+	if p.capture != nil {
+		err := p.capture.Mark(s.id, s.connectedAt, retroproxy.MarkerSessionStart)
+		if err != nil {
+			s.logger.Error("could not write marker to capture",
+				zap.Error(err),
+			)
+		}
+		defer func() {
+			err := p.capture.EndSession(s.id)
+			if err != nil {
+				s.logger.Error("could not write end of session to capture",
+					zap.Error(err),
+				)
+			}
+		}()
+	}
+	s.publish(retroproxy.EventSessionConnected, 0, retroproxy.SessionEventData{
+		ClientAddress: s.clientConn.RemoteAddr().String(),
+	})
+	retroproxy.MetricConnections.WithLabelValues(metricLabel).Inc()
+	retroproxy.MetricActiveConnections.WithLabelValues(metricLabel).Inc()
+	defer retroproxy.MetricActiveConnections.WithLabelValues(metricLabel).Dec()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.cancel = cancel
 
 	p.trackSession(s, true)
 	defer p.trackSession(s, false)
 
-	serverConn, err := net.DialTimeout("tcp4", p.serverAddr.String(), 3*time.Second)
+	serverConn, err := p.dialServer(ctx, s.server)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w: %w", errUpstream, retroproxy.ErrUpstreamDial, err)
 	}
 	defer serverConn.Close()
-	tcpServerConn, ok := serverConn.(*net.TCPConn)
-	if !ok {
-		return errors.New("could not assert server connection as a tcp connection")
-	}
-	p.logger.Info("connected to server",
-		zap.String("client_address", conn.RemoteAddr().String()),
-		zap.String("server_address", tcpServerConn.RemoteAddr().String()),
+	s.logger.Info("connected to server",
+		zap.String("server_address", serverConn.RemoteAddr().String()),
+		zap.Bool("tls", p.upstreamTLS != nil),
 	)
-	s.serverConn = tcpServerConn
+	s.serverConn = serverConn
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	_, s.handshakeSpan = p.tracer.Start(ctx, "login handshake")
+	defer s.handshakeSpan.End()
 
 	errCh := make(chan error)
 
@@ -224,6 +679,102 @@ func (p *Proxy) handleClientConn(ctx context.Context, conn *net.TCPConn) error {
 	}
 }
 
+// CheckServer reports whether the login server of new sessions is reachable, by connecting to it without going
+// through the circuit breaker.
+func (p *Proxy) CheckServer(ctx context.Context) error {
+	conn, err := p.dialer.DialContext(ctx, "tcp", p.server.Load().addr)
+	if err != nil {
+		return fmt.Errorf("%w: %w", retroproxy.ErrUpstreamDial, err)
+	}
+	return conn.Close()
+}
+
+// dialServer connects to srv, completing the TLS handshake before returning if the proxy connects to the login server
+// over TLS.
+func (p *Proxy) dialServer(ctx context.Context, srv *server) (_ net.Conn, err error) {
+	ctx, span := p.tracer.Start(ctx, "dial server", trace.WithAttributes(
+		attribute.String("server.address", srv.addr),
+	))
+	defer func() {
+		retroproxy.RecordError(span, err)
+		span.End()
+	}()
+
+	if p.breaker != nil {
+		if !p.breaker.Allow(srv.addr) {
+			p.logger.Warn("circuit breaker open, closing session",
+				zap.String("server_address", srv.addr),
+			)
+			return nil, errCircuitOpen
+		}
+		defer func() {
+			switch {
+			case ctx.Err() != nil:
+			case err == nil:
+				p.breaker.Success(srv.addr)
+			case p.breaker.Failure(srv.addr):
+				p.logger.Error("circuit breaker opened",
+					zap.String("server_address", srv.addr),
+					zap.Duration("cooldown", p.breaker.Cooldown()),
+				)
+			}
+		}()
+	}
+
+	conn, err := p.dialer.DialContext(ctx, "tcp", srv.addr)
+	if err != nil {
+		return nil, err
+	}
+	if p.tcpNagle {
+		err := retroproxy.SetNoDelay(conn, false)
+		if err != nil {
+			p.logger.Debug("could not enable nagle's algorithm", zap.Error(err))
+		}
+	}
+	if p.upstreamTLS == nil {
+		return conn, nil
+	}
+
+	cfg := p.upstreamTLS.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = srv.host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	handshakeCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	err = tlsConn.HandshakeContext(handshakeCtx)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake with login server failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// acquireIP counts a session from ip and reports whether it's within the limit of sessions per IP. The sessions beyond
+// the limit are not counted.
+func (p *Proxy) acquireIP(ip string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ipSessions[ip] >= p.maxIPSessions {
+		return false
+	}
+	if p.ipSessions == nil {
+		p.ipSessions = make(map[string]int)
+	}
+	p.ipSessions[ip]++
+	return true
+}
+
+// releaseIP uncounts a session from ip.
+func (p *Proxy) releaseIP(ip string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ipSessions[ip]--
+	if p.ipSessions[ip] <= 0 {
+		delete(p.ipSessions, ip)
+	}
+}
+
 func (p *Proxy) trackSession(s *session, add bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -236,3 +787,67 @@ func (p *Proxy) trackSession(s *session, add bool) {
 		delete(p.sessions, s)
 	}
 }
+
+func (p *Proxy) sessionCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// Listening reports whether the listener of the proxy is up.
+func (p *Proxy) Listening() bool {
+	return p.listening.Load()
+}
+
+// Addr returns the address of the listener of the proxy, which has the port picked by the system if it was configured
+// with port 0, or nil if the proxy is not listening.
+func (p *Proxy) Addr() net.Addr {
+	if !p.listening.Load() {
+		return nil
+	}
+	return p.ln.Addr()
+}
+
+// Sessions returns the active sessions of the proxy.
+func (p *Proxy) Sessions() []retroproxy.SessionInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	infos := make([]retroproxy.SessionInfo, 0, len(p.sessions))
+	for s := range p.sessions {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// Shadow returns a channel receiving the packets read by the session with the given id from now on, and a function
+// that stops shadowing it. See retroproxy.SessionShadower.
+func (p *Proxy) Shadow(id string, size int) (<-chan retroproxy.CaptureRecord, func(), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for s := range p.sessions {
+		if s.id == id {
+			ch, stop := s.shadows.Add(size)
+			s.logger.Info("shadowing session")
+			return ch, stop, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Kick closes the session with the given id and reports whether it was found.
+func (p *Proxy) Kick(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for s := range p.sessions {
+		if s.id == id {
+			s.logger.Info("kicking session")
+			s.kicked.Store(true)
+			s.cancel()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package login
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/kralamoure/retroproto"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/internal/gametest"
+)
+
+func TestProxyIPv6(t *testing.T) {
+	if ln, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		ln.Close()
+	}
+	srv, err := gametest.New(gametest.Config{
+		Addr:   "[::1]:0",
+		Hello:  string(retroproto.AksHelloConnect) + testKey,
+		Script: []gametest.Step{{Prefix: "1.29.1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	px := startProxy(t, srv, Config{Addr: "[::1]:0"})
+	if ip := px.Addr().(*net.TCPAddr).IP; !ip.Equal(net.IPv6loopback) {
+		t.Fatalf("proxy listens on %v, want %v", ip, net.IPv6loopback)
+	}
+
+	// The client connects over IPv6, and so does the proxy to the login server.
+	c := dial(t, px)
+	expectPkt(t, c, string(retroproto.AksHelloConnect)+testKey)
+	send(t, c, "1.29.1")
+	if got, want := srv.WaitReceived(1, testTimeout), []string{"1.29.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %q, want %q", got, want)
+	}
+}
+
+func TestNewIPv6GamePublicAddr(t *testing.T) {
+	_, err := New(Config{
+		Addr:           "[::1]:0",
+		ServerAddr:     "[::1]:443",
+		GamePublicAddr: "[::1]:5556",
+		Storer:         retroproxy.NewCache(nil),
+	})
+	if err == nil {
+		t.Error("made a proxy redirecting clients to an IPv6 address")
+	}
+}
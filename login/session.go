@@ -3,30 +3,104 @@ package login
 import (
 	"bufio"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/kralamoure/retroproto"
+	"github.com/kralamoure/retroproto/enum"
 	"github.com/kralamoure/retroproto/msgcli"
 	"github.com/kralamoure/retroproto/msgsvr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/kralamoure/retroproxy"
 )
 
-var errEndOfService = errors.New("end of service")
+// defaultGameServerPort is the port of the game server when the login server doesn't specify it.
+const defaultGameServerPort = "443"
+
+// encodedAddrLen is the length of the encoded address of the game server that starts AccountSelectServerSuccess
+// messages, 8 characters for the IP and 3 for the port.
+const encodedAddrLen = 11
+
+var (
+	errEndOfService = errors.New("end of service")
+	errIdleTimeout  = errors.New("idle timeout")
+	errWriteTimeout = errors.New("write timeout")
+	errCircuitOpen  = errors.New("circuit breaker open")
+	errBadVersion   = errors.New("client version not allowed")
+	errQuota        = errors.New("quota exceeded")
+	// errUpstream wraps the errors of the connection with the server.
+	errUpstream = errors.New("upstream error")
+	// errMalformed wraps the errors of the packets that could not be decoded, in strict mode.
+	errMalformed = errors.New("malformed packet")
+	// errDesync is wrapped in strict mode for the packets that don't look like messages.
+	errDesync = errors.New("protocol desync")
+	// errPanic wraps the values of the panics recovered while handling packets.
+	errPanic = errors.New("panic")
+)
+
+// readerPool holds the readers of finished sessions. Packets are read as strings, which are copies, so a reader is not
+// referenced anymore once its loop is done.
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReader(nil)
+	},
+}
 
 type session struct {
+	id         string
+	logger     retroproxy.Logger
 	proxy      *Proxy
-	clientConn *net.TCPConn
-	serverConn *net.TCPConn
-	serverIdCh chan int
-
+	server     *server
+	clientConn net.Conn
+	// clientWriteMu serializes the writes to clientConn, which come from the goroutines of both sides, such as the bad
+	// version error sent while the packets of the server are relayed.
+	clientWriteMu sync.Mutex
+	serverConn    net.Conn
+	serverIdCh    chan int
+	// hexDumper logs the packets sent by the session when the proxy dumps them.
+	hexDumper *retroproxy.HexDumper
+	// quota counts what the client sent in the current window when the proxy has a quota. It's only used by the
+	// goroutine reading from the client.
+	quota *retroproxy.QuotaCounter
+
+	connectedAt time.Time
+	cancel      context.CancelFunc
+	// span is the root span of the trace of the session, and handshakeSpan the one that ends with the response of the
+	// server to the credentials of the client.
+	span          trace.Span
+	handshakeSpan trace.Span
+	kicked        atomic.Bool
+	// shadows are the observers of the packets of the session, from the admin console.
+	shadows retroproxy.Shadows
+
+	// clientSeq and serverSeq are the sequence numbers of the last packets read from each side, starting at 1. Each
+	// one is only used by the goroutine reading from its side.
+	clientSeq uint64
+	serverSeq uint64
+	// clientBytes and serverBytes count the bytes read from each side, like the sequence numbers.
+	clientBytes uint64
+	serverBytes uint64
+	// lastClientPkt and lastServerPkt are the last packets read from each side, like the sequence numbers.
+	lastClientPkt string
+	lastServerPkt string
+
+	// mu guards username and version when they're set, since they're read by the session registry of the proxy.
+	mu       sync.Mutex
 	username string
+	// key is the salt sent by the server to encrypt the password, kept when the proxy has credential hooks.
+	key     string
+	version string
 }
 
 type msgOutCli interface {
@@ -39,59 +113,196 @@ type msgOutSvr interface {
 	Serialized() (extra string, err error)
 }
 
-func (s *session) receivePktsFromServer(ctx context.Context) error {
-	rd := bufio.NewReader(s.serverConn)
+func (s *session) receivePktsFromServer(ctx context.Context) (err error) {
+	defer s.recoverPanic(retroproxy.DirectionServer, &err)
+	rd := readerPool.Get().(*bufio.Reader)
+	rd.Reset(s.serverConn)
+	defer func() {
+		rd.Reset(nil)
+		readerPool.Put(rd)
+	}()
 	for {
-		pkt, err := rd.ReadString('\x00')
+		err := s.setReadDeadline(s.serverConn)
 		if err != nil {
 			return err
 		}
+		pkt, err := rd.ReadString('\x00')
+		if err != nil {
+			return s.readError(retroproxy.DirectionServer, err)
+		}
+		retroproxy.MetricBytes.WithLabelValues(metricLabel, string(retroproxy.DirectionServer)).Add(float64(len(pkt)))
+		s.serverBytes += uint64(len(pkt))
 		pkt = strings.TrimSuffix(pkt, "\x00")
 		if pkt == "" {
 			continue
 		}
+		s.observePkt(retroproxy.DirectionServer, pkt)
 		err = s.handlePktFromServer(ctx, pkt)
+		s.lastServerPkt = pkt
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func (s *session) receivePktsFromClient(ctx context.Context) error {
-	rd := bufio.NewReader(s.clientConn)
+func (s *session) receivePktsFromClient(ctx context.Context) (err error) {
+	defer s.recoverPanic(retroproxy.DirectionClient, &err)
+	rd := readerPool.Get().(*bufio.Reader)
+	rd.Reset(s.clientConn)
+	defer func() {
+		rd.Reset(nil)
+		readerPool.Put(rd)
+	}()
 	for {
-		pkt, err := rd.ReadString('\x00')
+		err := s.setReadDeadline(s.clientConn)
 		if err != nil {
 			return err
 		}
+		pkt, err := readPkt(rd, s.proxy.maxClientPacketSize)
+		if err != nil {
+			return s.readError(retroproxy.DirectionClient, err)
+		}
+		retroproxy.MetricBytes.WithLabelValues(metricLabel, string(retroproxy.DirectionClient)).Add(float64(len(pkt)))
+		s.clientBytes += uint64(len(pkt))
+		n := len(pkt)
 		pkt = strings.TrimSuffix(pkt, "\n\x00")
 		if pkt == "" {
 			continue
 		}
+		s.observePkt(retroproxy.DirectionClient, pkt)
+		if s.quota != nil && !s.quota.Add(n, time.Now()) {
+			return s.quotaExceeded()
+		}
 		err = s.handlePktFromClient(ctx, pkt)
+		s.lastClientPkt = pkt
 		if err != nil {
 			return err
 		}
 	}
 }
 
+// readPkt reads a packet from rd up to its null terminator, like ReadString, but fails with bufio.ErrTooLong once the
+// packet is longer than max bytes, so that a client can't make the proxy buffer an endless one.
+func readPkt(rd *bufio.Reader, max int) (string, error) {
+	var buf []byte
+	for {
+		chunk, err := rd.ReadSlice('\x00')
+		if len(buf)+len(chunk) > max {
+			return "", bufio.ErrTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			if buf == nil {
+				return string(chunk), err
+			}
+			return string(append(buf, chunk...)), err
+		}
+		buf = append(buf, chunk...)
+	}
+}
+
+// desync flags pkt, a packet from the dir side whose message id is unknown, if it doesn't look like a message either,
+// which likely means the framing is off. prev is the packet before it: the previous one read from the dir side or, if
+// handled is true, the one that the packet handlers made pkt from. Both are logged with hex dumps, and the desync is
+// counted. In strict mode, it returns errDesync wrapped with retroproxy.ErrProtocol to end the session.
+func (s *session) desync(dir retroproxy.Direction, pkt string, prev string, handled bool) error {
+	if !retroproxy.Desynced(pkt) {
+		return nil
+	}
+	retroproxy.MetricDesyncs.WithLabelValues(metricLabel, string(dir)).Inc()
+	s.logger.Warn("protocol desync",
+		zap.String("direction", string(dir)),
+		zap.Bool("handled", handled),
+		zap.String("hex_dump", hex.Dump([]byte(pkt))),
+		zap.String("previous_hex_dump", hex.Dump([]byte(prev))),
+	)
+	if s.proxy.strict {
+		return fmt.Errorf("%w: %w", retroproxy.ErrProtocol, errDesync)
+	}
+	return nil
+}
+
+// recoverPanic ends the session with an error wrapped with errPanic, instead of crashing the process, if the goroutine
+// reading from the dir side panics, such as in a packet handler. It must be deferred by that goroutine.
+func (s *session) recoverPanic(dir retroproxy.Direction, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	retroproxy.MetricPanics.WithLabelValues(metricLabel).Inc()
+	s.logger.Error("recovered from panic, closing session",
+		zap.String("direction", string(dir)),
+		zap.Any("panic", r),
+		zap.Stack("stack"),
+	)
+	*err = fmt.Errorf("%w: %v", errPanic, r)
+}
+
+// malformed logs a packet read from the dir side that could not be decoded, with a hex dump since it may hold
+// unprintable bytes. In strict mode, it returns err wrapped with errMalformed and retroproxy.ErrProtocol to end the
+// session. Otherwise, it returns nil and the packet is forwarded as it is.
+func (s *session) malformed(dir retroproxy.Direction, pkt string, err error) error {
+	s.logger.Warn("malformed packet",
+		zap.String("direction", string(dir)),
+		zap.String("hex_dump", hex.Dump([]byte(pkt))),
+		zap.Error(err),
+	)
+	if s.proxy.strict {
+		return fmt.Errorf("%w: %w: %w", retroproxy.ErrProtocol, errMalformed, err)
+	}
+	return nil
+}
+
 func (s *session) handlePktFromServer(ctx context.Context, pkt string) error {
 	id, ok := retroproto.MsgSvrIdByPkt(pkt)
+	retroproxy.CountMessage(metricLabel, retroproxy.DirectionServer, string(id))
 	name, _ := retroproto.MsgSvrNameByID(id)
-	s.proxy.logger.Info("received packet from server",
+	s.logger.Info("received packet from server",
 		zap.String("server_address", s.serverConn.RemoteAddr().String()),
-		zap.String("client_address", s.clientConn.RemoteAddr().String()),
+		zap.Uint64("seq", s.serverSeq),
 		zap.String("message_name", name),
 		zap.String("packet", pkt),
 	)
-	if ok {
+	if !ok {
+		err := s.desync(retroproxy.DirectionServer, pkt, s.lastServerPkt, false)
+		if err != nil {
+			return err
+		}
+	}
+	if id == retroproto.AksHelloConnect && (len(s.proxy.credentialHooks) > 0 || s.substitutesCredential()) {
+		msg := &msgsvr.AksHelloConnect{}
+		err := msg.Deserialize(strings.TrimPrefix(pkt, string(id)))
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.key = msg.Salt
+		s.mu.Unlock()
+	}
+	if id == retroproto.AccountLoginSuccess || id == retroproto.AccountLoginError {
+		s.handshakeSpan.SetAttributes(attribute.Bool("accepted", id == retroproto.AccountLoginSuccess))
+		s.handshakeSpan.End()
+	}
+	if ok && s.proxy.sniffOnly {
+		// The server id sent by the client must still be consumed.
+		switch id {
+		case retroproto.AccountSelectServerError, retroproto.AccountSelectServerSuccess, retroproto.AccountSelectServerPlainSuccess:
+			select {
+			case <-s.serverIdCh:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	} else if ok {
 		extra := strings.TrimPrefix(pkt, string(id))
 		switch id {
 		case retroproto.AccountLoginSuccess:
 			msg := &msgsvr.AccountLoginSuccess{}
 			err := msg.Deserialize(extra)
 			if err != nil {
-				return err
+				if err := s.malformed(retroproxy.DirectionServer, pkt, err); err != nil {
+					return err
+				}
+				break
 			}
 
 			if s.proxy.forceAdmin {
@@ -113,92 +324,240 @@ func (s *session) handlePktFromServer(ctx context.Context, pkt string) error {
 				return ctx.Err()
 			}
 
-			t := retroproxy.Ticket{ServerId: serverId}
-
-			if id == retroproto.AccountSelectServerSuccess {
-				msg := &msgsvr.AccountSelectServerSuccess{}
-				err := msg.Deserialize(extra)
-				if err != nil {
-					return err
-				}
-
-				t.Host = msg.Host
-				t.Original = msg.Ticket
-
-				if msg.Port == "" {
-					t.Port = "443"
-				} else {
-					t.Port = msg.Port
-				}
-			} else {
-				msg := &msgsvr.AccountSelectServerPlainSuccess{}
-				err := msg.Deserialize(extra)
-				if err != nil {
-					return err
-				}
-
-				t.Host = msg.Host
-				t.Original = msg.Ticket
-
-				if msg.Port == "" {
-					t.Port = "443"
-				} else {
-					t.Port = msg.Port
-				}
+			t, err := parseSelectServerSuccess(id, extra)
+			if err != nil {
+				return err
 			}
+			t.ServerId = serverId
 
-			id, err := uuid.NewV4()
+			ticketId, err := uuid.NewV4()
 			if err != nil {
 				return err
 			}
 
 			t.IssuedAt = time.Now()
-			s.proxy.storer.SetTicket(id.String(), t)
+			info := s.info()
+			if info.Account != "" {
+				t.SetMetadata(retroproxy.TicketAccount, info.Account)
+			}
+			if info.ClientVersion != "" {
+				t.SetMetadata(retroproxy.TicketClientVersion, info.ClientVersion)
+			}
+			for _, hook := range s.proxy.ticketHooks {
+				hook(&t, info)
+			}
+			s.proxy.storer.SetTicket(ticketId.String(), t)
 
+			gamePort := s.proxy.gamePort
+			if s.proxy.gamePortFunc != nil {
+				port, err := s.proxy.gamePortFunc(ticketId.String())
+				if err != nil {
+					s.logger.Warn("could not get game port of ticket, using the public one",
+						zap.Error(err),
+					)
+				} else {
+					gamePort = port
+				}
+			}
+
+			// The client is always redirected with a plain message, whatever form the server used.
 			msg := &msgsvr.AccountSelectServerPlainSuccess{
 				Host:   s.proxy.gameHost,
-				Port:   s.proxy.gamePort,
-				Ticket: id.String(),
+				Port:   gamePort,
+				Ticket: ticketId.String(),
 			}
 			err = s.sendMsgToClient(msg)
 			if err != nil {
 				return err
 			}
+			s.span.AddEvent("redirected", trace.WithAttributes(attribute.String("server.address", t.Addr())))
 			return errEndOfService
 		}
 	}
 
-	s.sendPktToClient(pkt)
-	return nil
+	return s.sendPktToClient(pkt)
+}
+
+// runCredentialHooks decrypts the password of msg and calls the credential hooks of the proxy with it. Credentials that
+// can't be decrypted are only logged, since the server is the one to refuse them.
+func (s *session) runCredentialHooks(msg *msgcli.AccountCredential) {
+	if msg.CryptoMethod != passwordCryptoMethod {
+		s.logger.Debug("unsupported password crypto method",
+			zap.Int("crypto_method", msg.CryptoMethod),
+		)
+		return
+	}
+	s.mu.Lock()
+	key := s.key
+	s.mu.Unlock()
+	password, err := DecryptPassword(msg.Hash, key)
+	if err != nil {
+		s.logger.Warn("could not decrypt password", zap.Error(err))
+		return
+	}
+
+	c := Credential{Username: msg.Username, Password: password}
+	info := s.info()
+	for _, hook := range s.proxy.credentialHooks {
+		hook(c, info)
+	}
+}
+
+// substitutesCredential reports whether the credentials of the client are replaced with the upstream ones.
+func (s *session) substitutesCredential() bool {
+	return s.proxy.upstreamAccount != "" && !s.proxy.sniffOnly
+}
+
+// sendUpstreamCredential sends the upstream credentials to the server instead of those of the client, with the password
+// encrypted with the key of the session like the client does.
+func (s *session) sendUpstreamCredential() error {
+	s.mu.Lock()
+	key := s.key
+	s.mu.Unlock()
+	// The client encrypts each character of the password with the matching one of the key.
+	if len(s.proxy.upstreamPassword) > len(key) {
+		return errors.New("upstream password is longer than the key of the server")
+	}
+
+	s.logger.Info("substituting credentials",
+		zap.String("upstream_account", s.proxy.upstreamAccount),
+	)
+	msg := msgcli.AccountCredential{
+		Username:     s.proxy.upstreamAccount,
+		Hash:         retroproto.EncryptPassword(s.proxy.upstreamPassword, key),
+		CryptoMethod: passwordCryptoMethod,
+	}
+	pkt, err := msg.Serialized()
+	if err != nil {
+		return err
+	}
+	// Like AccountVersion, the message has no id in its packet.
+	return s.sendPktToServer(pkt)
+}
+
+// parseSelectServerSuccess makes a ticket that targets the game server of a successful server selection, which is
+// either an AccountSelectServerSuccess message with an encoded address or an AccountSelectServerPlainSuccess one.
+func parseSelectServerSuccess(id retroproto.MsgSvrId, extra string) (retroproxy.Ticket, error) {
+	var t retroproxy.Ticket
+
+	switch id {
+	case retroproto.AccountSelectServerSuccess:
+		// retroproto slices the encoded address without checking its length.
+		if len(extra) < encodedAddrLen {
+			return retroproxy.Ticket{}, retroproto.ErrInvalidMsg
+		}
+		msg := &msgsvr.AccountSelectServerSuccess{}
+		err := msg.Deserialize(extra)
+		if err != nil {
+			return retroproxy.Ticket{}, err
+		}
+		t.Host = msg.Host
+		t.Port = msg.Port
+		t.Original = msg.Ticket
+	case retroproto.AccountSelectServerPlainSuccess:
+		msg := &msgsvr.AccountSelectServerPlainSuccess{}
+		err := msg.Deserialize(extra)
+		if err != nil {
+			return retroproxy.Ticket{}, err
+		}
+		t.Host = msg.Host
+		t.Port = msg.Port
+		t.Original = msg.Ticket
+	default:
+		return retroproxy.Ticket{}, fmt.Errorf("unexpected message id: %q", id)
+	}
+
+	if t.Host == "" {
+		return retroproxy.Ticket{}, errors.New("game server host is empty")
+	}
+	if t.Port == "" {
+		t.Port = defaultGameServerPort
+	}
+
+	return t, nil
 }
 
 func (s *session) handlePktFromClient(ctx context.Context, pkt string) error {
 	id, ok := retroproto.MsgCliIdByPkt(pkt)
+	retroproxy.CountMessage(metricLabel, retroproxy.DirectionClient, string(id))
 	name, _ := retroproto.MsgCliNameByID(id)
-	s.proxy.logger.Info("received packet from client",
-		zap.String("client_address", s.clientConn.RemoteAddr().String()),
+	s.logger.Info("received packet from client",
+		zap.Uint64("seq", s.clientSeq),
 		zap.String("message_name", name),
-		zap.String("packet", pkt),
+		zap.String("packet", loggedPacket(id, pkt)),
 	)
+	if !ok {
+		err := s.desync(retroproxy.DirectionClient, pkt, s.lastClientPkt, false)
+		if err != nil {
+			return err
+		}
+	}
 
 	if ok {
 		extra := strings.TrimPrefix(pkt, string(id))
 		switch id {
+		case retroproto.AccountVersion:
+			msg := &msgcli.AccountVersion{}
+			err := msg.Deserialize(extra)
+			if err != nil {
+				// The version is still checked as it was sent.
+				if err := s.malformed(retroproxy.DirectionClient, pkt, err); err != nil {
+					return err
+				}
+			}
+			s.mu.Lock()
+			s.version = extra
+			s.mu.Unlock()
+			s.span.SetAttributes(attribute.String("client.version", extra))
+			s.logger.Info("client version",
+				zap.String("version", extra),
+			)
+
+			if s.proxy.allowedVersions == nil {
+				break
+			}
+			if _, ok := s.proxy.allowedVersions[extra]; !ok {
+				s.logger.Info("client version not allowed, closing session")
+				err := s.sendMsgToClient(msgsvr.AccountLoginError{
+					Reason: enum.AccountLoginErrorReason.BadVersion,
+					Extra:  s.proxy.requiredVersion,
+				})
+				if err != nil {
+					return err
+				}
+				return errBadVersion
+			}
 		case retroproto.AccountCredential:
 			msg := &msgcli.AccountCredential{}
 			err := msg.Deserialize(extra)
 			if err != nil {
-				return err
+				if err := s.malformed(retroproxy.DirectionClient, pkt, err); err != nil {
+					return err
+				}
+				break
 			}
+			s.mu.Lock()
 			s.username = msg.Username
+			s.mu.Unlock()
+			s.span.SetAttributes(attribute.String("account", msg.Username))
+			if len(s.proxy.credentialHooks) > 0 {
+				s.runCredentialHooks(msg)
+			}
+			if s.substitutesCredential() {
+				return s.sendUpstreamCredential()
+			}
 		case retroproto.AccountSetServer:
-			s.sendPktToServer(pkt)
+			err := s.sendPktToServer(pkt)
+			if err != nil {
+				return err
+			}
 
 			msg := &msgcli.AccountSetServer{}
-			err := msg.Deserialize(extra)
+			err = msg.Deserialize(extra)
 			if err != nil {
 				return err
 			}
+			s.span.AddEvent("server selected", trace.WithAttributes(attribute.Int("server_id", msg.Id)))
 
 			select {
 			case s.serverIdCh <- msg.Id:
@@ -207,8 +566,14 @@ func (s *session) handlePktFromClient(ctx context.Context, pkt string) error {
 				return ctx.Err()
 			}
 		case retroproto.AccountConfiguredPort:
-			return s.sendMsgToServer(msgcli.AccountConfiguredPort{Port: s.proxy.cache.serverPort})
+			if s.proxy.sniffOnly {
+				break
+			}
+			return s.sendMsgToServer(msgcli.AccountConfiguredPort{Port: s.server.port})
 		case retroproto.AccountSendIdentity:
+			if s.proxy.sniffOnly {
+				break
+			}
 			id, err := s.identity(ctx)
 			if err != nil {
 				return err
@@ -217,9 +582,7 @@ func (s *session) handlePktFromClient(ctx context.Context, pkt string) error {
 		}
 	}
 
-	s.sendPktToServer(pkt)
-
-	return nil
+	return s.sendPktToServer(pkt)
 }
 
 func (s *session) identity(ctx context.Context) (string, error) {
@@ -245,8 +608,7 @@ func (s *session) sendMsgToServer(msg msgOutCli) error {
 	if err != nil {
 		return err
 	}
-	s.sendPktToServer(fmt.Sprint(msg.MessageId(), pkt))
-	return nil
+	return s.sendPktToServer(fmt.Sprint(msg.MessageId(), pkt))
 }
 
 func (s *session) sendMsgToClient(msg msgOutSvr) error {
@@ -254,28 +616,228 @@ func (s *session) sendMsgToClient(msg msgOutSvr) error {
 	if err != nil {
 		return err
 	}
-	s.sendPktToClient(fmt.Sprint(msg.MessageId(), pkt))
-	return nil
+	return s.sendPktToClient(fmt.Sprint(msg.MessageId(), pkt))
 }
 
-func (s *session) sendPktToServer(pkt string) {
+func (s *session) sendPktToServer(pkt string) error {
 	id, _ := retroproto.MsgCliIdByPkt(pkt)
 	name, _ := retroproto.MsgCliNameByID(id)
-	s.proxy.logger.Info("sent packet to server",
+	s.logger.Info("sent packet to server",
 		zap.String("server_address", s.serverConn.RemoteAddr().String()),
 		zap.String("message_name", name),
-		zap.String("packet", pkt),
+		zap.String("packet", loggedPacket(id, pkt)),
 	)
-	fmt.Fprint(s.serverConn, pkt+"\n\x00")
+	err := s.setWriteDeadline(s.serverConn)
+	if err != nil {
+		return err
+	}
+	b := pkt + "\n\x00"
+	if s.hexDumper != nil {
+		s.hexDumper.Dump(retroproxy.DirectionClient, loggedPacket(id, pkt)+"\n\x00")
+	}
+	_, err = fmt.Fprint(s.serverConn, b)
+	if err != nil {
+		return s.writeError(retroproxy.DirectionServer, err)
+	}
+	return nil
 }
 
-func (s *session) sendPktToClient(pkt string) {
+func (s *session) sendPktToClient(pkt string) error {
 	id, _ := retroproto.MsgSvrIdByPkt(pkt)
 	name, _ := retroproto.MsgSvrNameByID(id)
-	s.proxy.logger.Info("sent packet to client",
-		zap.String("client_address", s.clientConn.RemoteAddr().String()),
+	s.logger.Info("sent packet to client",
 		zap.String("message_name", name),
 		zap.String("packet", pkt),
 	)
-	fmt.Fprint(s.clientConn, pkt+"\x00")
+	s.clientWriteMu.Lock()
+	defer s.clientWriteMu.Unlock()
+	err := s.setWriteDeadline(s.clientConn)
+	if err != nil {
+		return err
+	}
+	b := pkt + "\x00"
+	if s.hexDumper != nil {
+		s.hexDumper.Dump(retroproxy.DirectionServer, b)
+	}
+	_, err = fmt.Fprint(s.clientConn, b)
+	if err != nil {
+		return s.writeError(retroproxy.DirectionClient, err)
+	}
+	return nil
+}
+
+// publish publishes an event of the session to the event hub of the proxy, where seq is the sequence number of the
+// packet it comes from, or zero.
+func (s *session) publish(typ retroproxy.EventType, seq uint64, data interface{}) {
+	s.proxy.events.Publish(retroproxy.Event{
+		Type:      typ,
+		Proxy:     metricLabel,
+		SessionId: s.id,
+		Seq:       seq,
+		Data:      data,
+	})
+}
+
+// observePkt gives a sequence number to a packet read from the dir side and records it. Packets dropped by handlers
+// are numbered too, so that the numbers match those of the capture.
+func (s *session) observePkt(dir retroproxy.Direction, pkt string) {
+	retroproxy.MetricPackets.WithLabelValues(metricLabel, string(dir)).Inc()
+
+	seq := &s.serverSeq
+	if dir == retroproxy.DirectionClient {
+		seq = &s.clientSeq
+	}
+	*seq++
+
+	s.shadows.Write(dir, s.id, *seq, pkt)
+	if s.proxy.capture == nil {
+		return
+	}
+	err := s.proxy.capture.Write(dir, s.id, s.connectedAt, *seq, pkt)
+	if err != nil {
+		s.logger.Error("could not write packet to capture",
+			zap.Error(err),
+		)
+	}
+}
+
+// setReadDeadline refreshes the read deadline of conn if a read timeout is configured.
+func (s *session) setReadDeadline(conn net.Conn) error {
+	if s.proxy.readTimeout <= 0 {
+		return nil
+	}
+	return conn.SetReadDeadline(time.Now().Add(s.proxy.readTimeout))
+}
+
+// setWriteDeadline refreshes the write deadline of conn if a write timeout is configured.
+func (s *session) setWriteDeadline(conn net.Conn) error {
+	if s.proxy.writeTimeout <= 0 {
+		return nil
+	}
+	return conn.SetWriteDeadline(time.Now().Add(s.proxy.writeTimeout))
+}
+
+// writeError converts a write timeout of the connection with the dir side to errWriteTimeout and wraps the other
+// errors of the server connection with errUpstream.
+func (s *session) writeError(dir retroproxy.Direction, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		s.logger.Info("write timeout",
+			zap.String("direction", string(dir)),
+			zap.Duration("write_timeout", s.proxy.writeTimeout),
+		)
+		return errWriteTimeout
+	}
+	if dir == retroproxy.DirectionServer {
+		err = fmt.Errorf("%w: %w", errUpstream, err)
+	}
+	return err
+}
+
+// readError converts a read timeout of the connection with the dir side to errIdleTimeout and wraps the other errors
+// of the server connection with errUpstream.
+func (s *session) readError(dir retroproxy.Direction, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		s.logger.Info("idle timeout",
+			zap.String("direction", string(dir)),
+			zap.Duration("read_timeout", s.proxy.readTimeout),
+		)
+		return errIdleTimeout
+	}
+	if dir == retroproxy.DirectionServer {
+		err = fmt.Errorf("%w: %w", errUpstream, err)
+	}
+	if errors.Is(err, bufio.ErrTooLong) {
+		s.logger.Warn("packet too large, closing session",
+			zap.String("direction", string(dir)),
+			zap.Int("max_client_packet_size", s.proxy.maxClientPacketSize),
+		)
+	}
+	return err
+}
+
+// quotaExceeded logs that the client went over the quota of the proxy and returns errQuota.
+func (s *session) quotaExceeded() error {
+	s.logger.Info("quota exceeded, closing session",
+		zap.Duration("quota_window", s.proxy.quota.Window),
+		zap.Int("bytes", s.quota.Bytes()),
+		zap.Int("packets", s.quota.Packets()),
+		zap.Int("max_bytes", s.proxy.quota.MaxBytes),
+		zap.Int("max_packets", s.proxy.quota.MaxPackets),
+	)
+	return errQuota
+}
+
+// disconnectReason returns why the session ended with err.
+func (s *session) disconnectReason(err error) retroproxy.DisconnectReason {
+	switch {
+	case s.kicked.Load():
+		return retroproxy.DisconnectKicked
+	case errors.Is(err, errIdleTimeout):
+		return retroproxy.DisconnectIdleTimeout
+	case errors.Is(err, errWriteTimeout):
+		return retroproxy.DisconnectWriteTimeout
+	case errors.Is(err, errCircuitOpen):
+		return retroproxy.DisconnectCircuitOpen
+	case errors.Is(err, errEndOfService):
+		return retroproxy.DisconnectRedirected
+	case errors.Is(err, errBadVersion):
+		return retroproxy.DisconnectRefused
+	case errors.Is(err, errQuota):
+		return retroproxy.DisconnectQuotaExceeded
+	case errors.Is(err, errPanic):
+		return retroproxy.DisconnectPanic
+	case errors.Is(err, errUpstream) && errors.Is(err, io.EOF):
+		return retroproxy.DisconnectServerClosed
+	case errors.Is(err, errUpstream):
+		return retroproxy.DisconnectUpstreamError
+	case err == nil || errors.Is(err, io.EOF):
+		return retroproxy.DisconnectClientClosed
+	case errors.Is(err, context.Canceled):
+		return retroproxy.DisconnectShutdown
+	default:
+		return retroproxy.DisconnectError
+	}
+}
+
+// info returns the state of the session as listed by the session registry of the proxy.
+func (s *session) info() retroproxy.SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return retroproxy.SessionInfo{
+		Id:            s.id,
+		ClientAddress: s.clientConn.RemoteAddr().String(),
+		ConnectedAt:   s.connectedAt,
+		Account:       s.username,
+		ClientVersion: s.version,
+	}
+}
+
+// logAccess writes the session, which ended with err, to the access log of the proxy.
+func (s *session) logAccess(err error) {
+	clientIP, _, _ := net.SplitHostPort(s.clientConn.RemoteAddr().String())
+	s.mu.Lock()
+	account := s.username
+	s.mu.Unlock()
+
+	err = s.proxy.accessLog.Write(retroproxy.AccessRecord{
+		Time:          time.Now(),
+		Proxy:         metricLabel,
+		SessionId:     s.id,
+		ClientIP:      clientIP,
+		Account:       account,
+		ServerAddress: s.server.addr,
+		ClientBytes:   s.clientBytes,
+		ServerBytes:   s.serverBytes,
+		ClientPackets: s.clientSeq,
+		ServerPackets: s.serverSeq,
+		DurationMs:    time.Since(s.connectedAt).Milliseconds(),
+		Reason:        s.disconnectReason(err),
+	})
+	if err != nil {
+		s.logger.Error("could not write to access log",
+			zap.Error(err),
+		)
+	}
 }
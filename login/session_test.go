@@ -0,0 +1,250 @@
+package login
+
+import (
+	"context"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kralamoure/retroproto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/internal/gametest"
+)
+
+// testTimeout bounds each read and wait of the tests.
+const testTimeout = 3 * time.Second
+
+// startProxy starts a login proxy configured with c on a local port, unless c has an address, relaying to srv, and
+// returns it once it listens. It's stopped at the end of the test.
+func startProxy(t *testing.T, srv *gametest.Server, c Config) *Proxy {
+	t.Helper()
+	if c.Addr == "" {
+		c.Addr = "127.0.0.1:0"
+	}
+	c.ServerAddr, c.GamePublicAddr = srv.Addr().String(), "127.0.0.1:5555"
+	c.Storer = retroproxy.NewCache(nil)
+	px, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- px.ListenAndServe(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-errCh
+	})
+	deadline := time.Now().Add(testTimeout)
+	for px.Addr() == nil {
+		select {
+		case err := <-errCh:
+			t.Fatalf("could not start login proxy: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("login proxy didn't listen in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return px
+}
+
+// dial connects a client to px.
+func dial(t *testing.T, px *Proxy) *gametest.Client {
+	t.Helper()
+	c, err := gametest.Dial(px.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func expectPkt(t *testing.T, c *gametest.Client, want string) {
+	t.Helper()
+	got, err := c.Read(testTimeout)
+	if err != nil {
+		t.Fatalf("could not read %q: %v", want, err)
+	}
+	if got != want {
+		t.Fatalf("got packet %q, want %q", got, want)
+	}
+}
+
+func send(t *testing.T, c *gametest.Client, pkt string) {
+	t.Helper()
+	err := c.Send(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendUpstreamCredential(t *testing.T) {
+	const (
+		upstreamAccount  = "upstream"
+		upstreamPassword = "hunter2"
+		clientPassword   = "clientsecret"
+	)
+	loginError := string(retroproto.AccountLoginError) + "f"
+	srv, err := gametest.New(gametest.Config{
+		Hello: string(retroproto.AksHelloConnect) + testKey,
+		Script: []gametest.Step{
+			{Prefix: "1.29.1"},
+			{Prefix: upstreamAccount + "\n", Replies: []string{loginError}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	core, logs := observer.New(zapcore.DebugLevel)
+	px := startProxy(t, srv, Config{
+		UpstreamAccount:  upstreamAccount,
+		UpstreamPassword: upstreamPassword,
+		HexDump:          true,
+		Logger:           zap.New(core),
+	})
+
+	c := dial(t, px)
+	expectPkt(t, c, string(retroproto.AksHelloConnect)+testKey)
+	clientHash := retroproto.EncryptPassword(clientPassword, testKey)
+	send(t, c, "1.29.1")
+	send(t, c, "alice\n#1"+clientHash)
+	// The response of the server to the upstream credentials is relayed to the client.
+	expectPkt(t, c, loginError)
+
+	got := srv.WaitReceived(2, testTimeout)
+	if err := srv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// The upstream password is encrypted with the key the server sent.
+	want := []string{"1.29.1", upstreamAccount + "\n#1" + retroproto.EncryptPassword(upstreamPassword, testKey)}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("server received %q, want %q", got, want)
+	}
+	for _, pkt := range got {
+		if strings.Contains(pkt, "alice") || strings.Contains(pkt, clientHash) {
+			t.Errorf("credentials of the client reached the server in %q", pkt)
+		}
+	}
+	upstreamHash := strings.TrimPrefix(got[len(got)-1], upstreamAccount+"\n#1")
+	password, err := DecryptPassword(upstreamHash, testKey)
+	if err != nil || password != upstreamPassword {
+		t.Errorf("server decrypts password %q (%v), want %q", password, err, upstreamPassword)
+	}
+
+	// The key is logged, so neither hash may be.
+	for _, e := range logs.All() {
+		for _, f := range e.Context {
+			s := f.String
+			if f.Key == "hex_dump" {
+				s = undumpHex(t, s)
+			}
+			if strings.Contains(s, upstreamHash) || strings.Contains(s, clientHash) {
+				t.Errorf("%q logged a password hash in %s: %q", e.Message, f.Key, s)
+			}
+		}
+	}
+}
+
+// undumpHex returns the bytes of dump, the output of hex.Dump.
+func undumpHex(t *testing.T, dump string) string {
+	t.Helper()
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(dump, "\n"), "\n") {
+		// Each line is an offset, up to 16 bytes in hex, and the same bytes as text between bars.
+		line, _, _ = strings.Cut(line, "|")
+		fields := strings.Fields(line)
+		b, err := hex.DecodeString(strings.Join(fields[1:], ""))
+		if err != nil {
+			t.Fatalf("invalid hex dump %q: %v", dump, err)
+		}
+		sb.Write(b)
+	}
+	return sb.String()
+}
+
+func TestParseSelectServerSuccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      retroproto.MsgSvrId
+		extra   string
+		want    retroproxy.Ticket
+		wantErr bool
+	}{
+		{
+			name:  "encoded address",
+			id:    retroproto.AccountSelectServerSuccess,
+			extra: "7?000001bwZ5f4dcc3b",
+			want:  retroproxy.Ticket{Host: "127.0.0.1", Port: "5555", Original: "5f4dcc3b"},
+		},
+		{
+			name:  "encoded private address",
+			id:    retroproto.AccountSelectServerSuccess,
+			extra: ":<10050:ag7a1b2c3",
+			want:  retroproxy.Ticket{Host: "172.16.5.10", Port: "443", Original: "a1b2c3"},
+		},
+		{
+			name:    "encoded address too short",
+			id:      retroproto.AccountSelectServerSuccess,
+			extra:   "7?0000",
+			wantErr: true,
+		},
+		{
+			name:    "encoded port invalid",
+			id:      retroproto.AccountSelectServerSuccess,
+			extra:   "7?000001b*Z5f4dcc3b",
+			wantErr: true,
+		},
+		{
+			name:  "plain address",
+			id:    retroproto.AccountSelectServerPlainSuccess,
+			extra: "game.example.com:5555;5f4dcc3b",
+			want:  retroproxy.Ticket{Host: "game.example.com", Port: "5555", Original: "5f4dcc3b"},
+		},
+		{
+			name:  "plain address without port",
+			id:    retroproto.AccountSelectServerPlainSuccess,
+			extra: "127.0.0.1;5f4dcc3b",
+			want:  retroproxy.Ticket{Host: "127.0.0.1", Port: defaultGameServerPort, Original: "5f4dcc3b"},
+		},
+		{
+			name:    "plain address without host",
+			id:      retroproto.AccountSelectServerPlainSuccess,
+			extra:   ":5555;5f4dcc3b",
+			wantErr: true,
+		},
+		{
+			name:    "plain address without ticket",
+			id:      retroproto.AccountSelectServerPlainSuccess,
+			extra:   "127.0.0.1:5555",
+			wantErr: true,
+		},
+		{
+			name:    "other message",
+			id:      retroproto.AccountSelectServerError,
+			extra:   "r",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSelectServerSuccess(tt.id, tt.extra)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package login
+
+import (
+	"github.com/kralamoure/retroproxy"
+)
+
+// TicketHook is called with each ticket issued by the login proxy before it's stored, along with the session the
+// ticket is issued to. It can attach metadata to the ticket, which the game proxy reads when the ticket is used.
+type TicketHook func(t *retroproxy.Ticket, si retroproxy.SessionInfo)
+
+// OnTicket registers hooks, which are called in order of registration after the proxy sets its own metadata.
+// It must not be called after ListenAndServe.
+func (p *Proxy) OnTicket(hooks ...TicketHook) {
+	p.ticketHooks = append(p.ticketHooks, hooks...)
+}
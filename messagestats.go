@@ -0,0 +1,109 @@
+package retroproxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kralamoure/retroproto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UnknownMessageId is the id under which the messages that are not known by retroproto are counted.
+const UnknownMessageId = "?"
+
+// MessageCount is the number of messages of an id received by a proxy from one side.
+type MessageCount struct {
+	Proxy     string    `json:"proxy"`
+	Direction Direction `json:"direction"`
+	Id        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Count     uint64    `json:"count"`
+}
+
+type messageKey struct {
+	proxy string
+	dir   Direction
+	id    string
+}
+
+// messageCounter is the count of the messages of a key, along with their counter of MetricMessages, which is looked up
+// once rather than for each message.
+type messageCounter struct {
+	n      atomic.Uint64
+	metric prometheus.Counter
+}
+
+// messageCounts are the numbers of messages received by the proxies since the process started. They are read far
+// less often than they're incremented, so the map is only locked for writing when a new id shows up.
+var messageCounts = struct {
+	sync.RWMutex
+	m map[messageKey]*messageCounter
+}{m: make(map[messageKey]*messageCounter)}
+
+// CountMessage counts a message with the given id received by proxy from the dir side, in MetricMessages and in the
+// counts returned by TopMessages. An empty id counts as UnknownMessageId.
+func CountMessage(proxy string, dir Direction, id string) {
+	if id == "" {
+		id = UnknownMessageId
+	}
+	k := messageKey{proxy: proxy, dir: dir, id: id}
+	messageCounts.RLock()
+	c, ok := messageCounts.m[k]
+	messageCounts.RUnlock()
+	if !ok {
+		messageCounts.Lock()
+		c, ok = messageCounts.m[k]
+		if !ok {
+			c = &messageCounter{metric: MetricMessages.WithLabelValues(proxy, string(dir), id)}
+			messageCounts.m[k] = c
+		}
+		messageCounts.Unlock()
+	}
+	c.n.Add(1)
+	c.metric.Inc()
+}
+
+// TopMessages returns the n most received messages, or all of them if n is not positive, from the most received.
+func TopMessages(n int) []MessageCount {
+	messageCounts.RLock()
+	counts := make([]MessageCount, 0, len(messageCounts.m))
+	for k, c := range messageCounts.m {
+		counts = append(counts, MessageCount{Proxy: k.proxy, Direction: k.dir, Id: k.id, Count: c.n.Load()})
+	}
+	messageCounts.RUnlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		if counts[i].Proxy != counts[j].Proxy {
+			return counts[i].Proxy < counts[j].Proxy
+		}
+		if counts[i].Direction != counts[j].Direction {
+			return counts[i].Direction < counts[j].Direction
+		}
+		return counts[i].Id < counts[j].Id
+	})
+	if n > 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	for i := range counts {
+		counts[i].Name = messageName(counts[i].Direction, counts[i].Id)
+	}
+	return counts
+}
+
+func messageName(dir Direction, id string) string {
+	if id == UnknownMessageId {
+		return ""
+	}
+	var name string
+	switch dir {
+	case DirectionClient:
+		name, _ = retroproto.MsgCliNameByID(retroproto.MsgCliId(id))
+	case DirectionServer:
+		name, _ = retroproto.MsgSvrNameByID(retroproto.MsgSvrId(id))
+	}
+	return name
+}
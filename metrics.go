@@ -0,0 +1,67 @@
+package retroproxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics of the proxies, labeled by proxy ("login" or "game") and, where relevant, by the Direction of
+// the traffic.
+var (
+	MetricConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "retroproxy",
+		Name:      "connections_total",
+		Help:      "Total number of client connections accepted.",
+	}, []string{"proxy"})
+	MetricActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "retroproxy",
+		Name:      "active_connections",
+		Help:      "Number of client connections currently open.",
+	}, []string{"proxy"})
+	MetricPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "retroproxy",
+		Name:      "packets_total",
+		Help:      "Total number of packets received.",
+	}, []string{"proxy", "direction"})
+	MetricMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "retroproxy",
+		Name:      "messages_total",
+		Help:      "Total number of messages received, by message id. Unknown messages have the id \"?\".",
+	}, []string{"proxy", "direction", "message_id"})
+	MetricBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "retroproxy",
+		Name:      "bytes_total",
+		Help:      "Total number of bytes received.",
+	}, []string{"proxy", "direction"})
+	MetricDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "retroproxy",
+		Name:      "disconnects_total",
+		Help:      "Total number of sessions ended, by DisconnectReason.",
+	}, []string{"proxy", "reason"})
+	MetricUpstreamRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "retroproxy",
+		Name:      "upstream_rtt_seconds",
+		Help:      "Time between a ping sent by a client and the pong of the server.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 10),
+	}, []string{"proxy"})
+	MetricDesyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "retroproxy",
+		Name:      "desyncs_total",
+		Help:      "Total number of packets that don't look like messages, which likely means the framing is off.",
+	}, []string{"proxy", "direction"})
+	MetricPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "retroproxy",
+		Name:      "panics_total",
+		Help:      "Total number of panics recovered while handling the packets of a session, which was closed.",
+	}, []string{"proxy"})
+	MetricCoalesced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "retroproxy",
+		Name:      "coalesced_packets_total",
+		Help:      "Total number of packets of the server dropped because a newer packet superseded them.",
+	}, []string{"proxy"})
+	MetricEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "retroproxy",
+		Name:      "events_dropped_total",
+		Help:      "Total number of events not delivered to a subscriber that was too slow.",
+	})
+)
@@ -0,0 +1,195 @@
+package retroproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// pcapMagicNanos is the magic number of the pcap files whose timestamps have a nanosecond resolution.
+	pcapMagicNanos = 0xa1b23c4d
+	// pcapLinkTypeRaw is the link type of the packets that start with their IP header.
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 262144
+
+	// PcapServerPort is the port of the server side of the synthetic TCP connections of pcap captures, so that a Dofus
+	// dissector can be bound to it. The client side has a port of its own for each session.
+	PcapServerPort = 5555
+	// pcapMaxPayload keeps the segments within the maximum length of an IPv4 packet.
+	pcapMaxPayload = 65535 - 40
+
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+)
+
+var (
+	pcapClientIP = net.IPv4(10, 0, 0, 1).To4()
+	pcapServerIP = net.IPv4(10, 0, 0, 2).To4()
+)
+
+// pcapConn is the synthetic TCP connection of a session in a pcap capture.
+type pcapConn struct {
+	clientPort uint16
+	// clientSeq and serverSeq are the next sequence numbers of each side.
+	clientSeq uint32
+	serverSeq uint32
+}
+
+// pcapEncoder writes the records of a capture as a pcap file of IPv4 packets, each session being a TCP connection
+// between pcapClientIP and pcapServerIP.
+type pcapEncoder struct {
+	w     io.Writer
+	conns map[string]*pcapConn
+	// ports is the number of connections opened so far, from which their client ports are chosen.
+	ports uint32
+}
+
+func newPcapEncoder(w io.Writer) (*pcapEncoder, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagicNanos)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	_, err := w.Write(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapEncoder{w: w, conns: make(map[string]*pcapConn)}, nil
+}
+
+// Encode writes the packet of rec, with its terminator, as TCP segments of the connection of its session, opening it
+// first if it's the first packet of the session. Markers are skipped.
+func (e *pcapEncoder) Encode(rec CaptureRecord) error {
+	if rec.Marker != "" {
+		return nil
+	}
+	t := time.Unix(0, rec.Time)
+
+	c, ok := e.conns[rec.SessionId]
+	if !ok {
+		c = &pcapConn{clientPort: uint16(49152 + e.ports%16384), clientSeq: 1, serverSeq: 1}
+		e.ports++
+		e.conns[rec.SessionId] = c
+		// The handshake consumes a sequence number on each side.
+		err := e.writeSegment(t, c, DirectionClient, tcpFlagSyn, nil)
+		if err != nil {
+			return err
+		}
+		err = e.writeSegment(t, c, DirectionServer, tcpFlagSyn|tcpFlagAck, nil)
+		if err != nil {
+			return err
+		}
+		err = e.writeSegment(t, c, DirectionClient, tcpFlagAck, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	payload := []byte(rec.Packet + "\x00")
+	if rec.Direction == DirectionClient {
+		payload = []byte(rec.Packet + "\n\x00")
+	}
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > pcapMaxPayload {
+			n = pcapMaxPayload
+		}
+		err := e.writeSegment(t, c, rec.Direction, tcpFlagPsh|tcpFlagAck, payload[:n])
+		if err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// End closes the connection of the session, if it has one.
+func (e *pcapEncoder) End(sessionId string, t time.Time) error {
+	c, ok := e.conns[sessionId]
+	if !ok {
+		return nil
+	}
+	delete(e.conns, sessionId)
+	err := e.writeSegment(t, c, DirectionClient, tcpFlagFin|tcpFlagAck, nil)
+	if err != nil {
+		return err
+	}
+	err = e.writeSegment(t, c, DirectionServer, tcpFlagFin|tcpFlagAck, nil)
+	if err != nil {
+		return err
+	}
+	return e.writeSegment(t, c, DirectionClient, tcpFlagAck, nil)
+}
+
+// writeSegment writes a TCP segment with payload sent by the dir side of c, and advances the sequence number of that
+// side.
+func (e *pcapEncoder) writeSegment(t time.Time, c *pcapConn, dir Direction, flags byte, payload []byte) error {
+	srcIP, dstIP := pcapClientIP, pcapServerIP
+	srcPort, dstPort := c.clientPort, uint16(PcapServerPort)
+	seq, ack := &c.clientSeq, c.serverSeq
+	if dir == DirectionServer {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = &c.serverSeq, c.clientSeq
+	}
+	if flags&tcpFlagAck == 0 {
+		ack = 0
+	}
+
+	pkt := make([]byte, 16+20+20+len(payload))
+	rec, ip, tcp := pkt[:16], pkt[16:36], pkt[36:56]
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)-16))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)-16))
+
+	ip[0] = 0x45 // IPv4, header of 5 words
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)-16))
+	ip[8] = 64 // TTL
+	ip[9] = 6  // TCP
+	copy(ip[12:], srcIP)
+	copy(ip[16:], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // header of 5 words
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	copy(pkt[56:], payload)
+	// The checksum covers a pseudo header with the addresses, the protocol and the length of the segment.
+	segment := pkt[36:]
+	pseudo := uint32(binary.BigEndian.Uint16(srcIP[0:])) + uint32(binary.BigEndian.Uint16(srcIP[2:])) +
+		uint32(binary.BigEndian.Uint16(dstIP[0:])) + uint32(binary.BigEndian.Uint16(dstIP[2:])) +
+		6 + uint32(len(segment))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(segment, pseudo))
+
+	*seq += uint32(len(payload))
+	if flags&(tcpFlagSyn|tcpFlagFin) != 0 {
+		*seq++
+	}
+
+	_, err := e.w.Write(pkt)
+	return err
+}
+
+// checksum returns the internet checksum of b, starting from the partial sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,142 @@
+package retroproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyProtocolV2Sig is the signature that starts a PROXY protocol v2 header.
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyProtocolV1MaxLen is the maximum length of a PROXY protocol v1 header, including its CRLF.
+	proxyProtocolV1MaxLen = 107
+	// proxyProtocolTimeout is how long the header of a connection is waited for.
+	proxyProtocolTimeout = 5 * time.Second
+)
+
+// ProxyProtocolConn is a connection whose remote address is the source address of its PROXY protocol header.
+type ProxyProtocolConn struct {
+	*net.TCPConn
+	remoteAddr *net.TCPAddr
+}
+
+// RemoteAddr returns the source address of the PROXY protocol header.
+func (c *ProxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// ReadProxyProtocol reads a PROXY protocol v1 or v2 header from conn, waiting for it up to 5 seconds, and returns a
+// connection with the source address of the header as its remote address. If the header doesn't carry an address,
+// for instance for health checks of the balancer, conn is returned as is.
+//
+// Exactly the bytes of the header are read, so conn can then be read from as usual.
+func ReadProxyProtocol(conn *net.TCPConn) (net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Both versions are recognized from the length of the v2 signature, which is shorter than any v1 header.
+	buf := make([]byte, len(proxyProtocolV2Sig))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, fmt.Errorf("could not read proxy protocol header: %w", err)
+	}
+
+	var addr *net.TCPAddr
+	switch {
+	case bytes.Equal(buf, proxyProtocolV2Sig):
+		addr, err = readProxyProtocolV2(conn)
+	case bytes.HasPrefix(buf, []byte("PROXY ")):
+		addr, err = readProxyProtocolV1(conn, buf)
+	default:
+		err = errors.New("missing proxy protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		return conn, nil
+	}
+	return &ProxyProtocolConn{TCPConn: conn, remoteAddr: addr}, nil
+}
+
+func readProxyProtocolV1(r io.Reader, start []byte) (*net.TCPAddr, error) {
+	line := append([]byte(nil), start...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLen {
+			return nil, errors.New("proxy protocol v1 header is too long")
+		}
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, fmt.Errorf("could not read proxy protocol header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, errors.New("invalid proxy protocol v1 source address")
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid proxy protocol v1 source port")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2(r io.Reader) (*net.TCPAddr, error) {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("could not read proxy protocol header: %w", err)
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, errors.New("invalid proxy protocol v2 version")
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not read proxy protocol header: %w", err)
+	}
+
+	switch hdr[0] & 0xF {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.New("invalid proxy protocol v2 command")
+	}
+
+	switch hdr[1] >> 4 {
+	case 0x1: // AF_INET
+		if len(data) < 12 {
+			return nil, errors.New("invalid proxy protocol v2 ipv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}, nil
+	case 0x2: // AF_INET6
+		if len(data) < 36 {
+			return nil, errors.New("invalid proxy protocol v2 ipv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,77 @@
+package retroproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Sources of the address detected by DetectPublicIP.
+const (
+	PublicIPFromListener  = "listener"
+	PublicIPFromCheck     = "check"
+	PublicIPFromInterface = "interface"
+)
+
+// DetectPublicIP returns the IPv4 address that clients can likely reach the proxy at, and where it was found. It is the
+// IP that the proxy listens on, if it's a specific one other than loopback, or the IP that the service at checkURL
+// responds with in plain text, if checkURL isn't empty, or the IP of the interface of the default route.
+//
+// The IP of the interface is private behind a NAT, so checkURL should be set for the proxies that are reachable from the
+// internet.
+func DetectPublicIP(ctx context.Context, listenIP net.IP, checkURL string) (net.IP, string, error) {
+	if ip := listenIP.To4(); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		return ip, PublicIPFromListener, nil
+	}
+
+	if checkURL != "" {
+		ip, err := checkPublicIP(ctx, checkURL)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not check public ip: %w", err)
+		}
+		return ip, PublicIPFromCheck, nil
+	}
+
+	// Dialing UDP sends nothing, but picks the local address of the default route.
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp4", "192.0.2.1:9")
+	if err != nil {
+		return nil, "", fmt.Errorf("could not find interface of default route: %w", err)
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP.To4()
+	if ip == nil || ip.IsLoopback() {
+		return nil, "", errors.New("default route has no ipv4 address")
+	}
+	return ip, PublicIPFromInterface, nil
+}
+
+// checkPublicIP returns the IPv4 address in the body of the response to a request to rawURL.
+func checkPublicIP(ctx context.Context, rawURL string) (net.IP, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body))).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("response is not an ipv4 address: %q", body)
+	}
+	return ip, nil
+}
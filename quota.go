@@ -0,0 +1,61 @@
+package retroproxy
+
+import "time"
+
+// Quota is the maximum bytes and packets that a session may read from its client in each window of time, beyond which
+// the session is closed, to stop runaway clients from flooding the servers through the proxy. The zero value disables
+// it.
+type Quota struct {
+	Window time.Duration
+	// MaxBytes and MaxPackets are the limits of each window. Zero disables each of them.
+	MaxBytes   int
+	MaxPackets int
+}
+
+// Enabled reports whether q limits anything.
+func (q Quota) Enabled() bool {
+	return q.Window > 0 && (q.MaxBytes > 0 || q.MaxPackets > 0)
+}
+
+// NewCounter returns a QuotaCounter for a session, or nil if q is not enabled.
+func (q Quota) NewCounter() *QuotaCounter {
+	if !q.Enabled() {
+		return nil
+	}
+	return &QuotaCounter{quota: q}
+}
+
+// QuotaCounter counts what a session read from its client in the current window of its Quota. The windows are fixed,
+// the first one starting with the first packet. It is not safe for concurrent use, since a side of a session is read
+// by a single goroutine.
+type QuotaCounter struct {
+	quota       Quota
+	windowStart time.Time
+	bytes       int
+	packets     int
+}
+
+// Add counts a packet of n bytes read at now, and reports whether the session is still within its quota.
+func (c *QuotaCounter) Add(n int, now time.Time) bool {
+	if now.Sub(c.windowStart) >= c.quota.Window {
+		c.windowStart = now
+		c.bytes = 0
+		c.packets = 0
+	}
+	c.bytes += n
+	c.packets++
+	if c.quota.MaxBytes > 0 && c.bytes > c.quota.MaxBytes {
+		return false
+	}
+	return c.quota.MaxPackets <= 0 || c.packets <= c.quota.MaxPackets
+}
+
+// Bytes returns the bytes counted in the current window.
+func (c *QuotaCounter) Bytes() int {
+	return c.bytes
+}
+
+// Packets returns the packets counted in the current window.
+func (c *QuotaCounter) Packets() int {
+	return c.packets
+}
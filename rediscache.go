@@ -0,0 +1,90 @@
+package retroproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const redisTicketKeyPrefix = "retroproxy:ticket:"
+
+// RedisCache is an implementation of Storer for a Redis server, so tickets can be shared by several proxy instances.
+type RedisCache struct {
+	logger Logger
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisCache makes a RedisCache for the Redis server at url, storing tickets that expire after ttl.
+func NewRedisCache(url string, ttl time.Duration, logger Logger) (*RedisCache, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisCache{
+		logger: logger,
+		client: redis.NewClient(opts),
+		ttl:    ttl,
+	}, nil
+}
+
+func (r *RedisCache) SetTicket(id string, t Ticket) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		r.logger.Error("could not marshal ticket", zap.Error(err), zap.String("ticket_id", id))
+		return
+	}
+
+	err = r.client.Set(ctx, redisTicketKeyPrefix+id, b, r.ttl).Err()
+	if err != nil {
+		r.logger.Error("could not set ticket", zap.Error(err), zap.String("ticket_id", id))
+		return
+	}
+	r.logger.Debug("ticket set",
+		zap.String("ticket_id", id),
+	)
+}
+
+// UseTicket gets and deletes the ticket atomically, so it can only be used once across all instances.
+func (r *RedisCache) UseTicket(id string) (Ticket, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	b, err := r.client.GetDel(ctx, redisTicketKeyPrefix+id).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			r.logger.Error("could not use ticket", zap.Error(err), zap.String("ticket_id", id))
+		}
+		return Ticket{}, false
+	}
+
+	var t Ticket
+	err = json.Unmarshal(b, &t)
+	if err != nil {
+		r.logger.Error("could not unmarshal ticket", zap.Error(err), zap.String("ticket_id", id))
+		return Ticket{}, false
+	}
+	r.logger.Debug("ticket used",
+		zap.String("ticket_id", id),
+	)
+	return t, true
+}
+
+// DeleteOldTickets does nothing, as Redis expires the tickets by itself.
+func (r *RedisCache) DeleteOldTickets(maxDur time.Duration) {}
+
+func (r *RedisCache) Close() error {
+	return r.client.Close()
+}
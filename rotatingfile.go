@@ -0,0 +1,259 @@
+package retroproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rotatedTimeLayout is the layout of the timestamp suffix of rotated files.
+const rotatedTimeLayout = "20060102T150405.000Z"
+
+// RotatingFileConfig is the configuration of a RotatingFile.
+type RotatingFileConfig struct {
+	// Path is the path of the current file. Rotated files get a timestamp suffix.
+	Path string
+	// MaxSize is the size in bytes of the data written beyond which the file is rotated, before compression. Zero
+	// disables it.
+	MaxSize int64
+	// MaxAge is how long the file is written to before it's rotated. Zero disables it.
+	MaxAge time.Duration
+	// Compression compresses the files on the fly. The extension of Path, such as .gz, is kept at the end of the names
+	// of rotated files. The compressed data is written out by RotatingFile.Flush, and each file is completed when it's
+	// rotated.
+	Compression Compression
+	// MaxFiles is how many rotated files are kept, the oldest ones being deleted. Zero keeps them all.
+	MaxFiles int
+	Logger   Logger
+}
+
+// RotatingFile is a file that is rotated by size and by age. Since it's meant for line oriented data, files are only
+// rotated after a newline, so lines are never split across files. It is safe for concurrent use.
+type RotatingFile struct {
+	logger      Logger
+	path        string
+	maxSize     int64
+	maxAge      time.Duration
+	compression Compression
+	maxFiles    int
+
+	f *os.File
+	// zw compresses what's written to f, if the file is compressed.
+	zw       compressWriter
+	size     int64
+	openedAt time.Time
+	lineEnd  bool
+	mu       sync.Mutex
+
+	// wg waits for the removal of old rotated files.
+	wg sync.WaitGroup
+}
+
+func NewRotatingFile(c RotatingFileConfig) (*RotatingFile, error) {
+	logger := c.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	if !c.Compression.Valid() {
+		return nil, fmt.Errorf("invalid compression: %q", c.Compression)
+	}
+
+	r := &RotatingFile{
+		logger:      logger,
+		path:        c.Path,
+		maxSize:     c.MaxSize,
+		maxAge:      c.MaxAge,
+		compression: c.Compression,
+		maxFiles:    c.MaxFiles,
+	}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if r.lineEnd && r.due() {
+			err := r.rotate()
+			if err != nil {
+				return written, err
+			}
+		}
+
+		chunk := p
+		if r.due() {
+			// The file is rotated after the next newline.
+			if i := bytes.IndexByte(p, '\n'); i >= 0 {
+				chunk = p[:i+1]
+			}
+		}
+		n, err := r.writer().Write(chunk)
+		written += n
+		r.size += int64(n)
+		if n > 0 {
+			r.lineEnd = chunk[n-1] == '\n'
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close completes and closes the current file, and waits for the old rotated files to be removed.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.wg.Wait()
+
+	if r.f == nil {
+		return os.ErrClosed
+	}
+	err := r.closeFile()
+	r.f = nil
+	return err
+}
+
+func (r *RotatingFile) writer() io.Writer {
+	if r.zw != nil {
+		return r.zw
+	}
+	return r.f
+}
+
+// closeFile completes the compressed data of the current file, if any, and closes it.
+func (r *RotatingFile) closeFile() error {
+	var err error
+	if r.zw != nil {
+		err = r.zw.Close()
+		r.zw = nil
+	}
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Flush writes out the data compressed so far, so that it can be read even if the file is never closed. It does
+// nothing if the file isn't compressed.
+func (r *RotatingFile) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.zw == nil {
+		return nil
+	}
+	return r.zw.Flush()
+}
+
+func (r *RotatingFile) due() bool {
+	return (r.maxSize > 0 && r.size >= r.maxSize) || (r.maxAge > 0 && time.Since(r.openedAt) >= r.maxAge)
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	r.f = f
+	if r.compression != CompressionNone {
+		r.zw, err = newCompressWriter(f, r.compression)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	r.size = 0
+	r.openedAt = time.Now()
+	r.lineEnd = true
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	err := r.closeFile()
+	if err != nil {
+		return err
+	}
+	ext := r.ext()
+	rotated := strings.TrimSuffix(r.path, ext) + "." + time.Now().UTC().Format(rotatedTimeLayout) + ext
+	err = os.Rename(r.path, rotated)
+	if err != nil {
+		return err
+	}
+	r.logger.Info("rotated file",
+		zap.String("path", rotated),
+	)
+
+	err = r.open()
+	if err != nil {
+		return err
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.removeOldFiles()
+	}()
+	return nil
+}
+
+// ext returns the extension of the compression of the file that ends its path, which rotated files keep, or an empty
+// string.
+func (r *RotatingFile) ext() string {
+	if ext := r.compression.Ext(); strings.HasSuffix(r.path, ext) {
+		return ext
+	}
+	return ""
+}
+
+// removeOldFiles deletes the oldest rotated files beyond the maximum count.
+func (r *RotatingFile) removeOldFiles() {
+	if r.maxFiles <= 0 {
+		return
+	}
+	ext := r.ext()
+	base := strings.TrimSuffix(r.path, ext)
+	matches, err := filepath.Glob(base + ".*" + ext)
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, base+"."), ext)
+		if _, err := time.Parse(rotatedTimeLayout, suffix); err == nil {
+			rotated = append(rotated, m)
+		}
+	}
+	// The timestamps sort in chronological order.
+	sort.Strings(rotated)
+	for len(rotated) > r.maxFiles {
+		err := os.Remove(rotated[0])
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			r.logger.Error("could not remove rotated file",
+				zap.Error(err),
+				zap.String("path", rotated[0]),
+			)
+		}
+		rotated = rotated[1:]
+	}
+}
@@ -0,0 +1,336 @@
+package retroproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// The error codes of JSON-RPC 2.0, and those of the console in the range reserved for the servers.
+const (
+	rpcParseError         = -32700
+	rpcInvalidRequest     = -32600
+	rpcMethodNotFound     = -32601
+	rpcInvalidParams      = -32602
+	rpcInternalError      = -32603
+	rpcSessionNotFound    = -32000
+	rpcNotSupported       = -32001
+	rpcCouldNotSendPacket = -32002
+	rpcAlreadySubscribed  = -32003
+)
+
+const (
+	// rpcEventsBufferSize is how many events a subscribed connection may lag behind before it misses some.
+	rpcEventsBufferSize = 256
+	// rpcMaxRequestSize is the maximum size in bytes of the requests posted over HTTP.
+	rpcMaxRequestSize = 1 << 20
+)
+
+// rpcRequest is a JSON-RPC 2.0 request, or a notification if it has no id.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Id      json.RawMessage `json:"id,omitempty"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response, which has either a result or an error.
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// rpcNotification is a notification sent by the console, such as an event of a subscription.
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcError is the error object of a JSON-RPC 2.0 response.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcConn is a connection to the admin socket that speaks JSON-RPC, which may be subscribed to the events of the hub.
+// Its writes don't interleave with those of the subscription.
+type rpcConn struct {
+	mu          sync.Mutex
+	w           io.Writer
+	unsubscribe func() // guarded by mu
+}
+
+func (rc *rpcConn) Write(b []byte) (int, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.w.Write(b)
+}
+
+// close ends the subscription of the connection, if it has one.
+func (rc *rpcConn) close() {
+	rc.mu.Lock()
+	unsubscribe := rc.unsubscribe
+	rc.unsubscribe = nil
+	rc.mu.Unlock()
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+}
+
+// serveRPC serves JSON-RPC 2.0 requests posted over HTTP. Subscribing to the events needs the admin socket.
+func (c *Console) serveRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		c.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, rpcMaxRequestSize))
+	if err != nil {
+		c.writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	resp := c.handleRPC(data, nil)
+	if resp == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(resp)
+	if err != nil {
+		c.logger.Debug("could not write response", zap.Error(err))
+	}
+}
+
+// handleRPC handles a JSON-RPC 2.0 request or batch of requests, received on rc if it came from the admin socket, and
+// returns the response to send, or nil if it only had notifications.
+func (c *Console) handleRPC(data []byte, rc *rpcConn) []byte {
+	data = bytes.TrimSpace(data)
+	var v interface{}
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		err := json.Unmarshal(data, &batch)
+		switch {
+		case err != nil:
+			v = rpcErrorResponse(nil, &rpcError{Code: rpcParseError, Message: "parse error"})
+		case len(batch) == 0:
+			v = rpcErrorResponse(nil, &rpcError{Code: rpcInvalidRequest, Message: "invalid request"})
+		default:
+			var resps []rpcResponse
+			for _, raw := range batch {
+				if resp, ok := c.callRPC(raw, rc); ok {
+					resps = append(resps, resp)
+				}
+			}
+			if len(resps) == 0 {
+				return nil
+			}
+			v = resps
+		}
+	} else {
+		resp, ok := c.callRPC(data, rc)
+		if !ok {
+			return nil
+		}
+		v = resp
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		c.logger.Error("could not marshal rpc response", zap.Error(err))
+		b, _ = json.Marshal(rpcErrorResponse(nil, &rpcError{Code: rpcInternalError, Message: "internal error"}))
+	}
+	return append(b, '\n')
+}
+
+// callRPC calls the method of a single request, and returns its response unless it's a notification.
+func (c *Console) callRPC(raw json.RawMessage, rc *rpcConn) (rpcResponse, bool) {
+	var req rpcRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return rpcErrorResponse(nil, &rpcError{Code: rpcParseError, Message: "parse error"}), true
+		}
+		return rpcErrorResponse(nil, &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}), true
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcErrorResponse(req.Id, &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}), true
+	}
+
+	c.logger.Debug("received rpc request",
+		zap.String("method", req.Method),
+	)
+	result, rerr := c.rpcMethod(req.Method, req.Params, rc)
+	if req.Id == nil {
+		return rpcResponse{}, false
+	}
+	if rerr != nil {
+		return rpcErrorResponse(req.Id, rerr), true
+	}
+	return rpcResponse{JSONRPC: "2.0", Result: result, Id: req.Id}, true
+}
+
+func rpcErrorResponse(id json.RawMessage, err *rpcError) rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return rpcResponse{JSONRPC: "2.0", Error: err, Id: id}
+}
+
+// rpcSessionParams are the params of the methods about a session.
+type rpcSessionParams struct {
+	Id string `json:"id"`
+	// Packet is the packet to send, for the methods that send one, without its terminator.
+	Packet string `json:"packet"`
+}
+
+// rpcMethod calls a method of the console with params.
+func (c *Console) rpcMethod(method string, params json.RawMessage, rc *rpcConn) (interface{}, *rpcError) {
+	switch method {
+	case "listSessions":
+		var p struct {
+			Account   string `json:"account"`
+			Character string `json:"character"`
+		}
+		if err := decodeRPCParams(params, &p); err != nil {
+			return nil, err
+		}
+		return c.sessions(p.Account, p.Character), nil
+	case "stats":
+		return c.stats(), nil
+	case "kick":
+		var p rpcSessionParams
+		if err := decodeRPCParams(params, &p); err != nil {
+			return nil, err
+		}
+		if p.Id == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "missing id"}
+		}
+		name, ok := c.kick(p.Id)
+		if !ok {
+			return nil, &rpcError{Code: rpcSessionNotFound, Message: "session not found"}
+		}
+		return map[string]string{"proxy": name, "id": p.Id}, nil
+	case "sendToClient", "sendToServer":
+		var p rpcSessionParams
+		if err := decodeRPCParams(params, &p); err != nil {
+			return nil, err
+		}
+		if p.Id == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "missing id"}
+		}
+		if err := validInjectedPacket(p.Packet); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		var name string
+		var err error
+		if method == "sendToClient" {
+			name, err = c.sendToClient(p.Id, p.Packet)
+		} else {
+			name, err = c.sendToServer(p.Id, p.Packet)
+		}
+		switch {
+		case errors.Is(err, errSessionNotFound):
+			return nil, &rpcError{Code: rpcSessionNotFound, Message: "session not found"}
+		case errors.Is(err, errNotSupported):
+			return nil, &rpcError{Code: rpcNotSupported, Message: err.Error()}
+		case err != nil:
+			return nil, &rpcError{Code: rpcCouldNotSendPacket, Message: err.Error()}
+		}
+		return map[string]string{"proxy": name, "id": p.Id}, nil
+	case "broadcast":
+		var p struct {
+			Text string `json:"text"`
+		}
+		if err := decodeRPCParams(params, &p); err != nil {
+			return nil, err
+		}
+		if p.Text == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "missing text"}
+		}
+		if err := validBroadcastText(p.Text); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		n, err := c.broadcast(p.Text)
+		if err != nil {
+			return nil, &rpcError{Code: rpcInternalError, Message: err.Error()}
+		}
+		return map[string]int{"sessions": n}, nil
+	case "subscribeEvents":
+		if rc == nil {
+			return nil, &rpcError{Code: rpcNotSupported, Message: "events can only be subscribed to over the admin socket"}
+		}
+		if c.events == nil {
+			return nil, &rpcError{Code: rpcNotSupported, Message: "events are disabled"}
+		}
+		if !c.subscribeRPC(rc) {
+			return nil, &rpcError{Code: rpcAlreadySubscribed, Message: "already subscribed"}
+		}
+		return true, nil
+	case "unsubscribeEvents":
+		if rc == nil {
+			return nil, &rpcError{Code: rpcNotSupported, Message: "events can only be subscribed to over the admin socket"}
+		}
+		rc.close()
+		return true, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found"}
+}
+
+// decodeRPCParams decodes the params of a request, given by name, into v. Params may be left out.
+func decodeRPCParams(params json.RawMessage, v interface{}) *rpcError {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: "invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+// subscribeRPC sends the events of the hub to rc as notifications until it's closed or unsubscribed, and reports
+// whether it wasn't subscribed already. A connection that can't keep up misses events.
+func (c *Console) subscribeRPC(rc *rpcConn) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.unsubscribe != nil {
+		return false
+	}
+	events, unsubscribe := c.events.Subscribe(rpcEventsBufferSize)
+	rc.unsubscribe = unsubscribe
+	go func() {
+		for e := range events {
+			b, err := json.Marshal(rpcNotification{JSONRPC: "2.0", Method: "event", Params: e})
+			if err != nil {
+				c.logger.Error("could not marshal event", zap.Error(err))
+				continue
+			}
+			_, err = rc.Write(append(b, '\n'))
+			if err != nil {
+				rc.close()
+			}
+		}
+	}()
+	return true
+}
+
+// isRPC reports whether a line received on the admin socket is a JSON-RPC request rather than a text command.
+func isRPC(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, "{") || strings.HasPrefix(line, "[")
+}
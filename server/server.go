@@ -0,0 +1,199 @@
+// Package server runs a login proxy and a game proxy together with the pruning of their tickets, so the proxy can be
+// embedded in other programs.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/game"
+	"github.com/kralamoure/retroproxy/login"
+)
+
+// DefaultTicketMaxDur is how long tickets are kept by default before they are deleted.
+const DefaultTicketMaxDur = 10 * time.Second
+
+// Config is the configuration of a Server.
+type Config struct {
+	// Login and Game are the configurations of the proxies. Their Storer is ignored in favor of the one of the server.
+	Login login.Config
+	Game  game.Config
+	// Storer is the ticket store shared by the proxies. If nil, an in-memory cache is used.
+	Storer retroproxy.Storer
+	// TicketMaxDur is how long tickets are kept before they are deleted. Zero means DefaultTicketMaxDur. The game proxy
+	// also refuses the tickets older than it, unless its TicketMaxAge is set.
+	TicketMaxDur time.Duration
+	// TicketPruneInterval is how often the old tickets are deleted. Zero means retroproxy.DefaultTicketPruneInterval.
+	TicketPruneInterval time.Duration
+	Logger              retroproxy.Logger
+
+	// DisableLogin and DisableGame leave out a proxy, for deployments where the other side runs elsewhere and shares
+	// the ticket store. At most one of them can be set.
+	DisableLogin bool
+	DisableGame  bool
+
+	// EphemeralGamePorts redirects each client to a port of the game proxy opened for its ticket, which accepts a
+	// single connection and is closed once the ticket expires if unused. It needs both proxies.
+	EphemeralGamePorts bool
+}
+
+// Server is a login proxy and a game proxy sharing a ticket store, either of which may be disabled.
+type Server struct {
+	logger       retroproxy.Logger
+	storer       retroproxy.Storer
+	ticketMaxDur time.Duration
+	pruneEvery   time.Duration
+	login        *login.Proxy
+	game         *game.Proxy
+}
+
+func New(c Config) (*Server, error) {
+	if c.DisableLogin && c.DisableGame {
+		return nil, errors.New("login and game proxies can't both be disabled")
+	}
+	if c.EphemeralGamePorts && (c.DisableLogin || c.DisableGame) {
+		return nil, errors.New("ephemeral game ports need both proxies")
+	}
+
+	logger := c.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	storer := c.Storer
+	if storer == nil {
+		storer = retroproxy.NewCache(retroproxy.WithFields(logger, zap.String("component", "cache")))
+	}
+
+	ticketMaxDur := c.TicketMaxDur
+	if ticketMaxDur <= 0 {
+		ticketMaxDur = DefaultTicketMaxDur
+	}
+
+	pruneEvery := c.TicketPruneInterval
+	if pruneEvery <= 0 {
+		pruneEvery = retroproxy.DefaultTicketPruneInterval
+	}
+
+	var loginPx *login.Proxy
+	if !c.DisableLogin {
+		loginConfig := c.Login
+		loginConfig.Storer = storer
+		var err error
+		loginPx, err = login.New(loginConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not make login proxy: %w", err)
+		}
+	}
+
+	var gamePx *game.Proxy
+	if !c.DisableGame {
+		gameConfig := c.Game
+		gameConfig.Storer = storer
+		if gameConfig.TicketMaxAge == 0 {
+			gameConfig.TicketMaxAge = ticketMaxDur
+		}
+		var err error
+		gamePx, err = game.New(gameConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not make game proxy: %w", err)
+		}
+	}
+
+	if c.EphemeralGamePorts {
+		loginPx.SetGamePort(func(ticket string) (string, error) {
+			port, err := gamePx.ListenEphemeral(ticket, ticketMaxDur)
+			if err != nil {
+				return "", err
+			}
+			return strconv.Itoa(port), nil
+		})
+	}
+
+	return &Server{
+		logger:       logger,
+		storer:       storer,
+		ticketMaxDur: ticketMaxDur,
+		pruneEvery:   pruneEvery,
+		login:        loginPx,
+		game:         gamePx,
+	}, nil
+}
+
+// Login returns the login proxy of the server, or nil if it's disabled.
+func (s *Server) Login() *login.Proxy {
+	return s.login
+}
+
+// Game returns the game proxy of the server, or nil if it's disabled.
+func (s *Server) Game() *game.Proxy {
+	return s.game
+}
+
+// Storer returns the ticket store shared by the proxies.
+func (s *Server) Storer() retroproxy.Storer {
+	return s.storer
+}
+
+// Run serves the enabled proxies and deletes their old tickets until ctx is done or one of the proxies fails, in which
+// case the other one is stopped too and the error is returned. Sessions are drained as configured before Run returns.
+//
+// The old tickets are only deleted when the login proxy is enabled, as it's the one issuing them: a server with only a
+// game proxy leaves that to the server of the login proxy sharing its ticket store.
+func (s *Server) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error)
+
+	if s.login != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.login.ListenAndServe(ctx)
+			if err != nil {
+				select {
+				case errCh <- fmt.Errorf("error while serving login proxy: %w", err):
+				case <-ctx.Done():
+				}
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retroproxy.DeleteOldTicketsEvery(ctx, s.storer, s.ticketMaxDur, s.pruneEvery)
+		}()
+	}
+
+	if s.game != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.game.ListenAndServe(ctx)
+			if err != nil {
+				select {
+				case errCh <- fmt.Errorf("error while serving game proxy: %w", err):
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
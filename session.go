@@ -0,0 +1,68 @@
+package retroproxy
+
+import (
+	"time"
+)
+
+// SessionInfo describes an active session of a proxy.
+type SessionInfo struct {
+	Id            string    `json:"id"`
+	ClientAddress string    `json:"client_address"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	// Account is the username of the account, once it's known by the login proxy.
+	Account string `json:"account,omitempty"`
+	// ClientVersion is the version of the client, once it's known by the login proxy.
+	ClientVersion string `json:"client_version,omitempty"`
+	// ClientRate and ServerRate are the rates of the bytes relayed from the client and from the server during the last
+	// second, in bytes per second, when the proxy throttles them.
+	ClientRate float64 `json:"client_rate,omitempty"`
+	ServerRate float64 `json:"server_rate,omitempty"`
+	// Character is the name of the selected character, once it's known by the game proxy.
+	Character string `json:"character,omitempty"`
+	// MapId is the id of the map of the character, once it's known by the game proxy.
+	MapId int `json:"map_id,omitempty"`
+}
+
+// SessionRegistry gives access to the active sessions of a proxy. It must be safe for concurrent use.
+type SessionRegistry interface {
+	// Sessions returns the active sessions.
+	Sessions() []SessionInfo
+	// Kick closes the session with the given id and reports whether it was found.
+	Kick(id string) bool
+}
+
+// ClientSender is implemented by the session registries that can send packets of their own to the clients of their
+// sessions.
+type ClientSender interface {
+	// SendToClient sends pkt to the client of the session with the given id and reports whether it was found.
+	SendToClient(id string, pkt string) bool
+}
+
+// ServerSender is implemented by the session registries that can send packets of their own to the servers of their
+// sessions, as if their clients sent them.
+type ServerSender interface {
+	// SendToServer sends pkt to the server of the session with the given id and reports whether it was found.
+	SendToServer(id string, pkt string) bool
+}
+
+// SessionShadower is implemented by the session registries that can tee the packets of a session to an observer,
+// to investigate the issue of a single client live.
+type SessionShadower interface {
+	// Shadow returns a channel receiving the packets read by the session with the given id from now on, buffering up
+	// to size of them, and a function that stops shadowing it. The channel is closed once the session ends or
+	// shadowing is stopped. It reports whether the session was found.
+	Shadow(id string, size int) (<-chan CaptureRecord, func(), bool)
+}
+
+// RTTReporter is implemented by the session registries that measure the round-trip time between the clients and the
+// server.
+type RTTReporter interface {
+	// AverageRTT returns a moving average of the round-trip time, or zero if none was measured yet.
+	AverageRTT() time.Duration
+}
+
+// CoalesceReporter is implemented by the session registries that coalesce the packets of the server.
+type CoalesceReporter interface {
+	// Coalesced returns the number of packets dropped because a newer packet superseded them.
+	Coalesced() uint64
+}
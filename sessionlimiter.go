@@ -0,0 +1,40 @@
+package retroproxy
+
+import "sync/atomic"
+
+// SessionLimiter caps the number of concurrent sessions of the proxies it's shared by, to protect the resources of
+// the host. It is safe for concurrent use.
+type SessionLimiter struct {
+	max int64
+	n   atomic.Int64
+}
+
+// NewSessionLimiter returns a SessionLimiter that allows up to max concurrent sessions.
+func NewSessionLimiter(max int) *SessionLimiter {
+	return &SessionLimiter{max: int64(max)}
+}
+
+// Acquire reports whether a new session may start, and counts it if it may. Each successful Acquire must be followed
+// by a Release once the session ends.
+func (l *SessionLimiter) Acquire() bool {
+	if l.n.Add(1) > l.max {
+		l.n.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Release uncounts a session that ended.
+func (l *SessionLimiter) Release() {
+	l.n.Add(-1)
+}
+
+// Count returns the number of sessions currently counted.
+func (l *SessionLimiter) Count() int {
+	return int(l.n.Load())
+}
+
+// Max returns the maximum number of concurrent sessions.
+func (l *SessionLimiter) Max() int {
+	return int(l.max)
+}
@@ -0,0 +1,100 @@
+package retroproxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shadows fans out the packets read by a session to the observers shadowing it. Writing never blocks: an observer
+// whose buffer is full misses the packet. The zero value is ready to use, and it is safe for concurrent use.
+type Shadows struct {
+	// n is the number of observers, so that sessions that aren't shadowed don't take the lock for each packet.
+	n      atomic.Int32
+	mu     sync.Mutex
+	subs   map[chan CaptureRecord]struct{}
+	closed bool
+}
+
+// Add returns a channel receiving the packets written from now on, buffering up to size of them, and a function that
+// stops shadowing and closes the channel. The channel is also closed by Close, and right away if Close was already
+// called.
+func (s *Shadows) Add(size int) (<-chan CaptureRecord, func()) {
+	ch := make(chan CaptureRecord, size)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if s.subs == nil {
+		s.subs = make(map[chan CaptureRecord]struct{})
+	}
+	s.subs[ch] = struct{}{}
+	s.n.Add(1)
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subs[ch]; !ok {
+			return
+		}
+		delete(s.subs, ch)
+		s.n.Add(-1)
+		close(ch)
+	}
+}
+
+// Write sends pkt, the packet with the sequence number seq read from the dir side of the session, to every observer
+// that has room for it.
+func (s *Shadows) Write(dir Direction, sessionId string, seq uint64, pkt string) {
+	if s.n.Load() == 0 {
+		return
+	}
+	s.write(CaptureRecord{
+		Direction: dir,
+		Time:      time.Now().UnixNano(),
+		SessionId: sessionId,
+		Seq:       seq,
+		Packet:    pkt,
+	})
+}
+
+// WriteInjected sends pkt, a packet injected into the session as if its dir side sent it, to every observer that has
+// room for it.
+func (s *Shadows) WriteInjected(dir Direction, sessionId string, pkt string) {
+	if s.n.Load() == 0 {
+		return
+	}
+	s.write(CaptureRecord{
+		Direction: dir,
+		Time:      time.Now().UnixNano(),
+		SessionId: sessionId,
+		Packet:    pkt,
+		Injected:  true,
+	})
+}
+
+func (s *Shadows) write(rec CaptureRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		select {
+		case ch <- rec:
+		default:
+		}
+	}
+}
+
+// Close closes the channels of the observers, once the session has ended.
+func (s *Shadows) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+	s.n.Store(0)
+}
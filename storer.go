@@ -5,14 +5,25 @@ import (
 	"time"
 )
 
+// Storer stores the tickets issued by the login proxy until the game proxy uses them.
 type Storer interface {
 	SetTicket(id string, t Ticket)
+	// UseTicket returns the ticket with the given id and deletes it, in a single atomic operation, so that each ticket
+	// is used once: when several connections present the same ticket concurrently, only one of them gets it.
 	UseTicket(id string) (Ticket, bool)
 	DeleteOldTickets(maxDur time.Duration)
 }
 
+// DefaultTicketPruneInterval is how often DeleteOldTicketsLoop deletes the old tickets.
+const DefaultTicketPruneInterval = time.Second
+
 func DeleteOldTicketsLoop(ctx context.Context, r Storer, maxDur time.Duration) {
-	ticker := time.NewTicker(time.Second)
+	DeleteOldTicketsEvery(ctx, r, maxDur, DefaultTicketPruneInterval)
+}
+
+// DeleteOldTicketsEvery deletes the tickets of r older than maxDur every interval, until ctx is done.
+func DeleteOldTicketsEvery(ctx context.Context, r Storer, maxDur time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
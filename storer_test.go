@@ -0,0 +1,69 @@
+package retroproxy
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// claimers is the number of goroutines that claim the same ticket at once.
+const claimers = 64
+
+// testConcurrentClaim stores a ticket in r and checks that exactly one of the goroutines claiming it at once gets it.
+func testConcurrentClaim(t *testing.T, r Storer) {
+	t.Helper()
+	want := Ticket{Host: "127.0.0.1", Port: "5555", Original: "original", IssuedAt: time.Now()}
+	r.SetTicket("t1", want)
+
+	var wins atomic.Int32
+	var got Ticket
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < claimers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if ticket, ok := r.UseTicket("t1"); ok {
+				wins.Add(1)
+				got = ticket
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := wins.Load(); n != 1 {
+		t.Fatalf("%d goroutines claimed the ticket, want 1", n)
+	}
+	if got.Original != want.Original || got.Host != want.Host || got.Port != want.Port {
+		t.Errorf("claimed ticket %+v, want %+v", got, want)
+	}
+	if _, ok := r.UseTicket("t1"); ok {
+		t.Error("ticket claimed again after its use")
+	}
+}
+
+func TestCacheConcurrentClaim(t *testing.T) {
+	testConcurrentClaim(t, NewCache(nil))
+}
+
+func TestFileCacheConcurrentClaim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets.json")
+	r, err := NewFileCache(path, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConcurrentClaim(t, r)
+
+	// The used ticket isn't loaded again after a restart.
+	r, err = NewFileCache(path, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.UseTicket("t1"); ok {
+		t.Error("used ticket loaded again from the file")
+	}
+}
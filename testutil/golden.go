@@ -0,0 +1,214 @@
+package testutil
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/game"
+)
+
+const (
+	// UpdateEnv is the environment variable that makes Assert write the golden captures instead of comparing them,
+	// when it's not empty.
+	UpdateEnv = "RETROPROXY_UPDATE_GOLDEN"
+	// GoldenExt is the extension of the golden capture of each capture, such as session.golden.jsonl for
+	// session.jsonl.
+	GoldenExt = ".golden.jsonl"
+
+	// runTimeout is how long a capture may take to run through the proxy.
+	runTimeout = 10 * time.Second
+)
+
+// Assert runs the capture testdata/<name>.jsonl through a game proxy made with c and using handlers, see Run, and
+// fails t if the packets that reached each side differ from those of the golden capture testdata/<name>.golden.jsonl.
+// With UpdateEnv set, it writes the golden capture instead.
+func Assert(t testing.TB, name string, c game.Config, handlers ...game.PacketHandler) {
+	t.Helper()
+	input := filepath.Join("testdata", name+".jsonl")
+	err := Check(input, goldenPath(input), os.Getenv(UpdateEnv) != "", c, handlers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckDir runs each capture of dir that isn't a golden capture through a game proxy made with c and using handlers,
+// and returns the errors of those whose output differs from their golden capture, joined. With update, it writes the
+// golden captures instead.
+func CheckDir(dir string, update bool, c game.Config, handlers ...game.PacketHandler) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	n := 0
+	for _, path := range paths {
+		if strings.HasSuffix(path, GoldenExt) {
+			continue
+		}
+		n++
+		err := Check(path, goldenPath(path), update, c, handlers...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	if n == 0 {
+		return fmt.Errorf("no capture in %s", dir)
+	}
+	return errors.Join(errs...)
+}
+
+// Check runs the capture at inputPath through a game proxy made with c and using handlers, and returns an error
+// listing the differences if the packets that reached each side differ from those of the golden capture at
+// goldenPath. With update, it writes the golden capture instead.
+func Check(inputPath, goldenPath string, update bool, c game.Config, handlers ...game.PacketHandler) error {
+	input, err := ReadCapture(inputPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), runTimeout)
+	defer cancel()
+	got, err := Run(ctx, input, c, handlers...)
+	if err != nil {
+		return err
+	}
+	if update {
+		return WriteCapture(goldenPath, got)
+	}
+	want, err := ReadCapture(goldenPath)
+	if err != nil {
+		return err
+	}
+	if diff := Diff(want, got); diff != "" {
+		return fmt.Errorf("packets differ from %s:\n%s", goldenPath, strings.TrimSuffix(diff, "\n"))
+	}
+	return nil
+}
+
+// ReadCapture reads the records of the capture at path, which may be compressed, see retroproxy.OpenDecompressed.
+func ReadCapture(path string) ([]retroproxy.CaptureRecord, error) {
+	f, err := retroproxy.OpenDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []retroproxy.CaptureRecord
+	rd := retroproxy.NewCaptureReader(bufio.NewReader(f))
+	for {
+		rec, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return recs, nil
+			}
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// WriteCapture writes recs to a capture file at path, replacing it.
+func WriteCapture(path string, recs []retroproxy.CaptureRecord) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	for _, rec := range recs {
+		err := enc.Encode(rec)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Diff compares the packets of got with those of want in each direction, ignoring everything else, and returns the
+// packets missing from got, prefixed with "-", and those added to it, prefixed with "+", or an empty string if they
+// are the same.
+func Diff(want, got []retroproxy.CaptureRecord) string {
+	var sb strings.Builder
+	for _, dir := range []retroproxy.Direction{retroproxy.DirectionClient, retroproxy.DirectionServer} {
+		a, b := packets(want, dir), packets(got, dir)
+		lines := diffLines(a, b)
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "packets of the %s:\n", dir)
+		for _, line := range lines {
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+func packets(recs []retroproxy.CaptureRecord, dir retroproxy.Direction) []string {
+	var pkts []string
+	for _, rec := range recs {
+		if rec.Direction == dir && rec.Marker == "" {
+			pkts = append(pkts, rec.Packet)
+		}
+	}
+	return pkts
+}
+
+// diffLines returns the edits that make b from a, as found by their longest common subsequence, with the index of
+// each packet in its sequence. Golden captures are small, so the quadratic cost doesn't matter.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, fmt.Sprintf("-%d\t%q", i+1, a[i]))
+			i++
+		default:
+			lines = append(lines, fmt.Sprintf("+%d\t%q", j+1, b[j]))
+			j++
+		}
+	}
+	return lines
+}
+
+// goldenPath returns the path of the golden capture of the capture at path.
+func goldenPath(path string) string {
+	return strings.TrimSuffix(path, ".jsonl") + GoldenExt
+}
@@ -0,0 +1,43 @@
+package testutil
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/game"
+)
+
+func TestAssert(t *testing.T) {
+	for _, name := range []string{"session", "unknown"} {
+		t.Run(name, func(t *testing.T) {
+			Assert(t, name, game.Config{})
+		})
+	}
+}
+
+func TestDiffDroppedPackets(t *testing.T) {
+	want, err := ReadCapture("testdata/session.golden.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := ReadCapture("testdata/session.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A handler that drops the packets of the client is caught by the golden capture.
+	drop := game.PacketHandlerFunc(func(dir retroproxy.Direction, pkt string) (string, bool, error) {
+		return pkt, dir == retroproxy.DirectionClient && pkt != endPkt, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), runTimeout)
+	defer cancel()
+	got, err := Run(ctx, input, game.Config{}, drop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := Diff(want, got)
+	if !strings.HasPrefix(diff, "packets of the client:\n-") {
+		t.Errorf("got diff %q, want packets of the client missing", diff)
+	}
+}
@@ -0,0 +1,237 @@
+// Package testutil feeds recorded sessions through a game proxy and compares the packets that reach each side with
+// golden captures, to lock in the behavior of the framing and of the packet handlers of the proxy.
+package testutil
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kralamoure/retroproto"
+	"go.uber.org/zap"
+
+	"github.com/kralamoure/retroproxy"
+	"github.com/kralamoure/retroproxy/game"
+	"github.com/kralamoure/retroproxy/internal/gametest"
+)
+
+const (
+	// endPkt is sent by each side once it sent the packets of the capture, so that the other side knows that it got
+	// all those relayed by the proxy. It's not a message of the protocol, so the proxy forwards it as it is.
+	endPkt = "~testutil:end"
+	// chunkSize is the size of the writes of each side, small enough to split most packets across reads of the proxy.
+	chunkSize = 7
+	// clientTerm terminates the packets of the client.
+	clientTerm = "\n\x00"
+)
+
+// Run feeds the session recorded in input through a game proxy made with c and using handlers, and returns the
+// packets that reached each side: first those of the client that reached the server, then those of the server that
+// reached the client, including those of the proxy itself, such as its hello. The records have the direction of the
+// side the packets come from and no time, so that the output is stable.
+//
+// The session is the first one of input, which must start with the ticket of the client and the hello of the server,
+// like the captures of the proxy. Its ticket is stored for the proxy, which connects to a server playing the packets
+// of the server of the session. Once the ticket is exchanged, each side sends its packets in the order of the capture,
+// regardless of those of the other side, so the handlers should not rely on how the directions interleave. They must
+// forward the packets they don't know. The listener, the store and, if it's nil, the logger of c are set by Run.
+func Run(ctx context.Context, input []retroproxy.CaptureRecord, c game.Config,
+	handlers ...game.PacketHandler) ([]retroproxy.CaptureRecord, error) {
+	sessionId, client, server := splitSession(input)
+	if len(client) == 0 || !strings.HasPrefix(client[0], string(retroproto.AccountSendTicket)) {
+		return nil, errors.New("session doesn't start with the ticket of the client")
+	}
+	if len(server) == 0 || server[0] != string(retroproto.AksHelloGame) {
+		return nil, errors.New("session doesn't start with the hello of the server")
+	}
+	ticket := strings.TrimPrefix(client[0], string(retroproto.AccountSendTicket))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The server sends its hello, then the rest of its packets once it gets the ticket.
+	srv, err := gametest.New(gametest.Config{
+		Script: []gametest.Step{{
+			Prefix:  string(retroproto.AccountSendTicket),
+			Replies: append(server[1:len(server):len(server)], endPkt),
+		}},
+		ChunkSize: chunkSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer srv.Close()
+
+	storer := retroproxy.NewCache(nil)
+	storer.SetTicket(ticket, srv.Ticket(ticket))
+	c.Addr, c.Listeners, c.Storer = "127.0.0.1:0", nil, storer
+	if c.Logger == nil {
+		c.Logger = zap.NewNop()
+	}
+	px, err := game.New(c)
+	if err != nil {
+		return nil, err
+	}
+	px.Use(handlers...)
+
+	proxyCtx, stopProxy := context.WithCancel(context.Background())
+	proxyErrCh := make(chan error, 1)
+	go func() {
+		proxyErrCh <- px.ListenAndServe(proxyCtx)
+	}()
+	defer func() {
+		stopProxy()
+		<-proxyErrCh
+	}()
+	for px.Addr() == nil {
+		select {
+		case err := <-proxyErrCh:
+			proxyErrCh <- err
+			return nil, fmt.Errorf("could not start game proxy: %w", err)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", px.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	closeOnDone(ctx, conn)
+	toClient, err := play(conn, client)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	toServer, err := srv.WaitPacket(ctx, endPkt)
+	if err != nil {
+		return nil, fmt.Errorf("server: %w", err)
+	}
+
+	recs := records(sessionId, retroproxy.DirectionClient, toServer)
+	return append(recs, records(sessionId, retroproxy.DirectionServer, toClient)...), nil
+}
+
+// splitSession returns the id of the first session with packets in recs, and the packets read from its client and
+// from its server. Markers and injected packets are left out.
+func splitSession(recs []retroproxy.CaptureRecord) (sessionId string, client, server []string) {
+	for _, rec := range recs {
+		if rec.Marker != "" || rec.Injected {
+			continue
+		}
+		if sessionId == "" {
+			sessionId = rec.SessionId
+		}
+		if rec.SessionId != sessionId {
+			continue
+		}
+		switch rec.Direction {
+		case retroproxy.DirectionClient:
+			client = append(client, rec.Packet)
+		case retroproxy.DirectionServer:
+			server = append(server, rec.Packet)
+		}
+	}
+	return sessionId, client, server
+}
+
+// play writes the ticket of the client, the first packet of pkts, to conn and reads the packets relayed to conn until
+// the response to the ticket, like a client waits for the ticket exchange. Then it writes the other packets, and
+// endPkt, while reading until the endPkt of the server. Each packet is written in small chunks, and the packets read
+// are returned without terminator.
+func play(conn net.Conn, pkts []string) ([]string, error) {
+	rd := bufio.NewReader(conn)
+	read := func() (string, error) {
+		pkt, err := rd.ReadString('\x00')
+		if err != nil {
+			return "", fmt.Errorf("connection closed before the end of the capture: %w", err)
+		}
+		return strings.TrimSuffix(pkt, "\x00"), nil
+	}
+
+	err := write(conn, pkts[0]+clientTerm)
+	if err != nil {
+		return nil, err
+	}
+	var got []string
+	for {
+		pkt, err := read()
+		if err != nil {
+			return nil, err
+		}
+		got = append(got, pkt)
+		// AccountTicketResponseSuccess or AccountTicketResponseError.
+		if strings.HasPrefix(pkt, "AT") {
+			break
+		}
+	}
+
+	var sb strings.Builder
+	for _, pkt := range append(pkts[1:], endPkt) {
+		sb.WriteString(pkt)
+		sb.WriteString(clientTerm)
+	}
+	writeErrCh := make(chan error, 1)
+	go func() {
+		writeErrCh <- write(conn, sb.String())
+	}()
+	for {
+		pkt, err := read()
+		if err != nil {
+			return nil, err
+		}
+		if pkt == endPkt {
+			break
+		}
+		got = append(got, pkt)
+	}
+	err = <-writeErrCh
+	if err != nil {
+		return nil, err
+	}
+	return got, nil
+}
+
+// write writes data to conn in chunks of chunkSize.
+func write(conn net.Conn, data string) error {
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err := io.WriteString(conn, data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// records returns pkts as the records of the given session read from the dir side, numbered from 1.
+func records(sessionId string, dir retroproxy.Direction, pkts []string) []retroproxy.CaptureRecord {
+	recs := make([]retroproxy.CaptureRecord, len(pkts))
+	for i, pkt := range pkts {
+		recs[i] = retroproxy.CaptureRecord{
+			Direction: dir,
+			SessionId: sessionId,
+			Seq:       uint64(i + 1),
+			Packet:    pkt,
+		}
+	}
+	return recs
+}
+
+// closeOnDone closes c once ctx is done, to unblock the reads and writes of the run.
+func closeOnDone(ctx context.Context, c io.Closer) {
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+}
@@ -0,0 +1,86 @@
+package retroproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// throttleBurstDur is how much of its rate a Throttle lets through at once. It's kept small so that the throughput
+// is smooth rather than bursty.
+const throttleBurstDur = 50 * time.Millisecond
+
+// Throttle limits the bytes per second relayed in one direction of a session with a token bucket, and measures the
+// rate it lets through. It is safe for concurrent use.
+type Throttle struct {
+	limiter *rate.Limiter
+	burst   int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	windowBytes int
+	// lastRate is the rate of the last full second, in bytes per second.
+	lastRate float64
+}
+
+// NewThrottle returns a Throttle that lets through bytesPerSecond bytes per second.
+func NewThrottle(bytesPerSecond int) *Throttle {
+	burst := int(float64(bytesPerSecond) * throttleBurstDur.Seconds())
+	if burst < 1 {
+		burst = 1
+	}
+	return &Throttle{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+		burst:   burst,
+	}
+}
+
+// Wait blocks until n bytes may be relayed, or until ctx is done.
+func (t *Throttle) Wait(ctx context.Context, n int) error {
+	for left := n; left > 0; {
+		chunk := left
+		if chunk > t.burst {
+			chunk = t.burst
+		}
+		err := t.limiter.WaitN(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		left -= chunk
+	}
+	t.record(n)
+	return nil
+}
+
+// Rate returns the rate at which bytes were relayed during the last second, in bytes per second.
+func (t *Throttle) Rate() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roll(time.Now())
+	return t.lastRate
+}
+
+func (t *Throttle) record(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roll(time.Now())
+	t.windowBytes += n
+}
+
+// roll starts a new window of a second once the current one is over. t.mu must be held.
+func (t *Throttle) roll(now time.Time) {
+	elapsed := now.Sub(t.windowStart)
+	switch {
+	case elapsed < time.Second:
+		return
+	case elapsed < 2*time.Second:
+		t.lastRate = float64(t.windowBytes) / elapsed.Seconds()
+	default:
+		// Nothing was relayed during the last full second.
+		t.lastRate = 0
+	}
+	t.windowStart = now
+	t.windowBytes = 0
+}
@@ -1,14 +1,49 @@
 package retroproxy
 
 import (
+	"net"
 	"time"
 )
 
+// Ticket is issued by the login proxy when a client selects a game server, and used by the game proxy to connect the
+// client to that server.
 type Ticket struct {
-	Host     string
-	Port     string
+	// Host and Port are the address of the game server.
+	Host string
+	Port string
+	// Original is the ticket issued by the login server, which the game server expects.
 	Original string
 
 	IssuedAt time.Time
 	ServerId int
+
+	// Metadata is data attached to the ticket by the login proxy for the game proxy, such as TicketAccount. Tickets
+	// issued before metadata was added have none.
+	Metadata map[string]string `json:",omitempty"`
+}
+
+// Metadata keys set by the login proxy.
+const (
+	// TicketAccount is the username of the account that was issued the ticket.
+	TicketAccount = "account"
+	// TicketClientVersion is the version of the client, as sent in the AccountVersion message.
+	TicketClientVersion = "client_version"
+)
+
+// SetMetadata sets the metadata of t with the given key to value.
+func (t *Ticket) SetMetadata(key, value string) {
+	if t.Metadata == nil {
+		t.Metadata = make(map[string]string)
+	}
+	t.Metadata[key] = value
+}
+
+// MetadataValue returns the metadata of t with the given key, or an empty string if it's not set.
+func (t Ticket) MetadataValue(key string) string {
+	return t.Metadata[key]
+}
+
+// Addr returns the address of the game server.
+func (t Ticket) Addr() string {
+	return net.JoinHostPort(t.Host, t.Port)
 }
@@ -0,0 +1,37 @@
+package retroproxy
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// noopTracer is the tracer of the proxies that don't trace their sessions. Its spans do nothing, so tracing costs
+// next to nothing when it's disabled.
+var noopTracer = trace.NewNoopTracerProvider().Tracer("")
+
+// TracerOrNoop returns t, or a tracer whose spans do nothing if t is nil.
+func TracerOrNoop(t trace.Tracer) trace.Tracer {
+	if t == nil {
+		return noopTracer
+	}
+	return t
+}
+
+// RecordDisconnect records on the span of a session why it ended, and marks the span as failed if reason is an
+// error.
+func RecordDisconnect(span trace.Span, reason DisconnectReason, err error) {
+	span.SetAttributes(attribute.String("disconnect.reason", string(reason)))
+	if reason.Failed() {
+		RecordError(span, err)
+	}
+}
+
+// RecordError records err on span and marks it as failed, if err is not nil.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
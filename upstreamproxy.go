@@ -0,0 +1,166 @@
+package retroproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer connects to the servers of the proxies. *net.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// NewUpstreamProxyDialer returns a Dialer that connects through the proxy at rawURL, which is either
+// socks5://[user:password@]host:port or http://[user:password@]host:port for an HTTP CONNECT proxy. Each dial,
+// including the handshake with the proxy, must complete within timeout.
+func NewUpstreamProxyDialer(rawURL string, timeout time.Duration) (Dialer, error) {
+	return NewUpstreamProxyDialerFrom(rawURL, &net.Dialer{Timeout: timeout})
+}
+
+// NewUpstreamProxyDialerFrom is like NewUpstreamProxyDialer, but connects to the proxy with forward, such as to set
+// the local address of the connections. The timeout of forward bounds each dial.
+func NewUpstreamProxyDialerFrom(rawURL string, forward *net.Dialer) (Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing proxy address")
+	}
+
+	var d Dialer
+	switch u.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := socks.(proxy.ContextDialer)
+		if !ok {
+			return nil, errors.New("socks5 dialer doesn't support contexts")
+		}
+		d = cd
+	case "http":
+		d = &httpConnectDialer{addr: u.Host, user: u.User, forward: forward}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", u.Scheme)
+	}
+	return &timeoutDialer{dialer: d, timeout: forward.Timeout}, nil
+}
+
+// timeoutDialer bounds the dials of a Dialer.
+type timeoutDialer struct {
+	dialer  Dialer
+	timeout time.Duration
+}
+
+func (d *timeoutDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	return d.dialer.DialContext(ctx, network, address)
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy with the CONNECT method.
+type httpConnectDialer struct {
+	addr    string
+	user    *url.Userinfo
+	forward *net.Dialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake is interrupted by closing the connection if ctx is done before it completes.
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+
+	br := bufio.NewReader(conn)
+	err = d.handshake(conn, br, address)
+	close(stop)
+	if <-interrupted {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if br.Buffered() > 0 {
+		// The server spoke first and its data was read along with the response of the proxy.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// handshake asks the proxy on conn, whose responses are read from br, to connect to address.
+func (d *httpConnectDialer) handshake(conn net.Conn, br *bufio.Reader, address string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused connection: %s", resp.Status)
+	}
+	return nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NetConn returns the connection with the proxy.
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}